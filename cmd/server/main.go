@@ -30,6 +30,12 @@ func main() {
 		zap.String("date", buildDate),
 		zap.String("commit", buildCommit),
 	)
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := server.Migrate(ctx, os.Args[2:], os.Stdout); err != nil {
+			logger.Log.Fatal(err.Error())
+		}
+		return
+	}
 	s := server.CreateServer(ctx)
 	s.Start(ctx)
 }
@@ -6,23 +6,44 @@ import (
 	"context"
 	"crypto/hmac"
 	"crypto/sha256"
-	"crypto/tls"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
+	"sync"
 	"time"
 
+	"github.com/megaded/metrictmr/internal/agent/breaker"
 	"github.com/megaded/metrictmr/internal/agent/collector"
 	"github.com/megaded/metrictmr/internal/agent/config"
+	"github.com/megaded/metrictmr/internal/agent/scrape"
 	"github.com/megaded/metrictmr/internal/data"
 	"github.com/megaded/metrictmr/internal/logger"
 	"github.com/megaded/metrictmr/internal/retry"
+	"github.com/megaded/metrictmr/internal/selfmetric"
 	"go.uber.org/zap"
 	"golang.org/x/sync/errgroup"
 )
 
 const (
+	// sendRetryBase, sendRetryMaxDelay, sendRetryDeadline параметры повторной отправки метрик
+	sendRetryBase     = time.Second
+	sendRetryMaxDelay = 10 * time.Second
+	sendRetryDeadline = 30 * time.Second
+	sendRetries       = 3
+
+	// параметры выключателя: доля ошибок среди последних запросов и время до пробного запроса
+	breakerWindow       = 20
+	breakerMinRequests  = 5
+	breakerFailureRatio = 0.5
+	breakerOpenTimeout  = 10 * time.Second
+
+	selfMetricBreakerState    = "AgentBreakerState"
+	selfMetricBreakerOpens    = "AgentBreakerOpens"
+	selfMetricBufferedBatches = "AgentBufferedBatches"
+	selfMetricDroppedBatches  = "AgentDroppedBatches"
+
 	gauge      = "gauge"
 	counter    = "counter"
 	hashHeader = "HashSHA256"
@@ -35,6 +56,10 @@ type Configer interface {
 	GetKey() string
 	GetRateLimit() int
 	GetCryptoKeyPath() string
+	GetBufferSize() int
+	GetDestinations() []config.Destination
+	GetDestinationMode() string
+	GetScrapeTargets() []config.ScrapeTarget
 }
 
 type MetricSender interface {
@@ -42,28 +67,190 @@ type MetricSender interface {
 }
 
 type Agent struct {
-	Config     Configer
-	httpClient *AgentHTTPClient
-	Protocol   string
+	Config Configer
+	sender *destinationSender
+	// scraper сбор метрик с endpoints Prometheus, nil если они не заданы
+	scraper *scrape.Scraper
 }
 
+// AgentHTTPClient клиент одного сервера: собственные ключ подписи, TLS,
+// выключатель для отслеживания доступности и буфер неотправленных пакетов
 type AgentHTTPClient struct {
 	httpClient *http.Client
 	retry      retry.Retry
-	key        string
+	// addr адрес сервера со схемой: http://host:port
+	addr string
+	key  string
+	// name суффикс собственных метрик клиента, пустой при единственном сервере
+	name    string
+	breaker *breaker.Breaker
+	buffer  *batchBuffer
+}
+
+func newAgentHTTPClient(httpClient *http.Client, addr string, key string, name string, bufferSize int) *AgentHTTPClient {
+	c := &AgentHTTPClient{httpClient: httpClient, retry: newSendRetry(), addr: addr, key: key, name: name, buffer: newBatchBuffer(bufferSize)}
+	selfmetric.Default.Gauge(c.metricName(selfMetricBreakerState)).Set(float64(breaker.Closed))
+	c.breaker = breaker.New(breaker.Settings{
+		Window:       breakerWindow,
+		MinRequests:  breakerMinRequests,
+		FailureRatio: breakerFailureRatio,
+		OpenTimeout:  breakerOpenTimeout,
+		OnStateChange: func(from breaker.State, to breaker.State) {
+			logger.Log.Warn("circuit breaker state changed", zap.String("addr", addr), zap.Stringer("from", from), zap.Stringer("to", to))
+			selfmetric.Default.Gauge(c.metricName(selfMetricBreakerState)).Set(float64(to))
+			if to == breaker.Open {
+				selfmetric.Default.Counter(c.metricName(selfMetricBreakerOpens)).Inc()
+			}
+		},
+	})
+	return c
 }
 
+// Do отправляет запрос с повторами. Перед каждой попыткой тело запроса создается заново:
+// после первой отправки исходное тело уже прочитано.
 func (c *AgentHTTPClient) Do(ctx context.Context, r *http.Request) error {
-	action := func() (*http.Response, error) {
-		return c.httpClient.Do(r)
+	return c.retry.DoHTTP(ctx, func(ctx context.Context) (*http.Response, error) {
+		req := r.WithContext(ctx)
+		if r.GetBody != nil {
+			body, err := r.GetBody()
+			if err != nil {
+				return nil, retry.Permanent(err)
+			}
+			req.Body = body
+		}
+		return c.httpClient.Do(req)
+	})
+}
+
+// Send отправляет пакет с учетом состояния выключателя.
+// Пока сервер недоступен, пакеты копятся в буфере и уходят перед следующей отправкой, каждый отдельным запросом.
+// В полуоткрытом состоянии сначала выполняется пробный запрос HEAD /.
+func (c *AgentHTTPClient) Send(ctx context.Context, metrics []data.Metric) error {
+	return c.send(ctx, metrics, true)
+}
+
+// send при keep = false пакет, который не удалось доставить, не попадает в буфер:
+// вызывающий отправит его на другой сервер. Ранее накопленные пакеты возвращаются в буфер в любом случае.
+func (c *AgentHTTPClient) send(ctx context.Context, metrics []data.Metric, keep bool) error {
+	allowed, probe := c.breaker.Allow()
+	if !allowed {
+		if !keep {
+			return errBreakerOpen
+		}
+		c.hold(metrics)
+		return nil
+	}
+	if probe {
+		if err := c.probe(ctx); err != nil {
+			c.breaker.Failure()
+			if keep {
+				c.hold(metrics)
+			}
+			return err
+		}
+		c.breaker.Success()
 	}
-	return c.retry.RetryAgent(ctx, action)()
+	defer c.updateBufferMetric()
+	buffered := c.buffer.drain()
+	for i, b := range buffered {
+		if err := c.deliver(ctx, b); err != nil && !retry.IsPermanent(err) {
+			// сервер снова недоступен: новый пакет встает в очередь за отложенными
+			rest := buffered[i:]
+			if keep {
+				rest = append(rest, metrics)
+			}
+			c.requeue(rest...)
+			return err
+		}
+	}
+	err := c.deliver(ctx, metrics)
+	if err != nil && keep && !retry.IsPermanent(err) {
+		c.requeue(metrics)
+	}
+	return err
+}
+
+// deliver отправляет один пакет и сообщает результат выключателю. Пакет, отклоненный сервером,
+// не повторяется и учитывается как отброшенный, остальные ошибки оставляют пакет вызывающему.
+func (c *AgentHTTPClient) deliver(ctx context.Context, metrics []data.Metric) error {
+	err := sendMetricJSON(ctx, c, c.addr, c.key, metrics...)
+	switch {
+	case err == nil:
+		c.breaker.Success()
+	case retry.IsPermanent(err):
+		// сервер доступен, но отклонил пакет: повтор не поможет
+		c.breaker.Success()
+		logger.Log.Warn("batch rejected by server, dropped", zap.String("addr", c.addr), zap.Int("metrics", len(metrics)), zap.Error(err))
+		selfmetric.Default.Counter(c.metricName(selfMetricDroppedBatches)).Inc()
+	case ctx.Err() != nil:
+	default:
+		c.breaker.Failure()
+	}
+	return err
+}
+
+// probe пробный запрос без повторов, проверяющий, что сервер отвечает. Любой ответ с кодом
+// меньше 500 означает доступность: /ping проверил бы еще и базу, от которой прием метрик
+// может не зависеть, а HEAD / не выполняет обработчик.
+func (c *AgentHTTPClient) probe(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, c.addr+"/", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return retry.ResponseError(resp)
+	}
+	return nil
+}
+
+// hold откладывает новый пакет в конец буфера
+func (c *AgentHTTPClient) hold(metrics []data.Metric) {
+	c.dropped(c.buffer.push(metrics))
+}
+
+// requeue возвращает неотправленные пакеты в начало буфера
+func (c *AgentHTTPClient) requeue(batches ...[]data.Metric) {
+	c.dropped(c.buffer.pushFront(batches...))
+}
+
+// dropped учитывает пакеты, вытесненные из переполненного буфера
+func (c *AgentHTTPClient) dropped(n int) {
+	if n > 0 {
+		logger.Log.Warn("agent buffer is full, batches dropped", zap.Int("dropped", n))
+		selfmetric.Default.Counter(c.metricName(selfMetricDroppedBatches)).Add(int64(n))
+	}
+	c.updateBufferMetric()
+}
+
+func (c *AgentHTTPClient) updateBufferMetric() {
+	selfmetric.Default.Gauge(c.metricName(selfMetricBufferedBatches)).Set(float64(c.buffer.len()))
+}
+
+func (c *AgentHTTPClient) metricName(base string) string {
+	return base + c.name
+}
+
+// selfMetrics собственные метрики агента. Счетчики передаются как gauge с накопленным значением:
+// сервер суммирует counter, и повторная отправка итога исказила бы его.
+func selfMetrics() []data.Metric {
+	metrics := selfmetric.Default.Metrics()
+	for i, m := range metrics {
+		if m.MType == data.MTypeCounter {
+			v := float64(*m.Delta)
+			metrics[i] = data.Metric{ID: m.ID, MType: data.MTypeGauge, Value: &v}
+		}
+	}
+	return metrics
 }
 
 func (a *Agent) StartSend(ctx context.Context) {
 	pollInterval := a.Config.GetPoolInterval()
-	addr := fmt.Sprintf("%s://%s", a.Protocol, a.Config.GetAddress())
-	key := a.Config.GetKey()
 	rateLimit := a.Config.GetRateLimit()
 	mch := make(chan collector.Metric, rateLimit)
 	metricCollector := &collector.MetricCollector{}
@@ -72,14 +259,17 @@ func (a *Agent) StartSend(ctx context.Context) {
 
 	for w := 0; w <= rateLimit; w++ {
 		group.Go(func() error {
-			return worker(ctxCancel, addr, key, a.httpClient, mch)
+			return worker(ctxCancel, a.sender, mch)
 		})
 
 	}
+	// канал закрывается, когда завершатся все источники метрик
+	var producers sync.WaitGroup
+	producers.Add(1)
 	group.Go(func() error {
+		defer producers.Done()
 		ticker := time.NewTicker(time.Duration(pollInterval) * time.Second)
 		defer ticker.Stop()
-		defer close(mch)
 		for {
 			select {
 			case <-ctxCancel.Done():
@@ -96,6 +286,18 @@ func (a *Agent) StartSend(ctx context.Context) {
 		}
 	})
 
+	if a.scraper != nil {
+		producers.Add(1)
+		group.Go(func() error {
+			defer producers.Done()
+			return a.scraper.Run(ctxCancel, mch)
+		})
+	}
+	go func() {
+		producers.Wait()
+		close(mch)
+	}()
+
 	collectMetrics := func(ct context.Context, mch chan collector.Metric) {
 
 	}
@@ -108,41 +310,45 @@ func (a *Agent) StartSend(ctx context.Context) {
 func CreateAgent() MetricSender {
 	a := &Agent{}
 	a.Config = config.GetConfig()
+	sender, err := newDestinationSender(a.Config.GetDestinationMode(), a.Config.GetDestinations(), a.Config.GetBufferSize())
+	if err != nil {
+		logger.Log.Error(err.Error())
+		panic(err)
+	}
+	a.sender = sender
+	if targets := a.Config.GetScrapeTargets(); len(targets) > 0 {
+		a.scraper, err = scrape.New(targets)
+		if err != nil {
+			logger.Log.Error(err.Error())
+			panic(err)
+		}
+	}
+	return a
+}
 
-	a.httpClient = &AgentHTTPClient{httpClient: &http.Client{Timeout: time.Second * 5}, retry: retry.NewRetry(1, 2, 3)}
+// newDestinationClient создает клиент сервера, TLS включается при заданном ключе шифрования или параметрах TLS
+func newDestinationClient(d config.Destination, name string, bufferSize int) (*AgentHTTPClient, error) {
+	httpClient := &http.Client{Timeout: time.Second * 5}
 	protocol := "http"
-	if a.Config.GetCryptoKeyPath() != "" {
+	if d.UseTLS() {
 		protocol = "https"
-		tlsConfig, err := createTLSConfig()
+		tlsConfig, err := createTLSConfig(d.TLS)
 		if err != nil {
-			logger.Log.Error(err.Error())
-			panic(err)
+			return nil, err
 		}
-		transport := &http.Transport{
+		httpClient.Transport = &http.Transport{
 			TLSClientConfig: tlsConfig,
 		}
-		a.httpClient.httpClient.Transport = transport
 	}
-	a.Protocol = protocol
-	return a
+	addr := fmt.Sprintf("%s://%s", protocol, d.Address)
+	return newAgentHTTPClient(httpClient, addr, d.Key, name, bufferSize), nil
 }
 
-func createTLSConfig() (*tls.Config, error) {
-	return &tls.Config{
-		InsecureSkipVerify: true,
-		MinVersion:         tls.VersionTLS12,
-		CipherSuites: []uint16{
-			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
-			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
-			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
-			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
-			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
-			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
-		},
-	}, nil
+func newSendRetry() retry.Retry {
+	return retry.NewRetry(sendRetryBase, sendRetryMaxDelay, sendRetries).WithDeadline(sendRetryDeadline)
 }
 
-func worker(ctx context.Context, addr string, key string, client *AgentHTTPClient, jobs <-chan collector.Metric) error {
+func worker(ctx context.Context, sender *destinationSender, jobs <-chan collector.Metric) error {
 	for {
 		select {
 		case <-ctx.Done():
@@ -151,26 +357,27 @@ func worker(ctx context.Context, addr string, key string, client *AgentHTTPClien
 			if !ok {
 				return nil
 			}
-			if err := sendBulkMetric(ctx, m, addr, key, client); err != nil {
+			if err := sendBulkMetric(ctx, m, sender); err != nil {
 				logger.Log.Warn("send metric error", zap.Error(err))
 			}
 		}
 	}
 }
 
-func sendBulkMetric(ctx context.Context, c collector.Metric, addr string, key string, client *AgentHTTPClient) error {
+func sendBulkMetric(ctx context.Context, c collector.Metric, sender *destinationSender) error {
 	if len(c.GaugeMetrics) == 0 && len(c.CounterMetrics) == 0 {
 		logger.Log.Info("Отправка метрик. Метрик нет")
 		return nil
 	}
 	d := make([]data.Metric, 0, len(c.GaugeMetrics)+len(c.CounterMetrics))
+	d = append(d, selfMetrics()...)
 	for _, v := range c.GaugeMetrics {
 		d = append(d, data.Metric{ID: string(v.Name), MType: data.MTypeGauge, Value: &v.Value})
 	}
 	for _, v := range c.CounterMetrics {
 		d = append(d, data.Metric{ID: string(v.Name), MType: data.MTypeCounter, Delta: &v.Value})
 	}
-	return sendMetricJSON(ctx, client, addr, key, d...)
+	return sender.Send(ctx, d)
 }
 
 func sendMetricJSON(ctx context.Context, client *AgentHTTPClient, addr string, key string, metric ...data.Metric) error {
@@ -195,16 +402,16 @@ func sendMetricJSON(ctx context.Context, client *AgentHTTPClient, addr string, k
 	}
 	gzipWriter.Close()
 	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, &buf)
+	if err != nil {
+		logger.Log.Info(err.Error())
+		return err
+	}
 	if key != "" {
 		h := hmac.New(sha256.New, []byte(key))
 		h.Write(data)
 		hash := hex.EncodeToString(h.Sum(nil))
 		req.Header.Set(hashHeader, hash)
 	}
-	if err != nil {
-		logger.Log.Info(err.Error())
-		return err
-	}
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Content-Encoding", "gzip")
 	return client.Do(ctx, req)
@@ -0,0 +1,197 @@
+package agent
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/megaded/metrictmr/internal/agent/breaker"
+	"github.com/megaded/metrictmr/internal/data"
+	"github.com/megaded/metrictmr/internal/retry"
+	"github.com/megaded/metrictmr/internal/selfmetric"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testServer сервер метрик, который можно "уронить"
+type testServer struct {
+	mu       sync.Mutex
+	down     bool
+	updates  int
+	probes   int
+	received []data.Metric
+	// reject пакеты с метрикой из списка отклоняются с кодом 400
+	reject map[string]bool
+}
+
+func (s *testServer) setDown(down bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.down = down
+}
+
+func (s *testServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r.Method == http.MethodHead {
+		s.probes++
+	} else {
+		s.updates++
+	}
+	if s.down {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	if r.Method == http.MethodPost {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var metrics []data.Metric
+		if err := json.NewDecoder(gz).Decode(&metrics); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		for _, m := range metrics {
+			if s.reject[m.ID] {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+		s.received = append(s.received, metrics...)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func newTestClient(addr string) *AgentHTTPClient {
+	c := newAgentHTTPClient(&http.Client{Timeout: time.Second}, addr, "", "", 2)
+	c.retry = retry.NewRetry(0, 0, 0)
+	c.breaker = breaker.New(breaker.Settings{Window: 2, MinRequests: 2, FailureRatio: 0.5, OpenTimeout: 20 * time.Millisecond})
+	return c
+}
+
+func TestAgentHTTPClient_Send(t *testing.T) {
+	srv := &testServer{}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	c := newTestClient(ts.URL)
+	ctx := context.Background()
+
+	srv.setDown(true)
+	assert.Error(t, c.Send(ctx, batch("1")))
+	assert.Error(t, c.Send(ctx, batch("2")))
+	assert.Equal(t, breaker.Open, c.breaker.State())
+
+	// выключатель разомкнут: запросы не отправляются, пакеты копятся с вытеснением старых
+	assert.NoError(t, c.Send(ctx, batch("3")))
+	assert.Equal(t, 2, srv.updates)
+	assert.Equal(t, 2, c.buffer.len())
+
+	// пробный запрос при недоступном сервере снова размыкает выключатель
+	time.Sleep(30 * time.Millisecond)
+	assert.Error(t, c.Send(ctx, batch("4")))
+	assert.Equal(t, 1, srv.probes)
+	assert.Equal(t, 2, srv.updates)
+	assert.Equal(t, breaker.Open, c.breaker.State())
+
+	srv.setDown(false)
+	time.Sleep(30 * time.Millisecond)
+	require.NoError(t, c.Send(ctx, batch("5")))
+	assert.Equal(t, breaker.Closed, c.breaker.State())
+	assert.Equal(t, 0, c.buffer.len())
+	ids := make([]string, 0, len(srv.received))
+	for _, m := range srv.received {
+		ids = append(ids, m.ID)
+	}
+	assert.Equal(t, []string{"3", "4", "5"}, ids)
+}
+
+func TestAgentHTTPClient_ProbeReachability(t *testing.T) {
+	var down atomic.Bool
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case down.Load():
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case r.URL.Path == "/ping/":
+			// база недоступна, но прием метрик работает
+			w.WriteHeader(http.StatusInternalServerError)
+		case r.Method == http.MethodHead:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		default:
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+	defer ts.Close()
+	c := newTestClient(ts.URL)
+	ctx := context.Background()
+
+	down.Store(true)
+	assert.Error(t, c.Send(ctx, batch("1")))
+	assert.Error(t, c.Send(ctx, batch("2")))
+	assert.Equal(t, breaker.Open, c.breaker.State())
+
+	// любой ответ сервера ниже 500 замыкает выключатель
+	down.Store(false)
+	time.Sleep(30 * time.Millisecond)
+	require.NoError(t, c.Send(ctx, batch("3")))
+	assert.Equal(t, breaker.Closed, c.breaker.State())
+	assert.Equal(t, 0, c.buffer.len())
+}
+
+func TestAgentHTTPClient_SendPermanentError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer ts.Close()
+	c := newTestClient(ts.URL)
+	for range 3 {
+		assert.Error(t, c.Send(context.Background(), batch("1")))
+	}
+	// отклоненные пакеты не повторяются и не размыкают выключатель
+	assert.Equal(t, breaker.Closed, c.breaker.State())
+	assert.Equal(t, 0, c.buffer.len())
+}
+
+func TestAgentHTTPClient_SendBufferedRejected(t *testing.T) {
+	srv := &testServer{reject: map[string]bool{"bad": true}}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	c := newTestClient(ts.URL)
+	c.buffer.push(batch("1"), batch("bad"))
+	dropped := selfmetric.Default.Counter(selfMetricDroppedBatches)
+	before := dropped.Value()
+
+	// отклоненный отложенный пакет отбрасывается и учитывается, остальные доставляются
+	require.NoError(t, c.Send(context.Background(), batch("2")))
+	assert.Equal(t, []string{"1", "2"}, receivedIDs(srv))
+	assert.Equal(t, 3, srv.updates)
+	assert.Equal(t, 0, c.buffer.len())
+	assert.Equal(t, before+1, dropped.Value())
+
+	// отклоненный новый пакет тоже учитывается и не попадает в буфер
+	assert.Error(t, c.Send(context.Background(), batch("bad")))
+	assert.Equal(t, 0, c.buffer.len())
+	assert.Equal(t, before+2, dropped.Value())
+}
+
+func TestAgentHTTPClient_SendBufferedUnavailable(t *testing.T) {
+	srv := &testServer{}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	c := newAgentHTTPClient(&http.Client{Timeout: time.Second}, ts.URL, "", "", 5)
+	c.retry = retry.NewRetry(0, 0, 0)
+	c.buffer.push(batch("1"), batch("2"))
+	srv.setDown(true)
+
+	// первый же отложенный пакет не доставлен: все пакеты остаются в буфере по порядку
+	assert.Error(t, c.Send(context.Background(), batch("3")))
+	assert.Equal(t, 1, srv.updates)
+	assert.Equal(t, [][]data.Metric{batch("1"), batch("2"), batch("3")}, c.buffer.drain())
+}
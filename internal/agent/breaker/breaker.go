@@ -0,0 +1,164 @@
+// Автоматический выключатель (circuit breaker) для отправки метрик
+//
+// В закрытом состоянии запросы проходят, результаты последних Window запросов учитываются.
+// Если доля ошибок достигает FailureRatio (при не менее MinRequests запросов), выключатель
+// размыкается на OpenTimeout. Затем он переходит в полуоткрытое состояние и пропускает
+// одну пробную попытку: успех замыкает выключатель, ошибка снова размыкает.
+package breaker
+
+import (
+	"sync"
+	"time"
+)
+
+type State int
+
+const (
+	Closed State = iota
+	Open
+	HalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+type Settings struct {
+	// Window количество последних запросов, по которым считается доля ошибок
+	Window int
+	// MinRequests минимальное число запросов в окне для размыкания
+	MinRequests int
+	// FailureRatio доля ошибок, при которой выключатель размыкается
+	FailureRatio float64
+	// OpenTimeout время в разомкнутом состоянии до пробной попытки
+	OpenTimeout time.Duration
+	// OnStateChange вызывается при смене состояния под блокировкой выключателя
+	OnStateChange func(from State, to State)
+}
+
+type Breaker struct {
+	settings Settings
+	now      func() time.Time
+
+	mu       sync.Mutex
+	state    State
+	openedAt time.Time
+	probing  bool
+	// results кольцевой буфер результатов, true - ошибка
+	results  []bool
+	next     int
+	count    int
+	failures int
+}
+
+func New(s Settings) *Breaker {
+	if s.Window < 1 {
+		s.Window = 1
+	}
+	return &Breaker{settings: s, now: time.Now, results: make([]bool, s.Window)}
+}
+
+// State текущее состояние с учетом истекшего времени размыкания
+func (b *Breaker) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refresh()
+	return b.state
+}
+
+// Allow можно ли выполнить запрос. probe - запрос пробный, его результат
+// нужно сообщить через Success или Failure до следующей пробы.
+func (b *Breaker) Allow() (allowed bool, probe bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refresh()
+	switch b.state {
+	case Closed:
+		return true, false
+	case HalfOpen:
+		if b.probing {
+			return false, false
+		}
+		b.probing = true
+		return true, true
+	}
+	return false, false
+}
+
+// Success учитывает успешный запрос
+func (b *Breaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == HalfOpen {
+		b.probing = false
+		b.setState(Closed)
+		return
+	}
+	b.record(false)
+}
+
+// Failure учитывает неудачный запрос
+func (b *Breaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case HalfOpen:
+		b.probing = false
+		b.open()
+	case Closed:
+		b.record(true)
+		if b.count >= b.settings.MinRequests && float64(b.failures) >= b.settings.FailureRatio*float64(b.count) {
+			b.open()
+		}
+	}
+}
+
+func (b *Breaker) record(failure bool) {
+	if b.count == len(b.results) {
+		if b.results[b.next] {
+			b.failures--
+		}
+	} else {
+		b.count++
+	}
+	b.results[b.next] = failure
+	if failure {
+		b.failures++
+	}
+	b.next = (b.next + 1) % len(b.results)
+}
+
+func (b *Breaker) open() {
+	b.openedAt = b.now()
+	b.setState(Open)
+}
+
+// refresh переводит разомкнутый выключатель в полуоткрытый по истечении OpenTimeout
+func (b *Breaker) refresh() {
+	if b.state == Open && b.now().Sub(b.openedAt) >= b.settings.OpenTimeout {
+		b.setState(HalfOpen)
+	}
+}
+
+func (b *Breaker) setState(s State) {
+	if b.state == s {
+		return
+	}
+	from := b.state
+	b.state = s
+	if s == Closed {
+		clear(b.results)
+		b.next, b.count, b.failures = 0, 0, 0
+	}
+	if b.settings.OnStateChange != nil {
+		b.settings.OnStateChange(from, s)
+	}
+}
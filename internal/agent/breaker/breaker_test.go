@@ -0,0 +1,102 @@
+package breaker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestBreaker() (*Breaker, *time.Time, *[]State) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var changes []State
+	b := New(Settings{
+		Window:        4,
+		MinRequests:   4,
+		FailureRatio:  0.5,
+		OpenTimeout:   time.Second,
+		OnStateChange: func(from State, to State) { changes = append(changes, to) },
+	})
+	b.now = func() time.Time { return now }
+	return b, &now, &changes
+}
+
+func TestBreaker_OpensOnFailureRate(t *testing.T) {
+	tests := []struct {
+		name     string
+		results  []bool
+		wantOpen bool
+	}{
+		{"below min requests", []bool{true, true, true}, false},
+		{"half failed", []bool{false, true, false, true}, true},
+		{"quarter failed", []bool{false, true, false, false}, false},
+		{"old failures leave window", []bool{true, true, false, false, false, false, true}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, _, _ := newTestBreaker()
+			for _, failed := range tt.results {
+				if failed {
+					b.Failure()
+				} else {
+					b.Success()
+				}
+			}
+			allowed, _ := b.Allow()
+			assert.Equal(t, tt.wantOpen, !allowed)
+			assert.Equal(t, tt.wantOpen, b.State() == Open)
+		})
+	}
+}
+
+func TestBreaker_HalfOpenProbe(t *testing.T) {
+	b, now, changes := newTestBreaker()
+	for range 4 {
+		b.Failure()
+	}
+	assert.Equal(t, Open, b.State())
+
+	*now = now.Add(time.Second)
+	assert.Equal(t, HalfOpen, b.State())
+	allowed, probe := b.Allow()
+	assert.True(t, allowed)
+	assert.True(t, probe)
+	// пока проба не завершена, остальные запросы не проходят
+	allowed, _ = b.Allow()
+	assert.False(t, allowed)
+
+	b.Failure()
+	assert.Equal(t, Open, b.State())
+
+	*now = now.Add(time.Second)
+	allowed, probe = b.Allow()
+	assert.True(t, allowed && probe)
+	b.Success()
+	assert.Equal(t, Closed, b.State())
+	allowed, probe = b.Allow()
+	assert.True(t, allowed)
+	assert.False(t, probe)
+
+	assert.Equal(t, []State{Open, HalfOpen, Open, HalfOpen, Closed}, *changes)
+}
+
+func TestBreaker_WindowResetOnClose(t *testing.T) {
+	b, now, _ := newTestBreaker()
+	for range 4 {
+		b.Failure()
+	}
+	*now = now.Add(time.Second)
+	b.Allow()
+	b.Success()
+	// после замыкания старые ошибки не учитываются
+	for range 3 {
+		b.Failure()
+	}
+	assert.Equal(t, Closed, b.State())
+}
+
+func TestState_String(t *testing.T) {
+	assert.Equal(t, "closed", Closed.String())
+	assert.Equal(t, "open", Open.String())
+	assert.Equal(t, "half-open", HalfOpen.String())
+}
@@ -0,0 +1,60 @@
+package agent
+
+import (
+	"sync"
+
+	"github.com/megaded/metrictmr/internal/data"
+)
+
+// batchBuffer ограниченная очередь пакетов, не доставленных на сервер.
+// При переполнении отбрасываются самые старые пакеты.
+type batchBuffer struct {
+	mu      sync.Mutex
+	size    int
+	batches [][]data.Metric
+}
+
+// newBatchBuffer отрицательный размер считается нулевым: пакеты не удерживаются
+func newBatchBuffer(size int) *batchBuffer {
+	return &batchBuffer{size: max(size, 0)}
+}
+
+// push добавляет пакеты в конец очереди и возвращает количество отброшенных
+func (b *batchBuffer) push(batches ...[]data.Metric) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.batches = append(b.batches, batches...)
+	return b.trim()
+}
+
+// pushFront возвращает пакеты в начало очереди после неудачной отправки
+func (b *batchBuffer) pushFront(batches ...[]data.Metric) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.batches = append(append(make([][]data.Metric, 0, len(batches)+len(b.batches)), batches...), b.batches...)
+	return b.trim()
+}
+
+// drain забирает все пакеты из очереди
+func (b *batchBuffer) drain() [][]data.Metric {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	batches := b.batches
+	b.batches = nil
+	return batches
+}
+
+func (b *batchBuffer) len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.batches)
+}
+
+func (b *batchBuffer) trim() int {
+	dropped := max(len(b.batches)-b.size, 0)
+	if dropped > 0 {
+		clear(b.batches[:dropped])
+		b.batches = b.batches[dropped:]
+	}
+	return dropped
+}
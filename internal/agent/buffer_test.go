@@ -0,0 +1,35 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/megaded/metrictmr/internal/data"
+	"github.com/stretchr/testify/assert"
+)
+
+func batch(id string) []data.Metric {
+	return []data.Metric{{ID: id, MType: data.MTypeGauge}}
+}
+
+func TestBatchBuffer(t *testing.T) {
+	b := newBatchBuffer(3)
+	assert.Equal(t, 0, b.push(batch("1"), batch("2")))
+	assert.Equal(t, 1, b.push(batch("3"), batch("4")))
+	assert.Equal(t, 3, b.len())
+
+	batches := b.drain()
+	assert.Equal(t, [][]data.Metric{batch("2"), batch("3"), batch("4")}, batches)
+	assert.Equal(t, 0, b.len())
+
+	b.push(batch("5"))
+	// возвращенные пакеты идут перед новыми, при переполнении вытесняются старые
+	assert.Equal(t, 1, b.pushFront(batches...))
+	assert.Equal(t, [][]data.Metric{batch("3"), batch("4"), batch("5")}, b.drain())
+}
+
+func TestBatchBuffer_NegativeSize(t *testing.T) {
+	b := newBatchBuffer(-1)
+	assert.Equal(t, 1, b.push(batch("1")))
+	assert.Equal(t, 1, b.pushFront(batch("2")))
+	assert.Equal(t, 0, b.len())
+}
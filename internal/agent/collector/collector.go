@@ -28,15 +28,21 @@ type Metric struct {
 
 type MetricCollector struct {
 	PollCount int
+	mu        sync.Mutex
 }
 
 func (c *MetricCollector) IncreasePollCount() {
-	var mutex sync.Mutex
-	mutex.Lock()
-	defer mutex.Unlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	c.PollCount++
 }
 
+func (c *MetricCollector) getPollCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.PollCount
+}
+
 const (
 	Alloc           = MetricName("Alloc")
 	BuckHashSys     = MetricName("BuckHashSys")
@@ -77,7 +83,7 @@ func (c *MetricCollector) GetRunTimeMetrics() Metric {
 		c.IncreasePollCount()
 	}()
 	return Metric{GaugeMetrics: GetGaugeMetrics(), CounterMetrics: []Counter{
-		{Name: PollCount, Value: int64(c.PollCount)},
+		{Name: PollCount, Value: int64(c.getPollCount())},
 	}}
 }
 
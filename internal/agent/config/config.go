@@ -5,6 +5,7 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/caarlos0/env"
 	"github.com/megaded/metrictmr/internal/logger"
@@ -14,8 +15,69 @@ const (
 	defaultAddr    = "localhost:8080"
 	reportInterval = 10
 	pollInterval   = 2
+	// defaultBufferSize количество пакетов, удерживаемых при недоступном сервере
+	defaultBufferSize = 100
 )
 
+// Режимы отправки на несколько серверов
+const (
+	// ModeFailover отправка на первый доступный сервер по порядку
+	ModeFailover = "failover"
+	// ModeFanout отправка на все серверы
+	ModeFanout = "fanout"
+	// ModeHash каждая метрика отправляется на один сервер, выбранный по хешу имени
+	ModeHash = "hash"
+)
+
+// TLS параметры проверки сервера и клиентский сертификат для mTLS
+type TLS struct {
+	// CACert файл с сертификатами удостоверяющих центров в PEM, без него используются системные
+	CACert     string `env:"CA_CERT" json:"ca_cert"`
+	ClientCert string `env:"CLIENT_CERT" json:"client_cert"`
+	ClientKey  string `env:"CLIENT_KEY" json:"client_key"`
+	// Pins хеши SHA-256 открытого ключа (SPKI) в base64, один из них должен быть в цепочке сервера
+	Pins       []string `env:"TLS_PINS" envSeparator:"," json:"pin_sha256"`
+	ServerName string   `env:"TLS_SERVER_NAME" json:"server_name"`
+}
+
+// Destination сервер, на который отправляются метрики, со своими ключом подписи и настройками TLS
+type Destination struct {
+	Address   string `json:"address"`
+	Key       string `json:"key"`
+	CryptoKey string `json:"crypto_key"`
+	TLS
+}
+
+// RelabelRule правило изменения меток собранной метрики, подмножество metric_relabel_configs Prometheus.
+// Имя метрики доступно как метка __name__.
+type RelabelRule struct {
+	SourceLabels []string `json:"source_labels"`
+	// Separator разделитель значений SourceLabels, по умолчанию ";"
+	Separator string `json:"separator"`
+	// Regex выражение для значения, привязано к началу и концу строки, по умолчанию "(.*)"
+	Regex string `json:"regex"`
+	// Action replace (по умолчанию), keep, drop, labeldrop, labelkeep
+	Action      string `json:"action"`
+	TargetLabel string `json:"target_label"`
+	// Replacement значение для replace, по умолчанию "$1"
+	Replacement *string `json:"replacement"`
+}
+
+// ScrapeTarget endpoint Prometheus, метрики которого агент собирает и пересылает на сервер
+type ScrapeTarget struct {
+	URL string `json:"url"`
+	// Interval период опроса в секундах
+	Interval int `json:"interval"`
+	// Timeout время ожидания ответа в секундах
+	Timeout int           `json:"timeout"`
+	Relabel []RelabelRule `json:"relabel"`
+}
+
+// UseTLS соединение с сервером защищено: задан ключ шифрования или параметры TLS
+func (d Destination) UseTLS() bool {
+	return d.CryptoKey != "" || d.CACert != "" || d.ClientCert != "" || len(d.Pins) > 0
+}
+
 type Config struct {
 	Address        string `env:"ADDRESS" json:"address"`
 	ReportInterval int64  `env:"REPORT_INTERVAL" json:"report_interval"`
@@ -23,6 +85,17 @@ type Config struct {
 	Key            string `env:"KEY"`
 	RateLimit      *int   `env:"RATE_LIMIT"`
 	CryptoKey      string `evn:"CRYPTO_KEY" json:"crypto_key"`
+	BufferSize     int    `env:"BUFFER_SIZE" json:"buffer_size"`
+	// Destinations серверы с индивидуальными настройками, задаются в файле конфигурации
+	Destinations []Destination `json:"destinations"`
+	// DestinationAddrs адреса серверов с общими ключом и настройками TLS
+	DestinationAddrs []string `env:"DESTINATIONS" envSeparator:","`
+	DestinationMode  string   `env:"DESTINATION_MODE" json:"destination_mode"`
+	TLS
+	// ScrapeTargets endpoints Prometheus с индивидуальными настройками, задаются в файле конфигурации
+	ScrapeTargets []ScrapeTarget `json:"scrape_targets"`
+	// ScrapeURLs адреса endpoints Prometheus с настройками по умолчанию
+	ScrapeURLs []string `env:"SCRAPE_TARGETS" envSeparator:","`
 }
 
 func (c *Config) GetAddress() string {
@@ -49,11 +122,48 @@ func (c *Config) GetCryptoKeyPath() string {
 	return c.CryptoKey
 }
 
+func (c *Config) GetBufferSize() int {
+	return c.BufferSize
+}
+
+// GetDestinations серверы для отправки: из файла конфигурации, из списка адресов
+// или единственный сервер Address
+func (c *Config) GetDestinations() []Destination {
+	if len(c.Destinations) > 0 {
+		return c.Destinations
+	}
+	addrs := c.DestinationAddrs
+	if len(addrs) == 0 {
+		addrs = []string{c.Address}
+	}
+	result := make([]Destination, 0, len(addrs))
+	for _, addr := range addrs {
+		result = append(result, Destination{Address: strings.TrimSpace(addr), Key: c.Key, CryptoKey: c.CryptoKey, TLS: c.TLS})
+	}
+	return result
+}
+
+// GetScrapeTargets endpoints Prometheus из файла конфигурации и списка адресов
+func (c *Config) GetScrapeTargets() []ScrapeTarget {
+	targets := append([]ScrapeTarget(nil), c.ScrapeTargets...)
+	for _, u := range c.ScrapeURLs {
+		if u = strings.TrimSpace(u); u != "" {
+			targets = append(targets, ScrapeTarget{URL: u})
+		}
+	}
+	return targets
+}
+
+func (c *Config) GetDestinationMode() string {
+	return c.DestinationMode
+}
+
 func GetConfig() *Config {
 	config := &Config{}
 	var configPath string
 	flag.StringVar(&configPath, "c", "", "config file")
 	flag.StringVar(&configPath, "config", "", "config file")
+	setCmdParam := defineCmdParam()
 	flag.Parse()
 	if configPath != "" {
 		data, err := readJSONFile(configPath)
@@ -69,34 +179,82 @@ func GetConfig() *Config {
 	}
 	setEnvParam(config)
 	setCmdParam(config)
+	switch config.DestinationMode {
+	case ModeFailover, ModeFanout, ModeHash:
+	default:
+		err := fmt.Errorf("unknown destination mode %q", config.DestinationMode)
+		logger.Log.Error(err.Error())
+		panic(err)
+	}
 	return config
 }
 
 func setEnvParam(c *Config) {
 	env.Parse(c)
+	// вложенные структуры библиотека не обходит
+	env.Parse(&c.TLS)
 }
 
-func setCmdParam(c *Config) {
+// defineCmdParam объявляет флаги командной строки до их разбора
+// и возвращает функцию, применяющую значения флагов к незаданным параметрам
+func defineCmdParam() func(c *Config) {
 	address := flag.String("a", defaultAddr, "server endpoint")
 	reportInterval := flag.Int64("r", reportInterval, "reportInterval")
 	pollInterval := flag.Int64("p", pollInterval, "pollInterval")
 	key := flag.String("k", "", "key")
 	rateLimit := flag.Int("l", 10, "rate limit")
-	flag.Parse()
-	if c.Address == "" {
-		c.Address = *address
-	}
-	if c.ReportInterval == 0 {
-		c.ReportInterval = *reportInterval
-	}
-	if c.PollInterval == 0 {
-		c.PollInterval = *pollInterval
-	}
-	if c.Key == "" {
-		c.Key = *key
-	}
-	if c.RateLimit == nil {
-		c.RateLimit = rateLimit
+	bufferSize := flag.Int("b", defaultBufferSize, "batches buffered while server is unavailable")
+	destinations := flag.String("destinations", "", "comma separated server endpoints")
+	destinationMode := flag.String("mode", ModeFailover, "destination mode: failover, fanout, hash")
+	caCert := flag.String("ca-cert", "", "CA bundle to verify server certificate")
+	clientCert := flag.String("client-cert", "", "client certificate for mutual TLS")
+	clientKey := flag.String("client-key", "", "client private key for mutual TLS")
+	pins := flag.String("tls-pin", "", "comma separated base64 SHA-256 SPKI pins of server certificate chain")
+	serverName := flag.String("tls-server-name", "", "server name to verify instead of address host")
+	scrapeURLs := flag.String("scrape", "", "comma separated Prometheus endpoints to scrape")
+	return func(c *Config) {
+		if c.Address == "" {
+			c.Address = *address
+		}
+		if c.ReportInterval == 0 {
+			c.ReportInterval = *reportInterval
+		}
+		if c.PollInterval == 0 {
+			c.PollInterval = *pollInterval
+		}
+		if c.Key == "" {
+			c.Key = *key
+		}
+		if c.RateLimit == nil {
+			c.RateLimit = rateLimit
+		}
+		if c.BufferSize == 0 {
+			c.BufferSize = *bufferSize
+		}
+		if len(c.DestinationAddrs) == 0 && *destinations != "" {
+			c.DestinationAddrs = strings.Split(*destinations, ",")
+		}
+		if c.DestinationMode == "" {
+			c.DestinationMode = *destinationMode
+		}
+		if c.CACert == "" {
+			c.CACert = *caCert
+		}
+		if c.ClientCert == "" {
+			c.ClientCert = *clientCert
+		}
+		if c.ClientKey == "" {
+			c.ClientKey = *clientKey
+		}
+		if len(c.Pins) == 0 && *pins != "" {
+			c.Pins = strings.Split(*pins, ",")
+		}
+		if c.ServerName == "" {
+			c.ServerName = *serverName
+		}
+		if len(c.ScrapeURLs) == 0 && *scrapeURLs != "" {
+			c.ScrapeURLs = strings.Split(*scrapeURLs, ",")
+		}
 	}
 }
 
@@ -0,0 +1,111 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"sync"
+
+	"github.com/megaded/metrictmr/internal/agent/config"
+	"github.com/megaded/metrictmr/internal/data"
+	"github.com/megaded/metrictmr/internal/retry"
+)
+
+var errBreakerOpen = errors.New("circuit breaker is open")
+
+// destinationSender распределяет пакеты между серверами в соответствии с режимом:
+//   - failover - на первый доступный сервер по порядку, пакет буферизуется только последним;
+//   - fanout - на все серверы, у каждого свой буфер;
+//   - hash - каждая метрика на сервер, выбранный по хешу имени. Распределение не меняется
+//     при недоступности сервера, чтобы значения counter не разъезжались между серверами.
+type destinationSender struct {
+	mode    string
+	clients []*AgentHTTPClient
+}
+
+func newDestinationSender(mode string, destinations []config.Destination, bufferSize int) (*destinationSender, error) {
+	if len(destinations) == 0 {
+		return nil, errors.New("no destinations configured")
+	}
+	if bufferSize < 0 {
+		return nil, fmt.Errorf("invalid buffer size %d", bufferSize)
+	}
+	s := &destinationSender{mode: mode, clients: make([]*AgentHTTPClient, 0, len(destinations))}
+	for i, d := range destinations {
+		name := ""
+		if len(destinations) > 1 {
+			name = strconv.Itoa(i)
+		}
+		c, err := newDestinationClient(d, name, bufferSize)
+		if err != nil {
+			return nil, fmt.Errorf("destination %s: %w", d.Address, err)
+		}
+		s.clients = append(s.clients, c)
+	}
+	return s, nil
+}
+
+func (s *destinationSender) Send(ctx context.Context, metrics []data.Metric) error {
+	switch s.mode {
+	case config.ModeFanout:
+		return s.fanout(ctx, metrics)
+	case config.ModeHash:
+		return s.hash(ctx, metrics)
+	}
+	return s.failover(ctx, metrics)
+}
+
+func (s *destinationSender) failover(ctx context.Context, metrics []data.Metric) error {
+	var errs []error
+	for i, c := range s.clients {
+		err := c.send(ctx, metrics, i == len(s.clients)-1)
+		if err == nil || retry.IsPermanent(err) || ctx.Err() != nil {
+			return err
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", c.addr, err))
+	}
+	return errors.Join(errs...)
+}
+
+func (s *destinationSender) fanout(ctx context.Context, metrics []data.Metric) error {
+	return s.sendAll(ctx, func(int) []data.Metric { return metrics })
+}
+
+func (s *destinationSender) hash(ctx context.Context, metrics []data.Metric) error {
+	shards := make([][]data.Metric, len(s.clients))
+	for _, m := range metrics {
+		i := shard(m.ID, len(s.clients))
+		shards[i] = append(shards[i], m)
+	}
+	return s.sendAll(ctx, func(i int) []data.Metric { return shards[i] })
+}
+
+// sendAll параллельно отправляет каждому серверу его часть пакета
+func (s *destinationSender) sendAll(ctx context.Context, part func(i int) []data.Metric) error {
+	errs := make([]error, len(s.clients))
+	var wg sync.WaitGroup
+	for i, c := range s.clients {
+		metrics := part(i)
+		if len(metrics) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := c.Send(ctx, metrics); err != nil {
+				errs[i] = fmt.Errorf("%s: %w", c.addr, err)
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// shard номер сервера для метрики, тип не учитывается: gauge и counter с одним именем попадают на один сервер
+func shard(id string, n int) int {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return int(h.Sum32() % uint32(n))
+}
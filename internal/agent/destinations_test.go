@@ -0,0 +1,100 @@
+package agent
+
+import (
+	"context"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/megaded/metrictmr/internal/agent/config"
+	"github.com/megaded/metrictmr/internal/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestSender(t *testing.T, mode string, servers ...*testServer) *destinationSender {
+	s := &destinationSender{mode: mode}
+	for _, srv := range servers {
+		ts := httptest.NewServer(srv)
+		t.Cleanup(ts.Close)
+		s.clients = append(s.clients, newTestClient(ts.URL))
+	}
+	return s
+}
+
+func receivedIDs(s *testServer) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := make([]string, 0, len(s.received))
+	for _, m := range s.received {
+		ids = append(ids, m.ID)
+	}
+	return ids
+}
+
+func TestDestinationSender_Failover(t *testing.T) {
+	primary, secondary := &testServer{}, &testServer{}
+	s := newTestSender(t, config.ModeFailover, primary, secondary)
+	ctx := context.Background()
+
+	require.NoError(t, s.Send(ctx, batch("1")))
+	primary.setDown(true)
+	require.NoError(t, s.Send(ctx, batch("2")))
+	require.NoError(t, s.Send(ctx, batch("3")))
+	// выключатель основного сервера разомкнут, запросы сразу идут на резервный
+	require.NoError(t, s.Send(ctx, batch("4")))
+
+	assert.Equal(t, []string{"1"}, receivedIDs(primary))
+	assert.Equal(t, []string{"2", "3", "4"}, receivedIDs(secondary))
+	assert.Equal(t, 0, s.clients[0].buffer.len())
+
+	// недоступны оба сервера: пакет остается в буфере последнего
+	secondary.setDown(true)
+	assert.Error(t, s.Send(ctx, batch("5")))
+	assert.Equal(t, 0, s.clients[0].buffer.len())
+	assert.Equal(t, 1, s.clients[1].buffer.len())
+}
+
+func TestDestinationSender_Fanout(t *testing.T) {
+	first, second := &testServer{}, &testServer{}
+	s := newTestSender(t, config.ModeFanout, first, second)
+	ctx := context.Background()
+
+	require.NoError(t, s.Send(ctx, batch("1")))
+	second.setDown(true)
+	assert.Error(t, s.Send(ctx, batch("2")))
+	second.setDown(false)
+	// ошибка разомкнула выключатель второго сервера, после паузы пробный запрос его замкнет
+	time.Sleep(30 * time.Millisecond)
+	require.NoError(t, s.Send(ctx, batch("3")))
+
+	assert.Equal(t, []string{"1", "2", "3"}, receivedIDs(first))
+	assert.Equal(t, []string{"1", "2", "3"}, receivedIDs(second))
+}
+
+func TestDestinationSender_Hash(t *testing.T) {
+	servers := []*testServer{{}, {}, {}}
+	s := newTestSender(t, config.ModeHash, servers...)
+	metrics := make([]data.Metric, 0, 30)
+	for i := range 30 {
+		metrics = append(metrics, data.Metric{ID: "m" + strconv.Itoa(i), MType: data.MTypeGauge})
+	}
+	require.NoError(t, s.Send(context.Background(), metrics))
+
+	total := 0
+	for i, srv := range servers {
+		ids := receivedIDs(srv)
+		assert.NotEmpty(t, ids)
+		for _, id := range ids {
+			assert.Equal(t, i, shard(id, len(servers)), id)
+		}
+		total += len(ids)
+	}
+	assert.Equal(t, len(metrics), total)
+}
+
+func TestNewDestinationSender_InvalidBufferSize(t *testing.T) {
+	_, err := newDestinationSender(config.ModeFailover, []config.Destination{{Address: "localhost:8080"}}, -1)
+	assert.Error(t, err)
+}
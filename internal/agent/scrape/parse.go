@@ -0,0 +1,155 @@
+// Сбор метрик с endpoints Prometheus
+//
+// Ответ в текстовом формате (text exposition format 0.0.4) разбирается в сэмплы,
+// к ним применяются правила relabel, после чего сэмплы переводятся в gauge и counter metrictmr.
+package scrape
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/megaded/metrictmr/internal/data"
+)
+
+// Sample одно значение временного ряда
+type Sample struct {
+	Name   string
+	Labels map[string]string
+	Value  float64
+	// MType тип в metrictmr: накопительные значения Prometheus - counter, остальные - gauge
+	MType string
+}
+
+// Parse разбирает текстовый формат Prometheus. Значения NaN и ±Inf пропускаются:
+// их нельзя передать в JSON.
+func Parse(r io.Reader) ([]Sample, error) {
+	types := make(map[string]string)
+	samples := make([]Sample, 0)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		if strings.HasPrefix(text, "#") {
+			fields := strings.Fields(text)
+			if len(fields) >= 4 && fields[1] == "TYPE" {
+				types[fields[2]] = fields[3]
+			}
+			continue
+		}
+		s, err := parseSample(text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		if math.IsNaN(s.Value) || math.IsInf(s.Value, 0) {
+			continue
+		}
+		s.MType = sampleType(s, types)
+		samples = append(samples, s)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return samples, nil
+}
+
+// sampleType тип сэмпла по объявлению TYPE его семейства.
+// Бакеты, суммы и количества гистограмм и summary накопительные, квантили summary - gauge.
+func sampleType(s Sample, types map[string]string) string {
+	if t, ok := types[s.Name]; ok {
+		if t == "counter" {
+			return data.MTypeCounter
+		}
+		return data.MTypeGauge
+	}
+	for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+		base, ok := strings.CutSuffix(s.Name, suffix)
+		if !ok {
+			continue
+		}
+		switch types[base] {
+		case "histogram", "summary":
+			return data.MTypeCounter
+		}
+	}
+	return data.MTypeGauge
+}
+
+// parseSample разбирает строку вида name{label="value",...} value [timestamp]
+func parseSample(text string) (Sample, error) {
+	s := Sample{Labels: map[string]string{}}
+	end := strings.IndexAny(text, "{ \t")
+	if end <= 0 {
+		return s, fmt.Errorf("invalid sample %q", text)
+	}
+	s.Name = text[:end]
+	rest := text[end:]
+	if rest[0] == '{' {
+		var err error
+		rest, err = parseLabels(rest[1:], s.Labels)
+		if err != nil {
+			return s, err
+		}
+	}
+	fields := strings.Fields(rest)
+	if len(fields) < 1 || len(fields) > 2 {
+		return s, fmt.Errorf("invalid sample value %q", text)
+	}
+	value, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return s, fmt.Errorf("invalid sample value %q", fields[0])
+	}
+	s.Value = value
+	return s, nil
+}
+
+// parseLabels разбирает метки до закрывающей скобки и возвращает остаток строки
+func parseLabels(text string, labels map[string]string) (string, error) {
+	for {
+		text = strings.TrimLeft(text, " \t")
+		if text == "" {
+			return "", fmt.Errorf("unterminated label set")
+		}
+		if text[0] == '}' {
+			return text[1:], nil
+		}
+		eq := strings.IndexByte(text, '=')
+		if eq <= 0 {
+			return "", fmt.Errorf("invalid label in %q", text)
+		}
+		name := strings.TrimSpace(text[:eq])
+		text = strings.TrimLeft(text[eq+1:], " \t")
+		if text == "" || text[0] != '"' {
+			return "", fmt.Errorf("label %s: value must be quoted", name)
+		}
+		var value strings.Builder
+		i := 1
+		for ; i < len(text) && text[i] != '"'; i++ {
+			if text[i] == '\\' && i+1 < len(text) {
+				i++
+				switch text[i] {
+				case 'n':
+					value.WriteByte('\n')
+				default:
+					value.WriteByte(text[i])
+				}
+				continue
+			}
+			value.WriteByte(text[i])
+		}
+		if i == len(text) {
+			return "", fmt.Errorf("label %s: unterminated value", name)
+		}
+		labels[name] = value.String()
+		text = strings.TrimLeft(text[i+1:], " \t")
+		if strings.HasPrefix(text, ",") {
+			text = text[1:]
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package scrape
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/megaded/metrictmr/internal/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const exposition = `# HELP http_requests_total Total requests.
+# TYPE http_requests_total counter
+http_requests_total{method="post",code="200"} 1027 1395066363000
+http_requests_total{method="post",code="400"}    3 1395066363000
+
+# TYPE temperature gauge
+temperature 21.5
+temperature_nan NaN
+untyped_metric{path="C:\\dir\\",msg="say \"hi\"\n"} -1.5e3
+
+# TYPE rpc_duration_seconds summary
+rpc_duration_seconds{quantile="0.5"} 0.05
+rpc_duration_seconds_sum 17.5
+rpc_duration_seconds_count 200
+# TYPE request_size histogram
+request_size_bucket{le="+Inf",} 10
+`
+
+func TestParse(t *testing.T) {
+	samples, err := Parse(strings.NewReader(exposition))
+	require.NoError(t, err)
+	want := []Sample{
+		{Name: "http_requests_total", Labels: map[string]string{"method": "post", "code": "200"}, Value: 1027, MType: data.MTypeCounter},
+		{Name: "http_requests_total", Labels: map[string]string{"method": "post", "code": "400"}, Value: 3, MType: data.MTypeCounter},
+		{Name: "temperature", Labels: map[string]string{}, Value: 21.5, MType: data.MTypeGauge},
+		{Name: "untyped_metric", Labels: map[string]string{"path": `C:\dir\`, "msg": "say \"hi\"\n"}, Value: -1500, MType: data.MTypeGauge},
+		{Name: "rpc_duration_seconds", Labels: map[string]string{"quantile": "0.5"}, Value: 0.05, MType: data.MTypeGauge},
+		{Name: "rpc_duration_seconds_sum", Labels: map[string]string{}, Value: 17.5, MType: data.MTypeCounter},
+		{Name: "rpc_duration_seconds_count", Labels: map[string]string{}, Value: 200, MType: data.MTypeCounter},
+		{Name: "request_size_bucket", Labels: map[string]string{"le": "+Inf"}, Value: 10, MType: data.MTypeCounter},
+	}
+	assert.Equal(t, want, samples)
+}
+
+func TestParse_Invalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"missing value", "metric\n"},
+		{"bad value", "metric abc\n"},
+		{"unquoted label", "metric{a=b} 1\n"},
+		{"unterminated labels", `metric{a="b" 1` + "\n"},
+		{"extra fields", "metric 1 2 3\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse(strings.NewReader(tt.input))
+			assert.Error(t, err)
+		})
+	}
+}
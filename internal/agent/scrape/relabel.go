@@ -0,0 +1,118 @@
+package scrape
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/megaded/metrictmr/internal/agent/config"
+)
+
+const (
+	actionReplace   = "replace"
+	actionKeep      = "keep"
+	actionDrop      = "drop"
+	actionLabelDrop = "labeldrop"
+	actionLabelKeep = "labelkeep"
+
+	// nameLabel метка с именем метрики
+	nameLabel = "__name__"
+)
+
+// relabelRule правило с разобранным выражением и значениями по умолчанию
+type relabelRule struct {
+	sourceLabels []string
+	separator    string
+	regex        *regexp.Regexp
+	action       string
+	targetLabel  string
+	replacement  string
+}
+
+func compileRules(rules []config.RelabelRule) ([]relabelRule, error) {
+	result := make([]relabelRule, 0, len(rules))
+	for i, r := range rules {
+		c := relabelRule{
+			sourceLabels: r.SourceLabels,
+			separator:    r.Separator,
+			action:       strings.ToLower(r.Action),
+			targetLabel:  r.TargetLabel,
+			replacement:  "$1",
+		}
+		if c.separator == "" {
+			c.separator = ";"
+		}
+		if c.action == "" {
+			c.action = actionReplace
+		}
+		if r.Replacement != nil {
+			c.replacement = *r.Replacement
+		}
+		expr := r.Regex
+		if expr == "" {
+			expr = "(.*)"
+		}
+		re, err := regexp.Compile("^(?:" + expr + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("relabel rule %d: %w", i, err)
+		}
+		c.regex = re
+		switch c.action {
+		case actionReplace:
+			if c.targetLabel == "" {
+				return nil, fmt.Errorf("relabel rule %d: replace requires target_label", i)
+			}
+		case actionKeep, actionDrop, actionLabelDrop, actionLabelKeep:
+		default:
+			return nil, fmt.Errorf("relabel rule %d: unknown action %q", i, r.Action)
+		}
+		result = append(result, c)
+	}
+	return result, nil
+}
+
+// relabel применяет правила к меткам сэмпла, имя метрики передается меткой __name__.
+// Возвращает false, если сэмпл отброшен.
+func relabel(labels map[string]string, rules []relabelRule) bool {
+	for _, r := range rules {
+		switch r.action {
+		case actionLabelDrop, actionLabelKeep:
+			for name := range labels {
+				if name == nameLabel {
+					continue
+				}
+				if r.regex.MatchString(name) == (r.action == actionLabelDrop) {
+					delete(labels, name)
+				}
+			}
+			continue
+		}
+		values := make([]string, 0, len(r.sourceLabels))
+		for _, name := range r.sourceLabels {
+			values = append(values, labels[name])
+		}
+		value := strings.Join(values, r.separator)
+		match := r.regex.FindStringSubmatchIndex(value)
+		switch r.action {
+		case actionKeep:
+			if match == nil {
+				return false
+			}
+		case actionDrop:
+			if match != nil {
+				return false
+			}
+		case actionReplace:
+			if match == nil {
+				continue
+			}
+			result := string(r.regex.ExpandString(nil, r.replacement, value, match))
+			if result == "" {
+				delete(labels, r.targetLabel)
+			} else {
+				labels[r.targetLabel] = result
+			}
+		}
+	}
+	return labels[nameLabel] != ""
+}
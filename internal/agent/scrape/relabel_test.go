@@ -0,0 +1,103 @@
+package scrape
+
+import (
+	"testing"
+
+	"github.com/megaded/metrictmr/internal/agent/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func ptr(s string) *string {
+	return &s
+}
+
+func TestRelabel(t *testing.T) {
+	tests := []struct {
+		name       string
+		rules      []config.RelabelRule
+		labels     map[string]string
+		wantKeep   bool
+		wantLabels map[string]string
+	}{
+		{
+			name:       "drop by name",
+			rules:      []config.RelabelRule{{SourceLabels: []string{"__name__"}, Regex: "go_.*", Action: "drop"}},
+			labels:     map[string]string{"__name__": "go_goroutines"},
+			wantKeep:   false,
+			wantLabels: map[string]string{"__name__": "go_goroutines"},
+		},
+		{
+			name:       "keep by label",
+			rules:      []config.RelabelRule{{SourceLabels: []string{"code"}, Regex: "5..", Action: "keep"}},
+			labels:     map[string]string{"__name__": "requests", "code": "200"},
+			wantKeep:   false,
+			wantLabels: map[string]string{"__name__": "requests", "code": "200"},
+		},
+		{
+			name: "replace with groups",
+			rules: []config.RelabelRule{{
+				SourceLabels: []string{"method", "code"},
+				Regex:        "(.*);(.)..",
+				TargetLabel:  "class",
+				Replacement:  ptr("${1}_${2}xx"),
+			}},
+			labels:     map[string]string{"__name__": "requests", "method": "get", "code": "404"},
+			wantKeep:   true,
+			wantLabels: map[string]string{"__name__": "requests", "method": "get", "code": "404", "class": "get_4xx"},
+		},
+		{
+			name:       "rename metric",
+			rules:      []config.RelabelRule{{SourceLabels: []string{"__name__"}, Regex: "app_(.*)", TargetLabel: "__name__"}},
+			labels:     map[string]string{"__name__": "app_requests"},
+			wantKeep:   true,
+			wantLabels: map[string]string{"__name__": "requests"},
+		},
+		{
+			name:       "empty replacement removes label",
+			rules:      []config.RelabelRule{{SourceLabels: []string{"instance"}, TargetLabel: "instance", Replacement: ptr("")}},
+			labels:     map[string]string{"__name__": "up", "instance": "host:9100"},
+			wantKeep:   true,
+			wantLabels: map[string]string{"__name__": "up"},
+		},
+		{
+			name:       "labeldrop",
+			rules:      []config.RelabelRule{{Regex: "le|quantile", Action: "labeldrop"}},
+			labels:     map[string]string{"__name__": "size", "le": "1", "job": "api"},
+			wantKeep:   true,
+			wantLabels: map[string]string{"__name__": "size", "job": "api"},
+		},
+		{
+			name:       "labelkeep",
+			rules:      []config.RelabelRule{{Regex: "job", Action: "labelkeep"}},
+			labels:     map[string]string{"__name__": "size", "le": "1", "job": "api"},
+			wantKeep:   true,
+			wantLabels: map[string]string{"__name__": "size", "job": "api"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := compileRules(tt.rules)
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantKeep, relabel(tt.labels, rules))
+			assert.Equal(t, tt.wantLabels, tt.labels)
+		})
+	}
+}
+
+func TestCompileRules_Invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		rule config.RelabelRule
+	}{
+		{"bad regex", config.RelabelRule{Regex: "(", Action: "drop"}},
+		{"unknown action", config.RelabelRule{Action: "hashmod"}},
+		{"replace without target", config.RelabelRule{SourceLabels: []string{"a"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := compileRules([]config.RelabelRule{tt.rule})
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,180 @@
+package scrape
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/megaded/metrictmr/internal/agent/collector"
+	"github.com/megaded/metrictmr/internal/agent/config"
+	"github.com/megaded/metrictmr/internal/data"
+	"github.com/megaded/metrictmr/internal/logger"
+	"github.com/megaded/metrictmr/internal/retry"
+	"github.com/megaded/metrictmr/internal/selfmetric"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultInterval = 15 * time.Second
+	defaultTimeout  = 5 * time.Second
+	// maxBodySize ограничение размера ответа endpoint
+	maxBodySize = 16 << 20
+
+	acceptHeader = "text/plain;version=0.0.4;q=1,*/*;q=0.1"
+
+	selfMetricScrapeErrors = "ScrapeErrors"
+)
+
+// Scraper периодически опрашивает endpoints Prometheus, каждый со своим интервалом
+type Scraper struct {
+	client  *http.Client
+	targets []*target
+}
+
+type target struct {
+	url      string
+	interval time.Duration
+	timeout  time.Duration
+	rules    []relabelRule
+
+	mu sync.Mutex
+	// last накопленные значения counter с прошлого опроса по идентификатору ряда,
+	// ряды, пропавшие из ответа endpoint, удаляются
+	last map[string]float64
+}
+
+func New(targets []config.ScrapeTarget) (*Scraper, error) {
+	s := &Scraper{client: &http.Client{}}
+	for _, t := range targets {
+		rules, err := compileRules(t.Relabel)
+		if err != nil {
+			return nil, fmt.Errorf("scrape target %s: %w", t.URL, err)
+		}
+		tg := &target{
+			url:      t.URL,
+			interval: defaultInterval,
+			timeout:  defaultTimeout,
+			rules:    rules,
+			last:     make(map[string]float64),
+		}
+		if t.Interval > 0 {
+			tg.interval = time.Duration(t.Interval) * time.Second
+		}
+		if t.Timeout > 0 {
+			tg.timeout = time.Duration(t.Timeout) * time.Second
+		}
+		s.targets = append(s.targets, tg)
+	}
+	return s, nil
+}
+
+// Run опрашивает endpoints до отмены ctx и передает результаты в out
+func (s *Scraper) Run(ctx context.Context, out chan<- collector.Metric) error {
+	var wg sync.WaitGroup
+	for _, t := range s.targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.run(ctx, t, out)
+		}()
+	}
+	wg.Wait()
+	return ctx.Err()
+}
+
+func (s *Scraper) run(ctx context.Context, t *target, out chan<- collector.Metric) {
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m, err := s.scrape(ctx, t)
+			if err != nil {
+				selfmetric.Default.Counter(selfMetricScrapeErrors).Inc()
+				logger.Log.Warn("scrape failed", zap.String("url", t.url), zap.Error(err))
+				continue
+			}
+			select {
+			case out <- m:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// scrape выполняет один опрос endpoint
+func (s *Scraper) scrape(ctx context.Context, t *target) (collector.Metric, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, t.url, nil)
+	if err != nil {
+		return collector.Metric{}, err
+	}
+	req.Header.Set("Accept", acceptHeader)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return collector.Metric{}, err
+	}
+	defer resp.Body.Close()
+	if err = retry.ResponseError(resp); err != nil {
+		return collector.Metric{}, err
+	}
+	samples, err := Parse(io.LimitReader(resp.Body, maxBodySize))
+	if err != nil {
+		return collector.Metric{}, err
+	}
+	return t.convert(samples), nil
+}
+
+// convert применяет relabel и переводит сэмплы в метрики агента.
+// Counter Prometheus накопительный, а сервер суммирует приращения: отправляется разность
+// с прошлым опросом. Первый опрос ряда только запоминает значение, уменьшение считается сбросом.
+// Ряд, отсутствующий в ответе, забывается: при появлении снова он считается новым.
+func (t *target) convert(samples []Sample) collector.Metric {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var m collector.Metric
+	seen := make(map[string]struct{}, len(t.last))
+	for _, s := range samples {
+		s.Labels[nameLabel] = s.Name
+		if !relabel(s.Labels, t.rules) {
+			continue
+		}
+		name := s.Labels[nameLabel]
+		for label := range s.Labels {
+			if strings.HasPrefix(label, "__") {
+				delete(s.Labels, label)
+			}
+		}
+		id := data.SeriesID(name, s.Labels)
+		if s.MType == data.MTypeGauge {
+			m.GaugeMetrics = append(m.GaugeMetrics, collector.GaugeMetric{Name: collector.MetricName(id), Value: s.Value})
+			continue
+		}
+		seen[id] = struct{}{}
+		last, ok := t.last[id]
+		t.last[id] = s.Value
+		if !ok {
+			continue
+		}
+		delta := math.Floor(s.Value) - math.Floor(last)
+		if s.Value < last {
+			delta = math.Floor(s.Value)
+		}
+		m.CounterMetrics = append(m.CounterMetrics, collector.Counter{Name: collector.MetricName(id), Value: int64(delta)})
+	}
+	for id := range t.last {
+		if _, ok := seen[id]; !ok {
+			delete(t.last, id)
+		}
+	}
+	return m
+}
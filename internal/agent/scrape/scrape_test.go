@@ -0,0 +1,119 @@
+package scrape
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/megaded/metrictmr/internal/agent/collector"
+	"github.com/megaded/metrictmr/internal/agent/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTarget endpoint, значение counter которого задается тестом
+func newTarget(t *testing.T, requests *atomic.Int64) *httptest.Server {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		fmt.Fprintf(w, "# TYPE requests_total counter\nrequests_total{code=\"200\"} %d\n", requests.Load())
+		fmt.Fprint(w, "# TYPE queue_length gauge\nqueue_length 7\n")
+		fmt.Fprint(w, "go_goroutines 12\n")
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestScraper_Scrape(t *testing.T) {
+	var requests atomic.Int64
+	ts := newTarget(t, &requests)
+	s, err := New([]config.ScrapeTarget{{
+		URL:     ts.URL,
+		Relabel: []config.RelabelRule{{SourceLabels: []string{"__name__"}, Regex: "go_.*", Action: "drop"}},
+	}})
+	require.NoError(t, err)
+	tg := s.targets[0]
+
+	requests.Store(100)
+	m, err := s.scrape(context.Background(), tg)
+	require.NoError(t, err)
+	assert.Equal(t, []collector.GaugeMetric{{Name: "queue_length", Value: 7}}, m.GaugeMetrics)
+	// первый опрос только запоминает значение counter
+	assert.Empty(t, m.CounterMetrics)
+
+	requests.Store(130)
+	m, err = s.scrape(context.Background(), tg)
+	require.NoError(t, err)
+	assert.Equal(t, []collector.Counter{{Name: "requests_total;code=200", Value: 30}}, m.CounterMetrics)
+
+	// сброс counter после перезапуска сервиса
+	requests.Store(5)
+	m, err = s.scrape(context.Background(), tg)
+	require.NoError(t, err)
+	assert.Equal(t, []collector.Counter{{Name: "requests_total;code=200", Value: 5}}, m.CounterMetrics)
+}
+
+func TestTarget_ConvertEvictsStaleSeries(t *testing.T) {
+	tg := &target{last: make(map[string]float64)}
+	counter := func(code string, v float64) Sample {
+		return Sample{Name: "requests_total", MType: "counter", Labels: map[string]string{"code": code}, Value: v}
+	}
+	tg.convert([]Sample{counter("200", 10), counter("500", 1)})
+	m := tg.convert([]Sample{counter("200", 15)})
+	assert.Equal(t, []collector.Counter{{Name: "requests_total;code=200", Value: 5}}, m.CounterMetrics)
+	assert.Len(t, tg.last, 1)
+
+	// вернувшийся ряд считается новым
+	m = tg.convert([]Sample{counter("200", 15), counter("500", 3)})
+	assert.Equal(t, []collector.Counter{{Name: "requests_total;code=200", Value: 0}}, m.CounterMetrics)
+	assert.Len(t, tg.last, 2)
+}
+
+func TestScraper_ScrapeErrors(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer slow.Close()
+
+	s, err := New([]config.ScrapeTarget{{URL: failing.URL}, {URL: slow.URL}})
+	require.NoError(t, err)
+	s.targets[1].timeout = 20 * time.Millisecond
+
+	_, err = s.scrape(context.Background(), s.targets[0])
+	assert.Error(t, err)
+	_, err = s.scrape(context.Background(), s.targets[1])
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestScraper_Run(t *testing.T) {
+	var requests atomic.Int64
+	ts := newTarget(t, &requests)
+	s, err := New([]config.ScrapeTarget{{URL: ts.URL}})
+	require.NoError(t, err)
+	s.targets[0].interval = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	out := make(chan collector.Metric)
+	done := make(chan error)
+	go func() { done <- s.Run(ctx, out) }()
+
+	m := <-out
+	assert.NotEmpty(t, m.GaugeMetrics)
+	cancel()
+	assert.ErrorIs(t, <-done, context.Canceled)
+}
+
+func TestNew_InvalidRelabel(t *testing.T) {
+	_, err := New([]config.ScrapeTarget{{URL: "http://localhost:9100/metrics", Relabel: []config.RelabelRule{{Action: "unknown"}}}})
+	assert.Error(t, err)
+}
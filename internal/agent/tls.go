@@ -0,0 +1,92 @@
+package agent
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/megaded/metrictmr/internal/agent/config"
+)
+
+// errPinMismatch ни один сертификат цепочки сервера не совпал с закрепленными ключами
+var errPinMismatch = errors.New("server certificate does not match any pinned SPKI hash")
+
+// createTLSConfig настройки TLS клиента: сертификат сервера проверяется по CA из файла
+// или системным, при заданных хешах дополнительно проверяется закрепление открытого ключа
+func createTLSConfig(c config.TLS) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: c.ServerName,
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+		},
+	}
+	if c.CACert != "" {
+		pem, err := os.ReadFile(c.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("read CA bundle: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", c.CACert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if c.ClientCert != "" || c.ClientKey != "" {
+		if c.ClientCert == "" || c.ClientKey == "" {
+			return nil, errors.New("both client certificate and key are required for mutual TLS")
+		}
+		pair, err := tls.LoadX509KeyPair(c.ClientCert, c.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{pair}
+	}
+	if len(c.Pins) > 0 {
+		pins, err := parsePins(c.Pins)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verifyPins(cs, pins)
+		}
+	}
+	return tlsConfig, nil
+}
+
+// parsePins разбирает хеши в base64, допускается префикс sha256/
+func parsePins(values []string) (map[[sha256.Size]byte]struct{}, error) {
+	pins := make(map[[sha256.Size]byte]struct{}, len(values))
+	for _, v := range values {
+		v = strings.TrimPrefix(strings.TrimSpace(v), "sha256/")
+		raw, err := base64.StdEncoding.DecodeString(v)
+		if err != nil || len(raw) != sha256.Size {
+			return nil, fmt.Errorf("invalid SPKI pin %q: expected base64 SHA-256", v)
+		}
+		pins[[sha256.Size]byte(raw)] = struct{}{}
+	}
+	return pins, nil
+}
+
+// verifyPins вызывается после стандартной проверки цепочки: закрепленным может быть
+// ключ самого сервера или любого удостоверяющего центра проверенной цепочки
+func verifyPins(cs tls.ConnectionState, pins map[[sha256.Size]byte]struct{}) error {
+	for _, chain := range cs.VerifiedChains {
+		for _, cert := range chain {
+			if _, ok := pins[sha256.Sum256(cert.RawSubjectPublicKeyInfo)]; ok {
+				return nil
+			}
+		}
+	}
+	return errPinMismatch
+}
@@ -0,0 +1,92 @@
+package agent
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/megaded/metrictmr/internal/agent/config"
+	"github.com/megaded/metrictmr/internal/tlstest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCreateTLSConfig(t *testing.T) {
+	ca := tlstest.NewCA(t, "metrics")
+	otherCA := tlstest.NewCA(t, "other")
+	serverCert := ca.Server(t, "server", time.Now().Add(time.Hour))
+	clientCert := ca.Client(t, "agent")
+	foreignClient := otherCA.Client(t, "foreign")
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ts.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverCert.TLSCertificate(t)},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    ca.Pool(),
+	}
+	ts.StartTLS()
+	defer ts.Close()
+
+	withClient := func(c config.TLS) config.TLS {
+		c.ClientCert, c.ClientKey = clientCert.CertFile, clientCert.KeyFile
+		return c
+	}
+	tests := []struct {
+		name    string
+		tls     config.TLS
+		wantErr string
+	}{
+		{"verified mutual tls", withClient(config.TLS{CACert: ca.CertFile}), ""},
+		{"system roots", withClient(config.TLS{}), "certificate"},
+		{"wrong ca", withClient(config.TLS{CACert: otherCA.CertFile}), "certificate"},
+		{"no client certificate", config.TLS{CACert: ca.CertFile}, "certificate"},
+		{"foreign client certificate", config.TLS{CACert: ca.CertFile, ClientCert: foreignClient.CertFile, ClientKey: foreignClient.KeyFile}, "certificate"},
+		{"ca pin", withClient(config.TLS{CACert: ca.CertFile, Pins: []string{tlstest.SPKIPin(ca.Cert)}}), ""},
+		{"leaf pin with prefix", withClient(config.TLS{CACert: ca.CertFile, Pins: []string{"sha256/" + tlstest.SPKIPin(serverCert.Cert)}}), ""},
+		{"pin mismatch", withClient(config.TLS{CACert: ca.CertFile, Pins: []string{tlstest.SPKIPin(otherCA.Cert)}}), errPinMismatch.Error()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tlsConfig, err := createTLSConfig(tt.tls)
+			require.NoError(t, err)
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}, Timeout: 5 * time.Second}
+			req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, ts.URL, nil)
+			require.NoError(t, err)
+			resp, err := client.Do(req)
+			if tt.wantErr == "" {
+				require.NoError(t, err)
+				resp.Body.Close()
+				assert.Equal(t, http.StatusOK, resp.StatusCode)
+				return
+			}
+			require.Error(t, err)
+			assert.True(t, strings.Contains(err.Error(), tt.wantErr), err.Error())
+		})
+	}
+}
+
+func TestCreateTLSConfig_Invalid(t *testing.T) {
+	ca := tlstest.NewCA(t, "metrics")
+	client := ca.Client(t, "agent")
+	tests := []struct {
+		name string
+		tls  config.TLS
+	}{
+		{"missing ca file", config.TLS{CACert: "/nonexistent/ca.pem"}},
+		{"ca file without certificates", config.TLS{CACert: client.KeyFile}},
+		{"certificate without key", config.TLS{ClientCert: client.CertFile}},
+		{"key without certificate", config.TLS{ClientKey: client.KeyFile}},
+		{"malformed pin", config.TLS{Pins: []string{"not-base64!"}}},
+		{"short pin", config.TLS{Pins: []string{"AAAA"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := createTLSConfig(tt.tls)
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package data
+
+import (
+	"sort"
+	"strings"
+)
+
+// labelEscaper экранирует в именах и значениях меток разделители идентификатора
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `;`, `\;`, `=`, `\=`)
+
+// SeriesID идентификатор метрики с метками в формате тегов Graphite: name;label=value;...
+// Метки упорядочиваются по имени, без меток возвращается имя метрики.
+// Символы ';', '=' и '\' в метках экранируются обратной косой чертой.
+func SeriesID(name string, labels map[string]string) string {
+	if len(labels) == 0 {
+		return name
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteString(name)
+	for _, k := range keys {
+		b.WriteByte(';')
+		b.WriteString(labelEscaper.Replace(k))
+		b.WriteByte('=')
+		b.WriteString(labelEscaper.Replace(labels[k]))
+	}
+	return b.String()
+}
+
+// ParseSeriesID разбирает идентификатор SeriesID на имя и метки.
+// Идентификатор с частью без знака равенства считается именем без меток.
+// Обратная косая черта перед другими символами остается как есть.
+func ParseSeriesID(id string) (string, map[string]string) {
+	name, rest, ok := strings.Cut(id, ";")
+	if !ok {
+		return id, nil
+	}
+	labels := make(map[string]string)
+	for {
+		part, tail, more := cutUnescaped(rest, ';')
+		k, v, ok := cutUnescaped(part, '=')
+		if !ok || k == "" {
+			return id, nil
+		}
+		labels[unescapeLabel(k)] = unescapeLabel(v)
+		if !more {
+			break
+		}
+		rest = tail
+	}
+	return name, labels
+}
+
+// cutUnescaped разделяет s по первому неэкранированному sep
+func cutUnescaped(s string, sep byte) (string, string, bool) {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case sep:
+			return s[:i], s[i+1:], true
+		}
+	}
+	return s, "", false
+}
+
+func unescapeLabel(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && strings.IndexByte(`\;=`, s[i+1]) >= 0 {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,55 @@
+package data
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSeriesID(t *testing.T) {
+	tests := []struct {
+		name   string
+		metric string
+		labels map[string]string
+		want   string
+	}{
+		{"no labels", "Alloc", nil, "Alloc"},
+		{"sorted labels", "http_requests_total", map[string]string{"method": "GET", "code": "200"}, "http_requests_total;code=200;method=GET"},
+		{"escaped labels", "q", map[string]string{"sql": `a=1;b\c`, "k;=": "v"}, `q;k\;\==v;sql=a\=1\;b\\c`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, SeriesID(tt.metric, tt.labels))
+		})
+	}
+}
+
+func TestParseSeriesID(t *testing.T) {
+	tests := []struct {
+		name       string
+		id         string
+		wantName   string
+		wantLabels map[string]string
+	}{
+		{"no labels", "Alloc", "Alloc", nil},
+		{"labels", "http_requests_total;code=200;method=GET", "http_requests_total", map[string]string{"code": "200", "method": "GET"}},
+		{"malformed label", "odd;name", "odd;name", nil},
+		{"empty label", "odd;", "odd;", nil},
+		{"escaped labels", `q;k\;\==v;sql=a\=1\;b\\c`, "q", map[string]string{"sql": `a=1;b\c`, "k;=": "v"}},
+		{"unknown escape", `path;dir=C:\tmp`, "path", map[string]string{"dir": `C:\tmp`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name, labels := ParseSeriesID(tt.id)
+			assert.Equal(t, tt.wantName, name)
+			assert.Equal(t, tt.wantLabels, labels)
+		})
+	}
+}
+
+func TestSeriesIDRoundTrip(t *testing.T) {
+	labels := map[string]string{"a": ";", "b": "=", "c": `\`, "d": `\;=x`, "e": ""}
+	name, got := ParseSeriesID(SeriesID("m", labels))
+	assert.Equal(t, "m", name)
+	assert.Equal(t, labels, got)
+}
@@ -0,0 +1,86 @@
+package retry
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StatusError сервер ответил кодом, отличным от 2xx
+type StatusError struct {
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+// RetriableStatus временная ошибка сервера или ограничение частоты запросов
+func RetriableStatus(code int) bool {
+	switch code {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests,
+		http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// ParseRetryAfter разбирает заголовок Retry-After: число секунд или дата HTTP
+func ParseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	at, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	return max(at.Sub(now), 0), true
+}
+
+// ResponseError переводит ответ в ошибку: nil для 2xx, повторяемую ошибку с Retry-After
+// для временных кодов и Permanent для остальных
+func ResponseError(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	err := error(&StatusError{StatusCode: resp.StatusCode})
+	if !RetriableStatus(resp.StatusCode) {
+		return Permanent(err)
+	}
+	if after, ok := ParseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+		return &AfterError{Err: err, After: after}
+	}
+	return err
+}
+
+// DoHTTP выполняет запрос с повторами. Повторяются сетевые ошибки и временные коды ответа,
+// тело ответа всегда дочитывается и закрывается, чтобы соединение вернулось в пул.
+// Ошибки клиента (тайм-аут http.Client) повторяются, пока не отменен ctx.
+func (r Retry) DoHTTP(ctx context.Context, send func(ctx context.Context) (*http.Response, error)) error {
+	var attemptCtx context.Context
+	retriable := func(err error) bool {
+		return !IsPermanent(err) && attemptCtx.Err() == nil
+	}
+	return r.DoIf(ctx, retriable, func(ctx context.Context) error {
+		attemptCtx = ctx
+		resp, err := send(ctx)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		io.Copy(io.Discard, resp.Body)
+		return ResponseError(resp)
+	})
+}
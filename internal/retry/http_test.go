@@ -0,0 +1,120 @@
+package retry
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		value  string
+		want   time.Duration
+		wantOk bool
+	}{
+		{"empty", "", 0, false},
+		{"seconds", "5", 5 * time.Second, true},
+		{"negative", "-1", 0, false},
+		{"date", now.Add(10 * time.Second).Format(http.TimeFormat), 10 * time.Second, true},
+		{"past date", now.Add(-time.Minute).Format(http.TimeFormat), 0, true},
+		{"garbage", "soon", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := ParseRetryAfter(tt.value, now)
+			assert.Equal(t, tt.wantOk, ok)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestResponseError(t *testing.T) {
+	tests := []struct {
+		name          string
+		status        int
+		retryAfter    string
+		wantErr       bool
+		wantRetriable bool
+		wantAfter     time.Duration
+	}{
+		{"ok", http.StatusOK, "", false, false, 0},
+		{"bad request", http.StatusBadRequest, "", true, false, 0},
+		{"not found", http.StatusNotFound, "", true, false, 0},
+		{"internal", http.StatusInternalServerError, "", true, true, 0},
+		{"unavailable", http.StatusServiceUnavailable, "3", true, true, 3 * time.Second},
+		{"too many requests", http.StatusTooManyRequests, "1", true, true, time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{StatusCode: tt.status, Header: http.Header{}}
+			if tt.retryAfter != "" {
+				resp.Header.Set("Retry-After", tt.retryAfter)
+			}
+			err := ResponseError(resp)
+			if !tt.wantErr {
+				assert.NoError(t, err)
+				return
+			}
+			var statusErr *StatusError
+			assert.ErrorAs(t, err, &statusErr)
+			assert.Equal(t, tt.status, statusErr.StatusCode)
+			assert.Equal(t, tt.wantRetriable, IsRetriable(err))
+			after, _ := RetryAfter(err)
+			assert.Equal(t, tt.wantAfter, after)
+		})
+	}
+}
+
+func TestRetry_DoHTTP(t *testing.T) {
+	tests := []struct {
+		name      string
+		statuses  []int
+		wantCalls int
+		wantErr   bool
+	}{
+		{"ok", []int{http.StatusOK}, 1, false},
+		{"unavailable then ok", []int{http.StatusServiceUnavailable, http.StatusBadGateway, http.StatusOK}, 3, false},
+		{"bad request", []int{http.StatusBadRequest, http.StatusOK}, 1, true},
+		{"always failing", []int{500, 500, 500, 500, 500}, 3, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.statuses[calls])
+				calls++
+			}))
+			defer srv.Close()
+			r := NewRetry(time.Millisecond, time.Millisecond, 2)
+			err := r.DoHTTP(context.Background(), func(ctx context.Context) (*http.Response, error) {
+				req, err := http.NewRequestWithContext(ctx, http.MethodPost, srv.URL, nil)
+				if err != nil {
+					return nil, err
+				}
+				return srv.Client().Do(req)
+			})
+			assert.Equal(t, tt.wantErr, err != nil, "error %v", err)
+			assert.Equal(t, tt.wantCalls, calls)
+		})
+	}
+}
+
+func TestRetry_DoHTTPNetworkError(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	url := srv.URL
+	srv.Close()
+	calls := 0
+	err := NewRetry(time.Millisecond, time.Millisecond, 2).DoHTTP(context.Background(), func(ctx context.Context) (*http.Response, error) {
+		calls++
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		return http.DefaultClient.Do(req)
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 3, calls)
+}
@@ -1,76 +1,186 @@
+// Повтор операций с экспоненциальной задержкой
+//
+// Задержка перед попыткой n выбирается случайно из [0, min(max, base*2^n)] (full jitter),
+// что разносит повторы клиентов, одновременно получивших ошибку.
+// Общее время всех попыток ограничивается сроком (deadline).
 package retry
 
 import (
 	"context"
 	"errors"
-	"net/http"
+	"fmt"
+	"math/rand/v2"
 	"time"
 
 	"github.com/megaded/metrictmr/internal/logger"
 	"go.uber.org/zap"
 )
 
+// ErrDeadline срок, отведенный на повторы, истек
+var ErrDeadline = errors.New("retry deadline exceeded")
+
+// MaxRetryAfter предел ожидания по Retry-After для Retry без maxDelay
+const MaxRetryAfter = time.Minute
+
 type Retry struct {
-	start    time.Duration
-	step     time.Duration
+	base     time.Duration
+	maxDelay time.Duration
 	maxRetry int
+	// deadline общее время на все попытки, 0 - без ограничения
+	deadline time.Duration
+	// onRetry вызывается перед каждой повторной попыткой
+	onRetry func(attempt int, err error)
+	// jitter выбирает задержку из [0, d], подменяется в тестах
+	jitter func(d time.Duration) time.Duration
 }
 
-func (r *Retry) RetryAgent(ctx context.Context, action func() (*http.Response, error)) func() error {
-	rt := func() error {
-		delay := r.start
-		for attempt := 0; attempt <= r.maxRetry; attempt++ {
-			resp, err := action()
-			if err == nil {
-				defer resp.Body.Close()
-				return nil
-			}
+// NewRetry base - задержка перед первым повтором, maxDelay - верхняя граница задержки (не меньше base),
+// maxRetry - количество повторов после первой попытки
+func NewRetry(base time.Duration, maxDelay time.Duration, maxRetry int) Retry {
+	return Retry{base: base, maxDelay: maxDelay, maxRetry: maxRetry, jitter: fullJitter}
+}
 
-			if attempt == r.maxRetry {
-				return err
-			}
+// WithDeadline возвращает копию с ограничением общего времени попыток
+func (r Retry) WithDeadline(d time.Duration) Retry {
+	r.deadline = d
+	return r
+}
 
-			logger.Log.Error("retry failed", zap.Int("attempt", attempt), zap.Error(err))
+// OnRetry возвращает копию с обработчиком повторных попыток, например для подсчета метрик
+func (r Retry) OnRetry(fn func(attempt int, err error)) Retry {
+	r.onRetry = fn
+	return r
+}
 
-			select {
-			case <-ctx.Done():
-				return ctx.Err()
-			case <-time.After(r.step):
-				delay += r.step
-			}
-		}
-		return errors.New("unreachable retry state")
+// Backoff верхняя граница задержки перед повтором attempt (с нуля)
+func (r Retry) Backoff(attempt int) time.Duration {
+	d := r.base
+	for i := 0; i < attempt && d < r.maxDelay; i++ {
+		d *= 2
 	}
-	return rt
+	return min(d, r.maxDelay)
 }
 
-func NewRetry(start int, step int, maxRetry int) Retry {
-	return Retry{start: time.Duration(start * int(time.Second)), step: time.Duration(step * int(time.Second)), maxRetry: maxRetry}
+// clampRetryAfter ограничивает ожидание, запрошенное сервером, сверху maxDelay,
+// а без maxDelay - MaxRetryAfter
+func (r Retry) clampRetryAfter(after time.Duration) time.Duration {
+	limit := MaxRetryAfter
+	if r.maxDelay > 0 {
+		limit = r.maxDelay
+	}
+	return min(after, limit)
 }
 
-func (r *Retry) Retry(ctx context.Context, action func() error) func() error {
-	rt := func() error {
-		delay := r.start
-		for attempt := 0; attempt <= r.maxRetry; attempt++ {
-			err := action()
-			if err == nil {
-				return nil
-			}
+// Do повторяет действие при любой ошибке, кроме Permanent и ошибок контекста
+func (r Retry) Do(ctx context.Context, action func(ctx context.Context) error) error {
+	return r.DoIf(ctx, IsRetriable, action)
+}
 
-			if attempt == r.maxRetry {
-				return err
-			}
+// DoIf повторяет действие только для ошибок, которые retriable считает временными.
+// Остальные ошибки возвращаются сразу. Если ошибка содержит AfterError,
+// следующая попытка выполняется через указанное сервером время, но не позже maxDelay.
+func (r Retry) DoIf(ctx context.Context, retriable func(err error) bool, action func(ctx context.Context) error) error {
+	var until time.Time
+	if r.deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.deadline)
+		defer cancel()
+		until, _ = ctx.Deadline()
+	}
+	for attempt := 0; ; attempt++ {
+		err := action(ctx)
+		if err == nil {
+			return nil
+		}
+		if attempt == r.maxRetry || !retriable(err) {
+			return err
+		}
 
-			logger.Log.Error("retry failed", zap.Int("attempt", attempt), zap.Error(err))
+		delay := r.jitter(r.Backoff(attempt))
+		if after, ok := RetryAfter(err); ok {
+			delay = r.clampRetryAfter(after)
+		}
+		if !until.IsZero() && time.Now().Add(delay).After(until) {
+			return fmt.Errorf("%w: %w", ErrDeadline, err)
+		}
 
-			select {
-			case <-ctx.Done():
-				return ctx.Err()
-			case <-time.After(r.step):
-				delay += r.step
+		logger.Log.Error("retry failed", zap.Int("attempt", attempt), zap.Duration("delay", delay), zap.Error(err))
+		if r.onRetry != nil {
+			r.onRetry(attempt+1, err)
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			if !until.IsZero() && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return fmt.Errorf("%w: %w", ErrDeadline, err)
 			}
+			return ctx.Err()
+		case <-timer.C:
 		}
-		return errors.New("unreachable retry state")
 	}
-	return rt
+}
+
+func fullJitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	return rand.N(d + 1)
+}
+
+// permanentError ошибка, повтор которой не имеет смысла
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e permanentError) Unwrap() error {
+	return e.err
+}
+
+// Permanent помечает ошибку как неповторяемую
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return permanentError{err: err}
+}
+
+// IsPermanent ошибка помечена Permanent
+func IsPermanent(err error) bool {
+	var p permanentError
+	return errors.As(err, &p)
+}
+
+// IsRetriable ошибка не помечена Permanent и не вызвана отменой контекста
+func IsRetriable(err error) bool {
+	return err != nil && !IsPermanent(err) &&
+		!errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
+
+// AfterError ошибка с временем, раньше которого повторять нельзя (Retry-After)
+type AfterError struct {
+	Err   error
+	After time.Duration
+}
+
+func (e *AfterError) Error() string {
+	return fmt.Sprintf("%v (retry after %s)", e.Err, e.After)
+}
+
+func (e *AfterError) Unwrap() error {
+	return e.Err
+}
+
+// RetryAfter извлекает из ошибки время ожидания, указанное сервером
+func RetryAfter(err error) (time.Duration, bool) {
+	var a *AfterError
+	if errors.As(err, &a) {
+		return a.After, true
+	}
+	return 0, false
 }
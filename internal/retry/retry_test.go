@@ -0,0 +1,170 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// noJitter задержка без случайной составляющей, чтобы тесты были детерминированными
+func noJitter(d time.Duration) time.Duration {
+	return d
+}
+
+func TestRetry_DoIf(t *testing.T) {
+	errTemporary := errors.New("temporary")
+	errPermanent := errors.New("permanent")
+	tests := []struct {
+		name        string
+		errs        []error
+		wantCalls   int
+		wantRetries []int
+		wantErr     error
+	}{
+		{"success", []error{nil}, 1, nil, nil},
+		{"temporary then success", []error{errTemporary, errTemporary, nil}, 3, []int{1, 2}, nil},
+		{"permanent fails fast", []error{errTemporary, errPermanent, nil}, 2, []int{1}, errPermanent},
+		{"attempts exhausted", []error{errTemporary, errTemporary, errTemporary, errTemporary, nil}, 4, []int{1, 2, 3}, errTemporary},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var retries []int
+			r := NewRetry(0, 0, 3).OnRetry(func(attempt int, err error) {
+				retries = append(retries, attempt)
+			})
+			calls := 0
+			err := r.DoIf(context.Background(), func(err error) bool {
+				return errors.Is(err, errTemporary)
+			}, func(context.Context) error {
+				err := tt.errs[calls]
+				calls++
+				return err
+			})
+			assert.ErrorIs(t, err, tt.wantErr)
+			assert.Equal(t, tt.wantCalls, calls)
+			assert.Equal(t, tt.wantRetries, retries)
+		})
+	}
+}
+
+func TestRetry_Backoff(t *testing.T) {
+	r := NewRetry(100*time.Millisecond, time.Second, 10)
+	want := []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		800 * time.Millisecond,
+		time.Second,
+		time.Second,
+	}
+	for attempt, d := range want {
+		assert.Equal(t, d, r.Backoff(attempt), "attempt %d", attempt)
+	}
+	assert.Equal(t, time.Second, r.Backoff(100))
+}
+
+func TestFullJitter(t *testing.T) {
+	for range 100 {
+		d := fullJitter(10 * time.Millisecond)
+		assert.GreaterOrEqual(t, d, time.Duration(0))
+		assert.LessOrEqual(t, d, 10*time.Millisecond)
+	}
+	assert.Equal(t, time.Duration(0), fullJitter(0))
+}
+
+func TestRetry_Do(t *testing.T) {
+	errTemporary := errors.New("temporary")
+	t.Run("permanent", func(t *testing.T) {
+		calls := 0
+		err := NewRetry(0, 0, 3).Do(context.Background(), func(context.Context) error {
+			calls++
+			return Permanent(errTemporary)
+		})
+		assert.ErrorIs(t, err, errTemporary)
+		assert.Equal(t, 1, calls)
+	})
+	t.Run("canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		calls := 0
+		err := NewRetry(time.Hour, time.Hour, 3).Do(ctx, func(context.Context) error {
+			calls++
+			cancel()
+			return errTemporary
+		})
+		assert.ErrorIs(t, err, context.Canceled)
+		assert.Equal(t, 1, calls)
+	})
+	t.Run("retry after", func(t *testing.T) {
+		r := NewRetry(0, 0, 1)
+		r.jitter = noJitter
+		calls := 0
+		start := time.Now()
+		err := r.Do(context.Background(), func(context.Context) error {
+			calls++
+			if calls == 1 {
+				return &AfterError{Err: errTemporary, After: 30 * time.Millisecond}
+			}
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.GreaterOrEqual(t, time.Since(start), 30*time.Millisecond)
+	})
+	t.Run("retry after clamped to max delay", func(t *testing.T) {
+		r := NewRetry(0, 20*time.Millisecond, 1)
+		r.jitter = noJitter
+		calls := 0
+		start := time.Now()
+		err := r.Do(context.Background(), func(context.Context) error {
+			calls++
+			if calls == 1 {
+				return &AfterError{Err: errTemporary, After: time.Hour}
+			}
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, 2, calls)
+		assert.Less(t, time.Since(start), time.Second)
+	})
+	t.Run("retry after limit", func(t *testing.T) {
+		assert.Equal(t, MaxRetryAfter, NewRetry(0, 0, 1).clampRetryAfter(24*time.Hour))
+		assert.Equal(t, time.Second, NewRetry(0, 0, 1).clampRetryAfter(time.Second))
+	})
+	t.Run("retry after beyond deadline", func(t *testing.T) {
+		calls := 0
+		start := time.Now()
+		err := NewRetry(0, 0, 3).WithDeadline(50*time.Millisecond).Do(context.Background(), func(context.Context) error {
+			calls++
+			return &AfterError{Err: errTemporary, After: time.Minute}
+		})
+		assert.ErrorIs(t, err, ErrDeadline)
+		assert.ErrorIs(t, err, errTemporary)
+		assert.Equal(t, 1, calls)
+		assert.Less(t, time.Since(start), time.Second)
+	})
+	t.Run("deadline", func(t *testing.T) {
+		r := NewRetry(20*time.Millisecond, 20*time.Millisecond, 100).WithDeadline(70 * time.Millisecond)
+		r.jitter = noJitter
+		calls := 0
+		err := r.Do(context.Background(), func(ctx context.Context) error {
+			calls++
+			_, ok := ctx.Deadline()
+			assert.True(t, ok)
+			return errTemporary
+		})
+		assert.ErrorIs(t, err, ErrDeadline)
+		assert.Less(t, calls, 10)
+	})
+}
+
+func TestIsRetriable(t *testing.T) {
+	assert.True(t, IsRetriable(errors.New("temporary")))
+	assert.False(t, IsRetriable(nil))
+	assert.False(t, IsRetriable(Permanent(errors.New("bad request"))))
+	assert.True(t, IsPermanent(fmt.Errorf("send: %w", Permanent(errors.New("bad request")))))
+	assert.False(t, IsRetriable(context.Canceled))
+	assert.False(t, IsRetriable(context.DeadlineExceeded))
+}
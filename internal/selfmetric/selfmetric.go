@@ -0,0 +1,130 @@
+// Собственные метрики сервера и агента
+//
+// Registry хранит счетчики и значения, описывающие работу самого процесса:
+// повторные попытки, отброшенные данные и т.п. Метрики отдаются в формате data.Metric.
+package selfmetric
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/megaded/metrictmr/internal/data"
+)
+
+// Default реестр процесса
+var Default = NewRegistry()
+
+// Counter накопительный счетчик
+type Counter struct {
+	v atomic.Int64
+}
+
+func (c *Counter) Inc() {
+	c.v.Add(1)
+}
+
+func (c *Counter) Add(n int64) {
+	c.v.Add(n)
+}
+
+func (c *Counter) Value() int64 {
+	return c.v.Load()
+}
+
+// Gauge текущее значение
+type Gauge struct {
+	bits atomic.Uint64
+}
+
+func (g *Gauge) Set(v float64) {
+	g.bits.Store(math.Float64bits(v))
+}
+
+func (g *Gauge) Value() float64 {
+	return math.Float64frombits(g.bits.Load())
+}
+
+// Registry набор именованных метрик, безопасен для конкурентного использования
+type Registry struct {
+	mu       sync.RWMutex
+	counters map[string]*Counter
+	gauges   map[string]*Gauge
+}
+
+func NewRegistry() *Registry {
+	return &Registry{counters: map[string]*Counter{}, gauges: map[string]*Gauge{}}
+}
+
+// Counter возвращает счетчик, создавая его при первом обращении
+func (r *Registry) Counter(name string) *Counter {
+	r.mu.RLock()
+	c, ok := r.counters[name]
+	r.mu.RUnlock()
+	if ok {
+		return c
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if c, ok = r.counters[name]; !ok {
+		c = &Counter{}
+		r.counters[name] = c
+	}
+	return c
+}
+
+// Gauge возвращает значение, создавая его при первом обращении
+func (r *Registry) Gauge(name string) *Gauge {
+	r.mu.RLock()
+	g, ok := r.gauges[name]
+	r.mu.RUnlock()
+	if ok {
+		return g
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if g, ok = r.gauges[name]; !ok {
+		g = &Gauge{}
+		r.gauges[name] = g
+	}
+	return g
+}
+
+// Metrics текущие значения, упорядоченные по имени и типу
+func (r *Registry) Metrics() []data.Metric {
+	r.mu.RLock()
+	result := make([]data.Metric, 0, len(r.counters)+len(r.gauges))
+	for name, c := range r.counters {
+		v := c.Value()
+		result = append(result, data.Metric{ID: name, MType: data.MTypeCounter, Delta: &v})
+	}
+	for name, g := range r.gauges {
+		v := g.Value()
+		result = append(result, data.Metric{ID: name, MType: data.MTypeGauge, Value: &v})
+	}
+	r.mu.RUnlock()
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].ID != result[j].ID {
+			return result[i].ID < result[j].ID
+		}
+		return result[i].MType < result[j].MType
+	})
+	return result
+}
+
+// Handler отдает метрики реестра в JSON
+func (r *Registry) Handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		resp, err := json.Marshal(r.Metrics())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(resp)
+	}
+}
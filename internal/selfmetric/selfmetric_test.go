@@ -0,0 +1,46 @@
+package selfmetric
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/megaded/metrictmr/internal/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("Retries").Inc()
+	r.Counter("Retries").Add(2)
+	r.Gauge("Buffer").Set(1.5)
+	r.Counter("Buffer").Inc()
+
+	assert.Equal(t, int64(3), r.Counter("Retries").Value())
+	assert.Equal(t, 1.5, r.Gauge("Buffer").Value())
+
+	metrics := r.Metrics()
+	require.Len(t, metrics, 3)
+	assert.Equal(t, "Buffer", metrics[0].ID)
+	assert.Equal(t, data.MTypeCounter, metrics[0].MType)
+	assert.Equal(t, "Buffer", metrics[1].ID)
+	assert.Equal(t, data.MTypeGauge, metrics[1].MType)
+	assert.Equal(t, "Retries", metrics[2].ID)
+	assert.Equal(t, int64(3), *metrics[2].Delta)
+}
+
+func TestRegistry_Handler(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("Retries").Inc()
+	w := httptest.NewRecorder()
+	r.Handler()(w, httptest.NewRequest(http.MethodGet, "/debug/metrics/", nil))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	var metrics []data.Metric
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &metrics))
+	require.Len(t, metrics, 1)
+	assert.Equal(t, "Retries", metrics[0].ID)
+}
@@ -0,0 +1,260 @@
+// Рассылка изменений метрик подписчикам
+//
+// Broker получает сохраненные метрики из хранилища и раздает их подписчикам.
+// Рассылка выполняется в отдельной горутине, чтобы не задерживать запись.
+// Для counter событие содержит накопленную сумму, прочитанную из хранилища при рассылке,
+// и приращение из запроса, поэтому клиент может восстановить значение после пропуска событий.
+// У каждого подписчика ограниченный буфер: если подписчик не успевает
+// забирать события и буфер переполнен, он отключается.
+package broker
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/megaded/metrictmr/internal/data"
+	"github.com/megaded/metrictmr/internal/logger"
+	"github.com/megaded/metrictmr/internal/selfmetric"
+	"github.com/megaded/metrictmr/internal/server/handler/storage"
+	"go.uber.org/zap"
+)
+
+const (
+	DefaultBufferSize = 256
+	queueSize         = 1024
+
+	selfMetricDroppedBatches = "BrokerDroppedBatches"
+)
+
+// Event событие изменения метрики
+type Event struct {
+	// Metric значение после сохранения, для counter - накопленная сумма, как в /value/
+	Metric data.Metric `json:"metric"`
+	// Increment приращение counter из запроса
+	Increment *int64    `json:"increment,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// Source хранилище, из которого читаются накопленные значения counter
+type Source interface {
+	GetMetricsByKeys(ctx context.Context, keys []storage.MetricKey) (map[storage.MetricKey]data.Metric, error)
+}
+
+// Filter условие отбора событий для подписчика
+type Filter struct {
+	// Names точные имена метрик, пустой - любые
+	Names   map[string]struct{}
+	Prefix  string
+	Pattern *regexp.Regexp
+	MType   string
+}
+
+// Match проверяет, подходит ли метрика под фильтр
+func (f Filter) Match(m data.Metric) bool {
+	if f.MType != "" && f.MType != m.MType {
+		return false
+	}
+	if len(f.Names) > 0 {
+		if _, ok := f.Names[m.ID]; !ok {
+			return false
+		}
+	}
+	if !strings.HasPrefix(m.ID, f.Prefix) {
+		return false
+	}
+	return f.Pattern == nil || f.Pattern.MatchString(m.ID)
+}
+
+// Subscription подписка на события
+type Subscription struct {
+	events chan Event
+	done   chan struct{}
+	filter Filter
+	once   sync.Once
+}
+
+// Events канал событий подписки
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+// Filter фильтр подписки
+func (s *Subscription) Filter() Filter {
+	return s.filter
+}
+
+// Done закрывается, когда подписка отключена брокером
+func (s *Subscription) Done() <-chan struct{} {
+	return s.done
+}
+
+// deliver отправляет подходящие события, false - буфер переполнен
+func (s *Subscription) deliver(events []Event) bool {
+	for _, e := range events {
+		if !s.filter.Match(e.Metric) {
+			continue
+		}
+		select {
+		case s.events <- e:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Subscription) close() {
+	s.once.Do(func() {
+		close(s.done)
+	})
+}
+
+type batch struct {
+	metrics []data.Metric
+	time    time.Time
+}
+
+type Broker struct {
+	ctx        context.Context
+	source     Source
+	mu         sync.RWMutex
+	subs       map[*Subscription]struct{}
+	bufferSize int
+	queue      chan batch
+	dropped    atomic.Int64
+}
+
+// NewBroker создает брокер и запускает рассылку до отмены ctx.
+// source - хранилище без оповещения, в которое сохраняются публикуемые метрики.
+func NewBroker(ctx context.Context, bufferSize int, source Source) *Broker {
+	if bufferSize <= 0 {
+		bufferSize = DefaultBufferSize
+	}
+	b := &Broker{ctx: ctx, source: source, subs: map[*Subscription]struct{}{}, bufferSize: bufferSize, queue: make(chan batch, queueSize)}
+	go b.run(ctx)
+	return b
+}
+
+func (b *Broker) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case m := <-b.queue:
+			b.dispatch(m)
+		}
+	}
+}
+
+// Subscribe создает подписку с фильтром
+func (b *Broker) Subscribe(filter Filter) *Subscription {
+	s := &Subscription{events: make(chan Event, b.bufferSize), done: make(chan struct{}), filter: filter}
+	b.mu.Lock()
+	b.subs[s] = struct{}{}
+	b.mu.Unlock()
+	return s
+}
+
+// Unsubscribe удаляет подписку
+func (b *Broker) Unsubscribe(s *Subscription) {
+	b.mu.Lock()
+	delete(b.subs, s)
+	b.mu.Unlock()
+	s.close()
+}
+
+// Publish ставит копию метрик в очередь рассылки. Не блокируется: если очередь
+// заполнена, пакет отбрасывается и учитывается в собственной метрике BrokerDroppedBatches.
+// Без подписчиков пакет не ставится в очередь.
+func (b *Broker) Publish(metric ...data.Metric) {
+	if b.Len() == 0 {
+		return
+	}
+	select {
+	case b.queue <- batch{metrics: copyMetrics(metric), time: time.Now()}:
+	default:
+		b.dropped.Add(1)
+		selfmetric.Default.Counter(selfMetricDroppedBatches).Inc()
+	}
+}
+
+// copyMetrics копирует метрики вместе со значениями: вызывающий может изменить их после Publish
+func copyMetrics(metric []data.Metric) []data.Metric {
+	result := make([]data.Metric, len(metric))
+	for i, m := range metric {
+		if m.Delta != nil {
+			delta := *m.Delta
+			m.Delta = &delta
+		}
+		if m.Value != nil {
+			value := *m.Value
+			m.Value = &value
+		}
+		result[i] = m
+	}
+	return result
+}
+
+// Dropped количество пакетов, отброшенных из-за переполнения очереди
+func (b *Broker) Dropped() int64 {
+	return b.dropped.Load()
+}
+
+// dispatch раздает пакет подписчикам, подписчик с переполненным буфером отключается
+func (b *Broker) dispatch(m batch) {
+	events := b.events(m)
+	var slow []*Subscription
+	b.mu.RLock()
+	for s := range b.subs {
+		if !s.deliver(events) {
+			slow = append(slow, s)
+		}
+	}
+	b.mu.RUnlock()
+	for _, s := range slow {
+		b.Unsubscribe(s)
+	}
+}
+
+// events переводит пакет в события. Накопленные значения counter читаются из хранилища
+// одним запросом; если чтение не удалось, counter пакета не рассылаются.
+func (b *Broker) events(m batch) []Event {
+	var keys []storage.MetricKey
+	for _, v := range m.metrics {
+		if v.MType == data.MTypeCounter {
+			keys = append(keys, storage.MetricKey{ID: v.ID, MType: v.MType})
+		}
+	}
+	var totals map[storage.MetricKey]data.Metric
+	if len(keys) > 0 {
+		var err error
+		totals, err = b.source.GetMetricsByKeys(b.ctx, keys)
+		if err != nil {
+			logger.Log.Warn("broker: counter totals are not available", zap.Int("counters", len(keys)), zap.Error(err))
+		}
+	}
+	events := make([]Event, 0, len(m.metrics))
+	for _, v := range m.metrics {
+		if v.MType != data.MTypeCounter {
+			events = append(events, Event{Metric: v, Time: m.time})
+			continue
+		}
+		total, ok := totals[storage.MetricKey{ID: v.ID, MType: v.MType}]
+		if !ok {
+			continue
+		}
+		events = append(events, Event{Metric: total, Increment: v.Delta, Time: m.time})
+	}
+	return events
+}
+
+// Len количество активных подписок
+func (b *Broker) Len() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return len(b.subs)
+}
@@ -0,0 +1,119 @@
+package broker
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/megaded/metrictmr/internal/data"
+	"github.com/megaded/metrictmr/internal/selfmetric"
+	"github.com/megaded/metrictmr/internal/server/handler/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBroker_SlowConsumer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b := NewBroker(ctx, 2, storage.NewInMemoryStorage())
+	slow := b.Subscribe(Filter{})
+	filtered := b.Subscribe(Filter{MType: data.MTypeCounter})
+
+	var value float64 = 1
+	m := data.Metric{ID: "g", MType: data.MTypeGauge, Value: &value}
+	b.Publish(m, m)
+	assert.Eventually(t, func() bool { return len(slow.Events()) == 2 }, time.Second, time.Millisecond)
+	assert.Len(t, filtered.Events(), 0)
+
+	b.Publish(m)
+	select {
+	case <-slow.Done():
+	case <-time.After(time.Second):
+		t.Fatal("slow consumer is not disconnected")
+	}
+	assert.Equal(t, 1, b.Len())
+
+	select {
+	case <-filtered.Done():
+		t.Fatal("filtered consumer is disconnected")
+	default:
+	}
+}
+
+func TestBroker_CounterTotal(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mem := storage.NewInMemoryStorage()
+	b := NewBroker(ctx, DefaultBufferSize, mem)
+	sub := b.Subscribe(Filter{})
+
+	var delta int64 = 2
+	m := data.Metric{ID: "c", MType: data.MTypeCounter, Delta: &delta}
+	require.NoError(t, mem.Store(ctx, m, m))
+	b.Publish(m)
+	select {
+	case e := <-sub.Events():
+		require.NotNil(t, e.Metric.Delta)
+		assert.Equal(t, int64(4), *e.Metric.Delta, "total from storage")
+		require.NotNil(t, e.Increment)
+		assert.Equal(t, int64(2), *e.Increment)
+	case <-time.After(time.Second):
+		t.Fatal("no event")
+	}
+
+	// counter, которого нет в хранилище, не рассылается
+	b.Publish(data.Metric{ID: "missing", MType: data.MTypeCounter, Delta: &delta})
+	var value float64 = 1
+	b.Publish(data.Metric{ID: "g", MType: data.MTypeGauge, Value: &value})
+	select {
+	case e := <-sub.Events():
+		assert.Equal(t, "g", e.Metric.ID)
+		assert.Nil(t, e.Increment)
+	case <-time.After(time.Second):
+		t.Fatal("no event")
+	}
+}
+
+func TestBroker_Publish(t *testing.T) {
+	// брокер без рассылки: пакеты остаются в очереди
+	b := &Broker{subs: map[*Subscription]struct{}{}, bufferSize: DefaultBufferSize, queue: make(chan batch, queueSize)}
+	var value float64 = 1
+	batch := []data.Metric{{ID: "g", MType: data.MTypeGauge, Value: &value}}
+	b.Publish(batch...)
+	assert.Len(t, b.queue, 0, "no subscribers")
+
+	b.Subscribe(Filter{})
+	b.Publish(batch...)
+	batch[0].ID = "changed"
+	value = 2
+	queued := <-b.queue
+	assert.Equal(t, "g", queued.metrics[0].ID)
+	assert.Equal(t, 1.0, *queued.metrics[0].Value)
+
+	dropped := selfmetric.Default.Counter(selfMetricDroppedBatches).Value()
+	for i := 0; i <= queueSize; i++ {
+		b.Publish(batch...)
+	}
+	assert.Equal(t, int64(1), b.Dropped())
+	assert.Equal(t, dropped+1, selfmetric.Default.Counter(selfMetricDroppedBatches).Value())
+}
+
+func TestFilter_Match(t *testing.T) {
+	m := data.Metric{ID: "HeapAlloc", MType: data.MTypeGauge}
+	tests := []struct {
+		name   string
+		filter Filter
+		want   bool
+	}{
+		{"empty", Filter{}, true},
+		{"type", Filter{MType: data.MTypeCounter}, false},
+		{"names", Filter{Names: map[string]struct{}{"HeapAlloc": {}}}, true},
+		{"other names", Filter{Names: map[string]struct{}{"Alloc": {}}}, false},
+		{"prefix", Filter{Prefix: "Heap"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.filter.Match(m))
+		})
+	}
+}
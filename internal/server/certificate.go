@@ -0,0 +1,161 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/megaded/metrictmr/internal/logger"
+	"github.com/megaded/metrictmr/internal/selfmetric"
+	"go.uber.org/zap"
+)
+
+const (
+	// certCheckInterval период проверки изменения файлов сертификата
+	certCheckInterval = 10 * time.Second
+	// certExpiryWarning срок до истечения сертификата, после которого в лог пишется предупреждение
+	certExpiryWarning = 14 * 24 * time.Hour
+
+	selfMetricCertDaysToExpiry = "TLSCertDaysToExpiry"
+	selfMetricCertReloadErrors = "TLSCertReloadErrors"
+)
+
+// certReloader отдает текущий сертификат сервера через GetCertificate и перечитывает файлы
+// при их изменении или по сигналу. Если новый сертификат не загружается, остается прежний.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	version fileVersion
+	// failed версия файлов, которую не удалось загрузить: повторно не читается до следующего изменения
+	failed fileVersion
+}
+
+// fileVersion время изменения и размер файлов, по которым определяется замена сертификата
+type fileVersion struct {
+	certMod  time.Time
+	certSize int64
+	keyMod   time.Time
+	keySize  int64
+}
+
+func newCertReloader(certFile string, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// reload загружает пару сертификат-ключ, при ошибке текущий сертификат не меняется
+func (r *certReloader) reload() error {
+	version, err := r.fileVersion()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	leaf := cert.Leaf
+	if leaf == nil {
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return err
+		}
+		cert.Leaf = leaf
+	}
+	r.mu.Lock()
+	r.cert = &cert
+	r.version = version
+	r.mu.Unlock()
+	logger.Log.Info("tls certificate loaded",
+		zap.String("subject", leaf.Subject.String()),
+		zap.Time("not_after", leaf.NotAfter))
+	if r.reportExpiry() < certExpiryWarning {
+		logger.Log.Warn("tls certificate expires soon", zap.Time("not_after", leaf.NotAfter))
+	}
+	return nil
+}
+
+// reloadIfChanged перечитывает сертификат, если файлы изменились с последней загрузки
+func (r *certReloader) reloadIfChanged() error {
+	version, err := r.fileVersion()
+	if err != nil {
+		return err
+	}
+	r.mu.RLock()
+	changed := version != r.version && version != r.failed
+	r.mu.RUnlock()
+	if !changed {
+		return nil
+	}
+	if err = r.reload(); err != nil {
+		r.mu.Lock()
+		r.failed = version
+		r.mu.Unlock()
+	}
+	return err
+}
+
+// reportExpiry обновляет количество дней до истечения текущего сертификата и возвращает оставшееся время
+func (r *certReloader) reportExpiry() time.Duration {
+	r.mu.RLock()
+	left := time.Until(r.cert.Leaf.NotAfter)
+	r.mu.RUnlock()
+	selfmetric.Default.Gauge(selfMetricCertDaysToExpiry).Set(left.Hours() / 24)
+	return left
+}
+
+// watch проверяет файлы каждые interval и перечитывает их по сигналу из reload
+func (r *certReloader) watch(ctx context.Context, interval time.Duration, reload <-chan os.Signal) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		var err error
+		select {
+		case <-ctx.Done():
+			return
+		case <-reload:
+			err = r.reload()
+		case <-ticker.C:
+			err = r.reloadIfChanged()
+			r.reportExpiry()
+		}
+		if err != nil {
+			selfmetric.Default.Counter(selfMetricCertReloadErrors).Inc()
+			logger.Log.Error("tls certificate reload failed, keeping previous certificate", zap.Error(err))
+		}
+	}
+}
+
+func (r *certReloader) fileVersion() (fileVersion, error) {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return fileVersion{}, err
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return fileVersion{}, err
+	}
+	if certInfo.IsDir() || keyInfo.IsDir() {
+		return fileVersion{}, errors.New("certificate path is a directory")
+	}
+	return fileVersion{
+		certMod:  certInfo.ModTime(),
+		certSize: certInfo.Size(),
+		keyMod:   keyInfo.ModTime(),
+		keySize:  keyInfo.Size(),
+	}, nil
+}
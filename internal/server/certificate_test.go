@@ -0,0 +1,104 @@
+package server
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/megaded/metrictmr/internal/selfmetric"
+	"github.com/megaded/metrictmr/internal/tlstest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// installCert копирует сертификат и ключ в файлы сервера, сдвигая время изменения,
+// чтобы замена была видна даже при грубом разрешении времени файловой системы
+func installCert(t *testing.T, cert *tlstest.Cert, certFile string, keyFile string, shift time.Duration) {
+	t.Helper()
+	for src, dst := range map[string]string{cert.CertFile: certFile, cert.KeyFile: keyFile} {
+		content, err := os.ReadFile(src)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(dst, content, 0o600))
+		mod := time.Now().Add(shift)
+		require.NoError(t, os.Chtimes(dst, mod, mod))
+	}
+}
+
+func currentSerial(r *certReloader) string {
+	cert, _ := r.GetCertificate(nil)
+	return cert.Leaf.SerialNumber.String()
+}
+
+func TestCertReloader(t *testing.T) {
+	ca := tlstest.NewCA(t, "metrics")
+	first := ca.Server(t, "first", time.Now().Add(10*24*time.Hour))
+	second := ca.Server(t, "second", time.Now().Add(30*24*time.Hour))
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "certificate.pem"), filepath.Join(dir, "private.key")
+
+	installCert(t, first, certFile, keyFile, 0)
+	r, err := newCertReloader(certFile, keyFile)
+	require.NoError(t, err)
+	assert.Equal(t, first.Cert.SerialNumber.String(), currentSerial(r))
+	assert.InDelta(t, 10, selfmetric.Default.Gauge(selfMetricCertDaysToExpiry).Value(), 0.1)
+
+	// файлы не менялись
+	require.NoError(t, r.reloadIfChanged())
+	assert.Equal(t, first.Cert.SerialNumber.String(), currentSerial(r))
+
+	installCert(t, second, certFile, keyFile, time.Minute)
+	require.NoError(t, r.reloadIfChanged())
+	assert.Equal(t, second.Cert.SerialNumber.String(), currentSerial(r))
+	assert.InDelta(t, 30, selfmetric.Default.Gauge(selfMetricCertDaysToExpiry).Value(), 0.1)
+
+	// битый сертификат не заменяет рабочий и не перечитывается до следующего изменения
+	require.NoError(t, os.WriteFile(certFile, []byte("garbage"), 0o600))
+	mod := time.Now().Add(2 * time.Minute)
+	require.NoError(t, os.Chtimes(certFile, mod, mod))
+	assert.Error(t, r.reloadIfChanged())
+	assert.NoError(t, r.reloadIfChanged())
+	assert.Equal(t, second.Cert.SerialNumber.String(), currentSerial(r))
+
+	installCert(t, first, certFile, keyFile, 3*time.Minute)
+	require.NoError(t, r.reloadIfChanged())
+	assert.Equal(t, first.Cert.SerialNumber.String(), currentSerial(r))
+}
+
+func TestCertReloader_Signal(t *testing.T) {
+	ca := tlstest.NewCA(t, "metrics")
+	first := ca.Server(t, "first", time.Now().Add(time.Hour))
+	second := ca.Server(t, "second", time.Now().Add(time.Hour))
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "certificate.pem"), filepath.Join(dir, "private.key")
+	installCert(t, first, certFile, keyFile, 0)
+	r, err := newCertReloader(certFile, keyFile)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	hup := make(chan os.Signal, 1)
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		r.watch(ctx, time.Hour, hup)
+	}()
+	// watch пишет в общий логгер, тест не должен завершиться раньше него
+	defer func() {
+		cancel()
+		<-stopped
+	}()
+
+	// время изменения не сдвигается: замену обнаружит только сигнал
+	installCert(t, second, certFile, keyFile, 0)
+	hup <- syscall.SIGHUP
+	assert.Eventually(t, func() bool {
+		return currentSerial(r) == second.Cert.SerialNumber.String()
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestNewCertReloader_Invalid(t *testing.T) {
+	_, err := newCertReloader("/nonexistent/certificate.pem", "/nonexistent/private.key")
+	assert.Error(t, err)
+}
@@ -0,0 +1,255 @@
+// Пересылка сохраненных метрик во внешние системы
+//
+// Exporter подключается к хранилищу как Publisher и получает каждый сохраненный пакет.
+// У каждого получателя (sink) своя очередь ограниченного размера и свой обработчик:
+// Publish не блокируется, при заполненной очереди пакет отбрасывается и учитывается,
+// поэтому задержка приема метрик не зависит от состояния получателей.
+package exporter
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/megaded/metrictmr/internal/data"
+	"github.com/megaded/metrictmr/internal/logger"
+	"github.com/megaded/metrictmr/internal/retry"
+	"github.com/megaded/metrictmr/internal/selfmetric"
+	"go.uber.org/zap"
+)
+
+const (
+	DefaultQueueSize     = 100
+	DefaultBatchSize     = 1000
+	DefaultFlushInterval = time.Second
+	DefaultTimeout       = 10 * time.Second
+
+	// shutdownTimeout время на отправку накопленных метрик при остановке
+	shutdownTimeout = 5 * time.Second
+
+	selfMetricSent        = "ExportSentMetrics"
+	selfMetricDropped     = "ExportDroppedMetrics"
+	selfMetricRetries     = "ExportRetries"
+	selfMetricQueueLength = "ExportQueueLength"
+)
+
+// Sink получатель метрик. Encode вызывается один раз на пакет, Send - на каждую попытку
+// отправки, поэтому состояние получателя меняется только в Encode.
+type Sink interface {
+	Encode(metrics []data.Metric) ([]byte, error)
+	// Send возвращает ошибку, обернутую retry.Permanent, если повтор не поможет
+	Send(ctx context.Context, body []byte) error
+}
+
+// Settings параметры очереди получателя
+type Settings struct {
+	// Name имя получателя в собственных метриках сервера
+	Name string
+	// QueueSize количество пакетов в очереди
+	QueueSize int
+	// BatchSize максимальное количество метрик в одной отправке
+	BatchSize int
+	// FlushInterval период отправки неполного пакета
+	FlushInterval time.Duration
+	// Timeout время ожидания одной попытки
+	Timeout time.Duration
+	// Retry повторы отправки, по умолчанию DefaultRetry
+	Retry *retry.Retry
+}
+
+// Target получатель с параметрами очереди
+type Target struct {
+	Sink     Sink
+	Settings Settings
+}
+
+// DefaultRetry повторы отправки: до 5 попыток, не дольше минуты на пакет
+func DefaultRetry() retry.Retry {
+	return retry.NewRetry(500*time.Millisecond, 10*time.Second, 5).WithDeadline(time.Minute)
+}
+
+type Exporter struct {
+	queues []*queue
+	cancel context.CancelFunc
+}
+
+type queue struct {
+	sink     Sink
+	settings Settings
+	retry    retry.Retry
+	ch       chan []data.Metric
+	// mu, stopped после остановки обработчика пакеты не ставятся в очередь, а учитываются как отброшенные
+	mu      sync.RWMutex
+	stopped bool
+
+	sent    *selfmetric.Counter
+	dropped *selfmetric.Counter
+	length  *selfmetric.Gauge
+	// done закрывается после остановки обработчика
+	done chan struct{}
+}
+
+// New создает очереди получателей и запускает их обработку до отмены ctx или вызова Stop
+func New(ctx context.Context, targets ...Target) *Exporter {
+	ctx, cancel := context.WithCancel(ctx)
+	e := &Exporter{cancel: cancel}
+	for _, t := range targets {
+		s := withDefaults(t.Settings)
+		labels := map[string]string{"sink": s.Name}
+		q := &queue{
+			sink:     t.Sink,
+			settings: s,
+			ch:       make(chan []data.Metric, s.QueueSize),
+			sent:     selfmetric.Default.Counter(data.SeriesID(selfMetricSent, labels)),
+			dropped:  selfmetric.Default.Counter(data.SeriesID(selfMetricDropped, labels)),
+			length:   selfmetric.Default.Gauge(data.SeriesID(selfMetricQueueLength, labels)),
+			done:     make(chan struct{}),
+		}
+		retries := selfmetric.Default.Counter(data.SeriesID(selfMetricRetries, labels))
+		q.retry = s.Retry.OnRetry(func(int, error) { retries.Inc() })
+		e.queues = append(e.queues, q)
+		go q.run(ctx)
+	}
+	return e
+}
+
+func withDefaults(s Settings) Settings {
+	if s.QueueSize <= 0 {
+		s.QueueSize = DefaultQueueSize
+	}
+	if s.BatchSize <= 0 {
+		s.BatchSize = DefaultBatchSize
+	}
+	if s.FlushInterval <= 0 {
+		s.FlushInterval = DefaultFlushInterval
+	}
+	if s.Timeout <= 0 {
+		s.Timeout = DefaultTimeout
+	}
+	if s.Retry == nil {
+		r := DefaultRetry()
+		s.Retry = &r
+	}
+	return s
+}
+
+// Publish ставит пакет в очереди получателей, не блокируясь
+func (e *Exporter) Publish(metric ...data.Metric) {
+	if len(metric) == 0 {
+		return
+	}
+	for _, q := range e.queues {
+		q.publish(metric)
+	}
+}
+
+func (q *queue) publish(metric []data.Metric) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.stopped {
+		q.dropped.Add(int64(len(metric)))
+		return
+	}
+	select {
+	case q.ch <- metric:
+		q.length.Set(float64(len(q.ch)))
+	default:
+		q.dropped.Add(int64(len(metric)))
+	}
+}
+
+// Stop останавливает обработчики: накопленные метрики отправляются, последующие Publish отбрасываются
+func (e *Exporter) Stop() {
+	e.cancel()
+}
+
+// Wait ждет остановки обработчиков после Stop или отмены контекста New
+func (e *Exporter) Wait() {
+	for _, q := range e.queues {
+		<-q.done
+	}
+}
+
+// run собирает пакеты из очереди в отправки по BatchSize метрик. Неполная отправка
+// уходит через FlushInterval. При остановке накопленное отправляется одной попыткой.
+func (q *queue) run(ctx context.Context) {
+	defer close(q.done)
+	ticker := time.NewTicker(q.settings.FlushInterval)
+	defer ticker.Stop()
+	pending := make([]data.Metric, 0, q.settings.BatchSize)
+	for {
+		select {
+		case <-ctx.Done():
+			q.mu.Lock()
+			q.stopped = true
+			q.mu.Unlock()
+			for drained := false; !drained; {
+				select {
+				case m := <-q.ch:
+					pending = append(pending, m...)
+				default:
+					drained = true
+				}
+			}
+			q.length.Set(0)
+			q.shutdown(context.WithoutCancel(ctx), pending)
+			return
+		case m := <-q.ch:
+			q.length.Set(float64(len(q.ch)))
+			pending = append(pending, m...)
+			for len(pending) >= q.settings.BatchSize {
+				q.send(ctx, pending[:q.settings.BatchSize])
+				pending = append(make([]data.Metric, 0, q.settings.BatchSize), pending[q.settings.BatchSize:]...)
+			}
+		case <-ticker.C:
+			if len(pending) > 0 {
+				q.send(ctx, pending)
+				pending = make([]data.Metric, 0, q.settings.BatchSize)
+			}
+		}
+	}
+}
+
+// send отправляет пакет с повторами, неотправленные метрики учитываются как отброшенные
+func (q *queue) send(ctx context.Context, batch []data.Metric) {
+	body, err := q.sink.Encode(batch)
+	if err == nil {
+		// тайм-аут отдельной попытки повторяется, пока не истек общий срок повторов
+		var retryCtx context.Context
+		retriable := func(err error) bool {
+			return !retry.IsPermanent(err) && retryCtx.Err() == nil
+		}
+		err = q.retry.DoIf(ctx, retriable, func(ctx context.Context) error {
+			retryCtx = ctx
+			ctx, cancel := context.WithTimeout(ctx, q.settings.Timeout)
+			defer cancel()
+			return q.sink.Send(ctx, body)
+		})
+	}
+	if err != nil {
+		q.dropped.Add(int64(len(batch)))
+		logger.Log.Error("export failed, metrics dropped", zap.String("sink", q.settings.Name), zap.Int("metrics", len(batch)), zap.Error(err))
+		return
+	}
+	q.sent.Add(int64(len(batch)))
+}
+
+func (q *queue) shutdown(ctx context.Context, pending []data.Metric) {
+	ctx, cancel := context.WithTimeout(ctx, shutdownTimeout)
+	defer cancel()
+	for len(pending) > 0 {
+		n := min(len(pending), q.settings.BatchSize)
+		batch := pending[:n]
+		pending = pending[n:]
+		body, err := q.sink.Encode(batch)
+		if err == nil {
+			err = q.sink.Send(ctx, body)
+		}
+		if err != nil {
+			q.dropped.Add(int64(len(batch) + len(pending)))
+			logger.Log.Error("export on shutdown failed, metrics dropped", zap.String("sink", q.settings.Name), zap.Error(err))
+			return
+		}
+		q.sent.Add(int64(len(batch)))
+	}
+}
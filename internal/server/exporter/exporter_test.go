@@ -0,0 +1,176 @@
+package exporter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/megaded/metrictmr/internal/data"
+	"github.com/megaded/metrictmr/internal/retry"
+	"github.com/megaded/metrictmr/internal/selfmetric"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSink запоминает отправленные пакеты, ошибки отправки берутся из errs по очереди
+type fakeSink struct {
+	mu      sync.Mutex
+	batches [][]data.Metric
+	errs    []error
+	// block задерживает отправку до закрытия канала
+	block chan struct{}
+}
+
+func (s *fakeSink) Encode(metrics []data.Metric) ([]byte, error) {
+	return json.Marshal(metrics)
+}
+
+func (s *fakeSink) Send(ctx context.Context, body []byte) error {
+	if s.block != nil {
+		select {
+		case <-s.block:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.errs) > 0 {
+		err := s.errs[0]
+		s.errs = s.errs[1:]
+		return err
+	}
+	var batch []data.Metric
+	if err := json.Unmarshal(body, &batch); err != nil {
+		return err
+	}
+	s.batches = append(s.batches, batch)
+	return nil
+}
+
+func (s *fakeSink) sent() [][]data.Metric {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([][]data.Metric(nil), s.batches...)
+}
+
+func gauges(ids ...string) []data.Metric {
+	metrics := make([]data.Metric, 0, len(ids))
+	for _, id := range ids {
+		v := 1.0
+		metrics = append(metrics, data.Metric{ID: id, MType: data.MTypeGauge, Value: &v})
+	}
+	return metrics
+}
+
+func counterValue(name string, sink string) int64 {
+	return selfmetric.Default.Counter(data.SeriesID(name, map[string]string{"sink": sink})).Value()
+}
+
+func fastRetry(retries int) *retry.Retry {
+	r := retry.NewRetry(time.Millisecond, time.Millisecond, retries)
+	return &r
+}
+
+func TestExporterBatching(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sink := &fakeSink{}
+	e := New(ctx, Target{Sink: sink, Settings: Settings{Name: "batching", BatchSize: 3, FlushInterval: 50 * time.Millisecond}})
+
+	e.Publish(gauges("a", "b")...)
+	e.Publish(gauges("c", "d")...)
+	assert.Eventually(t, func() bool { return len(sink.sent()) == 1 }, time.Second, 5*time.Millisecond)
+	assert.Len(t, sink.sent()[0], 3, "full batch is sent without waiting")
+
+	// остаток уходит по таймеру
+	assert.Eventually(t, func() bool { return len(sink.sent()) == 2 }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, "d", sink.sent()[1][0].ID)
+	assert.Equal(t, int64(4), counterValue(selfMetricSent, "batching"))
+
+	cancel()
+	e.Wait()
+}
+
+func TestExporterRetry(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sink := &fakeSink{errs: []error{&retry.StatusError{StatusCode: 503}, errors.New("connection refused")}}
+	e := New(ctx, Target{Sink: sink, Settings: Settings{Name: "retry", BatchSize: 1, Retry: fastRetry(3)}})
+
+	e.Publish(gauges("a")...)
+	assert.Eventually(t, func() bool { return len(sink.sent()) == 1 }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, int64(2), counterValue(selfMetricRetries, "retry"))
+	assert.Equal(t, int64(0), counterValue(selfMetricDropped, "retry"))
+}
+
+func TestExporterDropsAfterFailures(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sink := &fakeSink{errs: []error{
+		retry.Permanent(&retry.StatusError{StatusCode: 400}),
+		errors.New("timeout"), errors.New("timeout"),
+	}}
+	e := New(ctx, Target{Sink: sink, Settings: Settings{Name: "drop", BatchSize: 2, Retry: fastRetry(1)}})
+
+	e.Publish(gauges("a", "b")...)
+	assert.Eventually(t, func() bool { return counterValue(selfMetricDropped, "drop") == 2 }, time.Second, 5*time.Millisecond)
+	e.Publish(gauges("c", "d")...)
+	assert.Eventually(t, func() bool { return counterValue(selfMetricDropped, "drop") == 4 }, time.Second, 5*time.Millisecond)
+	e.Publish(gauges("e", "f")...)
+	assert.Eventually(t, func() bool { return len(sink.sent()) == 1 }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, int64(4), counterValue(selfMetricDropped, "drop"))
+}
+
+func TestExporterPublishDoesNotBlock(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sink := &fakeSink{block: make(chan struct{})}
+	e := New(ctx, Target{Sink: sink, Settings: Settings{Name: "slow", QueueSize: 2, BatchSize: 1}})
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 10; i++ {
+			e.Publish(gauges("a")...)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Publish blocked on a slow sink")
+	}
+	// один пакет отправляется, два ждут в очереди, остальные отброшены
+	assert.Eventually(t, func() bool { return counterValue(selfMetricDropped, "slow") >= 7 }, time.Second, 5*time.Millisecond)
+
+	close(sink.block)
+	cancel()
+	e.Wait()
+}
+
+func TestExporterFlushOnShutdown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sink := &fakeSink{}
+	e := New(ctx, Target{Sink: sink, Settings: Settings{Name: "shutdown", FlushInterval: time.Hour}})
+
+	e.Publish(gauges("a", "b")...)
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	e.Wait()
+	require.Len(t, sink.sent(), 1)
+	assert.Len(t, sink.sent()[0], 2)
+}
+
+func TestExporterPublishAfterStop(t *testing.T) {
+	sink := &fakeSink{}
+	e := New(context.Background(), Target{Sink: sink, Settings: Settings{Name: "stopped", FlushInterval: time.Hour}})
+	dropped := counterValue(selfMetricDropped, "stopped")
+
+	e.Stop()
+	e.Wait()
+	// обработчик остановлен: пакет не теряется молча, а учитывается как отброшенный
+	e.Publish(gauges("a", "b")...)
+	assert.Empty(t, sink.sent())
+	assert.Equal(t, dropped+2, counterValue(selfMetricDropped, "stopped"))
+}
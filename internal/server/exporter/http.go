@@ -0,0 +1,60 @@
+package exporter
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/megaded/metrictmr/internal/data"
+	"github.com/megaded/metrictmr/internal/retry"
+)
+
+// HTTPSink отправляет пакеты JSON-массивом в формате /updates/, сжатым gzip.
+// Получателем может быть другой сервер metrictmr.
+type HTTPSink struct {
+	url    string
+	client *http.Client
+}
+
+func NewHTTPSink(url string, client *http.Client) *HTTPSink {
+	if client == nil {
+		client = &http.Client{}
+	}
+	return &HTTPSink{url: url, client: client}
+}
+
+func (s *HTTPSink) Encode(metrics []data.Metric) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(zw).Encode(metrics); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (s *HTTPSink) Send(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return retry.Permanent(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	return do(s.client, req)
+}
+
+// do выполняет запрос и переводит код ответа в ошибку для retry
+func do(client *http.Client, req *http.Request) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	defer io.Copy(io.Discard, resp.Body)
+	return retry.ResponseError(resp)
+}
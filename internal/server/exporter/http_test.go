@@ -0,0 +1,45 @@
+package exporter
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/megaded/metrictmr/internal/data"
+	"github.com/megaded/metrictmr/internal/retry"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPSink(t *testing.T) {
+	var got []data.Metric
+	status := http.StatusOK
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/updates/", r.URL.Path)
+		assert.Equal(t, "gzip", r.Header.Get("Content-Encoding"))
+		zr, err := gzip.NewReader(r.Body)
+		require.NoError(t, err)
+		require.NoError(t, json.NewDecoder(zr).Decode(&got))
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+
+	sink := NewHTTPSink(ts.URL+"/updates/", ts.Client())
+	delta := int64(3)
+	body, err := sink.Encode([]data.Metric{{ID: "c", MType: data.MTypeCounter, Delta: &delta}})
+	require.NoError(t, err)
+	require.NoError(t, sink.Send(context.Background(), body))
+	require.Len(t, got, 1)
+	assert.Equal(t, int64(3), *got[0].Delta)
+
+	status = http.StatusServiceUnavailable
+	err = sink.Send(context.Background(), body)
+	assert.True(t, retry.IsRetriable(err))
+
+	status = http.StatusBadRequest
+	err = sink.Send(context.Background(), body)
+	assert.True(t, retry.IsPermanent(err))
+}
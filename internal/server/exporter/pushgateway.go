@@ -0,0 +1,164 @@
+package exporter
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/megaded/metrictmr/internal/data"
+	"github.com/megaded/metrictmr/internal/logger"
+	"github.com/megaded/metrictmr/internal/retry"
+	"go.uber.org/zap"
+)
+
+// DefaultJob группа pushgateway по умолчанию
+const DefaultJob = "metrictmr"
+
+// PushgatewaySink отправляет метрики в текстовом формате Prometheus методом POST
+// в группу /metrics/job/<job>.
+//
+// POST заменяет в группе все ряды метрики с тем же именем, поэтому отправляется семейство
+// целиком: sink хранит последние значения всех рядов. Counter передается накопленной суммой
+// приращений с момента запуска сервера, перезапуск для Prometheus выглядит как сброс счетчика.
+type PushgatewaySink struct {
+	url    string
+	client *http.Client
+
+	mu       sync.Mutex
+	families map[string]*family
+}
+
+type family struct {
+	mType string
+	// series значения по отрисованному набору меток
+	series map[string]float64
+}
+
+func NewPushgatewaySink(baseURL string, job string, client *http.Client) *PushgatewaySink {
+	if job == "" {
+		job = DefaultJob
+	}
+	if client == nil {
+		client = &http.Client{}
+	}
+	return &PushgatewaySink{
+		url:      strings.TrimRight(baseURL, "/") + "/metrics/job/" + url.PathEscape(job),
+		client:   client,
+		families: make(map[string]*family),
+	}
+}
+
+// Encode применяет пакет к сохраненным значениям и возвращает затронутые семейства
+func (s *PushgatewaySink) Encode(metrics []data.Metric) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	touched := make(map[string]struct{})
+	for _, m := range metrics {
+		id, labels := data.ParseSeriesID(m.ID)
+		name := promName(id)
+		f, ok := s.families[name]
+		if !ok {
+			f = &family{mType: m.MType, series: make(map[string]float64)}
+			s.families[name] = f
+		}
+		if f.mType != m.MType {
+			logger.Log.Debug("pushgateway: metric type conflict, skipped", zap.String("name", name), zap.String("type", m.MType))
+			continue
+		}
+		key := promLabels(labels)
+		switch {
+		case m.MType == data.MTypeGauge && m.Value != nil:
+			f.series[key] = *m.Value
+		case m.MType == data.MTypeCounter && m.Delta != nil:
+			f.series[key] += float64(*m.Delta)
+		default:
+			continue
+		}
+		touched[name] = struct{}{}
+	}
+
+	names := make([]string, 0, len(touched))
+	for name := range touched {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buf bytes.Buffer
+	for _, name := range names {
+		f := s.families[name]
+		buf.WriteString("# TYPE " + name + " " + f.mType + "\n")
+		keys := make([]string, 0, len(f.series))
+		for k := range f.series {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			buf.WriteString(name + k + " " + strconv.FormatFloat(f.series[k], 'g', -1, 64) + "\n")
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func (s *PushgatewaySink) Send(ctx context.Context, body []byte) error {
+	if len(body) == 0 {
+		return nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return retry.Permanent(err)
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	return do(s.client, req)
+}
+
+// promName приводит имя к допустимому в Prometheus: [a-zA-Z_:][a-zA-Z0-9_:]*
+func promName(name string) string {
+	return sanitize(name, true)
+}
+
+// promLabels отрисовывает метки {k="v",...} в порядке имен
+func promLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(sanitize(k, false))
+		b.WriteString(`="`)
+		b.WriteString(labelValueEscaper.Replace(labels[k]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// sanitize заменяет недопустимые символы подчеркиванием, двоеточие допустимо только в именах метрик
+func sanitize(s string, colon bool) string {
+	if s == "" {
+		return "_"
+	}
+	b := []byte(s)
+	for i, c := range b {
+		valid := c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') ||
+			(colon && c == ':') || (i > 0 && c >= '0' && c <= '9')
+		if !valid {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
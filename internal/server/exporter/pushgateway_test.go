@@ -0,0 +1,71 @@
+package exporter
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/megaded/metrictmr/internal/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func gauge(id string, v float64) data.Metric {
+	return data.Metric{ID: id, MType: data.MTypeGauge, Value: &v}
+}
+
+func counter(id string, d int64) data.Metric {
+	return data.Metric{ID: id, MType: data.MTypeCounter, Delta: &d}
+}
+
+func TestPushgatewaySinkEncode(t *testing.T) {
+	sink := NewPushgatewaySink("http://localhost:9091", "", nil)
+
+	body, err := sink.Encode([]data.Metric{
+		gauge("cpu;host=a", 0.5),
+		gauge("cpu;host=b", 0.25),
+		counter("http.requests;path=/a\"b", 2),
+		counter("http.requests;path=/a\"b", 3),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "# TYPE cpu gauge\n"+
+		"cpu{host=\"a\"} 0.5\n"+
+		"cpu{host=\"b\"} 0.25\n"+
+		"# TYPE http_requests counter\n"+
+		"http_requests{path=\"/a\\\"b\"} 5\n", string(body))
+
+	// семейство отправляется целиком, counter накапливается, нетронутые семейства не отправляются
+	body, err = sink.Encode([]data.Metric{gauge("cpu;host=a", 0.75), counter("http.requests;path=/a\"b", 1)})
+	require.NoError(t, err)
+	assert.Equal(t, "# TYPE cpu gauge\n"+
+		"cpu{host=\"a\"} 0.75\n"+
+		"cpu{host=\"b\"} 0.25\n"+
+		"# TYPE http_requests counter\n"+
+		"http_requests{path=\"/a\\\"b\"} 6\n", string(body))
+
+	// конфликт типов: ряд с тем же именем другого типа пропускается
+	body, err = sink.Encode([]data.Metric{counter("cpu", 1)})
+	require.NoError(t, err)
+	assert.Empty(t, body)
+}
+
+func TestPushgatewaySinkSend(t *testing.T) {
+	var path, contentType, got string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		path, contentType = r.URL.EscapedPath(), r.Header.Get("Content-Type")
+		b, _ := io.ReadAll(r.Body)
+		got = string(b)
+	}))
+	defer ts.Close()
+
+	sink := NewPushgatewaySink(ts.URL+"/", "edge/1", ts.Client())
+	body, err := sink.Encode([]data.Metric{gauge("9lives", 1)})
+	require.NoError(t, err)
+	require.NoError(t, sink.Send(context.Background(), body))
+	assert.Equal(t, "/metrics/job/edge%2F1", path)
+	assert.Equal(t, "text/plain; version=0.0.4", contentType)
+	assert.Equal(t, "# TYPE _lives gauge\n_lives 1\n", got)
+}
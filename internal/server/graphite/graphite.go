@@ -0,0 +1,110 @@
+// Прием метрик по протоколу Graphite plaintext
+//
+// Строка имеет вид path value [timestamp], путь может содержать теги Graphite 1.1:
+// path;tag=value;... Значения сохраняются как gauge, пути, подходящие под правило
+// counter, - как приращения counter. Временная метка проверяется, но не сохраняется:
+// хранилище держит только последнее значение.
+package graphite
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/megaded/metrictmr/internal/data"
+)
+
+// Sample одна строка протокола
+type Sample struct {
+	Path  string
+	Tags  map[string]string
+	Value float64
+	// Timestamp время в секундах Unix, -1 или отсутствие означают время приема
+	Timestamp int64
+}
+
+// ParseLine разбирает строку без завершающего перевода строки
+func ParseLine(line string) (Sample, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || len(fields) > 3 {
+		return Sample{}, errors.New("expected path, value and optional timestamp")
+	}
+	s := Sample{Timestamp: -1}
+	path, tags, err := parsePath(fields[0])
+	if err != nil {
+		return Sample{}, err
+	}
+	s.Path, s.Tags = path, tags
+
+	s.Value, err = strconv.ParseFloat(fields[1], 64)
+	if err != nil || math.IsNaN(s.Value) || math.IsInf(s.Value, 0) {
+		return Sample{}, fmt.Errorf("invalid value %q", fields[1])
+	}
+
+	if len(fields) == 3 {
+		// часть клиентов передает время с дробной частью
+		ts, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil || math.IsNaN(ts) || ts < -1 || ts >= math.MaxInt64 {
+			return Sample{}, fmt.Errorf("invalid timestamp %q", fields[2])
+		}
+		s.Timestamp = int64(ts)
+	}
+	return s, nil
+}
+
+// parsePath отделяет теги от пути
+func parsePath(value string) (string, map[string]string, error) {
+	parts := strings.Split(value, ";")
+	path := parts[0]
+	if path == "" || strings.HasPrefix(path, ".") || strings.HasSuffix(path, ".") || strings.Contains(path, "..") {
+		return "", nil, fmt.Errorf("invalid path %q", path)
+	}
+	if len(parts) == 1 {
+		return path, nil, nil
+	}
+	tags := make(map[string]string, len(parts)-1)
+	for _, tag := range parts[1:] {
+		k, v, ok := strings.Cut(tag, "=")
+		if !ok || k == "" || v == "" {
+			return "", nil, fmt.Errorf("invalid tag %q", tag)
+		}
+		tags[k] = v
+	}
+	return path, tags, nil
+}
+
+// Rules определяет тип метрики по пути
+type Rules struct {
+	counterPaths *regexp.Regexp
+}
+
+// NewRules пути, подходящие под выражение counterPaths, сохраняются как counter.
+// Пустое выражение означает, что все значения сохраняются как gauge.
+func NewRules(counterPaths string) (*Rules, error) {
+	r := &Rules{}
+	if counterPaths != "" {
+		re, err := regexp.Compile(counterPaths)
+		if err != nil {
+			return nil, fmt.Errorf("invalid counter paths rule: %w", err)
+		}
+		r.counterPaths = re
+	}
+	return r, nil
+}
+
+// Metric переводит строку в метрику. Значение counter должно быть целым.
+func (r *Rules) Metric(s Sample) (data.Metric, error) {
+	id := data.SeriesID(s.Path, s.Tags)
+	if r.counterPaths == nil || !r.counterPaths.MatchString(s.Path) {
+		value := s.Value
+		return data.Metric{ID: id, MType: data.MTypeGauge, Value: &value}, nil
+	}
+	if s.Value != math.Trunc(s.Value) || math.Abs(s.Value) >= math.MaxInt64 {
+		return data.Metric{}, fmt.Errorf("counter %s: value %v is not an integer", s.Path, s.Value)
+	}
+	delta := int64(s.Value)
+	return data.Metric{ID: id, MType: data.MTypeCounter, Delta: &delta}, nil
+}
@@ -0,0 +1,101 @@
+package graphite
+
+import (
+	"testing"
+
+	"github.com/megaded/metrictmr/internal/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLine(t *testing.T) {
+	testCases := []struct {
+		name string
+		line string
+		want Sample
+	}{
+		{
+			name: "path value timestamp",
+			line: "servers.web1.cpu 0.75 1700000000",
+			want: Sample{Path: "servers.web1.cpu", Value: 0.75, Timestamp: 1700000000},
+		},
+		{
+			name: "without timestamp",
+			line: "jobs.backup.duration 12",
+			want: Sample{Path: "jobs.backup.duration", Value: 12, Timestamp: -1},
+		},
+		{
+			name: "timestamp -1 and extra spaces",
+			line: "  jobs.count\t3   -1 ",
+			want: Sample{Path: "jobs.count", Value: 3, Timestamp: -1},
+		},
+		{
+			name: "fractional timestamp",
+			line: "jobs.count 3 1700000000.5",
+			want: Sample{Path: "jobs.count", Value: 3, Timestamp: 1700000000},
+		},
+		{
+			name: "tags",
+			line: "disk.used;host=a;mount=/var 42 1700000000",
+			want: Sample{Path: "disk.used", Tags: map[string]string{"host": "a", "mount": "/var"}, Value: 42, Timestamp: 1700000000},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s, err := ParseLine(tc.line)
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, s)
+		})
+	}
+}
+
+func TestParseLineErrors(t *testing.T) {
+	testCases := []struct {
+		name string
+		line string
+	}{
+		{name: "only path", line: "jobs.count"},
+		{name: "too many fields", line: "jobs.count 1 2 3"},
+		{name: "invalid value", line: "jobs.count abc 1700000000"},
+		{name: "NaN value", line: "jobs.count NaN"},
+		{name: "invalid timestamp", line: "jobs.count 1 now"},
+		{name: "negative timestamp", line: "jobs.count 1 -5"},
+		{name: "empty path segment", line: "jobs..count 1"},
+		{name: "leading dot", line: ".jobs.count 1"},
+		{name: "tag without value", line: "jobs.count;host 1"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := ParseLine(tc.line)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestRules(t *testing.T) {
+	rules, err := NewRules(`^stats_counts\.`)
+	require.NoError(t, err)
+
+	m, err := rules.Metric(Sample{Path: "stats_counts.jobs.done", Tags: map[string]string{"host": "a"}, Value: 5})
+	require.NoError(t, err)
+	assert.Equal(t, "stats_counts.jobs.done;host=a", m.ID)
+	assert.Equal(t, data.MTypeCounter, m.MType)
+	assert.Equal(t, int64(5), *m.Delta)
+
+	m, err = rules.Metric(Sample{Path: "stats.jobs.duration", Value: 1.5})
+	require.NoError(t, err)
+	assert.Equal(t, data.MTypeGauge, m.MType)
+	assert.Equal(t, 1.5, *m.Value)
+
+	_, err = rules.Metric(Sample{Path: "stats_counts.jobs.done", Value: 1.5})
+	assert.Error(t, err)
+
+	_, err = NewRules(`(`)
+	assert.Error(t, err)
+
+	gauges, err := NewRules("")
+	require.NoError(t, err)
+	m, err = gauges.Metric(Sample{Path: "stats_counts.jobs.done", Value: 5})
+	require.NoError(t, err)
+	assert.Equal(t, data.MTypeGauge, m.MType)
+}
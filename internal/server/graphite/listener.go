@@ -0,0 +1,309 @@
+package graphite
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/megaded/metrictmr/internal/data"
+	"github.com/megaded/metrictmr/internal/logger"
+	"github.com/megaded/metrictmr/internal/selfmetric"
+	"github.com/megaded/metrictmr/internal/server/handler/storage"
+	"go.uber.org/zap"
+)
+
+const (
+	NetworkTCP  = "tcp"
+	NetworkUDP  = "udp"
+	NetworkBoth = "both"
+
+	DefaultMaxConns      = 100
+	DefaultMaxLineLength = 4096
+	defaultIdleTimeout   = 5 * time.Minute
+	// maxBatch количество строк соединения, после которого метрики сохраняются, не дожидаясь паузы
+	maxBatch = 500
+	// maxDatagram максимальный размер UDP-датаграммы
+	maxDatagram = 64 * 1024
+	// minAcceptDelay, maxAcceptDelay пауза после ошибки Accept, удваивается до maxAcceptDelay, как в net/http
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = time.Second
+	// flushTimeout время на сохранение последней пачки соединения после отмены ctx
+	flushTimeout = 5 * time.Second
+
+	selfMetricLines         = "GraphiteLines"
+	selfMetricInvalidLines  = "GraphiteInvalidLines"
+	selfMetricRejectedConns = "GraphiteRejectedConns"
+	selfMetricStoreErrors   = "GraphiteStoreErrors"
+)
+
+// Listener принимает строки Graphite по TCP и/или UDP и сохраняет их в Storage
+type Listener struct {
+	Addr string
+	// Network tcp, udp или both
+	Network string
+	Storage storage.Storager
+	Rules   *Rules
+	// MaxConns ограничение одновременных TCP-соединений, лишние соединения закрываются сразу
+	MaxConns int
+	// MaxLineLength ограничение длины строки, более длинные строки отбрасываются
+	MaxLineLength int
+	// IdleTimeout время, после которого закрывается TCP-соединение без данных
+	IdleTimeout time.Duration
+
+	// tcp, udp сокеты, открытые Listen
+	tcp net.Listener
+	udp net.PacketConn
+}
+
+// ListenAndServe открывает сокеты и принимает данные до отмены ctx.
+// Ошибка открытия сокета возвращается сразу.
+func (l *Listener) ListenAndServe(ctx context.Context) error {
+	if err := l.Listen(); err != nil {
+		return err
+	}
+	return l.Serve(ctx)
+}
+
+// Listen открывает сокеты, чтобы ошибка адреса обнаруживалась при запуске, а не в Serve
+func (l *Listener) Listen() error {
+	switch l.Network {
+	case NetworkTCP, NetworkUDP, NetworkBoth:
+	default:
+		return fmt.Errorf("graphite: unknown network %q", l.Network)
+	}
+	var ln net.Listener
+	if l.Network != NetworkUDP {
+		var err error
+		if ln, err = net.Listen("tcp", l.Addr); err != nil {
+			return err
+		}
+	}
+	if l.Network != NetworkTCP {
+		conn, err := net.ListenPacket("udp", l.Addr)
+		if err != nil {
+			if ln != nil {
+				ln.Close()
+			}
+			return err
+		}
+		l.udp = conn
+	}
+	l.tcp = ln
+	return nil
+}
+
+// Serve принимает данные на сокетах, открытых Listen, до отмены ctx
+func (l *Listener) Serve(ctx context.Context) error {
+	var serve []func() error
+	if l.tcp != nil {
+		serve = append(serve, func() error { return l.ServeTCP(ctx, l.tcp) })
+	}
+	if l.udp != nil {
+		serve = append(serve, func() error { return l.ServeUDP(ctx, l.udp) })
+	}
+	if len(serve) == 0 {
+		return errors.New("graphite: Serve called before Listen")
+	}
+	errs := make(chan error, len(serve))
+	for _, fn := range serve {
+		go func() { errs <- fn() }()
+	}
+	var result error
+	for range serve {
+		if err := <-errs; err != nil && result == nil {
+			result = err
+		}
+	}
+	return result
+}
+
+// ServeTCP принимает соединения до отмены ctx и закрывает ln
+func (l *Listener) ServeTCP(ctx context.Context, ln net.Listener) error {
+	stop := context.AfterFunc(ctx, func() { ln.Close() })
+	defer stop()
+	logger.Log.Info("graphite tcp listener started", zap.String("addr", ln.Addr().String()))
+
+	maxConns := l.MaxConns
+	if maxConns <= 0 {
+		maxConns = DefaultMaxConns
+	}
+	sem := make(chan struct{}, maxConns)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	var delay time.Duration
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			// например, исчерпаны файловые дескрипторы: повтор без паузы только нагрузит процессор
+			delay = min(max(delay*2, minAcceptDelay), maxAcceptDelay)
+			logger.Log.Warn("graphite accept failed", zap.Duration("retry in", delay), zap.Error(err))
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(delay):
+			}
+			continue
+		}
+		delay = 0
+		select {
+		case sem <- struct{}{}:
+		default:
+			selfmetric.Default.Counter(selfMetricRejectedConns).Inc()
+			logger.Log.Warn("graphite connection limit reached", zap.String("remote", conn.RemoteAddr().String()))
+			conn.Close()
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			l.handleConn(ctx, conn)
+		}()
+	}
+}
+
+// handleConn читает строки соединения. Метрики сохраняются пачкой, когда во входном
+// буфере не остается данных или пачка достигает maxBatch.
+func (l *Listener) handleConn(ctx context.Context, conn net.Conn) {
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	defer conn.Close()
+
+	idle := l.IdleTimeout
+	if idle <= 0 {
+		idle = defaultIdleTimeout
+	}
+	// +1 на перевод строки
+	r := bufio.NewReaderSize(conn, l.maxLineLength()+1)
+	batch := make([]data.Metric, 0)
+	for {
+		if r.Buffered() == 0 || len(batch) >= maxBatch {
+			batch = l.store(ctx, batch)
+		}
+		conn.SetReadDeadline(time.Now().Add(idle))
+		line, err := r.ReadSlice('\n')
+		if errors.Is(err, bufio.ErrBufferFull) {
+			l.invalid(conn.RemoteAddr(), "line too long")
+			if err = skipLine(r); err != nil {
+				l.flush(ctx, batch)
+				return
+			}
+			continue
+		}
+		batch = l.appendLine(conn.RemoteAddr(), line, batch)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && ctx.Err() == nil {
+				logger.Log.Debug("graphite connection closed", zap.Error(err))
+			}
+			l.flush(ctx, batch)
+			return
+		}
+	}
+}
+
+// skipLine отбрасывает остаток слишком длинной строки
+func skipLine(r *bufio.Reader) error {
+	for {
+		_, err := r.ReadSlice('\n')
+		if !errors.Is(err, bufio.ErrBufferFull) {
+			return err
+		}
+	}
+}
+
+// ServeUDP читает датаграммы до отмены ctx и закрывает conn. Каждая датаграмма сохраняется целиком.
+func (l *Listener) ServeUDP(ctx context.Context, conn net.PacketConn) error {
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	logger.Log.Info("graphite udp listener started", zap.String("addr", conn.LocalAddr().String()))
+
+	buf := make([]byte, maxDatagram)
+	maxLine := l.maxLineLength()
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			logger.Log.Warn("graphite read failed", zap.Error(err))
+			continue
+		}
+		batch := make([]data.Metric, 0)
+		for line := range bytes.Lines(buf[:n]) {
+			if len(bytes.TrimRight(line, "\r\n")) > maxLine {
+				l.invalid(addr, "line too long")
+				continue
+			}
+			batch = l.appendLine(addr, line, batch)
+		}
+		l.store(ctx, batch)
+	}
+}
+
+// appendLine разбирает строку и добавляет метрику в пачку, ошибочные строки учитываются и пропускаются
+func (l *Listener) appendLine(addr net.Addr, line []byte, batch []data.Metric) []data.Metric {
+	text := string(bytes.TrimSpace(line))
+	if text == "" {
+		return batch
+	}
+	s, err := ParseLine(text)
+	if err != nil {
+		l.invalid(addr, err.Error())
+		return batch
+	}
+	m, err := l.Rules.Metric(s)
+	if err != nil {
+		l.invalid(addr, err.Error())
+		return batch
+	}
+	selfmetric.Default.Counter(selfMetricLines).Inc()
+	return append(batch, m)
+}
+
+func (l *Listener) invalid(addr net.Addr, reason string) {
+	selfmetric.Default.Counter(selfMetricInvalidLines).Inc()
+	logger.Log.Debug("graphite line rejected", zap.String("remote", addr.String()), zap.String("reason", reason))
+}
+
+// store сохраняет пачку и возвращает новый срез для следующей: хранилище может
+// передать сохраненный срез подписчикам, поэтому он не переиспользуется
+func (l *Listener) store(ctx context.Context, batch []data.Metric) []data.Metric {
+	if len(batch) == 0 {
+		return batch
+	}
+	if err := l.Storage.Store(ctx, batch...); err != nil {
+		selfmetric.Default.Counter(selfMetricStoreErrors).Inc()
+		logger.Log.Error("graphite store failed", zap.Int("metrics", len(batch)), zap.Error(err))
+	}
+	return make([]data.Metric, 0, len(batch))
+}
+
+// flush сохраняет последнюю пачку соединения. Соединение закрывается и при остановке сервера,
+// поэтому пачка сохраняется и после отмены ctx, но не дольше flushTimeout.
+func (l *Listener) flush(ctx context.Context, batch []data.Metric) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), flushTimeout)
+	defer cancel()
+	l.store(ctx, batch)
+}
+
+func (l *Listener) maxLineLength() int {
+	if l.MaxLineLength <= 0 {
+		return DefaultMaxLineLength
+	}
+	return l.MaxLineLength
+}
@@ -0,0 +1,213 @@
+package graphite
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/megaded/metrictmr/internal/server/handler/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestListener(t *testing.T, store storage.Storager) *Listener {
+	t.Helper()
+	rules, err := NewRules(`^stats_counts\.`)
+	require.NoError(t, err)
+	return &Listener{Storage: store, Rules: rules, MaxConns: 1, MaxLineLength: 64}
+}
+
+// gaugeValue значение gauge и признак его наличия
+func gaugeValue(store storage.Storager, id string) (float64, bool) {
+	m, err := store.GetGauge(context.TODO(), id)
+	if err != nil {
+		return 0, false
+	}
+	return *m.Value, true
+}
+
+func TestListenerTCP(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	store := storage.NewInMemoryStorage()
+	l := newTestListener(t, store)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	done := make(chan error, 1)
+	go func() { done <- l.ServeTCP(ctx, ln) }()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	lines := []string{
+		"jobs.backup.duration 12.5 1700000000",
+		"stats_counts.jobs.done 2 1700000000",
+		"jobs.too.long " + strings.Repeat("1", 100),
+		"broken line here now",
+		"stats_counts.jobs.done 3 -1",
+		"jobs.last;host=a 1",
+	}
+	_, err = conn.Write([]byte(strings.Join(lines, "\n") + "\n"))
+	require.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		_, ok := gaugeValue(store, "jobs.last;host=a")
+		return ok
+	}, time.Second, 10*time.Millisecond)
+	v, ok := gaugeValue(store, "jobs.backup.duration")
+	assert.True(t, ok)
+	assert.Equal(t, 12.5, v)
+	c, err := store.GetCounter(context.TODO(), "stats_counts.jobs.done")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), *c.Delta)
+	_, ok = gaugeValue(store, "jobs.too.long")
+	assert.False(t, ok)
+
+	t.Run("connection limit", func(t *testing.T) {
+		extra, err := net.Dial("tcp", ln.Addr().String())
+		require.NoError(t, err)
+		defer extra.Close()
+		extra.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = extra.Read(make([]byte, 1))
+		assert.ErrorIs(t, err, io.EOF)
+	})
+
+	conn.Close()
+	cancel()
+	select {
+	case err = <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("listener did not stop")
+	}
+}
+
+func TestListenerTCPLastLineWithoutNewline(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	store := storage.NewInMemoryStorage()
+	l := newTestListener(t, store)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go l.ServeTCP(ctx, ln)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("cron.nightly.status 1 1700000000"))
+	require.NoError(t, err)
+	conn.Close()
+
+	assert.Eventually(t, func() bool {
+		_, ok := gaugeValue(store, "cron.nightly.status")
+		return ok
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestListenerTCPFlushOnShutdown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	store := storage.NewInMemoryStorage()
+	l := newTestListener(t, store)
+	server, client := net.Pipe()
+	defer client.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		l.handleConn(ctx, server)
+	}()
+
+	// запись в net.Pipe завершается, когда соединение прочитало данные
+	_, err := client.Write([]byte("cron.nightly.status 1 1700000000"))
+	require.NoError(t, err)
+	cancel()
+	<-done
+
+	v, ok := gaugeValue(store, "cron.nightly.status")
+	assert.True(t, ok)
+	assert.Equal(t, 1.0, v)
+}
+
+// failingListener listener, Accept которого возвращает ошибку fails раз, затем net.ErrClosed
+type failingListener struct {
+	net.Listener
+	fails int
+	calls int
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	l.calls++
+	if l.calls > l.fails {
+		return nil, net.ErrClosed
+	}
+	return nil, errors.New("too many open files")
+}
+
+func (l *failingListener) Close() error {
+	return nil
+}
+
+func (l *failingListener) Addr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+func TestListenerTCPAcceptBackoff(t *testing.T) {
+	l := newTestListener(t, storage.NewInMemoryStorage())
+	ln := &failingListener{fails: 4}
+	start := time.Now()
+	err := l.ServeTCP(context.Background(), ln)
+	assert.ErrorIs(t, err, net.ErrClosed)
+	assert.Equal(t, 5, ln.calls)
+	// паузы 5, 10, 20 и 40 мс
+	assert.GreaterOrEqual(t, time.Since(start), 75*time.Millisecond)
+}
+
+func TestListenerUDP(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	store := storage.NewInMemoryStorage()
+	l := newTestListener(t, store)
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	done := make(chan error, 1)
+	go func() { done <- l.ServeUDP(ctx, pc) }()
+
+	conn, err := net.Dial("udp", pc.LocalAddr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	payload := "udp.a 1\nudp.too.long " + strings.Repeat("1", 100) + "\r\nudp.b 2 1700000000\r\n"
+	_, err = conn.Write([]byte(payload))
+	require.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		_, ok := gaugeValue(store, "udp.b")
+		return ok
+	}, time.Second, 10*time.Millisecond)
+	_, ok := gaugeValue(store, "udp.a")
+	assert.True(t, ok)
+	_, ok = gaugeValue(store, "udp.too.long")
+	assert.False(t, ok)
+
+	cancel()
+	select {
+	case err = <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("listener did not stop")
+	}
+}
+
+func TestListenAndServeUnknownNetwork(t *testing.T) {
+	l := &Listener{Addr: "127.0.0.1:0", Network: "sctp"}
+	assert.Error(t, l.ListenAndServe(context.Background()))
+}
+
+func TestListenAddressInUse(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer busy.Close()
+
+	// ошибка адреса возвращается из Listen, до начала приема
+	l := &Listener{Addr: busy.Addr().String(), Network: NetworkBoth}
+	assert.Error(t, l.Listen())
+	assert.Error(t, l.Serve(context.Background()), "nothing to serve")
+}
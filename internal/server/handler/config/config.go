@@ -5,6 +5,7 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/caarlos0/env"
 	"github.com/megaded/metrictmr/internal/logger"
@@ -15,8 +16,41 @@ const (
 	defaultStoreInternal = 0
 	defaultFilePath      = "metric.txt"
 	defaultRestore       = true
+
+	// DefaultDBMaxConns, DefaultDBMaxIdleConns, DefaultDBConnMaxLifetime параметры пула соединений
+	// с базой, если в конфигурации указан 0
+	DefaultDBMaxConns        = 20
+	DefaultDBMaxIdleConns    = 10
+	DefaultDBConnMaxLifetime = 300
+
+	defaultGraphiteNetwork       = "tcp"
+	defaultGraphiteMaxConns      = 100
+	defaultGraphiteMaxLineLength = 4096
+)
+
+// Типы получателей пересылки метрик
+const (
+	ExportHTTP        = "http"
+	ExportPushgateway = "pushgateway"
 )
 
+// Export получатель, в который пересылаются сохраненные метрики
+type Export struct {
+	// Type http или pushgateway
+	Type string `json:"type"`
+	URL  string `json:"url"`
+	// Job группа pushgateway
+	Job string `json:"job"`
+	// QueueSize количество пакетов в очереди получателя
+	QueueSize int `json:"queue_size"`
+	// BatchSize максимальное количество метрик в одной отправке
+	BatchSize int `json:"batch_size"`
+	// FlushInterval период отправки неполного пакета в секундах
+	FlushInterval int `json:"flush_interval"`
+	// Timeout время ожидания ответа в секундах
+	Timeout int `json:"timeout"`
+}
+
 type Config struct {
 	Address       string `env:"ADDRESS" json:"address"`
 	StoreInterval *int   `env:"STORE_INTERVAL" json:"store_interval"`
@@ -25,6 +59,45 @@ type Config struct {
 	DBConnString  string `env:"DATABASE_DSN" json:"database_dsn"`
 	Key           string `env:"KEY"`
 	CryptoKey     string `env:"CRYPTO_KEY" json:"crypto_key"`
+	// WALSync политика сброса журнала файлового хранилища: always, interval, none
+	WALSync string `env:"WAL_SYNC" json:"wal_sync"`
+	// SnapshotFormat кодирование снимка файлового хранилища: json, binary
+	SnapshotFormat string `env:"SNAPSHOT_FORMAT" json:"snapshot_format"`
+	// SnapshotGenerations количество хранимых поколений снимка
+	SnapshotGenerations *int `env:"SNAPSHOT_GENERATIONS" json:"snapshot_generations"`
+	// BoltPath файл встроенной базы bbolt. Если задан, метрики хранятся в ней.
+	BoltPath string `env:"BOLT_PATH" json:"bolt_path"`
+	// DBMaxConns максимальное число соединений с базой. 0 - значение по умолчанию (20),
+	// отрицательное - без ограничения
+	DBMaxConns int `env:"DB_MAX_CONNS" json:"db_max_conns"`
+	// DBMaxIdleConns число простаивающих соединений в пуле. 0 - значение по умолчанию (10),
+	// отрицательное - простаивающие соединения закрываются
+	DBMaxIdleConns int `env:"DB_MAX_IDLE_CONNS" json:"db_max_idle_conns"`
+	// DBConnMaxLifetime время жизни соединения в секундах. 0 - значение по умолчанию (300),
+	// отрицательное - без ограничения
+	DBConnMaxLifetime int `env:"DB_CONN_MAX_LIFETIME" json:"db_conn_max_lifetime"`
+	// ClientCA сертификаты удостоверяющих центров в PEM. Если задан, сервер требует
+	// клиентский сертификат, подписанный одним из них (mTLS)
+	ClientCA string `env:"CLIENT_CA" json:"client_ca"`
+	// InfluxCounterFields регулярное выражение для имен measurement_field: подходящие целочисленные
+	// поля line protocol сохраняются как приращения counter, остальные - как gauge
+	InfluxCounterFields string `env:"INFLUX_COUNTER_FIELDS" json:"influx_counter_fields"`
+	// GraphiteAddress адрес приема Graphite plaintext, пустое значение отключает прием
+	GraphiteAddress string `env:"GRAPHITE_ADDRESS" json:"graphite_address"`
+	// GraphiteNetwork протокол приема Graphite: tcp, udp, both
+	GraphiteNetwork string `env:"GRAPHITE_NETWORK" json:"graphite_network"`
+	// GraphiteCounterPaths регулярное выражение путей Graphite, сохраняемых как приращения counter
+	GraphiteCounterPaths string `env:"GRAPHITE_COUNTER_PATHS" json:"graphite_counter_paths"`
+	// GraphiteMaxConns ограничение одновременных TCP-соединений Graphite
+	GraphiteMaxConns int `env:"GRAPHITE_MAX_CONNS" json:"graphite_max_conns"`
+	// GraphiteMaxLineLength ограничение длины строки Graphite в байтах
+	GraphiteMaxLineLength int `env:"GRAPHITE_MAX_LINE_LENGTH" json:"graphite_max_line_length"`
+	// Exports получатели пересылки с индивидуальными настройками, задаются в файле конфигурации
+	Exports []Export `json:"exports"`
+	// ExportHTTPURLs адреса получателей JSON с настройками по умолчанию
+	ExportHTTPURLs []string `env:"EXPORT_HTTP" envSeparator:","`
+	// ExportPushgatewayURL адрес pushgateway с настройками по умолчанию
+	ExportPushgatewayURL string `env:"EXPORT_PUSHGATEWAY"`
 }
 
 func (c *Config) GetAddress() string {
@@ -35,58 +108,151 @@ func (c *Config) GetFilePath() (fp string, isDefault bool) {
 	return c.FilePath, c.FilePath == defaultFilePath
 }
 
+// GetExports получатели пересылки из файла конфигурации и списков адресов
+func (c *Config) GetExports() []Export {
+	exports := append([]Export(nil), c.Exports...)
+	for _, u := range c.ExportHTTPURLs {
+		if u = strings.TrimSpace(u); u != "" {
+			exports = append(exports, Export{Type: ExportHTTP, URL: u})
+		}
+	}
+	if c.ExportPushgatewayURL != "" {
+		exports = append(exports, Export{Type: ExportPushgateway, URL: c.ExportPushgatewayURL})
+	}
+	return exports
+}
+
+// GetConfig читает конфигурацию из файла, окружения и флагов командной строки процесса
 func GetConfig() *Config {
+	config, err := ParseConfig(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		logger.Log.Error(err.Error())
+		panic(err)
+	}
+	return config
+}
+
+// ParseConfig разбирает флаги args в fs и читает конфигурацию. Флаги объявляются в fs,
+// поэтому для повторного разбора нужен новый FlagSet. Аргументы после флагов остаются в fs.Args().
+func ParseConfig(fs *flag.FlagSet, args []string) (*Config, error) {
 	config := &Config{}
 	var configPath string
-	flag.StringVar(&configPath, "c", "", "config file")
-	flag.StringVar(&configPath, "config", "", "config file")
-	flag.Parse()
+	fs.StringVar(&configPath, "c", "", "config file")
+	fs.StringVar(&configPath, "config", "", "config file")
+	setCmdParam := defineCmdParam(fs)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
 	if configPath != "" {
 		data, err := readJSONFile(configPath)
 		if err != nil {
-			logger.Log.Error(err.Error())
-			panic(err)
+			return nil, err
 		}
-		err = json.Unmarshal(data, &config)
-		if err != nil {
-			logger.Log.Error(err.Error())
-			panic(err)
+		if err = json.Unmarshal(data, &config); err != nil {
+			return nil, err
 		}
 	}
 	setEnvParam(config)
 	setCmdParam(config)
-	return config
+	return config, nil
 }
 
 func setEnvParam(c *Config) {
 	env.Parse(c)
 }
 
-func setCmdParam(c *Config) {
-	address := flag.String("a", defaultAddr, "server endpoint")
-	dBConnString := flag.String("d", "", "db conn string")
-	storeInterval := flag.Int("i", defaultStoreInternal, "store internal")
-	filePath := flag.String("f", defaultFilePath, "file path")
-	restore := flag.Bool("r", defaultRestore, "restore")
-	key := flag.String("k", "", "key")
-	flag.Parse()
-	if c.Address == "" {
-		c.Address = *address
-	}
-	if c.DBConnString == "" {
-		c.DBConnString = *dBConnString
-	}
-	if c.StoreInterval == nil {
-		c.StoreInterval = storeInterval
-	}
-	if c.FilePath == "" {
-		c.FilePath = *filePath
-	}
-	if c.Restore == nil {
-		c.Restore = restore
-	}
-	if c.Key == "" {
-		c.Key = *key
+// defineCmdParam объявляет флаги командной строки до их разбора
+// и возвращает функцию, применяющую значения флагов к незаданным параметрам
+func defineCmdParam(fs *flag.FlagSet) func(c *Config) {
+	address := fs.String("a", defaultAddr, "server endpoint")
+	dBConnString := fs.String("d", "", "db conn string, sqlite://path for SQLite")
+	storeInterval := fs.Int("i", defaultStoreInternal, "store internal")
+	filePath := fs.String("f", defaultFilePath, "file path")
+	restore := fs.Bool("r", defaultRestore, "restore")
+	key := fs.String("k", "", "key")
+	walSync := fs.String("wal-sync", "always", "wal sync policy: always, interval, none")
+	snapshotFormat := fs.String("snapshot-format", "json", "snapshot format: json, binary")
+	snapshotGenerations := fs.Int("snapshot-generations", 3, "snapshot generations to keep")
+	boltPath := fs.String("bolt", "", "bolt database file path")
+	dbMaxConns := fs.Int("db-max-conns", DefaultDBMaxConns, "max open db connections, negative - unlimited")
+	dbMaxIdleConns := fs.Int("db-max-idle-conns", DefaultDBMaxIdleConns, "max idle db connections, negative - none")
+	dbConnMaxLifetime := fs.Int("db-conn-lifetime", DefaultDBConnMaxLifetime, "db connection lifetime, seconds, negative - unlimited")
+	clientCA := fs.String("client-ca", "", "CA bundle to require and verify client certificates")
+	influxCounterFields := fs.String("influx-counter-fields", "", "regexp of influx measurement_field names stored as counters")
+	graphiteAddress := fs.String("graphite", "", "graphite plaintext listen address, empty to disable")
+	graphiteNetwork := fs.String("graphite-network", defaultGraphiteNetwork, "graphite network: tcp, udp, both")
+	graphiteCounterPaths := fs.String("graphite-counter-paths", "", "regexp of graphite paths stored as counters")
+	graphiteMaxConns := fs.Int("graphite-max-conns", defaultGraphiteMaxConns, "max concurrent graphite tcp connections")
+	graphiteMaxLineLength := fs.Int("graphite-max-line", defaultGraphiteMaxLineLength, "max graphite line length, bytes")
+	exportHTTP := fs.String("export-http", "", "comma separated URLs to forward stored metrics as JSON")
+	exportPushgateway := fs.String("export-pushgateway", "", "pushgateway URL to forward stored metrics")
+	return func(c *Config) {
+		if c.Address == "" {
+			c.Address = *address
+		}
+		if c.DBConnString == "" {
+			c.DBConnString = *dBConnString
+		}
+		if c.StoreInterval == nil {
+			c.StoreInterval = storeInterval
+		}
+		if c.FilePath == "" {
+			c.FilePath = *filePath
+		}
+		if c.Restore == nil {
+			c.Restore = restore
+		}
+		if c.Key == "" {
+			c.Key = *key
+		}
+		if c.WALSync == "" {
+			c.WALSync = *walSync
+		}
+		if c.SnapshotFormat == "" {
+			c.SnapshotFormat = *snapshotFormat
+		}
+		if c.SnapshotGenerations == nil {
+			c.SnapshotGenerations = snapshotGenerations
+		}
+		if c.BoltPath == "" {
+			c.BoltPath = *boltPath
+		}
+		if c.DBMaxConns == 0 {
+			c.DBMaxConns = *dbMaxConns
+		}
+		if c.DBMaxIdleConns == 0 {
+			c.DBMaxIdleConns = *dbMaxIdleConns
+		}
+		if c.DBConnMaxLifetime == 0 {
+			c.DBConnMaxLifetime = *dbConnMaxLifetime
+		}
+		if c.ClientCA == "" {
+			c.ClientCA = *clientCA
+		}
+		if c.InfluxCounterFields == "" {
+			c.InfluxCounterFields = *influxCounterFields
+		}
+		if c.GraphiteAddress == "" {
+			c.GraphiteAddress = *graphiteAddress
+		}
+		if c.GraphiteNetwork == "" {
+			c.GraphiteNetwork = *graphiteNetwork
+		}
+		if c.GraphiteCounterPaths == "" {
+			c.GraphiteCounterPaths = *graphiteCounterPaths
+		}
+		if c.GraphiteMaxConns == 0 {
+			c.GraphiteMaxConns = *graphiteMaxConns
+		}
+		if c.GraphiteMaxLineLength == 0 {
+			c.GraphiteMaxLineLength = *graphiteMaxLineLength
+		}
+		if len(c.ExportHTTPURLs) == 0 && *exportHTTP != "" {
+			c.ExportHTTPURLs = strings.Split(*exportHTTP, ",")
+		}
+		if c.ExportPushgatewayURL == "" {
+			c.ExportPushgatewayURL = *exportPushgateway
+		}
 	}
 }
 
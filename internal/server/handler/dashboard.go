@@ -0,0 +1,69 @@
+package handler
+
+import (
+	"embed"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/megaded/metrictmr/internal/data"
+)
+
+//go:embed templates static
+var dashboardFS embed.FS
+
+var dashboardTemplate = template.Must(template.ParseFS(dashboardFS, "templates/dashboard.html"))
+
+// updateTracker хранилище, запоминающее время изменения метрик
+type updateTracker interface {
+	LastUpdate(id string, mType string) (time.Time, bool)
+}
+
+// dashboardRow строка таблицы метрик
+type dashboardRow struct {
+	ID      string
+	MType   string
+	Value   string
+	Updated time.Time
+}
+
+type dashboardPage struct {
+	Rows []dashboardRow
+	Live bool
+}
+
+func (h *handler) dashboardRows(metrics []data.Metric) []dashboardRow {
+	sort.Slice(metrics, func(i, j int) bool {
+		if metrics[i].ID == metrics[j].ID {
+			return metrics[i].MType < metrics[j].MType
+		}
+		return metrics[i].ID < metrics[j].ID
+	})
+	rows := make([]dashboardRow, 0, len(metrics))
+	for _, m := range metrics {
+		row := dashboardRow{ID: m.ID, MType: m.MType}
+		switch {
+		case m.MType == gaugeType && m.Value != nil:
+			row.Value = strconv.FormatFloat(*m.Value, 'f', -1, 64)
+		case m.MType == counterType && m.Delta != nil:
+			row.Value = strconv.FormatInt(*m.Delta, 10)
+		}
+		if updates, ok := h.storage.(updateTracker); ok {
+			row.Updated, _ = updates.LastUpdate(m.ID, m.MType)
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// staticHandler отдает статические файлы страницы метрик
+func staticHandler() http.Handler {
+	static, err := fs.Sub(dashboardFS, "static")
+	if err != nil {
+		panic(err)
+	}
+	return http.StripPrefix("/static/", http.FileServer(http.FS(static)))
+}
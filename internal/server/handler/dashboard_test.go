@@ -0,0 +1,47 @@
+package handler
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/megaded/metrictmr/internal/data"
+	"github.com/megaded/metrictmr/internal/server/handler/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDashboard(t *testing.T) {
+	store := storage.NewObservableStorage(storage.NewInMemoryStorage())
+	var value float64 = 0.5
+	var delta int64 = 7
+	store.Store(context.TODO(),
+		data.Metric{ID: "<script>alert(1)</script>", MType: gaugeType, Value: &value},
+		data.Metric{ID: "PollCount", MType: counterType, Delta: &delta},
+	)
+	ts := httptest.NewServer(CreateRouter(store, nil))
+	defer ts.Close()
+
+	res, err := ts.Client().Get(ts.URL + "/")
+	require.NoError(t, err)
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "text/html; charset=utf-8", res.Header.Get("Content-Type"))
+	assert.NotContains(t, string(body), "<script>alert(1)</script>")
+	assert.Contains(t, string(body), "&lt;script&gt;alert(1)&lt;/script&gt;")
+	assert.Contains(t, string(body), `<span class="badge badge-counter">counter</span>`)
+	assert.Contains(t, string(body), `data-live="false"`)
+	updated, ok := store.LastUpdate("PollCount", counterType)
+	require.True(t, ok)
+	assert.Contains(t, string(body), `<time datetime="`+updated.Format("2006-01-02T15:04:05Z07:00")+`">`)
+
+	for _, path := range []string{"/static/dashboard.js", "/static/dashboard.css"} {
+		res, err = ts.Client().Get(ts.URL + path)
+		require.NoError(t, err)
+		res.Body.Close()
+		assert.Equal(t, http.StatusOK, res.StatusCode, path)
+	}
+}
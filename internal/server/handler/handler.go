@@ -7,7 +7,9 @@ package handler
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
@@ -15,42 +17,102 @@ import (
 
 	"github.com/go-chi/chi/v5"
 	"github.com/megaded/metrictmr/internal/data"
+	"github.com/megaded/metrictmr/internal/server/broker"
 	"github.com/megaded/metrictmr/internal/server/handler/storage"
+	"github.com/megaded/metrictmr/internal/server/influx"
+	"github.com/megaded/metrictmr/internal/server/otlp"
 )
 
+const maxBulkKeys = 1000
+
 type handler struct {
 	storage storage.Storager
+	broker  *broker.Broker
+	influx  *influx.Converter
+	otlp    *otlp.Converter
+}
+
+// bulkValue элемент ответа пакетного чтения метрик
+type bulkValue struct {
+	data.Metric
+	NotFound bool `json:"not_found,omitempty"`
 }
 
 // Возвращает страницу со списком метрик
 func (h *handler) getMetricListHandler() func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		b := new(bytes.Buffer)
-		metrics, err := h.storage.GetMetrics()
+		metrics, err := h.storage.GetMetrics(r.Context())
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeStorageError(w, err)
 			return
 		}
-		for _, value := range metrics {
-			if value.MType == gaugeType {
-				fmt.Fprintf(b, "Name %v=\"%f\"\n", value.ID, *value.Value)
-			}
-			if value.MType == counterType {
-				fmt.Fprintf(b, "Name %v=\"%d\"\n", value.ID, *value.Delta)
-			}
-
+		b := new(bytes.Buffer)
+		page := dashboardPage{Rows: h.dashboardRows(metrics), Live: h.broker != nil}
+		if err = dashboardTemplate.Execute(b, page); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
 
-		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
 		w.WriteHeader(http.StatusOK)
 		w.Write(b.Bytes())
 	}
 }
 
+// Возвращает список метрик в JSON с фильтрацией, сортировкой и постраничным выводом
+//
+// Параметры запроса: prefix, match (регулярное выражение), type, sort (name|type),
+// order (asc|desc), limit, cursor (значение next с предыдущей страницы)
+func (h *handler) getMetricListJSONHandler() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		filter := storage.MetricFilter{
+			Prefix:  q.Get("prefix"),
+			Pattern: q.Get("match"),
+			MType:   q.Get("type"),
+			SortBy:  q.Get("sort"),
+			Cursor:  q.Get("cursor"),
+		}
+		switch q.Get("order") {
+		case "", "asc":
+		case "desc":
+			filter.Desc = true
+		default:
+			http.Error(w, "invalid order", http.StatusBadRequest)
+			return
+		}
+		if limit := q.Get("limit"); limit != "" {
+			l, err := strconv.Atoi(limit)
+			if err != nil || l < 0 {
+				http.Error(w, "invalid limit", http.StatusBadRequest)
+				return
+			}
+			filter.Limit = l
+		}
+		if err := filter.Normalize(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		page, err := h.storage.FindMetrics(r.Context(), filter)
+		if err != nil {
+			writeStorageError(w, err)
+			return
+		}
+		resp, err := json.Marshal(page)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(resp)
+	}
+}
+
 // Пинг к БД
 func (h *handler) getPingDBHandler() func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		ping := h.storage.HealthCheck()
+		ping := h.storage.HealthCheck(r.Context())
 		if ping {
 			w.WriteHeader(http.StatusOK)
 			return
@@ -71,23 +133,23 @@ func (h *handler) getMetricHandler() func(w http.ResponseWriter, r *http.Request
 		mName := chi.URLParam(r, nameParam)
 		switch mType {
 		case gaugeType:
-			value, ok, err := h.storage.GetGauge(mName)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+			value, err := h.storage.GetGauge(r.Context(), mName)
+			if err == nil {
+				w.Write([]byte(FloatFormat(*value.Value)))
 				return
 			}
-			if ok {
-				w.Write([]byte(FloatFormat(*value.Value)))
+			if !errors.Is(err, storage.ErrNotFound) {
+				writeStorageError(w, err)
 				return
 			}
 		case counterType:
-			value, ok, err := h.storage.GetCounter(mName)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+			value, err := h.storage.GetCounter(r.Context(), mName)
+			if err == nil {
+				w.Write([]byte(fmt.Sprintf("%d", *value.Delta)))
 				return
 			}
-			if ok {
-				w.Write([]byte(fmt.Sprintf("%d", *value.Delta)))
+			if !errors.Is(err, storage.ErrNotFound) {
+				writeStorageError(w, err)
 				return
 			}
 		}
@@ -109,13 +171,9 @@ func (h *handler) getMetricJSONHandler() func(w http.ResponseWriter, r *http.Req
 		var resp []byte
 		switch metric.MType {
 		case gaugeType:
-			storedMetric, ok, err := h.storage.GetGauge(metric.ID)
+			storedMetric, err := h.storage.GetGauge(r.Context(), metric.ID)
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			if !ok {
-				w.WriteHeader(http.StatusNotFound)
+				writeStorageError(w, err)
 				return
 			}
 			metric.Value = storedMetric.Value
@@ -125,13 +183,9 @@ func (h *handler) getMetricJSONHandler() func(w http.ResponseWriter, r *http.Req
 				return
 			}
 		case counterType:
-			storedMetric, ok, err := h.storage.GetCounter(metric.ID)
+			storedMetric, err := h.storage.GetCounter(r.Context(), metric.ID)
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			if !ok {
-				w.WriteHeader(http.StatusNotFound)
+				writeStorageError(w, err)
 				return
 			}
 			metric.Delta = storedMetric.Delta
@@ -148,6 +202,47 @@ func (h *handler) getMetricJSONHandler() func(w http.ResponseWriter, r *http.Req
 	}
 }
 
+// Получение списка метрик по именам и типам
+//
+// Отсутствующие метрики возвращаются с признаком not_found
+func (h *handler) getMetricsBulkJSONHandler() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var keys []storage.MetricKey
+		err := json.NewDecoder(r.Body).Decode(&keys)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		if len(keys) > maxBulkKeys {
+			http.Error(w, fmt.Sprintf("too many metrics, max %d", maxBulkKeys), http.StatusBadRequest)
+			return
+		}
+		stored, err := h.storage.GetMetricsByKeys(r.Context(), keys)
+		if err != nil {
+			writeStorageError(w, err)
+			return
+		}
+		result := make([]bulkValue, 0, len(keys))
+		for _, k := range keys {
+			m, ok := stored[k]
+			if !ok {
+				result = append(result, bulkValue{Metric: data.Metric{ID: k.ID, MType: k.MType}, NotFound: true})
+				continue
+			}
+			result = append(result, bulkValue{Metric: m})
+		}
+		resp, err := json.Marshal(result)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(resp)
+	}
+}
+
 // Сохранение метрики
 func (h *handler) getSaveHandler() func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -176,7 +271,7 @@ func (h *handler) getSaveHandler() func(w http.ResponseWriter, r *http.Request)
 			}
 			err = h.storage.Store(r.Context(), data.Metric{ID: mName, MType: gaugeType, Value: &fValue})
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				writeStorageError(w, err)
 				return
 			}
 		case counterType:
@@ -191,7 +286,7 @@ func (h *handler) getSaveHandler() func(w http.ResponseWriter, r *http.Request)
 			}
 			err = h.storage.Store(r.Context(), data.Metric{ID: mName, MType: counterType, Delta: &fValue})
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				writeStorageError(w, err)
 				return
 			}
 		}
@@ -219,12 +314,12 @@ func (h *handler) getSaveJSONHandler() func(w http.ResponseWriter, r *http.Reque
 			}
 			err = h.storage.Store(r.Context(), metric)
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				writeStorageError(w, err)
 				return
 			}
-			storedMetric, _, err := h.storage.GetGauge(metric.ID)
+			storedMetric, err := h.storage.GetGauge(r.Context(), metric.ID)
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				writeStorageError(w, err)
 				return
 			}
 			resp, err = json.Marshal(storedMetric)
@@ -239,12 +334,12 @@ func (h *handler) getSaveJSONHandler() func(w http.ResponseWriter, r *http.Reque
 			}
 			err = h.storage.Store(r.Context(), metric)
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				writeStorageError(w, err)
 				return
 			}
-			storedMetric, _, err := h.storage.GetCounter(metric.ID)
+			storedMetric, err := h.storage.GetCounter(r.Context(), metric.ID)
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				writeStorageError(w, err)
 				return
 			}
 			resp, err = json.Marshal(storedMetric)
@@ -273,7 +368,7 @@ func (h *handler) getSaveBulkJSONHandler() func(w http.ResponseWriter, r *http.R
 
 		err = h.storage.Store(r.Context(), metric...)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeStorageError(w, err)
 			return
 		}
 
@@ -282,6 +377,23 @@ func (h *handler) getSaveBulkJSONHandler() func(w http.ResponseWriter, r *http.R
 	}
 }
 
+// writeStorageError отвечает кодом, соответствующим типу ошибки хранилища
+func writeStorageError(w http.ResponseWriter, err error) {
+	http.Error(w, err.Error(), storageErrorStatus(err))
+}
+
+func storageErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, storage.ErrInvalid):
+		return http.StatusBadRequest
+	case errors.Is(err, storage.ErrUnavailable), errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
 func FloatFormat(value float64) string {
 	return strings.TrimRight(fmt.Sprintf("%.3f", value), "0.")
 }
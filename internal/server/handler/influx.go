@@ -0,0 +1,72 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/megaded/metrictmr/internal/data"
+	"github.com/megaded/metrictmr/internal/server/influx"
+)
+
+// maxWriteBodySize ограничение размера тела запроса /write после распаковки
+const maxWriteBodySize = 32 << 20
+
+// writeResponse ответ /write при ошибках в строках
+type writeResponse struct {
+	Error string             `json:"error"`
+	Lines []influx.LineError `json:"lines"`
+}
+
+// Сохранение метрик в формате InfluxDB line protocol
+//
+// Параметр запроса precision (ns, us, ms, s) задает единицу временной метки.
+// Корректные строки сохраняются, даже если в запросе есть ошибочные: о них сообщается
+// ответом 400 с номерами строк.
+func (h *handler) getInfluxWriteHandler() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		precision, err := influx.Precision(r.URL.Query().Get("precision"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		body := http.MaxBytesReader(w, r.Body, maxWriteBodySize)
+		points, lineErrors, err := influx.Parse(body, precision, time.Now())
+		if err != nil {
+			var maxErr *http.MaxBytesError
+			if errors.As(err, &maxErr) {
+				http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		metrics := make([]data.Metric, 0, len(points))
+		for _, p := range points {
+			metrics = append(metrics, h.influx.Metrics(p)...)
+		}
+		if len(metrics) > 0 {
+			if err = h.storage.Store(r.Context(), metrics...); err != nil {
+				writeStorageError(w, err)
+				return
+			}
+		}
+		if len(lineErrors) == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		resp, err := json.Marshal(writeResponse{
+			Error: fmt.Sprintf("partial write: %d of %d lines rejected", len(lineErrors), len(lineErrors)+len(points)),
+			Lines: lineErrors,
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(resp)
+	}
+}
@@ -0,0 +1,101 @@
+package handler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/megaded/metrictmr/internal/server/handler/storage"
+	"github.com/megaded/metrictmr/internal/server/influx"
+	"github.com/megaded/metrictmr/internal/server/middleware"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInfluxWrite(t *testing.T) {
+	store := storage.NewInMemoryStorage()
+	converter, err := influx.NewConverter(`^http_requests$`)
+	require.NoError(t, err)
+	ts := httptest.NewServer(CreateRouterWithOptions(store, nil, Options{Influx: converter}, middleware.GzipMiddleware))
+	defer ts.Close()
+
+	t.Run("plain body", func(t *testing.T) {
+		body := "cpu,host=a usage=0.5,cores=4i 1700000000000000000\nhttp,host=a requests=3i\nhttp,host=a requests=2i"
+		res, err := ts.Client().Post(ts.URL+"/write", "text/plain", strings.NewReader(body))
+		require.NoError(t, err)
+		res.Body.Close()
+		assert.Equal(t, http.StatusNoContent, res.StatusCode)
+
+		m, err := store.GetGauge(context.TODO(), "cpu_usage;host=a")
+		require.NoError(t, err)
+		assert.Equal(t, 0.5, *m.Value)
+		m, err = store.GetGauge(context.TODO(), "cpu_cores;host=a")
+		require.NoError(t, err)
+		assert.Equal(t, 4.0, *m.Value)
+		m, err = store.GetCounter(context.TODO(), "http_requests;host=a")
+		require.NoError(t, err)
+		assert.Equal(t, int64(5), *m.Delta)
+	})
+
+	t.Run("gzip body", func(t *testing.T) {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		_, err := zw.Write([]byte("mem,host=b used=42 1700000000"))
+		require.NoError(t, err)
+		require.NoError(t, zw.Close())
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/write?precision=s", &buf)
+		require.NoError(t, err)
+		req.Header.Set("Content-Encoding", "gzip")
+		res, err := ts.Client().Do(req)
+		require.NoError(t, err)
+		res.Body.Close()
+		assert.Equal(t, http.StatusNoContent, res.StatusCode)
+
+		m, err := store.GetGauge(context.TODO(), "mem_used;host=b")
+		require.NoError(t, err)
+		assert.Equal(t, 42.0, *m.Value)
+	})
+
+	t.Run("partial write reports lines", func(t *testing.T) {
+		body := "disk free=1\ndisk free=abc\ndisk\nnet rx=7"
+		res, err := ts.Client().Post(ts.URL+"/write", "text/plain", strings.NewReader(body))
+		require.NoError(t, err)
+		defer res.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+		var resp writeResponse
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&resp))
+		assert.Equal(t, "partial write: 2 of 4 lines rejected", resp.Error)
+		require.Len(t, resp.Lines, 2)
+		assert.Equal(t, 2, resp.Lines[0].Line)
+		assert.Equal(t, 3, resp.Lines[1].Line)
+
+		_, err = store.GetGauge(context.TODO(), "disk_free")
+		assert.NoError(t, err)
+		_, err = store.GetGauge(context.TODO(), "net_rx")
+		assert.NoError(t, err)
+	})
+
+	t.Run("invalid precision", func(t *testing.T) {
+		res, err := ts.Client().Post(ts.URL+"/write?precision=h", "text/plain", strings.NewReader("cpu value=1"))
+		require.NoError(t, err)
+		res.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	})
+}
+
+func TestInfluxWriteStorageError(t *testing.T) {
+	s := &failingStorage{InMemoryStorage: storage.NewInMemoryStorage(), err: storage.ErrUnavailable}
+	ts := httptest.NewServer(CreateRouter(s, nil))
+	defer ts.Close()
+
+	res, err := ts.Client().Post(ts.URL+"/write", "text/plain", strings.NewReader("cpu value=1"))
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+}
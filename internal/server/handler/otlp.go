@@ -0,0 +1,81 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"github.com/megaded/metrictmr/internal/data"
+	"github.com/megaded/metrictmr/internal/server/otlp"
+)
+
+const (
+	// maxOTLPBodySize ограничение размера тела запроса /v1/metrics после распаковки
+	maxOTLPBodySize = 32 << 20
+
+	// коды google.rpc.Code для тела ответа с ошибкой
+	rpcInvalidArgument = 3
+	rpcUnavailable     = 14
+	rpcInternal        = 13
+)
+
+// Прием метрик OpenTelemetry по OTLP/HTTP, поддерживается только кодировка JSON
+//
+// Неподдерживаемые виды метрик и ошибочные точки не мешают сохранению остальных:
+// о них сообщается в partialSuccess ответа.
+func (h *handler) getOTLPMetricsHandler() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+			writeOTLPStatus(w, http.StatusUnsupportedMediaType, rpcInvalidArgument, "only application/json encoding is supported")
+			return
+		}
+		var req otlp.ExportRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxOTLPBodySize)).Decode(&req); err != nil {
+			var maxErr *http.MaxBytesError
+			if errors.As(err, &maxErr) {
+				writeOTLPStatus(w, http.StatusRequestEntityTooLarge, rpcInvalidArgument, err.Error())
+				return
+			}
+			writeOTLPStatus(w, http.StatusBadRequest, rpcInvalidArgument, err.Error())
+			return
+		}
+		result, err := h.otlp.Ingest(req, func(metrics []data.Metric) error {
+			return h.storage.Store(r.Context(), metrics...)
+		})
+		if err != nil {
+			status := storageErrorStatus(err)
+			code := rpcInternal
+			if status == http.StatusServiceUnavailable {
+				code = rpcUnavailable
+			}
+			writeOTLPStatus(w, status, code, err.Error())
+			return
+		}
+
+		var resp otlp.ExportResponse
+		if result.Rejected > 0 {
+			resp.PartialSuccess = &otlp.PartialSuccess{
+				RejectedDataPoints: strconv.FormatInt(result.Rejected, 10),
+				ErrorMessage:       result.Message(),
+			}
+		}
+		body, err := json.Marshal(resp)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(body)
+	}
+}
+
+// writeOTLPStatus отвечает ошибкой в формате google.rpc.Status
+func writeOTLPStatus(w http.ResponseWriter, status int, code int, message string) {
+	body, _ := json.Marshal(otlp.Status{Code: code, Message: message})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
@@ -0,0 +1,179 @@
+package handler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/megaded/metrictmr/internal/data"
+	"github.com/megaded/metrictmr/internal/server/handler/storage"
+	"github.com/megaded/metrictmr/internal/server/middleware"
+	"github.com/megaded/metrictmr/internal/server/otlp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const otlpBody = `{"resourceMetrics":[{"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"api"}}]},
+"scopeMetrics":[{"metrics":[
+ {"name":"cpu","gauge":{"dataPoints":[{"asDouble":0.25}]}},
+ {"name":"requests","sum":{"aggregationTemporality":1,"isMonotonic":true,"dataPoints":[{"asInt":"4"}]}},
+ {"name":"latency","summary":{"dataPoints":[{"count":"1"}]}}
+]}]}]}`
+
+func postOTLP(t *testing.T, ts *httptest.Server, contentType string, body []byte, gzipped bool) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, ts.URL+"/v1/metrics", bytes.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", contentType)
+	if gzipped {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	res, err := ts.Client().Do(req)
+	require.NoError(t, err)
+	return res
+}
+
+func TestOTLPMetrics(t *testing.T) {
+	store := storage.NewInMemoryStorage()
+	ts := httptest.NewServer(CreateRouter(store, nil, middleware.GzipMiddleware))
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err := zw.Write([]byte(otlpBody))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	res := postOTLP(t, ts, "application/json", buf.Bytes(), true)
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	var resp otlp.ExportResponse
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&resp))
+	require.NotNil(t, resp.PartialSuccess)
+	assert.Equal(t, "1", resp.PartialSuccess.RejectedDataPoints)
+	assert.Contains(t, resp.PartialSuccess.ErrorMessage, "summary is not supported")
+
+	g, err := store.GetGauge(context.TODO(), "cpu;service.name=api")
+	require.NoError(t, err)
+	assert.Equal(t, 0.25, *g.Value)
+	c, err := store.GetCounter(context.TODO(), "requests;service.name=api")
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), *c.Delta)
+}
+
+func TestOTLPMetricsErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		storage     storage.Storager
+		contentType string
+		body        string
+		code        int
+	}{
+		{name: "protobuf", contentType: "application/x-protobuf", body: "", code: http.StatusUnsupportedMediaType},
+		{name: "invalid json", contentType: "application/json", body: `{"resourceMetrics":`, code: http.StatusBadRequest},
+		{name: "full success", contentType: "application/json; charset=utf-8", body: `{"resourceMetrics":[]}`, code: http.StatusOK},
+		{
+			name:        "storage unavailable",
+			storage:     &failingStorage{InMemoryStorage: storage.NewInMemoryStorage(), err: storage.ErrUnavailable},
+			contentType: "application/json",
+			body:        otlpBody,
+			code:        http.StatusServiceUnavailable,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := tt.storage
+			if s == nil {
+				s = storage.NewInMemoryStorage()
+			}
+			ts := httptest.NewServer(CreateRouter(s, nil))
+			defer ts.Close()
+			res := postOTLP(t, ts, tt.contentType, []byte(tt.body), false)
+			defer res.Body.Close()
+			assert.Equal(t, tt.code, res.StatusCode)
+			assert.Equal(t, "application/json", res.Header.Get("Content-Type"))
+			if tt.code == http.StatusOK {
+				var resp otlp.ExportResponse
+				require.NoError(t, json.NewDecoder(res.Body).Decode(&resp))
+				assert.Nil(t, resp.PartialSuccess)
+				return
+			}
+			var status otlp.Status
+			require.NoError(t, json.NewDecoder(res.Body).Decode(&status))
+			assert.NotEmpty(t, status.Message)
+		})
+	}
+}
+
+func TestOTLPMetricsRetryAfterStoreError(t *testing.T) {
+	s := &failingStorage{InMemoryStorage: storage.NewInMemoryStorage(), err: storage.ErrUnavailable}
+	ts := httptest.NewServer(CreateRouter(s, nil))
+	defer ts.Close()
+	cumulative := func(value string) []byte {
+		return []byte(`{"resourceMetrics":[{"scopeMetrics":[{"metrics":[{"name":"bytes","sum":{"aggregationTemporality":2,"isMonotonic":true,` +
+			`"dataPoints":[{"startTimeUnixNano":"1","asInt":"` + value + `"}]}}]}]}]}`)
+	}
+	s.err = nil
+	res := postOTLP(t, ts, "application/json", cumulative("10"), false)
+	res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+
+	s.err = storage.ErrUnavailable
+	res = postOTLP(t, ts, "application/json", cumulative("25"), false)
+	res.Body.Close()
+	require.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+
+	// повтор после ошибки хранилища сохраняет приращение, а не теряет его
+	s.err = nil
+	res = postOTLP(t, ts, "application/json", cumulative("25"), false)
+	res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	c, err := s.GetCounter(context.TODO(), "bytes")
+	require.NoError(t, err)
+	assert.Equal(t, int64(15), *c.Delta)
+}
+
+// slowStorage хранилище с задержкой сохранения, расширяющей окно гонки между запросами
+type slowStorage struct {
+	*storage.InMemoryStorage
+}
+
+func (s *slowStorage) Store(ctx context.Context, metric ...data.Metric) error {
+	time.Sleep(5 * time.Millisecond)
+	return s.InMemoryStorage.Store(ctx, metric...)
+}
+
+func TestOTLPMetricsConcurrent(t *testing.T) {
+	store := &slowStorage{InMemoryStorage: storage.NewInMemoryStorage()}
+	ts := httptest.NewServer(CreateRouter(store, nil))
+	defer ts.Close()
+	point := func(value string) []byte {
+		return []byte(`{"resourceMetrics":[{"scopeMetrics":[{"metrics":[{"name":"bytes","sum":{"aggregationTemporality":2,"isMonotonic":true,` +
+			`"dataPoints":[{"startTimeUnixNano":"1","asInt":"` + value + `"}]}}]}]}]}`)
+	}
+	res := postOTLP(t, ts, "application/json", point("100"), false)
+	res.Body.Close()
+
+	// одна и та же накопительная точка из нескольких запросов дает приращение один раз
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res := postOTLP(t, ts, "application/json", point("130"), false)
+			res.Body.Close()
+			assert.Equal(t, http.StatusOK, res.StatusCode)
+		}()
+	}
+	wg.Wait()
+
+	c, err := store.GetCounter(context.TODO(), "bytes")
+	require.NoError(t, err)
+	assert.Equal(t, int64(30), *c.Delta)
+}
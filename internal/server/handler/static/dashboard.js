@@ -0,0 +1,114 @@
+// Поиск по таблице метрик и обновление значений из потока /stream.
+// История значений для графиков хранится только на странице.
+(function () {
+	"use strict";
+
+	var historySize = 60;
+	var table = document.getElementById("metrics");
+	var tbody = table.tBodies[0];
+	var search = document.getElementById("search");
+	var count = document.getElementById("count");
+	var empty = document.getElementById("empty");
+	var rows = new Map();
+
+	function key(id, type) {
+		return type + "\u0000" + id;
+	}
+
+	function track(tr) {
+		var value = Number(tr.dataset.value);
+		var row = {
+			tr: tr,
+			type: tr.dataset.type,
+			value: value,
+			history: isNaN(value) ? [] : [value],
+		};
+		rows.set(key(tr.dataset.id, tr.dataset.type), row);
+		draw(row);
+		return row;
+	}
+
+	function createRow(id, type) {
+		var tr = document.createElement("tr");
+		tr.dataset.id = id;
+		tr.dataset.type = type;
+		tr.innerHTML =
+			'<td class="name"></td><td><span class="badge"></span></td>' +
+			'<td class="num value"></td><td class="updated"></td>' +
+			'<td class="spark"><svg viewBox="0 0 100 20" preserveAspectRatio="none"><polyline points=""></polyline></svg></td>';
+		tr.querySelector(".name").textContent = id;
+		var badge = tr.querySelector(".badge");
+		badge.textContent = type;
+		badge.classList.add("badge-" + type);
+		tbody.appendChild(tr);
+		var row = track(tr);
+		applySearch();
+		return row;
+	}
+
+	function draw(row) {
+		var h = row.history;
+		var points = "";
+		if (h.length > 1) {
+			var min = Math.min.apply(null, h);
+			var max = Math.max.apply(null, h);
+			var span = max - min || 1;
+			points = h.map(function (v, i) {
+				var x = (i / (historySize - 1)) * 100;
+				var y = 19 - ((v - min) / span) * 18;
+				return x.toFixed(2) + "," + y.toFixed(2);
+			}).join(" ");
+		}
+		row.tr.querySelector("polyline").setAttribute("points", points);
+	}
+
+	function update(metric, time) {
+		var row = rows.get(key(metric.id, metric.type)) || createRow(metric.id, metric.type);
+		// counter приходит накопленной суммой, поэтому пропущенные события не искажают значение
+		row.value = metric.type === "counter" ? metric.delta : metric.value;
+		row.history.push(row.value);
+		if (row.history.length > historySize) {
+			row.history.shift();
+		}
+		row.tr.querySelector(".value").textContent = String(row.value);
+		var updated = row.tr.querySelector(".updated");
+		var t = new Date(time);
+		var el = document.createElement("time");
+		el.dateTime = t.toISOString();
+		el.textContent = t.toLocaleTimeString();
+		updated.replaceChildren(el);
+		draw(row);
+	}
+
+	function applySearch() {
+		var q = search.value.trim().toLowerCase();
+		var visible = 0;
+		rows.forEach(function (row) {
+			var show = q === "" || row.tr.dataset.id.toLowerCase().indexOf(q) !== -1;
+			row.tr.hidden = !show;
+			if (show) {
+				visible++;
+			}
+		});
+		count.textContent = String(visible);
+		empty.hidden = visible > 0;
+	}
+
+	Array.prototype.forEach.call(tbody.rows, track);
+	search.addEventListener("input", applySearch);
+
+	if (table.dataset.live === "true" && window.EventSource) {
+		var live = document.getElementById("live");
+		var source = new EventSource("/stream");
+		source.addEventListener("open", function () {
+			live.hidden = false;
+		});
+		source.addEventListener("error", function () {
+			live.hidden = true;
+		});
+		source.addEventListener("metric", function (e) {
+			var event = JSON.parse(e.data);
+			update(event.metric, event.time);
+		});
+	}
+})();
@@ -0,0 +1,212 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"math"
+	"time"
+
+	"github.com/megaded/metrictmr/internal/data"
+	"github.com/megaded/metrictmr/internal/logger"
+	"github.com/megaded/metrictmr/internal/server/handler/config"
+	bolt "go.etcd.io/bbolt"
+	berrors "go.etcd.io/bbolt/errors"
+)
+
+// boltOpenTimeout ожидание блокировки файла другим процессом
+const boltOpenTimeout = 5 * time.Second
+
+var (
+	boltGauges   = []byte(gauge)
+	boltCounters = []byte(counter)
+)
+
+// BoltStorage хранит метрики во встроенной базе bbolt.
+// Каждый вызов Store выполняется в одной транзакции: пакет применяется целиком или не применяется.
+//
+// Метрики лежат в двух бакетах по типу, ключ - имя метрики.
+// Значение - 8 байт (биты float64 для gauge, int64 для counter). Пустые значения, записанные
+// до запрета метрик без значения, считаются отсутствующими.
+type BoltStorage struct {
+	db *bolt.DB
+	// closed закрывается после закрытия базы по отмене контекста
+	closed chan struct{}
+}
+
+func NewBoltStorage(ctx context.Context, cfg config.Config) *BoltStorage {
+	db, err := bolt.Open(cfg.BoltPath, 0o600, &bolt.Options{Timeout: boltOpenTimeout})
+	if err != nil {
+		logger.Log.Fatal(err.Error())
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(boltGauges); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(boltCounters)
+		return err
+	})
+	if err != nil {
+		logger.Log.Fatal(err.Error())
+	}
+	s := &BoltStorage{db: db, closed: make(chan struct{})}
+	go func() {
+		<-ctx.Done()
+		if err := db.Close(); err != nil {
+			logger.Log.Error(err.Error())
+		}
+		close(s.closed)
+	}()
+	return s
+}
+
+// Closed закрывается, когда база закрыта и файл можно открыть снова
+func (s *BoltStorage) Closed() <-chan struct{} {
+	return s.closed
+}
+
+func (s *BoltStorage) GetGauge(ctx context.Context, name string) (data.Metric, error) {
+	return s.get(ctx, gauge, name)
+}
+
+func (s *BoltStorage) GetCounter(ctx context.Context, name string) (data.Metric, error) {
+	return s.get(ctx, counter, name)
+}
+
+func (s *BoltStorage) get(ctx context.Context, mType string, name string) (data.Metric, error) {
+	if err := ctx.Err(); err != nil {
+		return data.Metric{}, ctxError(err)
+	}
+	var metric data.Metric
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var ok bool
+		metric, ok = decodeBoltMetric(mType, name, tx.Bucket([]byte(mType)).Get([]byte(name)))
+		if !ok {
+			return notFound(mType, name)
+		}
+		return nil
+	})
+	return metric, boltError(err)
+}
+
+func (s *BoltStorage) Store(ctx context.Context, metric ...data.Metric) error {
+	if err := validateBatch(metric); err != nil {
+		return err
+	}
+	if len(metric) == 0 {
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return ctxError(err)
+	}
+	return boltError(s.db.Update(func(tx *bolt.Tx) error {
+		gauges := tx.Bucket(boltGauges)
+		counters := tx.Bucket(boltCounters)
+		for _, v := range metric {
+			key := []byte(v.ID)
+			if v.MType == gauge {
+				if err := gauges.Put(key, binary.BigEndian.AppendUint64(nil, math.Float64bits(*v.Value))); err != nil {
+					return err
+				}
+				continue
+			}
+			old := counters.Get(key)
+			delta := *v.Delta
+			if len(old) == 8 {
+				delta += int64(binary.BigEndian.Uint64(old))
+			}
+			if err := counters.Put(key, binary.BigEndian.AppendUint64(nil, uint64(delta))); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+}
+
+func (s *BoltStorage) GetMetrics(ctx context.Context) ([]data.Metric, error) {
+	return s.scan(ctx, nil)
+}
+
+// scan читает метрики обоих типов, имена которых начинаются с prefix
+func (s *BoltStorage) scan(ctx context.Context, prefix []byte) ([]data.Metric, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, ctxError(err)
+	}
+	result := make([]data.Metric, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		for _, mType := range []string{counter, gauge} {
+			c := tx.Bucket([]byte(mType)).Cursor()
+			for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+				if m, ok := decodeBoltMetric(mType, string(k), v); ok {
+					result = append(result, m)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, boltError(err)
+	}
+	return result, nil
+}
+
+func (s *BoltStorage) FindMetrics(ctx context.Context, filter MetricFilter) (MetricPage, error) {
+	metrics, err := s.scan(ctx, []byte(filter.Prefix))
+	if err != nil {
+		return MetricPage{}, err
+	}
+	return filterMetrics(metrics, filter)
+}
+
+func (s *BoltStorage) GetMetricsByKeys(ctx context.Context, keys []MetricKey) (map[MetricKey]data.Metric, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, ctxError(err)
+	}
+	result := make(map[MetricKey]data.Metric, len(keys))
+	err := s.db.View(func(tx *bolt.Tx) error {
+		for _, k := range keys {
+			b := tx.Bucket([]byte(k.MType))
+			if b == nil {
+				continue
+			}
+			if m, ok := decodeBoltMetric(k.MType, k.ID, b.Get([]byte(k.ID))); ok {
+				result[k] = m
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, boltError(err)
+	}
+	return result, nil
+}
+
+func (s *BoltStorage) HealthCheck(ctx context.Context) bool {
+	return s.db.View(func(tx *bolt.Tx) error { return nil }) == nil
+}
+
+// boltError закрытая база означает недоступность хранилища
+func boltError(err error) error {
+	if errors.Is(err, berrors.ErrDatabaseNotOpen) {
+		return unavailable(err)
+	}
+	return err
+}
+
+// decodeBoltMetric разбирает значение метрики, false - значения нет
+func decodeBoltMetric(mType string, name string, v []byte) (data.Metric, bool) {
+	m := data.Metric{ID: name, MType: mType}
+	if len(v) != 8 {
+		return m, false
+	}
+	bits := binary.BigEndian.Uint64(v)
+	if mType == gauge {
+		value := math.Float64frombits(bits)
+		m.Value = &value
+	} else {
+		delta := int64(bits)
+		m.Delta = &delta
+	}
+	return m, true
+}
@@ -0,0 +1,50 @@
+package storage
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/megaded/metrictmr/internal/data"
+	"github.com/megaded/metrictmr/internal/server/handler/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestBoltStorage_Reopen(t *testing.T) {
+	cfg := config.Config{BoltPath: filepath.Join(t.TempDir(), "metrics.db")}
+	var delta int64 = 3
+	var value float64 = 2.5
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := NewBoltStorage(ctx, cfg)
+	require.NoError(t, s.Store(ctx,
+		data.Metric{ID: "PollCount", MType: data.MTypeCounter, Delta: &delta},
+		data.Metric{ID: "PollCount", MType: data.MTypeCounter, Delta: &delta},
+		data.Metric{ID: "Alloc", MType: data.MTypeGauge, Value: &value},
+	))
+	// пустое значение из прежних версий считается отсутствующим
+	require.NoError(t, s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltGauges).Put([]byte("Empty"), []byte{})
+	}))
+	cancel()
+	<-s.Closed()
+
+	reopened := NewBoltStorage(testContext(t), cfg)
+	assert.Equal(t, int64(6), counterValue(t, reopened, "PollCount"))
+	g, err := reopened.GetGauge(context.TODO(), "Alloc")
+	require.NoError(t, err)
+	assert.Equal(t, value, *g.Value)
+	_, err = reopened.GetGauge(context.TODO(), "Empty")
+	assert.ErrorIs(t, err, ErrNotFound)
+	metrics, err := reopened.GetMetrics(context.TODO())
+	require.NoError(t, err)
+	assert.Len(t, metrics, 2)
+}
+
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	return ctx
+}
@@ -0,0 +1,64 @@
+package storage_test
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"github.com/megaded/metrictmr/internal/server/handler/config"
+	"github.com/megaded/metrictmr/internal/server/handler/storage"
+	"github.com/megaded/metrictmr/internal/server/handler/storage/storagetest"
+	"github.com/stretchr/testify/require"
+)
+
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func TestConformance_InMemory(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storager {
+		return storage.NewInMemoryStorage()
+	})
+}
+
+func TestConformance_File(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storager {
+		interval := 3600
+		restore := true
+		return storage.NewFileStorage(testContext(t), config.Config{
+			FilePath:      filepath.Join(t.TempDir(), "metrics.json"),
+			StoreInterval: &interval,
+			Restore:       &restore,
+			WALSync:       storage.WALSyncNone,
+		})
+	})
+}
+
+func TestConformance_Postgres(t *testing.T) {
+	dsn := storagetest.PostgresDSN(t)
+	db, err := sql.Open("pgx", dsn)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	storagetest.Run(t, func(t *testing.T) storage.Storager {
+		s := storage.NewPgStorage(testContext(t), config.Config{DBConnString: dsn})
+		_, err := db.Exec("truncate table metrics")
+		require.NoError(t, err)
+		return s
+	})
+}
+
+func TestConformance_Bolt(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storager {
+		return storage.NewBoltStorage(testContext(t), config.Config{BoltPath: filepath.Join(t.TempDir(), "metrics.db")})
+	})
+}
+
+func TestConformance_SQLite(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storager {
+		dsn := storage.SQLiteScheme + filepath.Join(t.TempDir(), "metrics.db")
+		return storage.NewSQLiteStorage(testContext(t), config.Config{DBConnString: dsn})
+	})
+}
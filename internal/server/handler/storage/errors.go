@@ -0,0 +1,60 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/megaded/metrictmr/internal/data"
+)
+
+// Типы ошибок хранилища. Реализации оборачивают в них исходную ошибку,
+// проверка выполняется через errors.Is.
+var (
+	// ErrNotFound метрика не найдена
+	ErrNotFound = errors.New("metric not found")
+	// ErrInvalid некорректная метрика или параметры запроса
+	ErrInvalid = errors.New("invalid argument")
+	// ErrUnavailable хранилище временно недоступно, запрос можно повторить
+	ErrUnavailable = errors.New("storage unavailable")
+)
+
+// unavailable оборачивает ошибку в ErrUnavailable
+func unavailable(err error) error {
+	if err == nil || errors.Is(err, ErrUnavailable) {
+		return err
+	}
+	return fmt.Errorf("%w: %w", ErrUnavailable, err)
+}
+
+// ctxError оборачивает отмену и истечение контекста в ErrUnavailable, остальные ошибки не меняет
+func ctxError(err error) error {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return unavailable(err)
+	}
+	return err
+}
+
+// notFound ошибка отсутствия метрики
+func notFound(mType string, name string) error {
+	return fmt.Errorf("%w: %s %s", ErrNotFound, mType, name)
+}
+
+// validateBatch проверяет пакет до записи, чтобы некорректная метрика не привела к частичной записи
+func validateBatch(metrics []data.Metric) error {
+	for _, m := range metrics {
+		if m.ID == "" {
+			return fmt.Errorf("%w: empty metric name", ErrInvalid)
+		}
+		if m.MType != gauge && m.MType != counter {
+			return fmt.Errorf("%w: unknown metric type %q", ErrInvalid, m.MType)
+		}
+		if m.MType == gauge && m.Value == nil {
+			return fmt.Errorf("%w: gauge %s without value", ErrInvalid, m.ID)
+		}
+		if m.MType == counter && m.Delta == nil {
+			return fmt.Errorf("%w: counter %s without delta", ErrInvalid, m.ID)
+		}
+	}
+	return nil
+}
@@ -2,7 +2,6 @@ package storage
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"os"
 	"sync"
@@ -11,86 +10,207 @@ import (
 	"github.com/megaded/metrictmr/internal/data"
 	"github.com/megaded/metrictmr/internal/logger"
 	"github.com/megaded/metrictmr/internal/retry"
+	"github.com/megaded/metrictmr/internal/selfmetric"
 	"github.com/megaded/metrictmr/internal/server/handler/config"
+	"go.uber.org/zap"
 )
 
+const (
+	// defaultSnapshotInterval период снимка, если STORE_INTERVAL равен 0
+	defaultSnapshotInterval = 5 * time.Minute
+	walSyncPeriod           = time.Second
+	walSuffix               = ".wal"
+	// DefaultSnapshotGenerations количество хранимых поколений снимка
+	DefaultSnapshotGenerations = 3
+
+	selfMetricRestoreDataLoss = "FileStorageRestoreDataLoss"
+)
+
+// FileStorage хранит метрики в памяти, каждая операция Store пишется в журнал (WAL).
+// Периодически пишется снимок всех метрик, после чего начинается новый журнал. Журналы
+// хранятся, пока хранится предыдущее им поколение снимка, поэтому при восстановлении
+// из старого поколения изменения до более нового снимка не теряются.
 type FileStorage struct {
 	m        Storager
 	filePath string
 	internal int
 	restore  bool
 	retry    retry.Retry
+	wal      *wal
+	// format кодирование снимка: json или binary
+	format      string
+	generations int
+	// mu упорядочивает запись в журнал и память относительно снимка
+	mu sync.Mutex
 }
 
-func (s *FileStorage) GetGauge(name string) (metric data.Metric, exist bool, err error) {
-	return s.m.GetGauge(name)
+func (s *FileStorage) GetGauge(ctx context.Context, name string) (data.Metric, error) {
+	return s.m.GetGauge(ctx, name)
 }
 func (s *FileStorage) Store(ctx context.Context, metric ...data.Metric) error {
-	err := s.m.Store(ctx, metric...)
-	if err != nil {
+	if err := validateBatch(metric); err != nil {
 		return err
 	}
-	if s.internal == 0 {
-		return s.persistData(ctx)
+	if err := ctx.Err(); err != nil {
+		return ctxError(err)
 	}
-	return nil
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.wal.append(metric); err != nil {
+		return unavailable(err)
+	}
+	return s.m.Store(ctx, metric...)
+}
+
+func (s *FileStorage) GetCounter(ctx context.Context, name string) (data.Metric, error) {
+	return s.m.GetCounter(ctx, name)
 }
 
-func (s *FileStorage) GetCounter(name string) (metric data.Metric, exist bool, err error) {
-	return s.m.GetCounter(name)
+func (s *FileStorage) GetMetrics(ctx context.Context) ([]data.Metric, error) {
+	return s.m.GetMetrics(ctx)
 }
 
-func (s *FileStorage) GetMetrics() ([]data.Metric, error) {
-	return s.m.GetMetrics()
+func (s *FileStorage) FindMetrics(ctx context.Context, filter MetricFilter) (MetricPage, error) {
+	return s.m.FindMetrics(ctx, filter)
 }
-func (s *FileStorage) HealthCheck() bool {
+
+func (s *FileStorage) GetMetricsByKeys(ctx context.Context, keys []MetricKey) (map[MetricKey]data.Metric, error) {
+	return s.m.GetMetricsByKeys(ctx, keys)
+}
+
+func (s *FileStorage) HealthCheck(ctx context.Context) bool {
 	return true
 }
 
 func NewFileStorage(ctx context.Context, cfg config.Config) *FileStorage {
-	fs := FileStorage{m: NewInMemoryStorage(), internal: *cfg.StoreInterval, filePath: cfg.FilePath, restore: *cfg.Restore, retry: retry.NewRetry(1, 2, 3)}
-	if fs.internal != 0 {
-		go func() {
-			timer := time.NewTicker(time.Duration(*cfg.StoreInterval * int(time.Second)))
-			for {
-				select {
-				case <-ctx.Done():
-					return
-				case <-timer.C:
-					var mutex sync.Mutex
-					mutex.Lock()
-					fs.persistData(ctx)
-					mutex.Unlock()
-				}
-			}
-		}()
+	fs := FileStorage{m: NewInMemoryStorage(), internal: *cfg.StoreInterval, filePath: cfg.FilePath, restore: *cfg.Restore, retry: retry.NewRetry(time.Second, 5*time.Second, 3)}
+	policy, err := ParseWALSync(cfg.WALSync)
+	if err != nil {
+		logger.Log.Fatal(err.Error())
 	}
+	fs.format, err = ParseSnapshotFormat(cfg.SnapshotFormat)
+	if err != nil {
+		logger.Log.Fatal(err.Error())
+	}
+	fs.generations = DefaultSnapshotGenerations
+	if cfg.SnapshotGenerations != nil && *cfg.SnapshotGenerations > 0 {
+		fs.generations = *cfg.SnapshotGenerations
+	}
+	seq, generation := fs.restoreStorage(ctx)
+	var replay *journalReplay
+	var apply walApply
 	if fs.restore {
-		fs.restoreStorage(ctx)
+		replay = &journalReplay{next: seq + 1, store: func(metrics []data.Metric) error {
+			return fs.m.Store(ctx, metrics...)
+		}}
+		apply = replay.apply
+		if seq, err = fs.replaySegments(seq, generation, replay); err != nil {
+			logger.Log.Fatal(err.Error())
+		}
+	} else if err = rotateWAL(fs.filePath + walSuffix); err != nil {
+		logger.Log.Fatal(err.Error())
+	}
+	fs.wal, err = openWAL(fs.filePath+walSuffix, policy, seq, apply)
+	if err != nil {
+		logger.Log.Fatal(err.Error())
 	}
+	if replay != nil && replay.lost {
+		selfmetric.Default.Counter(selfMetricRestoreDataLoss).Inc()
+		logger.Log.Error("snapshot restore: journal records are missing, updates after the restored snapshot are lost",
+			zap.Int("generation", generation))
+	}
+
+	interval := time.Duration(fs.internal) * time.Second
+	if interval == 0 {
+		interval = defaultSnapshotInterval
+	}
+	go func() {
+		snapshotTimer := time.NewTicker(interval)
+		defer snapshotTimer.Stop()
+		syncTimer := time.NewTicker(walSyncPeriod)
+		defer syncTimer.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				if err := fs.wal.close(); err != nil {
+					logger.Log.Error("wal close", zap.Error(err))
+				}
+				return
+			case <-syncTimer.C:
+				if policy != WALSyncInterval {
+					continue
+				}
+				if err := fs.wal.sync(); err != nil {
+					logger.Log.Error("wal sync", zap.Error(err))
+				}
+			case <-snapshotTimer.C:
+				if err := fs.persistData(ctx); err != nil {
+					logger.Log.Error("snapshot", zap.Error(err))
+				}
+			}
+		}
+	}()
 	return &fs
 }
 
-func (s FileStorage) restoreStorage(ctx context.Context) {
-	var metrics []data.Metric
-	data, err := os.ReadFile(s.filePath)
+// restoreStorage загружает снимок и возвращает номер последней вошедшей в него записи журнала
+// и номер поколения снимка. Если восстановление выключено, метрики не загружаются.
+func (s *FileStorage) restoreStorage(ctx context.Context) (uint64, int) {
+	snap, generation, err := readSnapshotFile(s.filePath, s.generations)
 	if err != nil {
-		logger.Log.Info(err.Error())
-		return
+		if !errors.Is(err, os.ErrNotExist) {
+			logger.Log.Error("snapshot restore", zap.Error(err))
+		}
+		return 0, 0
+	}
+	if s.restore {
+		if err = s.m.Store(ctx, snap.Metrics...); err != nil {
+			logger.Log.Info(err.Error())
+		}
 	}
+	return snap.WALSeq, generation
+}
 
-	err = json.Unmarshal(data, &metrics)
-	if err != nil {
-		logger.Log.Info(err.Error())
-		return
+// replaySegments воспроизводит сегменты журнала от поколения загруженного снимка к новым
+// и возвращает номер последней записи. Для текущего поколения сегменты не нужны.
+func (s *FileStorage) replaySegments(seq uint64, generation int, replay *journalReplay) (uint64, error) {
+	for n := generation; n > 0; n-- {
+		last, err := replaySegment(segmentPath(s.filePath+walSuffix, n), seq, replay.apply)
+		if errors.Is(err, os.ErrNotExist) {
+			replay.lost = true
+			continue
+		}
+		if err != nil {
+			return seq, err
+		}
+		seq = max(seq, last)
 	}
-	for _, m := range metrics {
-		s.Store(ctx, m)
+	return seq, nil
+}
+
+// journalReplay применяет записи журнала при восстановлении. Записи после снимка должны
+// идти подряд: пропуск номера означает, что часть изменений потеряна.
+type journalReplay struct {
+	store func(metrics []data.Metric) error
+	next  uint64
+	lost  bool
+}
+
+func (r *journalReplay) apply(seq uint64, metrics []data.Metric) error {
+	if seq != r.next {
+		r.lost = true
 	}
+	r.next = seq + 1
+	return r.store(metrics)
 }
 
+// persistData пишет снимок метрик и начинает новый сегмент журнала.
+// Под блокировкой снимаются только метрики и позиция журнала, запись файла идет без нее.
 func (s *FileStorage) persistData(ctx context.Context) error {
-	metrics, err := s.m.GetMetrics()
+	s.mu.Lock()
+	metrics, err := s.m.GetMetrics(ctx)
+	mark := s.wal.mark()
+	s.mu.Unlock()
 	if err != nil {
 		return err
 	}
@@ -98,29 +218,16 @@ func (s *FileStorage) persistData(ctx context.Context) error {
 	if len(metrics) == 0 {
 		return nil
 	}
-	data, err := json.Marshal(metrics)
+	content, err := encodeSnapshot(snapshot{WALSeq: mark.seq, Metrics: metrics}, s.format)
 	if err != nil {
 		logger.Log.Info(err.Error())
 		return err
 	}
-	file, err := os.Create(s.filePath)
+	err = s.retry.Do(ctx, func(context.Context) error {
+		return writeSnapshotFile(s.filePath, content, s.generations)
+	})
 	if err != nil {
-		logger.Log.Info(err.Error())
 		return err
 	}
-
-	defer file.Close()
-	action := func() error {
-		d, err := file.Write(data)
-		if err != nil {
-			return err
-		}
-		if d != len(data) {
-			return errors.New("invalid write data")
-		}
-		defer file.Close()
-		return nil
-	}
-	fn := s.retry.Retry(ctx, action)
-	return fn()
+	return s.wal.rotate(s.generations-1, mark)
 }
@@ -0,0 +1,197 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/megaded/metrictmr/internal/data"
+	"github.com/megaded/metrictmr/internal/selfmetric"
+	"github.com/megaded/metrictmr/internal/server/handler/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestFileStorage(t *testing.T, path string) *FileStorage {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	return newFileStorageWithContext(ctx, path, true)
+}
+
+func newFileStorageWithContext(ctx context.Context, path string, restore bool) *FileStorage {
+	interval := 3600
+	return NewFileStorage(ctx, config.Config{FilePath: path, StoreInterval: &interval, Restore: &restore, WALSync: WALSyncAlways})
+}
+
+func counterValue(t *testing.T, s Storager, name string) int64 {
+	t.Helper()
+	m, err := s.GetCounter(context.TODO(), name)
+	require.NoError(t, err)
+	return *m.Delta
+}
+
+func TestFileStorage_WAL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	var delta int64 = 2
+	var value float64 = 1.5
+	counter := data.Metric{ID: "PollCount", MType: data.MTypeCounter, Delta: &delta}
+
+	s := newTestFileStorage(t, path)
+	require.NoError(t, s.Store(context.TODO(), counter))
+	require.NoError(t, s.Store(context.TODO(), counter, data.Metric{ID: "Alloc", MType: data.MTypeGauge, Value: &value}))
+
+	t.Run("replay without snapshot", func(t *testing.T) {
+		restored := newTestFileStorage(t, path)
+		assert.Equal(t, int64(4), counterValue(t, restored, "PollCount"))
+		g, err := restored.GetGauge(context.TODO(), "Alloc")
+		require.NoError(t, err)
+		assert.Equal(t, value, *g.Value)
+	})
+
+	t.Run("snapshot and corrupt tail", func(t *testing.T) {
+		require.NoError(t, s.persistData(context.TODO()))
+		info, err := os.Stat(path + walSuffix)
+		require.NoError(t, err)
+		assert.Zero(t, info.Size())
+
+		require.NoError(t, s.Store(context.TODO(), counter))
+		f, err := os.OpenFile(path+walSuffix, os.O_APPEND|os.O_WRONLY, 0o644)
+		require.NoError(t, err)
+		f.Write([]byte{0, 0, 0, 40, 1, 2, 3, 4, 5})
+		f.Close()
+
+		restored := newTestFileStorage(t, path)
+		assert.Equal(t, int64(6), counterValue(t, restored, "PollCount"))
+		require.NoError(t, restored.Store(context.TODO(), counter))
+		assert.Equal(t, int64(8), counterValue(t, newTestFileStorage(t, path), "PollCount"))
+	})
+}
+
+func TestFileStorage_SnapshotCoversWAL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	var delta int64 = 1
+	s := newTestFileStorage(t, path)
+	require.NoError(t, s.Store(context.TODO(), data.Metric{ID: "c", MType: data.MTypeCounter, Delta: &delta}))
+
+	// снимок записан, но журнал не очищен: записи журнала не должны применяться повторно
+	metrics, _ := s.GetMetrics(context.TODO())
+	content, err := encodeSnapshot(snapshot{WALSeq: s.wal.lastSeq(), Metrics: metrics}, SnapshotFormatJSON)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, content, 0o644))
+
+	assert.Equal(t, int64(1), counterValue(t, newTestFileStorage(t, path), "c"))
+}
+
+func TestFileStorage_LegacySnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	require.NoError(t, os.WriteFile(path, []byte(`[{"id":"c","type":"counter","delta":3}]`), 0o644))
+	assert.Equal(t, int64(3), counterValue(t, newTestFileStorage(t, path), "c"))
+}
+
+func TestFileStorage_NoRestoreKeepsWAL(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "metrics.json")
+	var delta int64 = 2
+	counter := data.Metric{ID: "c", MType: data.MTypeCounter, Delta: &delta}
+	require.NoError(t, newTestFileStorage(t, path).Store(context.TODO(), counter))
+	journal, err := os.ReadFile(path + walSuffix)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := newFileStorageWithContext(ctx, path, false)
+	_, err = s.GetCounter(context.TODO(), "c")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	// журнал, не прочитанный при запуске, переименован, а не удален
+	rotated, err := filepath.Glob(path + walSuffix + ".*")
+	require.NoError(t, err)
+	require.Len(t, rotated, 1)
+	content, err := os.ReadFile(rotated[0])
+	require.NoError(t, err)
+	assert.Equal(t, journal, content)
+	info, err := os.Stat(path + walSuffix)
+	require.NoError(t, err)
+	assert.Zero(t, info.Size())
+}
+
+func TestFileStorage_StoreAfterClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	ctx, cancel := context.WithCancel(context.Background())
+	s := newFileStorageWithContext(ctx, path, true)
+	cancel()
+	var delta int64 = 1
+	counter := data.Metric{ID: "c", MType: data.MTypeCounter, Delta: &delta}
+	require.Eventually(t, func() bool {
+		return errors.Is(s.Store(context.TODO(), counter), ErrUnavailable)
+	}, time.Second, time.Millisecond)
+	_, err := s.wal.append([]data.Metric{counter})
+	assert.ErrorIs(t, err, errWALClosed)
+}
+
+func TestFileStorage_OlderGeneration(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	var delta int64 = 1
+	counter := data.Metric{ID: "c", MType: data.MTypeCounter, Delta: &delta}
+	s := newTestFileStorage(t, path)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, s.Store(context.TODO(), counter))
+		require.NoError(t, s.persistData(context.TODO()))
+	}
+	require.NoError(t, s.Store(context.TODO(), counter))
+
+	// текущий снимок поврежден: предыдущее поколение дополняется сегментом журнала
+	require.NoError(t, os.WriteFile(path, []byte("MTMR garbage"), 0o644))
+	lost := selfmetric.Default.Counter(selfMetricRestoreDataLoss).Value()
+	assert.Equal(t, int64(4), counterValue(t, newTestFileStorage(t, path), "c"))
+	assert.Equal(t, lost, selfmetric.Default.Counter(selfMetricRestoreDataLoss).Value())
+
+	// без сегмента изменения между поколениями потеряны, это учитывается
+	require.NoError(t, os.Remove(segmentPath(path+walSuffix, 1)))
+	assert.Equal(t, int64(3), counterValue(t, newTestFileStorage(t, path), "c"))
+	assert.Equal(t, lost+1, selfmetric.Default.Counter(selfMetricRestoreDataLoss).Value())
+}
+
+func TestFileStorage_StoreDuringSnapshot(t *testing.T) {
+	for _, generations := range []int{1, 3} {
+		t.Run(strconv.Itoa(generations), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "metrics.json")
+			var delta int64 = 1
+			counter := data.Metric{ID: "c", MType: data.MTypeCounter, Delta: &delta}
+			s := newTestFileStorage(t, path)
+			s.generations = generations
+			require.NoError(t, s.Store(context.TODO(), counter))
+
+			// запись, сделанная во время записи файла снимка, в снимок не входит
+			metrics, err := s.GetMetrics(context.TODO())
+			require.NoError(t, err)
+			mark := s.wal.mark()
+			require.NoError(t, s.Store(context.TODO(), counter))
+			content, err := encodeSnapshot(snapshot{WALSeq: mark.seq, Metrics: metrics}, SnapshotFormatJSON)
+			require.NoError(t, err)
+			require.NoError(t, writeSnapshotFile(path, content, generations))
+			require.NoError(t, s.wal.rotate(generations-1, mark))
+
+			seqs := func(path string) []uint64 {
+				var result []uint64
+				_, err := replaySegment(path, 0, func(seq uint64, _ []data.Metric) error {
+					result = append(result, seq)
+					return nil
+				})
+				require.NoError(t, err)
+				return result
+			}
+			assert.Equal(t, []uint64{2}, seqs(path+walSuffix))
+			if generations > 1 {
+				assert.Equal(t, []uint64{1}, seqs(segmentPath(path+walSuffix, 1)))
+			}
+			require.NoError(t, s.Store(context.TODO(), counter))
+			assert.Equal(t, int64(3), counterValue(t, newTestFileStorage(t, path), "c"))
+		})
+	}
+}
@@ -0,0 +1,297 @@
+package storage
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/megaded/metrictmr/internal/data"
+)
+
+const (
+	SortByName = "name"
+	SortByType = "type"
+
+	DefaultPageLimit = 100
+	MaxPageLimit     = 1000
+)
+
+var ErrInvalidCursor = fmt.Errorf("%w: invalid cursor", ErrInvalid)
+
+// MetricFilter параметры выборки списка метрик
+type MetricFilter struct {
+	// Prefix префикс имени метрики
+	Prefix string
+	// Pattern регулярное выражение для имени метрики в синтаксисе Go (RE2).
+	// Допускается общее с регулярными выражениями Postgres подмножество: без флагов (?i),
+	// классов Unicode \pL, \Q...\E и восьмеричных кодов \1-\9.
+	Pattern string
+	// MType тип метрики, пустая строка - все типы
+	MType string
+	// SortBy поле сортировки: name или type
+	SortBy string
+	// Desc сортировка по убыванию
+	Desc bool
+	// Cursor курсор, полученный с предыдущей страницы
+	Cursor string
+	// Limit размер страницы
+	Limit int
+}
+
+// MetricPage страница списка метрик
+type MetricPage struct {
+	Metrics []data.Metric `json:"metrics"`
+	Next    string        `json:"next,omitempty"`
+}
+
+type cursor struct {
+	Name  string `json:"n"`
+	MType string `json:"t"`
+}
+
+func encodeCursor(m data.Metric) string {
+	b, _ := json.Marshal(cursor{Name: m.ID, MType: m.MType})
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(s string) (cursor, error) {
+	var c cursor
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, ErrInvalidCursor
+	}
+	if err = json.Unmarshal(b, &c); err != nil {
+		return c, ErrInvalidCursor
+	}
+	return c, nil
+}
+
+// Normalize проверяет фильтр и подставляет значения по умолчанию
+func (f *MetricFilter) Normalize() error {
+	if f.Limit <= 0 {
+		f.Limit = DefaultPageLimit
+	}
+	if f.Limit > MaxPageLimit {
+		f.Limit = MaxPageLimit
+	}
+	switch f.SortBy {
+	case "":
+		f.SortBy = SortByName
+	case SortByName, SortByType:
+	default:
+		return fmt.Errorf("%w: invalid sort field", ErrInvalid)
+	}
+	if f.MType != "" && f.MType != gauge && f.MType != counter {
+		return fmt.Errorf("%w: invalid metric type", ErrInvalid)
+	}
+	if f.Pattern != "" {
+		if _, err := regexp.Compile(f.Pattern); err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalid, err)
+		}
+		if _, err := postgresPattern(f.Pattern); err != nil {
+			return err
+		}
+	}
+	if f.Cursor != "" {
+		if _, err := decodeCursor(f.Cursor); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// less сравнивает метрики в порядке сортировки фильтра
+func (f *MetricFilter) less(a, b cursor) bool {
+	c := strings.Compare(a.Name, b.Name)
+	if f.SortBy == SortByType {
+		c = strings.Compare(a.MType, b.MType)
+	}
+	if c == 0 {
+		c = strings.Compare(a.Name+"\x00"+a.MType, b.Name+"\x00"+b.MType)
+	}
+	if f.Desc {
+		return c > 0
+	}
+	return c < 0
+}
+
+// filterMetrics применяет фильтр к полному списку метрик.
+// Используется хранилищами, которые не умеют фильтровать на своей стороне.
+func filterMetrics(metrics []data.Metric, f MetricFilter) (MetricPage, error) {
+	if err := f.Normalize(); err != nil {
+		return MetricPage{}, err
+	}
+	var re *regexp.Regexp
+	if f.Pattern != "" {
+		re = regexp.MustCompile(f.Pattern)
+	}
+	var after *cursor
+	if f.Cursor != "" {
+		c, _ := decodeCursor(f.Cursor)
+		after = &c
+	}
+	result := make([]data.Metric, 0)
+	for _, m := range metrics {
+		if f.MType != "" && m.MType != f.MType {
+			continue
+		}
+		if !strings.HasPrefix(m.ID, f.Prefix) {
+			continue
+		}
+		if re != nil && !re.MatchString(m.ID) {
+			continue
+		}
+		if after != nil && !f.less(*after, cursor{Name: m.ID, MType: m.MType}) {
+			continue
+		}
+		result = append(result, m)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return f.less(cursor{Name: result[i].ID, MType: result[i].MType}, cursor{Name: result[j].ID, MType: result[j].MType})
+	})
+	return newPage(result, f.Limit), nil
+}
+
+// newPage обрезает выборку до limit, лишняя запись означает наличие следующей страницы
+func newPage(result []data.Metric, limit int) MetricPage {
+	page := MetricPage{Metrics: result}
+	if len(result) > limit {
+		page.Metrics = result[:limit]
+		page.Next = encodeCursor(page.Metrics[limit-1])
+	}
+	return page
+}
+
+// findDialect различия SQL хранилищ в запросе выборки по фильтру
+type findDialect struct {
+	// placeholder формат параметра запроса по номеру
+	placeholder string
+	// collate порядок сравнения строк, совпадающий с порядком курсора
+	collate string
+	// prefix условие на префикс имени
+	prefix func(arg func(any) string, prefix string) string
+	// match условие на регулярное выражение для имени, Pattern уже проверен Normalize
+	match func(arg func(any) string, pattern string) string
+}
+
+// buildFindQuery строит запрос выборки по нормализованному фильтру.
+// Запрос всегда ограничен Limit+1 строками: лишняя строка означает наличие следующей страницы.
+func buildFindQuery(f MetricFilter, d findDialect) (string, []any) {
+	var where []string
+	var args []any
+	arg := func(v any) string {
+		args = append(args, v)
+		return fmt.Sprintf(d.placeholder, len(args))
+	}
+	if f.Prefix != "" {
+		where = append(where, d.prefix(arg, f.Prefix))
+	}
+	if f.Pattern != "" {
+		where = append(where, d.match(arg, f.Pattern))
+	}
+	if f.MType != "" {
+		where = append(where, "m.type = "+arg(f.MType))
+	}
+	cmp, dir := ">", "asc"
+	if f.Desc {
+		cmp, dir = "<", "desc"
+	}
+	order := []string{"m.name" + d.collate, "m.type" + d.collate}
+	if f.SortBy == SortByType {
+		order[0], order[1] = order[1], order[0]
+	}
+	if f.Cursor != "" {
+		c, _ := decodeCursor(f.Cursor)
+		first, second := arg(c.Name), arg(c.MType)
+		if f.SortBy == SortByType {
+			first, second = second, first
+		}
+		where = append(where, fmt.Sprintf("(%s, %s) %s (%s, %s)", order[0], order[1], cmp, first, second))
+	}
+	query := "select m.name, m.type, m.delta, m.value from metrics m"
+	if len(where) > 0 {
+		query += " where " + strings.Join(where, " and ")
+	}
+	query += fmt.Sprintf(" order by %s %s, %s %s", order[0], dir, order[1], dir)
+	query += " limit " + arg(f.Limit+1)
+	return query + ";", args
+}
+
+// postgresPattern переводит проверенное регулярное выражение RE2 в синтаксис Postgres (ARE):
+// \b и \B становятся \y и \Y, \z - \Z, именованные группы - обычными. Конструкции,
+// которых в ARE нет или которые означают в нем другое, отклоняются.
+func postgresPattern(pattern string) (string, error) {
+	unsupported := func(what string) error {
+		return fmt.Errorf("%w: %s is not supported in pattern", ErrInvalid, what)
+	}
+	var b strings.Builder
+	inClass := false
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			e := pattern[i]
+			switch {
+			case e == 'b' && !inClass:
+				b.WriteString(`\y`)
+			case e == 'B':
+				b.WriteString(`\Y`)
+			case e == 'z':
+				b.WriteString(`\Z`)
+			case e == 'p' || e == 'P' || e == 'Q' || e == 'E' || e == 'C':
+				return "", unsupported(`\` + string(e))
+			case e >= '1' && e <= '9':
+				return "", unsupported("octal escape")
+			case e == 'x' && strings.HasPrefix(pattern[i+1:], "{"):
+				return "", unsupported(`\x{...}`)
+			default:
+				b.WriteByte('\\')
+				b.WriteByte(e)
+			}
+		case inClass:
+			if c == '[' && strings.HasPrefix(pattern[i:], "[:") {
+				end := strings.Index(pattern[i+2:], ":]")
+				if end >= 0 {
+					b.WriteString(pattern[i : i+end+4])
+					i += end + 3
+					continue
+				}
+			}
+			if c == ']' {
+				inClass = false
+			}
+			b.WriteByte(c)
+		case c == '[':
+			inClass = true
+			b.WriteByte(c)
+			// ] сразу после [ или [^ - символ класса
+			if strings.HasPrefix(pattern[i+1:], "^") {
+				i++
+				b.WriteByte('^')
+			}
+			if strings.HasPrefix(pattern[i+1:], "]") {
+				i++
+				b.WriteByte(']')
+			}
+		case c == '(' && strings.HasPrefix(pattern[i:], "(?"):
+			rest := pattern[i:]
+			switch {
+			case strings.HasPrefix(rest, "(?:"):
+				b.WriteString("(?:")
+				i += 2
+			case strings.HasPrefix(rest, "(?P<"), strings.HasPrefix(rest, "(?<"):
+				b.WriteByte('(')
+				i += strings.IndexByte(rest, '>')
+			default:
+				return "", unsupported("flag group")
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String(), nil
+}
@@ -2,6 +2,9 @@ package storage
 
 import (
 	"context"
+	"math"
+	"sync"
+	"sync/atomic"
 
 	"github.com/megaded/metrictmr/internal/data"
 )
@@ -9,77 +12,172 @@ import (
 const (
 	gauge   = "gauge"
 	counter = "counter"
+
+	// shardCount количество сегментов хранилища, степень двойки
+	shardCount = 64
 )
 
+// cell значение метрики. Для gauge хранит биты float64, для counter - int64.
+// Изменение существующей метрики выполняется атомарно без блокировки сегмента на запись.
+// Новое значение заполняется до добавления в сегмент, поэтому читатели не видят пустых значений.
+type cell struct {
+	bits atomic.Uint64
+}
+
+// shard сегмент хранилища со своей блокировкой
+type shard struct {
+	mu       sync.RWMutex
+	gauges   map[string]*cell
+	counters map[string]*cell
+}
+
+// InMemoryStorage хранилище в памяти, разбитое на сегменты по хэшу имени метрики.
+// Безопасно для конкурентного использования.
 type InMemoryStorage struct {
-	Metrics    map[string]data.Metric
-	gaugeKey   map[string]bool
-	counterKey map[string]bool
+	shards [shardCount]*shard
 }
 
-func (s *InMemoryStorage) GetGauge(name string) (metric data.Metric, exist bool, err error) {
-	metric, exist = s.Metrics[getKey(gauge, name)]
-	return metric, exist, nil
+func (s *InMemoryStorage) GetGauge(ctx context.Context, name string) (data.Metric, error) {
+	c, exist := s.shard(name).get(gauge, name)
+	if !exist {
+		return data.Metric{}, notFound(gauge, name)
+	}
+	return gaugeMetric(name, c), nil
 }
 
 func (s *InMemoryStorage) Store(ctx context.Context, metric ...data.Metric) error {
+	if err := validateBatch(metric); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return ctxError(err)
+	}
 	for _, v := range metric {
-		key := getKey(v.MType, v.ID)
-		if v.MType == gauge {
-			s.Metrics[key] = v
-			s.gaugeKey[key] = true
-		} else {
-			s.storeCounter(v)
+		sh := s.shard(v.ID)
+		switch {
+		case v.MType == gauge && v.Value != nil:
+			bits := math.Float64bits(*v.Value)
+			sh.update(gauge, v.ID, func(c *cell) { c.bits.Store(bits) })
+		case v.MType == counter && v.Delta != nil:
+			delta := uint64(*v.Delta)
+			sh.update(counter, v.ID, func(c *cell) { c.bits.Add(delta) })
 		}
 	}
 	return nil
 }
 
-func (s *InMemoryStorage) GetCounter(name string) (metric data.Metric, exist bool, err error) {
-	metric, exist = s.Metrics[getKey(counter, name)]
-	return metric, exist, nil
+func (s *InMemoryStorage) GetCounter(ctx context.Context, name string) (data.Metric, error) {
+	c, exist := s.shard(name).get(counter, name)
+	if !exist {
+		return data.Metric{}, notFound(counter, name)
+	}
+	return counterMetric(name, c), nil
 }
 
 func NewInMemoryStorage() *InMemoryStorage {
-	return &InMemoryStorage{Metrics: map[string]data.Metric{}, gaugeKey: map[string]bool{}, counterKey: map[string]bool{}}
+	s := &InMemoryStorage{}
+	for i := range s.shards {
+		s.shards[i] = &shard{gauges: map[string]*cell{}, counters: map[string]*cell{}}
+	}
+	return s
 }
 
-func (s *InMemoryStorage) GetMetrics() ([]data.Metric, error) {
+func (s *InMemoryStorage) GetMetrics(ctx context.Context) ([]data.Metric, error) {
 	result := make([]data.Metric, 0)
-	for k := range s.counterKey {
-		m, ok := s.Metrics[k]
-		if ok {
-			result = append(result, m)
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		for name, c := range sh.counters {
+			result = append(result, counterMetric(name, c))
 		}
+		for name, c := range sh.gauges {
+			result = append(result, gaugeMetric(name, c))
+		}
+		sh.mu.RUnlock()
+	}
+	return result, nil
+}
 
+func (s *InMemoryStorage) FindMetrics(ctx context.Context, filter MetricFilter) (MetricPage, error) {
+	metrics, err := s.GetMetrics(ctx)
+	if err != nil {
+		return MetricPage{}, err
 	}
-	for k := range s.gaugeKey {
-		m, ok := s.Metrics[k]
-		if ok {
-			result = append(result, m)
-		}
+	return filterMetrics(metrics, filter)
+}
 
+func (s *InMemoryStorage) GetMetricsByKeys(ctx context.Context, keys []MetricKey) (map[MetricKey]data.Metric, error) {
+	result := make(map[MetricKey]data.Metric, len(keys))
+	for _, k := range keys {
+		c, ok := s.shard(k.ID).get(k.MType, k.ID)
+		if !ok {
+			continue
+		}
+		if k.MType == gauge {
+			result[k] = gaugeMetric(k.ID, c)
+		} else {
+			result[k] = counterMetric(k.ID, c)
+		}
 	}
 	return result, nil
 }
 
-func (s *InMemoryStorage) HealthCheck() bool {
+func (s *InMemoryStorage) HealthCheck(ctx context.Context) bool {
 	return true
 }
 
-func (s *InMemoryStorage) storeCounter(metric data.Metric) {
-	key := getKey(counter, metric.ID)
-	v, ok := s.Metrics[key]
-	if ok {
-		newValue := *v.Delta + *metric.Delta
-		v.Delta = &newValue
-		s.Metrics[key] = v
-	} else {
-		s.Metrics[key] = metric
+// shard сегмент для имени метрики, хэш FNV-1a
+func (s *InMemoryStorage) shard(name string) *shard {
+	var h uint32 = 2166136261
+	for i := 0; i < len(name); i++ {
+		h ^= uint32(name[i])
+		h *= 16777619
+	}
+	return s.shards[h&(shardCount-1)]
+}
+
+func (sh *shard) values(mType string) map[string]*cell {
+	if mType == gauge {
+		return sh.gauges
+	}
+	if mType == counter {
+		return sh.counters
+	}
+	return nil
+}
+
+func (sh *shard) get(mType string, name string) (*cell, bool) {
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	c, ok := sh.values(mType)[name]
+	return c, ok
+}
+
+// update изменяет значение метрики. Новое значение создается и заполняется под блокировкой
+// сегмента на запись до того, как станет видно читателям.
+func (sh *shard) update(mType string, name string, apply func(c *cell)) {
+	if c, ok := sh.get(mType, name); ok {
+		apply(c)
+		return
+	}
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	values := sh.values(mType)
+	c, ok := values[name]
+	if !ok {
+		c = &cell{}
+		apply(c)
+		values[name] = c
+		return
 	}
-	s.counterKey[key] = true
+	apply(c)
+}
+
+func gaugeMetric(name string, c *cell) data.Metric {
+	v := math.Float64frombits(c.bits.Load())
+	return data.Metric{ID: name, MType: gauge, Value: &v}
 }
 
-func getKey(mType string, name string) string {
-	return mType + name
+func counterMetric(name string, c *cell) data.Metric {
+	v := int64(c.bits.Load())
+	return data.Metric{ID: name, MType: counter, Delta: &v}
 }
@@ -2,7 +2,10 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"reflect"
+	"strconv"
+	"sync"
 	"testing"
 
 	"github.com/megaded/metrictmr/internal/data"
@@ -14,7 +17,8 @@ func TestInMemoryStorage_GetGauge(t *testing.T) {
 	}
 	storeWithData := NewInMemoryStorage()
 	metricName := "test"
-	gauge := data.Metric{MType: data.MTypeGauge, ID: metricName}
+	var value float64 = 1.5
+	gauge := data.Metric{MType: data.MTypeGauge, ID: metricName, Value: &value}
 	storeWithData.Store(context.TODO(), gauge)
 	tests := []struct {
 		name       string
@@ -29,16 +33,19 @@ func TestInMemoryStorage_GetGauge(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			gotMetric, gotExist, _ := tt.s.GetGauge(tt.args.name)
-			if !gotExist {
+			gotMetric, err := tt.s.GetGauge(context.TODO(), tt.args.name)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("InMemoryStorage.GetGauge() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if gotExist := !errors.Is(err, ErrNotFound); gotExist != tt.wantExist {
+				t.Errorf("InMemoryStorage.GetGauge() gotExist = %v, want %v", gotExist, tt.wantExist)
+			}
+			if err != nil {
 				return
 			}
 			if !reflect.DeepEqual(gotMetric, tt.wantMetric) {
 				t.Errorf("InMemoryStorage.GetGauge() gotMetric = %v, want %v", gotMetric, tt.wantMetric)
 			}
-			if gotExist != tt.wantExist {
-				t.Errorf("InMemoryStorage.GetGauge() gotExist = %v, want %v", gotExist, tt.wantExist)
-			}
 		})
 	}
 }
@@ -54,7 +61,11 @@ func TestInMemoryStorage_Store(t *testing.T) {
 		args    args
 		wantErr bool
 	}{
-		{"store", NewInMemoryStorage(), args{ctx: context.TODO(), metric: make([]data.Metric, 1)}, false},
+		{"store", NewInMemoryStorage(), args{ctx: context.TODO(), metric: []data.Metric{{ID: "test", MType: data.MTypeGauge, Value: new(float64)}}}, false},
+		{"gauge without value", NewInMemoryStorage(), args{ctx: context.TODO(), metric: []data.Metric{{ID: "test", MType: data.MTypeGauge}}}, true},
+		{"counter without delta", NewInMemoryStorage(), args{ctx: context.TODO(), metric: []data.Metric{{ID: "test", MType: data.MTypeCounter}}}, true},
+		{"empty metric", NewInMemoryStorage(), args{ctx: context.TODO(), metric: make([]data.Metric, 1)}, true},
+		{"unknown type", NewInMemoryStorage(), args{ctx: context.TODO(), metric: []data.Metric{{ID: "test", MType: "histogram"}}}, true},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -71,7 +82,8 @@ func TestInMemoryStorage_GetCounter(t *testing.T) {
 	}
 	storeWithData := NewInMemoryStorage()
 	metricName := "test"
-	counter := data.Metric{MType: data.MTypeGauge, ID: metricName}
+	var delta int64 = 5
+	counter := data.Metric{MType: data.MTypeCounter, ID: metricName, Delta: &delta}
 	storeWithData.Store(context.TODO(), counter)
 	tests := []struct {
 		name       string
@@ -86,16 +98,19 @@ func TestInMemoryStorage_GetCounter(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			gotMetric, gotExist, _ := tt.s.GetCounter(tt.args.name)
-			if gotExist {
+			gotMetric, err := tt.s.GetCounter(context.TODO(), tt.args.name)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("InMemoryStorage.GetCounter() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if gotExist := !errors.Is(err, ErrNotFound); gotExist != tt.wantExist {
+				t.Errorf("InMemoryStorage.GetCounter() gotExist = %v, want %v", gotExist, tt.wantExist)
+			}
+			if err != nil {
 				return
 			}
 			if !reflect.DeepEqual(gotMetric, tt.wantMetric) {
 				t.Errorf("InMemoryStorage.GetCounter() gotMetric = %v, want %v", gotMetric, tt.wantMetric)
 			}
-			if gotExist != tt.wantExist {
-				t.Errorf("InMemoryStorage.GetCounter() gotExist = %v, want %v", gotExist, tt.wantExist)
-			}
 		})
 	}
 }
@@ -103,7 +118,8 @@ func TestInMemoryStorage_GetCounter(t *testing.T) {
 func TestInMemoryStorage_GetMetrics(t *testing.T) {
 	storeWithData := NewInMemoryStorage()
 	metricName := "test"
-	counter := data.Metric{MType: data.MTypeGauge, ID: metricName}
+	var value float64 = 1.5
+	counter := data.Metric{MType: data.MTypeGauge, ID: metricName, Value: &value}
 	storeWithData.Store(context.TODO(), counter)
 	tests := []struct {
 		name    string
@@ -115,7 +131,7 @@ func TestInMemoryStorage_GetMetrics(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := tt.s.GetMetrics()
+			got, err := tt.s.GetMetrics(context.TODO())
 			if (err != nil) != tt.wantErr {
 				t.Errorf("InMemoryStorage.GetMetrics() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -126,3 +142,185 @@ func TestInMemoryStorage_GetMetrics(t *testing.T) {
 		})
 	}
 }
+
+func TestInMemoryStorage_NilPayload(t *testing.T) {
+	s := NewInMemoryStorage()
+	var value float64 = 1
+	s.Store(context.TODO(), data.Metric{ID: "g", MType: data.MTypeGauge, Value: &value})
+	s.Store(context.TODO(),
+		data.Metric{ID: "g", MType: data.MTypeGauge},
+		data.Metric{ID: "c", MType: data.MTypeCounter},
+	)
+
+	g, err := s.GetGauge(context.TODO(), "g")
+	if err != nil || g.Value == nil || *g.Value != value {
+		t.Errorf("InMemoryStorage.GetGauge() = %v, %v, want value %v", g, err, value)
+	}
+	if _, err = s.GetCounter(context.TODO(), "c"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("InMemoryStorage.GetCounter() error = %v, want ErrNotFound", err)
+	}
+	metrics, _ := s.GetMetrics(context.TODO())
+	keys, _ := s.GetMetricsByKeys(context.TODO(), []MetricKey{{ID: "c", MType: counter}})
+	if len(metrics) != 1 || len(keys) != 0 {
+		t.Errorf("InMemoryStorage lists metrics without value: %v, %v", metrics, keys)
+	}
+}
+
+func TestInMemoryStorage_FindMetrics(t *testing.T) {
+	store := NewInMemoryStorage()
+	var delta int64 = 1
+	var value float64 = 1
+	store.Store(context.TODO(),
+		data.Metric{ID: "HeapAlloc", MType: data.MTypeGauge, Value: &value},
+		data.Metric{ID: "HeapSys", MType: data.MTypeGauge, Value: &value},
+		data.Metric{ID: "PollCount", MType: data.MTypeCounter, Delta: &delta},
+		data.Metric{ID: "Alloc", MType: data.MTypeGauge, Value: &value},
+		data.Metric{ID: "Alloc", MType: data.MTypeCounter, Delta: &delta},
+	)
+	ids := func(p MetricPage) []string {
+		result := make([]string, 0, len(p.Metrics))
+		for _, m := range p.Metrics {
+			result = append(result, m.MType+":"+m.ID)
+		}
+		return result
+	}
+	tests := []struct {
+		name    string
+		filter  MetricFilter
+		want    []string
+		wantErr bool
+	}{
+		{"all by name", MetricFilter{}, []string{"counter:Alloc", "gauge:Alloc", "gauge:HeapAlloc", "gauge:HeapSys", "counter:PollCount"}, false},
+		{"by type", MetricFilter{SortBy: SortByType}, []string{"counter:Alloc", "counter:PollCount", "gauge:Alloc", "gauge:HeapAlloc", "gauge:HeapSys"}, false},
+		{"desc", MetricFilter{Desc: true, Limit: 2}, []string{"counter:PollCount", "gauge:HeapSys"}, false},
+		{"prefix", MetricFilter{Prefix: "Heap"}, []string{"gauge:HeapAlloc", "gauge:HeapSys"}, false},
+		{"pattern", MetricFilter{Pattern: "Alloc$"}, []string{"counter:Alloc", "gauge:Alloc", "gauge:HeapAlloc"}, false},
+		{"type", MetricFilter{MType: data.MTypeCounter}, []string{"counter:Alloc", "counter:PollCount"}, false},
+		{"invalid pattern", MetricFilter{Pattern: "("}, nil, true},
+		{"invalid cursor", MetricFilter{Cursor: "!"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := store.FindMetrics(context.TODO(), tt.filter)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("InMemoryStorage.FindMetrics() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(ids(got), tt.want) {
+				t.Errorf("InMemoryStorage.FindMetrics() = %v, want %v", ids(got), tt.want)
+			}
+		})
+	}
+
+	t.Run("pagination", func(t *testing.T) {
+		var got []string
+		filter := MetricFilter{Limit: 2}
+		for i := 0; i < 5; i++ {
+			page, err := store.FindMetrics(context.TODO(), filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, ids(page)...)
+			if page.Next == "" {
+				break
+			}
+			filter.Cursor = page.Next
+		}
+		want := []string{"counter:Alloc", "gauge:Alloc", "gauge:HeapAlloc", "gauge:HeapSys", "counter:PollCount"}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("InMemoryStorage.FindMetrics() pages = %v, want %v", got, want)
+		}
+	})
+}
+
+func TestInMemoryStorage_Concurrent(t *testing.T) {
+	store := NewInMemoryStorage()
+	const workers = 16
+	const iterations = 1000
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			var delta int64 = 1
+			value := float64(w)
+			for i := 0; i < iterations; i++ {
+				store.Store(context.TODO(),
+					data.Metric{ID: "PollCount", MType: data.MTypeCounter, Delta: &delta},
+					data.Metric{ID: "gauge" + strconv.Itoa(i%100), MType: data.MTypeGauge, Value: &value},
+				)
+				if i%100 == 0 {
+					metrics, _ := store.GetMetrics(context.TODO())
+					for _, m := range metrics {
+						// новая метрика видна читателям только со значением
+						if m.Value == nil && m.Delta == nil {
+							t.Errorf("InMemoryStorage.GetMetrics() returned %s without value", m.ID)
+						}
+					}
+				}
+				if m, err := store.GetCounter(context.TODO(), "PollCount"); err == nil && m.Delta == nil {
+					t.Error("InMemoryStorage.GetCounter() returned counter without value")
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	m, err := store.GetCounter(context.TODO(), "PollCount")
+	if err != nil || *m.Delta != workers*iterations {
+		t.Errorf("InMemoryStorage.GetCounter() = %v, want %d", m.Delta, workers*iterations)
+	}
+	metrics, _ := store.GetMetrics(context.TODO())
+	if len(metrics) != 101 {
+		t.Errorf("InMemoryStorage.GetMetrics() len = %d, want 101", len(metrics))
+	}
+}
+
+// Запуск с -cpu=1,2,4,8 показывает масштабирование по ядрам
+func BenchmarkInMemoryStorage_Store(b *testing.B) {
+	store := NewInMemoryStorage()
+	names := make([]string, 1024)
+	for i := range names {
+		names[i] = "metric" + strconv.Itoa(i)
+	}
+	b.RunParallel(func(pb *testing.PB) {
+		var delta int64 = 1
+		value := 1.5
+		i := 0
+		for pb.Next() {
+			name := names[i%len(names)]
+			store.Store(context.TODO(),
+				data.Metric{ID: name, MType: data.MTypeCounter, Delta: &delta},
+				data.Metric{ID: name, MType: data.MTypeGauge, Value: &value},
+			)
+			i++
+		}
+	})
+}
+
+func BenchmarkInMemoryStorage_StoreSameCounter(b *testing.B) {
+	store := NewInMemoryStorage()
+	b.RunParallel(func(pb *testing.PB) {
+		var delta int64 = 1
+		for pb.Next() {
+			store.Store(context.TODO(), data.Metric{ID: "PollCount", MType: data.MTypeCounter, Delta: &delta})
+		}
+	})
+}
+
+func BenchmarkInMemoryStorage_GetGauge(b *testing.B) {
+	store := NewInMemoryStorage()
+	value := 1.5
+	for i := 0; i < 1024; i++ {
+		store.Store(context.TODO(), data.Metric{ID: "metric" + strconv.Itoa(i), MType: data.MTypeGauge, Value: &value})
+	}
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			store.GetGauge(context.TODO(), "metric"+strconv.Itoa(i%1024))
+			i++
+		}
+	})
+}
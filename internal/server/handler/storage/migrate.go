@@ -0,0 +1,242 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/megaded/metrictmr/internal/logger"
+	"go.uber.org/zap"
+)
+
+// migrationLockKey ключ advisory lock, под которым выполняются миграции.
+// Несколько реплик сервера, стартующих одновременно, применяют миграции по очереди.
+const migrationLockKey int64 = 0x6d74_6d72_6d69_67
+
+const createMigrationsTable = `create table if not exists schema_migrations(
+	version bigint primary key,
+	name text not null,
+	applied_at timestamptz not null default now());`
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationName имя файла миграции: 0001_create_metrics.up.sql
+var migrationName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+type migration struct {
+	version int64
+	name    string
+	up      string
+	down    string
+}
+
+// MigrationState состояние миграции в базе
+type MigrationState struct {
+	Version   int64
+	Name      string
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// loadMigrations читает миграции из каталога, упорядочивая их по версии.
+// У каждой версии должен быть up-файл, down-файл необязателен.
+func loadMigrations(fsys fs.FS, dir string) ([]migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int64]*migration)
+	for _, e := range entries {
+		parts := migrationName.FindStringSubmatch(e.Name())
+		if e.IsDir() || parts == nil {
+			continue
+		}
+		version, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s: %w", e.Name(), err)
+		}
+		content, err := fs.ReadFile(fsys, path.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		m, ok := byVersion[version]
+		if !ok {
+			m = &migration{version: version, name: parts[2]}
+			byVersion[version] = m
+		}
+		if m.name != parts[2] {
+			return nil, fmt.Errorf("migration %d has different names: %s, %s", version, m.name, parts[2])
+		}
+		if parts[3] == "up" {
+			m.up = string(content)
+		} else {
+			m.down = string(content)
+		}
+	}
+	result := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.up == "" {
+			return nil, fmt.Errorf("migration %d_%s has no up file", m.version, m.name)
+		}
+		result = append(result, *m)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].version < result[j].version })
+	return result, nil
+}
+
+// MigrateUp применяет все непримененные миграции и возвращает их количество
+func MigrateUp(ctx context.Context, db *sql.DB) (int, error) {
+	migrations, err := loadMigrations(migrationFiles, "migrations")
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	err = withMigrationLock(ctx, db, func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, m := range migrations {
+			if _, ok := applied[m.version]; ok {
+				continue
+			}
+			err = inTx(ctx, conn, func(tx *sql.Tx) error {
+				if _, err := tx.ExecContext(ctx, m.up); err != nil {
+					return err
+				}
+				_, err := tx.ExecContext(ctx, `insert into schema_migrations (version, name) values ($1, $2);`, m.version, m.name)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("migration %d_%s up: %w", m.version, m.name, err)
+			}
+			logger.Log.Info("migration applied", zap.Int64("version", m.version), zap.String("name", m.name))
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
+
+// MigrateDown откатывает steps последних примененных миграций и возвращает их количество
+func MigrateDown(ctx context.Context, db *sql.DB, steps int) (int, error) {
+	migrations, err := loadMigrations(migrationFiles, "migrations")
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	err = withMigrationLock(ctx, db, func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for i := len(migrations) - 1; i >= 0 && count < steps; i-- {
+			m := migrations[i]
+			if _, ok := applied[m.version]; !ok {
+				continue
+			}
+			if m.down == "" {
+				return fmt.Errorf("migration %d_%s has no down file", m.version, m.name)
+			}
+			err = inTx(ctx, conn, func(tx *sql.Tx) error {
+				if _, err := tx.ExecContext(ctx, m.down); err != nil {
+					return err
+				}
+				_, err := tx.ExecContext(ctx, `delete from schema_migrations where version = $1;`, m.version)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("migration %d_%s down: %w", m.version, m.name, err)
+			}
+			logger.Log.Info("migration reverted", zap.Int64("version", m.version), zap.String("name", m.name))
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
+
+// MigrationStatus состояние всех известных миграций
+func MigrationStatus(ctx context.Context, db *sql.DB) ([]MigrationState, error) {
+	migrations, err := loadMigrations(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if _, err = conn.ExecContext(ctx, createMigrationsTable); err != nil {
+		return nil, err
+	}
+	applied, err := appliedMigrations(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]MigrationState, 0, len(migrations))
+	for _, m := range migrations {
+		at, ok := applied[m.version]
+		result = append(result, MigrationState{Version: m.version, Name: m.name, Applied: ok, AppliedAt: at})
+	}
+	return result, nil
+}
+
+// withMigrationLock выполняет fn на одном соединении под advisory lock
+func withMigrationLock(ctx context.Context, db *sql.DB, fn func(conn *sql.Conn) error) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err = conn.ExecContext(ctx, `select pg_advisory_lock($1);`, migrationLockKey); err != nil {
+		return err
+	}
+	defer func() {
+		if _, err := conn.ExecContext(context.Background(), `select pg_advisory_unlock($1);`, migrationLockKey); err != nil {
+			logger.Log.Error("migration unlock", zap.Error(err))
+		}
+	}()
+	if _, err = conn.ExecContext(ctx, createMigrationsTable); err != nil {
+		return err
+	}
+	return fn(conn)
+}
+
+func appliedMigrations(ctx context.Context, conn *sql.Conn) (map[int64]time.Time, error) {
+	rows, err := conn.QueryContext(ctx, `select version, applied_at from schema_migrations;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make(map[int64]time.Time)
+	for rows.Next() {
+		var version int64
+		var at time.Time
+		if err = rows.Scan(&version, &at); err != nil {
+			return nil, err
+		}
+		result[version] = at
+	}
+	return result, rows.Err()
+}
+
+func inTx(ctx context.Context, conn *sql.Conn, fn func(tx *sql.Tx) error) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err = fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,70 @@
+package storage
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	t.Run("embedded", func(t *testing.T) {
+		migrations, err := loadMigrations(migrationFiles, "migrations")
+		require.NoError(t, err)
+		require.NotEmpty(t, migrations)
+		for i, m := range migrations {
+			assert.NotEmpty(t, m.up)
+			assert.NotEmpty(t, m.down, "migration %d has no down", m.version)
+			if i > 0 {
+				assert.Less(t, migrations[i-1].version, m.version)
+			}
+		}
+	})
+
+	tests := []struct {
+		name     string
+		files    fstest.MapFS
+		versions []int64
+		wantErr  bool
+	}{
+		{
+			name: "ordered by version",
+			files: fstest.MapFS{
+				"m/0010_b.up.sql":   {Data: []byte("b")},
+				"m/0002_a.up.sql":   {Data: []byte("a")},
+				"m/0002_a.down.sql": {Data: []byte("-a")},
+				"m/README.md":       {Data: []byte("skip")},
+			},
+			versions: []int64{2, 10},
+		},
+		{
+			name:    "down without up",
+			files:   fstest.MapFS{"m/0001_a.down.sql": {Data: []byte("-a")}},
+			wantErr: true,
+		},
+		{
+			name: "name mismatch",
+			files: fstest.MapFS{
+				"m/0001_a.up.sql":   {Data: []byte("a")},
+				"m/0001_b.down.sql": {Data: []byte("-b")},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			migrations, err := loadMigrations(tt.files, "m")
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			versions := make([]int64, 0, len(migrations))
+			for _, m := range migrations {
+				versions = append(versions, m.version)
+			}
+			assert.Equal(t, tt.versions, versions)
+		})
+	}
+}
@@ -0,0 +1,7 @@
+create table if not exists metrics(
+	id uuid primary key default gen_random_uuid(),
+	name text not null,
+	type text not null,
+	delta bigint null,
+	value double precision null,
+	constraint metrics_name_type unique (name, type));
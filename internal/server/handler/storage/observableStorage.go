@@ -0,0 +1,53 @@
+package storage
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/megaded/metrictmr/internal/data"
+)
+
+// Publisher получает метрики после успешного сохранения
+type Publisher interface {
+	Publish(metric ...data.Metric)
+}
+
+// ObservableStorage хранилище, оповещающее подписчиков о сохраненных метриках.
+// Время последнего сохранения метрик запоминается при записи, до оповещения.
+type ObservableStorage struct {
+	Storager
+	publishers []Publisher
+
+	mu      sync.RWMutex
+	updated map[MetricKey]time.Time
+}
+
+func NewObservableStorage(s Storager, publishers ...Publisher) *ObservableStorage {
+	return &ObservableStorage{Storager: s, publishers: publishers, updated: map[MetricKey]time.Time{}}
+}
+
+func (s *ObservableStorage) Store(ctx context.Context, metric ...data.Metric) error {
+	err := s.Storager.Store(ctx, metric...)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	s.mu.Lock()
+	for _, m := range metric {
+		s.updated[MetricKey{ID: m.ID, MType: m.MType}] = now
+	}
+	s.mu.Unlock()
+	for _, p := range s.publishers {
+		p.Publish(metric...)
+	}
+	return nil
+}
+
+// LastUpdate время последнего сохранения метрики с момента запуска сервера
+func (s *ObservableStorage) LastUpdate(id string, mType string) (time.Time, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	t, ok := s.updated[MetricKey{ID: id, MType: mType}]
+	return t, ok
+}
@@ -0,0 +1,74 @@
+package storage
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Коды SQLSTATE временных ошибок Postgres
+const (
+	// класс 08 - ошибки соединения
+	pgClassConnection = "08"
+	// результат фиксации транзакции неизвестен, запись повторять нельзя
+	pgTransactionResolutionUnknown = "08007"
+	pgSerializationFailure         = "40001"
+	pgDeadlockDetected             = "40P01"
+	pgAdminShutdown                = "57P01"
+	pgCrashShutdown                = "57P02"
+	pgCannotConnectNow             = "57P03"
+)
+
+// isRetriablePgError ошибка временная и запрос можно повторить.
+//
+// Повторяются ошибки соединения, конфликты сериализации, взаимные блокировки и остановка сервера.
+// Для записи (write) обрыв соединения после отправки запроса не повторяется:
+// изменения могли быть применены, и повтор удвоит значения counter.
+func isRetriablePgError(err error, write bool) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch pgErr.Code {
+		case pgTransactionResolutionUnknown:
+			return !write
+		case pgSerializationFailure, pgDeadlockDetected, pgAdminShutdown, pgCrashShutdown, pgCannotConnectNow:
+			return true
+		}
+		return strings.HasPrefix(pgErr.Code, pgClassConnection)
+	}
+	var connectErr *pgconn.ConnectError
+	if errors.As(err, &connectErr) || pgconn.SafeToRetry(err) || errors.Is(err, driver.ErrBadConn) {
+		return true
+	}
+	var netErr net.Error
+	return !write && errors.As(err, &netErr)
+}
+
+// pgError оборачивает ошибки соединения и остановки сервера в ErrUnavailable
+func pgError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch {
+		case strings.HasPrefix(pgErr.Code, pgClassConnection),
+			pgErr.Code == pgAdminShutdown, pgErr.Code == pgCrashShutdown, pgErr.Code == pgCannotConnectNow,
+			pgErr.Code == pgSerializationFailure, pgErr.Code == pgDeadlockDetected:
+			return unavailable(err)
+		}
+		return err
+	}
+	var connectErr *pgconn.ConnectError
+	var netErr net.Error
+	if errors.As(err, &connectErr) || errors.As(err, &netErr) || errors.Is(err, driver.ErrBadConn) || pgconn.SafeToRetry(err) {
+		return unavailable(err)
+	}
+	return ctxError(err)
+}
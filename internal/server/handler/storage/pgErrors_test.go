@@ -0,0 +1,64 @@
+package storage
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsRetriablePgError(t *testing.T) {
+	netErr := &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}
+	tests := []struct {
+		name      string
+		err       error
+		wantWrite bool
+		wantRead  bool
+	}{
+		{"nil", nil, false, false},
+		{"canceled", context.Canceled, false, false},
+		{"deadline", fmt.Errorf("query: %w", context.DeadlineExceeded), false, false},
+		{"serialization failure", &pgconn.PgError{Code: pgSerializationFailure}, true, true},
+		{"deadlock", &pgconn.PgError{Code: pgDeadlockDetected}, true, true},
+		{"admin shutdown", &pgconn.PgError{Code: pgAdminShutdown}, true, true},
+		{"cannot connect now", &pgconn.PgError{Code: pgCannotConnectNow}, true, true},
+		{"connection failure", &pgconn.PgError{Code: "08006"}, true, true},
+		{"resolution unknown", &pgconn.PgError{Code: pgTransactionResolutionUnknown}, false, true},
+		{"unique violation", &pgconn.PgError{Code: "23505"}, false, false},
+		{"bad conn", driver.ErrBadConn, true, true},
+		{"network error", netErr, false, true},
+		{"other", errors.New("syntax"), false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.wantWrite, isRetriablePgError(tt.err, true), "write")
+			assert.Equal(t, tt.wantRead, isRetriablePgError(tt.err, false), "read")
+		})
+	}
+}
+
+func TestPgError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{"connection failure", &pgconn.PgError{Code: "08006"}, ErrUnavailable},
+		{"deadlock", &pgconn.PgError{Code: pgDeadlockDetected}, ErrUnavailable},
+		{"bad conn", driver.ErrBadConn, ErrUnavailable},
+		{"deadline", context.DeadlineExceeded, ErrUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.ErrorIs(t, pgError(tt.err), tt.want)
+		})
+	}
+	assert.NoError(t, pgError(nil))
+	unique := &pgconn.PgError{Code: "23505"}
+	assert.NotErrorIs(t, pgError(unique), ErrUnavailable)
+}
@@ -1,25 +1,31 @@
 package storage
 
 import (
+	"cmp"
 	"context"
 	"database/sql"
 	"errors"
+	"strings"
+	"time"
 
 	_ "github.com/jackc/pgx/v5/stdlib"
 	"github.com/megaded/metrictmr/internal/data"
 	"github.com/megaded/metrictmr/internal/logger"
 	"github.com/megaded/metrictmr/internal/retry"
+	"github.com/megaded/metrictmr/internal/selfmetric"
 	"github.com/megaded/metrictmr/internal/server/handler/config"
 )
 
+// Собственные метрики повторных попыток запросов к Postgres
 const (
-	CreateTable = `create table if not exists metrics(
-	id uuid primary key default gen_random_uuid() ,
-	name text not null,
-	type text not null,
-	delta bigint null,
-	value double precision null,
-	constraint metrics_name_type unique (name, type));`
+	selfMetricPgRetries       = "PgRetryAttempts"
+	selfMetricPgRetryFailures = "PgRetryFailures"
+
+	// pgRetryBase, pgRetryMaxDelay, pgRetryDeadline параметры повтора запросов
+	pgRetryBase     = 100 * time.Millisecond
+	pgRetryMaxDelay = 2 * time.Second
+	pgRetryDeadline = 10 * time.Second
+	pgRetries       = 3
 )
 
 type PgStorage struct {
@@ -33,11 +39,15 @@ func NewPgStorage(ctx context.Context, cfg config.Config) *PgStorage {
 	if err != nil {
 		logger.Log.Fatal(err.Error())
 	}
+	pool := newPgPool(cfg)
+	db.SetMaxOpenConns(pool.maxConns)
+	db.SetMaxIdleConns(pool.maxIdleConns)
+	db.SetConnMaxLifetime(pool.connMaxLifetime)
 	ping := db.Ping()
 	if ping != nil {
-		logger.Log.Fatal(err.Error())
+		logger.Log.Fatal(ping.Error())
 	}
-	err = migrate(db)
+	_, err = MigrateUp(ctx, db)
 	if err != nil {
 		logger.Log.Fatal(err.Error())
 	}
@@ -46,86 +56,164 @@ func NewPgStorage(ctx context.Context, cfg config.Config) *PgStorage {
 		<-ctx.Done()
 	}()
 
-	return &PgStorage{dbConnString: cfg.DBConnString, db: db, retry: retry.NewRetry(1, 2, 3)}
+	retries := selfmetric.Default.Counter(selfMetricPgRetries)
+	r := retry.NewRetry(pgRetryBase, pgRetryMaxDelay, pgRetries).WithDeadline(pgRetryDeadline).OnRetry(func(attempt int, err error) {
+		retries.Inc()
+	})
+	return &PgStorage{dbConnString: cfg.DBConnString, db: db, retry: r}
 }
 
-func migrate(db *sql.DB) error {
-	_, err := db.Exec(CreateTable)
-	return err
+// pgPool параметры пула соединений
+type pgPool struct {
+	maxConns        int
+	maxIdleConns    int
+	connMaxLifetime time.Duration
 }
 
-func store(db *sql.DB, m ...data.Metric) error {
-	if len(m) == 0 {
-		return nil
-	}
-	tx, err := db.Begin()
-	if err != nil {
-		return err
+// newPgPool заменяет нулевые параметры значениями по умолчанию. Отрицательные значения
+// database/sql понимает как отсутствие ограничения или простаивающих соединений.
+func newPgPool(cfg config.Config) pgPool {
+	return pgPool{
+		maxConns:        cmp.Or(cfg.DBMaxConns, config.DefaultDBMaxConns),
+		maxIdleConns:    cmp.Or(cfg.DBMaxIdleConns, config.DefaultDBMaxIdleConns),
+		connMaxLifetime: time.Duration(cmp.Or(cfg.DBConnMaxLifetime, config.DefaultDBConnMaxLifetime)) * time.Second,
 	}
-	for _, v := range m {
-		_, err = tx.Exec(`insert into metrics as m (name, type, delta, value) values ($1, $2, $3, $4) 
-ON conflict(name ,type) do 
-update set value = EXCLUDED.value, delta = m.delta + EXCLUDED.delta;`, v.ID, v.MType, v.Delta, v.Value)
-		if err != nil {
-			logger.Log.Info(err.Error())
-			tx.Rollback()
-			return err
-		}
+}
+
+// withRetry выполняет запрос, повторяя его при временных ошибках Postgres.
+// Для записи повторяются только ошибки, после которых изменения гарантированно не применены.
+func (s *PgStorage) withRetry(ctx context.Context, write bool, action func(ctx context.Context) error) error {
+	err := s.retry.DoIf(ctx, func(err error) bool {
+		return isRetriablePgError(err, write)
+	}, action)
+	if err != nil && isRetriablePgError(err, write) {
+		selfmetric.Default.Counter(selfMetricPgRetryFailures).Inc()
 	}
-	return tx.Commit()
+	return pgError(err)
 }
 
-func (s *PgStorage) GetGauge(name string) (metric data.Metric, exist bool, err error) {
-	result := data.Metric{
-		ID:    name,
-		MType: gauge,
+// upsertMetrics вставляет пакет одним запросом: массивы колонок разворачиваются через unnest
+const upsertMetrics = `insert into metrics as m (name, type, delta, value)
+select * from unnest($1::text[], $2::text[], $3::bigint[], $4::double precision[])
+on conflict(name, type) do
+update set value = excluded.value, delta = m.delta + excluded.delta;`
+
+// store записывает пакет одним запросом. Повторы метрики в пакете предварительно сворачиваются:
+// on conflict не может обновить одну строку дважды в одной команде.
+func store(ctx context.Context, db *sql.DB, m ...data.Metric) error {
+	if len(m) == 0 {
+		return nil
 	}
-	row := s.db.QueryRow(`select m.delta, m.value
-	from metrics m 
-	where m."name" =$1 and m."type" = $2;`, name, gauge)
-	var value sql.NullFloat64
-	var delta sql.NullInt64
-	err = row.Scan(&delta, &value)
+	m = aggregateBatch(m)
+	names := make([]string, len(m))
+	types := make([]string, len(m))
+	deltas := make([]*int64, len(m))
+	values := make([]*float64, len(m))
+	for i, v := range m {
+		names[i], types[i], deltas[i], values[i] = v.ID, v.MType, v.Delta, v.Value
+	}
+	_, err := db.ExecContext(ctx, upsertMetrics, names, types, deltas, values)
 	if err != nil {
 		logger.Log.Info(err.Error())
-		if errors.Is(err, sql.ErrNoRows) {
-			return result, false, nil
+	}
+	return err
+}
+
+// aggregateBatch сворачивает повторы метрики в пакете с сохранением порядка первого появления:
+// для gauge остается последнее значение, значения counter суммируются.
+func aggregateBatch(metrics []data.Metric) []data.Metric {
+	index := make(map[MetricKey]int, len(metrics))
+	result := make([]data.Metric, 0, len(metrics))
+	for _, v := range metrics {
+		key := MetricKey{ID: v.ID, MType: v.MType}
+		i, ok := index[key]
+		if !ok {
+			index[key] = len(result)
+			result = append(result, v)
+			continue
 		}
-		return result, false, err
+		if v.MType == gauge {
+			result[i].Value = v.Value
+			continue
+		}
+		if v.Delta == nil {
+			continue
+		}
+		sum := *v.Delta
+		if result[i].Delta != nil {
+			sum += *result[i].Delta
+		}
+		result[i].Delta = &sum
 	}
-	result.Value = &value.Float64
-	return result, true, nil
+	return result
 }
+
+func (s *PgStorage) GetGauge(ctx context.Context, name string) (data.Metric, error) {
+	return s.get(ctx, gauge, name)
+}
+
 func (s *PgStorage) Store(ctx context.Context, metric ...data.Metric) error {
-	return store(s.db, metric...)
+	if err := validateBatch(metric); err != nil {
+		return err
+	}
+	return s.withRetry(ctx, true, func(ctx context.Context) error {
+		return store(ctx, s.db, metric...)
+	})
+}
+
+func (s *PgStorage) GetCounter(ctx context.Context, name string) (data.Metric, error) {
+	return s.get(ctx, counter, name)
 }
 
-func (s *PgStorage) GetCounter(name string) (metric data.Metric, exist bool, err error) {
+func (s *PgStorage) get(ctx context.Context, mType string, name string) (data.Metric, error) {
+	var result data.Metric
+	err := s.withRetry(ctx, false, func(ctx context.Context) error {
+		var err error
+		result, err = s.queryMetric(ctx, mType, name)
+		return err
+	})
+	return result, err
+}
+
+func (s *PgStorage) queryMetric(ctx context.Context, mType string, name string) (data.Metric, error) {
 	result := data.Metric{
 		ID:    name,
-		MType: counter,
+		MType: mType,
 	}
-	row := s.db.QueryRow(`select m.delta, m.value
+	row := s.db.QueryRowContext(ctx, `select m.delta, m.value
 	from metrics m 
-	where m."name" =$1 and m."type" = $2;`, name, counter)
+	where m."name" =$1 and m."type" = $2;`, name, mType)
 	var value sql.NullFloat64
 	var delta sql.NullInt64
-	err = row.Scan(&delta, &value)
+	err := row.Scan(&delta, &value)
 	if err != nil {
-		logger.Log.Info(err.Error())
-		if err == sql.ErrNoRows {
-			return result, false, nil
+		if errors.Is(err, sql.ErrNoRows) {
+			return data.Metric{}, notFound(mType, name)
 		}
-		return result, false, err
+		logger.Log.Info(err.Error())
+		return data.Metric{}, err
 	}
+	if mType == gauge {
+		result.Value = &value.Float64
+	} else {
+		result.Delta = &delta.Int64
+	}
+	return result, nil
+}
 
-	result.Delta = &delta.Int64
-	return result, true, nil
+func (s *PgStorage) GetMetrics(ctx context.Context) ([]data.Metric, error) {
+	var result []data.Metric
+	err := s.withRetry(ctx, false, func(ctx context.Context) error {
+		var err error
+		result, err = s.queryMetrics(ctx)
+		return err
+	})
+	return result, err
 }
 
-func (s *PgStorage) GetMetrics() ([]data.Metric, error) {
+func (s *PgStorage) queryMetrics(ctx context.Context) ([]data.Metric, error) {
 	result := make([]data.Metric, 0)
-	rows, err := s.db.Query(`select m.name, m.type, m.delta, m.value from metrics m;`)
+	rows, err := s.db.QueryContext(ctx, `select m.name, m.type, m.delta, m.value from metrics m;`)
 
 	if err != nil {
 		return result, err
@@ -157,7 +245,120 @@ func (s *PgStorage) GetMetrics() ([]data.Metric, error) {
 
 }
 
-func (s *PgStorage) HealthCheck() bool {
-	err := s.db.Ping()
+func (s *PgStorage) FindMetrics(ctx context.Context, filter MetricFilter) (MetricPage, error) {
+	if err := filter.Normalize(); err != nil {
+		return MetricPage{}, err
+	}
+	var page MetricPage
+	err := s.withRetry(ctx, false, func(ctx context.Context) error {
+		var err error
+		page, err = s.findMetrics(ctx, filter)
+		return err
+	})
+	return page, err
+}
+
+// findMetrics выбирает страницу одним запросом: все условия фильтра, включая Pattern, проверяются в Postgres
+func (s *PgStorage) findMetrics(ctx context.Context, filter MetricFilter) (MetricPage, error) {
+	query, args := buildFindQuery(filter, pgFindDialect)
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return MetricPage{}, err
+	}
+	defer rows.Close()
+	result := make([]data.Metric, 0, filter.Limit+1)
+	for rows.Next() {
+		var m data.Metric
+		var value sql.NullFloat64
+		var delta sql.NullInt64
+		err = rows.Scan(&m.ID, &m.MType, &delta, &value)
+		if err != nil {
+			return MetricPage{}, err
+		}
+		if m.MType == counter {
+			m.Delta = &delta.Int64
+		}
+		if m.MType == gauge {
+			m.Value = &value.Float64
+		}
+		result = append(result, m)
+	}
+	if err = rows.Err(); err != nil {
+		return MetricPage{}, err
+	}
+	return newPage(result, filter.Limit), nil
+}
+
+// GetMetricsByKeys получает набор метрик одним запросом
+func (s *PgStorage) GetMetricsByKeys(ctx context.Context, keys []MetricKey) (map[MetricKey]data.Metric, error) {
+	result := make(map[MetricKey]data.Metric, len(keys))
+	if len(keys) == 0 {
+		return result, nil
+	}
+	names := make([]string, 0, len(keys))
+	types := make([]string, 0, len(keys))
+	for _, k := range keys {
+		names = append(names, k.ID)
+		types = append(types, k.MType)
+	}
+	err := s.withRetry(ctx, false, func(ctx context.Context) error {
+		clear(result)
+		return s.queryMetricsByKeys(ctx, names, types, result)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (s *PgStorage) queryMetricsByKeys(ctx context.Context, names []string, types []string, result map[MetricKey]data.Metric) error {
+	rows, err := s.db.QueryContext(ctx, `select m.name, m.type, m.delta, m.value
+	from metrics m
+	where (m.name, m.type) in (select k.name, k.type from unnest($1::text[], $2::text[]) as k(name, type));`, names, types)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var m data.Metric
+		var value sql.NullFloat64
+		var delta sql.NullInt64
+		err = rows.Scan(&m.ID, &m.MType, &delta, &value)
+		if err != nil {
+			return err
+		}
+		if m.MType == counter {
+			m.Delta = &delta.Int64
+		}
+		if m.MType == gauge {
+			m.Value = &value.Float64
+		}
+		result[MetricKey{ID: m.ID, MType: m.MType}] = m
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// pgFindDialect сравнение строк в collate "C", регулярное выражение переводится в синтаксис Postgres
+var pgFindDialect = findDialect{
+	placeholder: "$%d",
+	collate:     ` collate "C"`,
+	prefix: func(arg func(any) string, prefix string) string {
+		return "m.name like " + arg(escapeLike(prefix)+"%")
+	},
+	match: func(arg func(any) string, pattern string) string {
+		re, _ := postgresPattern(pattern)
+		return "m.name ~ " + arg(re)
+	},
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+func (s *PgStorage) HealthCheck(ctx context.Context) bool {
+	err := s.db.PingContext(ctx)
 	return err == nil
 }
@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/megaded/metrictmr/internal/data"
+	"github.com/megaded/metrictmr/internal/server/handler/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAggregateBatch(t *testing.T) {
+	d1, d2 := int64(2), int64(3)
+	v1, v2 := 1.5, 2.5
+	batch := []data.Metric{
+		{ID: "PollCount", MType: counter, Delta: &d1},
+		{ID: "Alloc", MType: gauge, Value: &v1},
+		{ID: "PollCount", MType: counter},
+		{ID: "PollCount", MType: counter, Delta: &d2},
+		{ID: "Alloc", MType: gauge, Value: &v2},
+		{ID: "Alloc", MType: counter, Delta: &d2},
+	}
+	result := aggregateBatch(batch)
+	require.Len(t, result, 3)
+	assert.Equal(t, "PollCount", result[0].ID)
+	assert.Equal(t, int64(5), *result[0].Delta)
+	assert.Equal(t, "Alloc", result[1].ID)
+	assert.Equal(t, v2, *result[1].Value)
+	assert.Equal(t, counter, result[2].MType)
+	assert.Equal(t, int64(2), d1, "input is not modified")
+}
+
+func BenchmarkAggregateBatch(b *testing.B) {
+	batch := make([]data.Metric, 0, 60)
+	for i := 0; i < 30; i++ {
+		v := float64(i)
+		d := int64(i)
+		batch = append(batch,
+			data.Metric{ID: "gauge" + strconv.Itoa(i), MType: gauge, Value: &v},
+			data.Metric{ID: "counter" + strconv.Itoa(i%5), MType: counter, Delta: &d})
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		aggregateBatch(batch)
+	}
+}
+
+func TestBuildFindQuery(t *testing.T) {
+	f := MetricFilter{Prefix: "Heap", Pattern: `\bAlloc`, Limit: 10}
+	require.NoError(t, f.Normalize())
+	query, args := buildFindQuery(f, pgFindDialect)
+	assert.Contains(t, query, "m.name like $1 and m.name ~ $2")
+	assert.Contains(t, query, "limit $3")
+	assert.Equal(t, []any{"Heap%", `\yAlloc`, 11}, args)
+
+	query, args = buildFindQuery(f, sqliteFindDialect)
+	assert.Contains(t, query, "substr(m.name, 1, length(?1)) = ?1 and m.name regexp ?2")
+	assert.NotContains(t, query, "collate")
+	assert.Contains(t, query, "limit ?3")
+	assert.Equal(t, []any{"Heap", `\bAlloc`, 11}, args)
+
+	f.Pattern = ""
+	f.Cursor = encodeCursor(data.Metric{ID: "HeapAlloc", MType: gauge})
+	f.SortBy = SortByType
+	f.Desc = true
+	query, args = buildFindQuery(f, pgFindDialect)
+	assert.Contains(t, query, `(m.type collate "C", m.name collate "C") < ($3, $2)`)
+	assert.Contains(t, query, `order by m.type collate "C" desc, m.name collate "C" desc limit $4`)
+	assert.Equal(t, []any{"Heap%", "HeapAlloc", gauge, 11}, args)
+}
+
+func TestPostgresPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		want    string
+		wantErr bool
+	}{
+		{pattern: `^Heap\w+$`, want: `^Heap\w+$`},
+		{pattern: `\bHeap\B`, want: `\yHeap\Y`},
+		{pattern: `Alloc\z`, want: `Alloc\Z`},
+		{pattern: `^(?P<p>Heap)(?<s>Alloc)(?:Sys)?`, want: `^(Heap)(Alloc)(?:Sys)?`},
+		{pattern: `[(?i)\]]\b`, want: `[(?i)\]]\y`},
+		{pattern: `[]b][^]b][[:alpha:]]`, want: `[]b][^]b][[:alpha:]]`},
+		{pattern: `(?i)heap`, wantErr: true},
+		{pattern: `(?s:a.b)`, wantErr: true},
+		{pattern: `\pL+`, wantErr: true},
+		{pattern: `[\PL]`, wantErr: true},
+		{pattern: `\Q.\E`, wantErr: true},
+		{pattern: `\12`, wantErr: true},
+		{pattern: `\x{41}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern, func(t *testing.T) {
+			got, err := postgresPattern(tt.pattern)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrInvalid)
+				f := MetricFilter{Pattern: tt.pattern}
+				assert.ErrorIs(t, f.Normalize(), ErrInvalid)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestNewPgPool(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  config.Config
+		want pgPool
+	}{
+		{"zero config", config.Config{}, pgPool{maxConns: 20, maxIdleConns: 10, connMaxLifetime: 300 * time.Second}},
+		{"explicit", config.Config{DBMaxConns: 5, DBMaxIdleConns: 2, DBConnMaxLifetime: 60}, pgPool{maxConns: 5, maxIdleConns: 2, connMaxLifetime: time.Minute}},
+		{"negative", config.Config{DBMaxConns: -1, DBMaxIdleConns: -1, DBConnMaxLifetime: -1}, pgPool{maxConns: -1, maxIdleConns: -1, connMaxLifetime: -time.Second}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, newPgPool(tt.cfg))
+		})
+	}
+}
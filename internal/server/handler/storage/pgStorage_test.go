@@ -0,0 +1,80 @@
+package storage_test
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/megaded/metrictmr/internal/data"
+	"github.com/megaded/metrictmr/internal/server/handler/config"
+	"github.com/megaded/metrictmr/internal/server/handler/storage"
+	"github.com/megaded/metrictmr/internal/server/handler/storage/storagetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrations_Postgres(t *testing.T) {
+	db, err := sql.Open("pgx", storagetest.PostgresDSN(t))
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	applied := make([]int, 3)
+	for i := range applied {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			n, err := storage.MigrateUp(ctx, db)
+			assert.NoError(t, err)
+			applied[i] = n
+		}(i)
+	}
+	wg.Wait()
+	states, err := storage.MigrationStatus(ctx, db)
+	require.NoError(t, err)
+	total := 0
+	for _, n := range applied {
+		total += n
+	}
+	assert.Equal(t, len(states), total, "every migration is applied exactly once")
+
+	n, err := storage.MigrateDown(ctx, db, len(states))
+	require.NoError(t, err)
+	assert.Equal(t, len(states), n)
+	states, err = storage.MigrationStatus(ctx, db)
+	require.NoError(t, err)
+	for _, s := range states {
+		assert.False(t, s.Applied)
+	}
+
+	n, err = storage.MigrateUp(ctx, db)
+	require.NoError(t, err)
+	assert.Equal(t, len(states), n)
+}
+
+func BenchmarkPgStorage_Store(b *testing.B) {
+	dsn := storagetest.PostgresDSN(b)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := storage.NewPgStorage(ctx, config.Config{DBConnString: dsn, DBMaxConns: 10, DBMaxIdleConns: 10})
+	for _, size := range []int{1, 30, 300} {
+		batch := make([]data.Metric, 0, size)
+		for i := 0; i < size; i++ {
+			v := float64(i)
+			d := int64(1)
+			batch = append(batch, data.Metric{ID: "bench" + strconv.Itoa(i/2), MType: data.MTypeGauge, Value: &v})
+			batch = append(batch, data.Metric{ID: "bench" + strconv.Itoa(i/2), MType: data.MTypeCounter, Delta: &d})
+		}
+		batch = batch[:size]
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if err := s.Store(ctx, batch...); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,290 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"os"
+	"path/filepath"
+
+	"github.com/megaded/metrictmr/internal/data"
+	"github.com/megaded/metrictmr/internal/logger"
+	"go.uber.org/zap"
+)
+
+// Кодирование метрик в снимке
+const (
+	SnapshotFormatJSON   = "json"
+	SnapshotFormatBinary = "binary"
+)
+
+const (
+	// snapshotVersion версия формата с заголовком. Версии 0 (массив метрик JSON)
+	// и 1 (объект JSON с номером записи журнала) записывались без заголовка.
+	snapshotVersion = 2
+	snapshotMagic   = "MTMR"
+	// заголовок: magic, версия uint16, кодирование uint8, резерв uint8,
+	// номер записи журнала uint64, длина данных uint64, crc32c данных uint32
+	snapshotHeaderSize = 4 + 2 + 1 + 1 + 8 + 8 + 4
+
+	encodingJSON   = 0
+	encodingBinary = 1
+
+	binaryGauge   = 0
+	binaryCounter = 1
+)
+
+var (
+	ErrSnapshotVersion  = errors.New("unsupported snapshot version")
+	ErrSnapshotChecksum = errors.New("snapshot checksum mismatch")
+	ErrSnapshotCorrupt  = errors.New("corrupt snapshot")
+)
+
+// snapshot содержимое файла снимка
+type snapshot struct {
+	// WALSeq номер последней записи журнала, вошедшей в снимок
+	WALSeq  uint64        `json:"wal_seq"`
+	Metrics []data.Metric `json:"metrics"`
+}
+
+// ParseSnapshotFormat проверяет название кодирования снимка
+func ParseSnapshotFormat(format string) (string, error) {
+	switch format {
+	case "":
+		return SnapshotFormatJSON, nil
+	case SnapshotFormatJSON, SnapshotFormatBinary:
+		return format, nil
+	}
+	return "", fmt.Errorf("unknown snapshot format %q", format)
+}
+
+// encodeSnapshot кодирует снимок в текущей версии формата
+func encodeSnapshot(s snapshot, format string) ([]byte, error) {
+	var payload []byte
+	var encoding byte
+	var err error
+	switch format {
+	case SnapshotFormatBinary:
+		encoding = encodingBinary
+		payload, err = encodeMetricsBinary(s.Metrics)
+	default:
+		encoding = encodingJSON
+		payload, err = json.Marshal(s.Metrics)
+	}
+	if err != nil {
+		return nil, err
+	}
+	content := make([]byte, snapshotHeaderSize, snapshotHeaderSize+len(payload))
+	copy(content, snapshotMagic)
+	binary.BigEndian.PutUint16(content[4:6], snapshotVersion)
+	content[6] = encoding
+	binary.BigEndian.PutUint64(content[8:16], s.WALSeq)
+	binary.BigEndian.PutUint64(content[16:24], uint64(len(payload)))
+	binary.BigEndian.PutUint32(content[24:28], crc32.Checksum(payload, walCRCTable))
+	return append(content, payload...), nil
+}
+
+// decodeSnapshot разбирает снимок. Снимки старых версий без заголовка
+// читаются как есть и при следующей записи сохраняются в текущей версии.
+func decodeSnapshot(content []byte) (snapshot, error) {
+	var snap snapshot
+	if !bytes.HasPrefix(content, []byte(snapshotMagic)) {
+		trimmed := bytes.TrimSpace(content)
+		switch {
+		case bytes.HasPrefix(trimmed, []byte("[")):
+			err := json.Unmarshal(trimmed, &snap.Metrics)
+			return snap, err
+		case bytes.HasPrefix(trimmed, []byte("{")):
+			err := json.Unmarshal(trimmed, &snap)
+			return snap, err
+		}
+		return snap, ErrSnapshotCorrupt
+	}
+	if len(content) < snapshotHeaderSize {
+		return snap, ErrSnapshotCorrupt
+	}
+	if version := binary.BigEndian.Uint16(content[4:6]); version != snapshotVersion {
+		return snap, fmt.Errorf("%w: %d", ErrSnapshotVersion, version)
+	}
+	encoding := content[6]
+	snap.WALSeq = binary.BigEndian.Uint64(content[8:16])
+	length := binary.BigEndian.Uint64(content[16:24])
+	payload := content[snapshotHeaderSize:]
+	if uint64(len(payload)) != length {
+		return snap, ErrSnapshotCorrupt
+	}
+	if crc32.Checksum(payload, walCRCTable) != binary.BigEndian.Uint32(content[24:28]) {
+		return snap, ErrSnapshotChecksum
+	}
+	var err error
+	switch encoding {
+	case encodingJSON:
+		err = json.Unmarshal(payload, &snap.Metrics)
+	case encodingBinary:
+		snap.Metrics, err = decodeMetricsBinary(payload)
+	default:
+		err = fmt.Errorf("%w: encoding %d", ErrSnapshotVersion, encoding)
+	}
+	return snap, err
+}
+
+// encodeMetricsBinary компактное кодирование:
+// количество, затем для каждой метрики тип, наличие значения, имя и значение
+func encodeMetricsBinary(metrics []data.Metric) ([]byte, error) {
+	buf := binary.AppendUvarint(nil, uint64(len(metrics)))
+	for _, m := range metrics {
+		switch m.MType {
+		case gauge:
+			buf = append(buf, binaryGauge)
+		case counter:
+			buf = append(buf, binaryCounter)
+		default:
+			return nil, fmt.Errorf("unknown metric type %q", m.MType)
+		}
+		hasValue := (m.MType == gauge && m.Value != nil) || (m.MType == counter && m.Delta != nil)
+		if hasValue {
+			buf = append(buf, 1)
+		} else {
+			buf = append(buf, 0)
+		}
+		buf = binary.AppendUvarint(buf, uint64(len(m.ID)))
+		buf = append(buf, m.ID...)
+		if !hasValue {
+			continue
+		}
+		if m.MType == gauge {
+			buf = binary.BigEndian.AppendUint64(buf, math.Float64bits(*m.Value))
+		} else {
+			buf = binary.AppendVarint(buf, *m.Delta)
+		}
+	}
+	return buf, nil
+}
+
+func decodeMetricsBinary(payload []byte) ([]data.Metric, error) {
+	r := bytes.NewReader(payload)
+	count, err := binary.ReadUvarint(r)
+	if err != nil || count > uint64(len(payload)) {
+		return nil, ErrSnapshotCorrupt
+	}
+	metrics := make([]data.Metric, 0, count)
+	for i := uint64(0); i < count; i++ {
+		var m data.Metric
+		mType, err := r.ReadByte()
+		if err != nil {
+			return nil, ErrSnapshotCorrupt
+		}
+		hasValue, err := r.ReadByte()
+		if err != nil {
+			return nil, ErrSnapshotCorrupt
+		}
+		length, err := binary.ReadUvarint(r)
+		if err != nil || length > uint64(r.Len()) {
+			return nil, ErrSnapshotCorrupt
+		}
+		name := make([]byte, length)
+		r.Read(name)
+		m.ID = string(name)
+		switch mType {
+		case binaryGauge:
+			m.MType = gauge
+			if hasValue == 1 {
+				var bits uint64
+				if err = binary.Read(r, binary.BigEndian, &bits); err != nil {
+					return nil, ErrSnapshotCorrupt
+				}
+				v := math.Float64frombits(bits)
+				m.Value = &v
+			}
+		case binaryCounter:
+			m.MType = counter
+			if hasValue == 1 {
+				v, err := binary.ReadVarint(r)
+				if err != nil {
+					return nil, ErrSnapshotCorrupt
+				}
+				m.Delta = &v
+			}
+		default:
+			return nil, ErrSnapshotCorrupt
+		}
+		metrics = append(metrics, m)
+	}
+	return metrics, nil
+}
+
+// generationPath путь к поколению снимка, 0 - текущий снимок
+func generationPath(path string, generation int) string {
+	if generation == 0 {
+		return path
+	}
+	return fmt.Sprintf("%s.%d", path, generation)
+}
+
+// writeSnapshotFile атомарно заменяет снимок: данные пишутся во временный файл,
+// предыдущие поколения сдвигаются, затем временный файл переименовывается.
+// Хранится generations поколений, включая текущее.
+func writeSnapshotFile(path string, content []byte, generations int) error {
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(content); err != nil {
+		file.Close()
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	for g := generations - 1; g > 0; g-- {
+		err = os.Rename(generationPath(path, g-1), generationPath(path, g))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// readSnapshotFile читает самое новое исправное поколение снимка и возвращает его номер.
+// os.ErrNotExist - снимков нет.
+func readSnapshotFile(path string, generations int) (snapshot, int, error) {
+	lastErr := os.ErrNotExist
+	for g := 0; g < max(generations, 1); g++ {
+		p := generationPath(path, g)
+		content, err := os.ReadFile(p)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err == nil {
+			var snap snapshot
+			snap, err = decodeSnapshot(content)
+			if err == nil {
+				return snap, g, nil
+			}
+		}
+		logger.Log.Warn("snapshot skipped", zap.String("path", p), zap.Error(err))
+		lastErr = err
+	}
+	return snapshot{}, 0, lastErr
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
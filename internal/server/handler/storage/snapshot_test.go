@@ -0,0 +1,72 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/megaded/metrictmr/internal/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshot_Encoding(t *testing.T) {
+	var delta int64 = -7
+	var value float64 = 3.25
+	snap := snapshot{WALSeq: 42, Metrics: []data.Metric{
+		{ID: "Alloc", MType: data.MTypeGauge, Value: &value},
+		{ID: "PollCount", MType: data.MTypeCounter, Delta: &delta},
+		{ID: "Empty", MType: data.MTypeGauge},
+	}}
+	for _, format := range []string{SnapshotFormatJSON, SnapshotFormatBinary} {
+		t.Run(format, func(t *testing.T) {
+			content, err := encodeSnapshot(snap, format)
+			require.NoError(t, err)
+			got, err := decodeSnapshot(content)
+			require.NoError(t, err)
+			assert.Equal(t, snap, got)
+
+			content[len(content)-1] ^= 0xff
+			_, err = decodeSnapshot(content)
+			assert.ErrorIs(t, err, ErrSnapshotChecksum)
+		})
+	}
+
+	t.Run("unsupported version", func(t *testing.T) {
+		content, err := encodeSnapshot(snap, SnapshotFormatJSON)
+		require.NoError(t, err)
+		binary.BigEndian.PutUint16(content[4:6], snapshotVersion+1)
+		_, err = decodeSnapshot(content)
+		assert.ErrorIs(t, err, ErrSnapshotVersion)
+	})
+}
+
+func TestSnapshot_Generations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.db")
+	for seq := uint64(1); seq <= 4; seq++ {
+		content, err := encodeSnapshot(snapshot{WALSeq: seq}, SnapshotFormatBinary)
+		require.NoError(t, err)
+		require.NoError(t, writeSnapshotFile(path, content, 3))
+	}
+	for g, want := range []uint64{4, 3, 2} {
+		content, err := os.ReadFile(generationPath(path, g))
+		require.NoError(t, err)
+		snap, err := decodeSnapshot(content)
+		require.NoError(t, err)
+		assert.Equal(t, want, snap.WALSeq)
+	}
+	_, err := os.Stat(generationPath(path, 3))
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+
+	// поврежденный текущий снимок: используется предыдущее поколение
+	require.NoError(t, os.WriteFile(path, []byte("MTMR garbage"), 0o644))
+	snap, generation, err := readSnapshotFile(path, 3)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), snap.WALSeq)
+	assert.Equal(t, 1, generation)
+
+	_, _, err = readSnapshotFile(filepath.Join(t.TempDir(), "missing"), 3)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
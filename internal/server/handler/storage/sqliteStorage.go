@@ -0,0 +1,271 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/megaded/metrictmr/internal/data"
+	"github.com/megaded/metrictmr/internal/logger"
+	"github.com/megaded/metrictmr/internal/server/handler/config"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// SQLiteScheme префикс строки подключения, выбирающий SQLite: sqlite://path/to/metrics.db
+const SQLiteScheme = "sqlite://"
+
+const (
+	createSQLiteTable = `create table if not exists metrics(
+	name text not null,
+	type text not null,
+	delta integer null,
+	value real null,
+	primary key (name, type));`
+
+	// sqliteKeysChunk количество пар имя-тип в одном запросе, ограничено числом параметров
+	sqliteKeysChunk = 500
+
+	// sqliteRegexpCache число скомпилированных выражений, которые хранит функция regexp
+	sqliteRegexpCache = 64
+)
+
+// sqliteFindDialect строки сравниваются побайтно (BINARY), как и в курсоре
+var sqliteFindDialect = findDialect{
+	placeholder: "?%d",
+	prefix: func(arg func(any) string, prefix string) string {
+		p := arg(prefix)
+		return fmt.Sprintf("substr(m.name, 1, length(%s)) = %s", p, p)
+	},
+	match: func(arg func(any) string, pattern string) string {
+		return "m.name regexp " + arg(pattern)
+	},
+}
+
+var sqliteRegexps = struct {
+	sync.Mutex
+	m map[string]*regexp.Regexp
+}{m: make(map[string]*regexp.Regexp)}
+
+// В SQLite оператор X REGEXP Y вызывает функцию regexp(Y, X), встроенной реализации нет
+func init() {
+	sqlite.MustRegisterDeterministicScalarFunction("regexp", 2, func(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		pattern, ok := args[0].(string)
+		if !ok {
+			return nil, errors.New("regexp: pattern must be text")
+		}
+		s, ok := args[1].(string)
+		if !ok {
+			return false, nil
+		}
+		re, err := sqliteRegexp(pattern)
+		if err != nil {
+			return nil, err
+		}
+		return re.MatchString(s), nil
+	})
+}
+
+// sqliteRegexp компилирует выражение один раз на запрос, а не на каждую строку
+func sqliteRegexp(pattern string) (*regexp.Regexp, error) {
+	sqliteRegexps.Lock()
+	defer sqliteRegexps.Unlock()
+	if re, ok := sqliteRegexps.m[pattern]; ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if len(sqliteRegexps.m) >= sqliteRegexpCache {
+		clear(sqliteRegexps.m)
+	}
+	sqliteRegexps.m[pattern] = re
+	return re, nil
+}
+
+// SQLiteStorage хранит метрики в файле SQLite.
+// База открывается в режиме журнала WAL, пишущие транзакции берут блокировку сразу (BEGIN IMMEDIATE).
+type SQLiteStorage struct {
+	db *sql.DB
+}
+
+// IsSQLiteDSN строка подключения указывает на SQLite
+func IsSQLiteDSN(dsn string) bool {
+	return strings.HasPrefix(dsn, SQLiteScheme)
+}
+
+// sqliteDSN переводит строку подключения sqlite://path?params в формат драйвера
+func sqliteDSN(dsn string) string {
+	path := strings.TrimPrefix(dsn, SQLiteScheme)
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	return "file:" + path + sep + "_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)&_pragma=synchronous(NORMAL)&_txlock=immediate"
+}
+
+func NewSQLiteStorage(ctx context.Context, cfg config.Config) *SQLiteStorage {
+	db, err := sql.Open("sqlite", sqliteDSN(cfg.DBConnString))
+	if err != nil {
+		logger.Log.Fatal(err.Error())
+	}
+	if _, err = db.Exec(createSQLiteTable); err != nil {
+		logger.Log.Fatal(err.Error())
+	}
+	go func() {
+		defer db.Close()
+		<-ctx.Done()
+	}()
+	return &SQLiteStorage{db: db}
+}
+
+func (s *SQLiteStorage) GetGauge(ctx context.Context, name string) (data.Metric, error) {
+	return s.get(ctx, gauge, name)
+}
+
+func (s *SQLiteStorage) GetCounter(ctx context.Context, name string) (data.Metric, error) {
+	return s.get(ctx, counter, name)
+}
+
+func (s *SQLiteStorage) get(ctx context.Context, mType string, name string) (data.Metric, error) {
+	row := s.db.QueryRowContext(ctx, `select name, type, delta, value from metrics where name = ? and type = ?;`, name, mType)
+	metric, err := scanSQLiteMetric(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return data.Metric{}, notFound(mType, name)
+	}
+	if err != nil {
+		return data.Metric{}, sqliteError(err)
+	}
+	return metric, nil
+}
+
+// Store записывает пакет в одной транзакции с той же семантикой, что и insert ... on conflict в Postgres
+func (s *SQLiteStorage) Store(ctx context.Context, metric ...data.Metric) error {
+	if err := validateBatch(metric); err != nil {
+		return err
+	}
+	if len(metric) == 0 {
+		return nil
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return sqliteError(err)
+	}
+	stmt, err := tx.PrepareContext(ctx, `insert into metrics (name, type, delta, value) values (?, ?, ?, ?)
+on conflict(name, type) do
+update set value = excluded.value, delta = metrics.delta + excluded.delta;`)
+	if err != nil {
+		tx.Rollback()
+		return sqliteError(err)
+	}
+	defer stmt.Close()
+	for _, v := range metric {
+		if _, err = stmt.ExecContext(ctx, v.ID, v.MType, v.Delta, v.Value); err != nil {
+			logger.Log.Info(err.Error())
+			tx.Rollback()
+			return sqliteError(err)
+		}
+	}
+	return sqliteError(tx.Commit())
+}
+
+func (s *SQLiteStorage) GetMetrics(ctx context.Context) ([]data.Metric, error) {
+	return s.query(ctx, `select name, type, delta, value from metrics;`)
+}
+
+// FindMetrics выбирает страницу одним запросом, Pattern проверяется зарегистрированной функцией regexp
+func (s *SQLiteStorage) FindMetrics(ctx context.Context, filter MetricFilter) (MetricPage, error) {
+	if err := filter.Normalize(); err != nil {
+		return MetricPage{}, err
+	}
+	query, args := buildFindQuery(filter, sqliteFindDialect)
+	metrics, err := s.query(ctx, query, args...)
+	if err != nil {
+		return MetricPage{}, err
+	}
+	return newPage(metrics, filter.Limit), nil
+}
+
+func (s *SQLiteStorage) GetMetricsByKeys(ctx context.Context, keys []MetricKey) (map[MetricKey]data.Metric, error) {
+	result := make(map[MetricKey]data.Metric, len(keys))
+	for start := 0; start < len(keys); start += sqliteKeysChunk {
+		chunk := keys[start:min(start+sqliteKeysChunk, len(keys))]
+		var query strings.Builder
+		query.WriteString(`select name, type, delta, value from metrics where (name, type) in (values `)
+		args := make([]any, 0, len(chunk)*2)
+		for i, k := range chunk {
+			if i > 0 {
+				query.WriteString(", ")
+			}
+			query.WriteString("(?, ?)")
+			args = append(args, k.ID, k.MType)
+		}
+		query.WriteString(");")
+		metrics, err := s.query(ctx, query.String(), args...)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range metrics {
+			result[MetricKey{ID: m.ID, MType: m.MType}] = m
+		}
+	}
+	return result, nil
+}
+
+func (s *SQLiteStorage) HealthCheck(ctx context.Context) bool {
+	return s.db.PingContext(ctx) == nil
+}
+
+func (s *SQLiteStorage) query(ctx context.Context, query string, args ...any) ([]data.Metric, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, sqliteError(err)
+	}
+	defer rows.Close()
+	result := make([]data.Metric, 0)
+	for rows.Next() {
+		m, err := scanSQLiteMetric(rows)
+		if err != nil {
+			return nil, sqliteError(err)
+		}
+		result = append(result, m)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, sqliteError(err)
+	}
+	return result, nil
+}
+
+// sqliteError занятая или заблокированная база и отмена запроса означают недоступность хранилища
+func sqliteError(err error) error {
+	var e *sqlite.Error
+	if errors.As(err, &e) {
+		switch e.Code() & 0xff {
+		case sqlite3.SQLITE_BUSY, sqlite3.SQLITE_LOCKED:
+			return unavailable(err)
+		}
+	}
+	return ctxError(err)
+}
+
+func scanSQLiteMetric(row interface{ Scan(dest ...any) error }) (data.Metric, error) {
+	var m data.Metric
+	var value sql.NullFloat64
+	var delta sql.NullInt64
+	if err := row.Scan(&m.ID, &m.MType, &delta, &value); err != nil {
+		return m, err
+	}
+	if m.MType == counter && delta.Valid {
+		m.Delta = &delta.Int64
+	}
+	if m.MType == gauge && value.Valid {
+		m.Value = &value.Float64
+	}
+	return m, nil
+}
@@ -0,0 +1,33 @@
+package storage
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/megaded/metrictmr/internal/data"
+	"github.com/megaded/metrictmr/internal/server/handler/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSQLiteStorage(t *testing.T) {
+	dsn := SQLiteScheme + filepath.Join(t.TempDir(), "metrics.db")
+	s := NewSQLiteStorage(testContext(t), config.Config{DBConnString: dsn})
+
+	var mode string
+	require.NoError(t, s.db.QueryRow("pragma journal_mode;").Scan(&mode))
+	assert.Equal(t, "wal", mode)
+
+	var delta int64 = 4
+	require.NoError(t, s.Store(context.TODO(), data.Metric{ID: "PollCount", MType: data.MTypeCounter, Delta: &delta}))
+	reopened := NewSQLiteStorage(testContext(t), config.Config{DBConnString: dsn})
+	assert.Equal(t, int64(4), counterValue(t, reopened, "PollCount"))
+}
+
+func TestSQLiteDSN(t *testing.T) {
+	assert.True(t, IsSQLiteDSN("sqlite:///var/lib/metrics.db"))
+	assert.False(t, IsSQLiteDSN("postgres://user@localhost/metrics"))
+	assert.Equal(t, "file:/tmp/m.db?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)&_pragma=synchronous(NORMAL)&_txlock=immediate", sqliteDSN("sqlite:///tmp/m.db"))
+	assert.Equal(t, "file:m.db?mode=rwc&_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)&_pragma=synchronous(NORMAL)&_txlock=immediate", sqliteDSN("sqlite://m.db?mode=rwc"))
+}
@@ -7,18 +7,36 @@ import (
 	"github.com/megaded/metrictmr/internal/server/handler/config"
 )
 
+// MetricKey идентификатор метрики: имя и тип
+type MetricKey struct {
+	ID    string `json:"id"`
+	MType string `json:"type"`
+}
+
+// Storager хранилище метрик.
+//
+// Ошибки оборачивают ErrNotFound, ErrInvalid или ErrUnavailable.
+// Пакет в Store проверяется целиком: при ErrInvalid ничего не записывается.
 type Storager interface {
-	GetGauge(name string) (metric data.Metric, exist bool, err error)
+	GetGauge(ctx context.Context, name string) (data.Metric, error)
 	Store(ctx context.Context, metric ...data.Metric) error
-	GetCounter(name string) (metric data.Metric, exist bool, err error)
-	GetMetrics() ([]data.Metric, error)
-	HealthCheck() bool
+	GetCounter(ctx context.Context, name string) (data.Metric, error)
+	GetMetrics(ctx context.Context) ([]data.Metric, error)
+	FindMetrics(ctx context.Context, filter MetricFilter) (MetricPage, error)
+	GetMetricsByKeys(ctx context.Context, keys []MetricKey) (map[MetricKey]data.Metric, error)
+	HealthCheck(ctx context.Context) bool
 }
 
 func CreateStorage(ctx context.Context, cfg config.Config) Storager {
+	if IsSQLiteDSN(cfg.DBConnString) {
+		return NewSQLiteStorage(ctx, cfg)
+	}
 	if cfg.DBConnString != "" {
 		return NewPgStorage(ctx, cfg)
 	}
+	if cfg.BoltPath != "" {
+		return NewBoltStorage(ctx, cfg)
+	}
 	_, isDefault := cfg.GetFilePath()
 	if !isDefault {
 		return NewFileStorage(ctx, cfg)
@@ -0,0 +1,76 @@
+package storagetest
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// DSNEnv переменная окружения со строкой подключения к тестовой базе Postgres
+const DSNEnv = "TEST_DATABASE_DSN"
+
+// PostgresDSN возвращает строку подключения к Postgres для тестов.
+// Берется из TEST_DATABASE_DSN, иначе запускается временный кластер через initdb и pg_ctl.
+// Если Postgres недоступен, тест или бенчмарк пропускается.
+func PostgresDSN(t testing.TB) string {
+	t.Helper()
+	if dsn := os.Getenv(DSNEnv); dsn != "" {
+		return dsn
+	}
+	initdb, pgCtl, ok := findPostgresBin()
+	if !ok {
+		t.Skipf("postgres is not available: set %s or install initdb and pg_ctl", DSNEnv)
+	}
+	port, err := freePort()
+	if err != nil {
+		t.Skipf("postgres: %v", err)
+	}
+	dir := t.TempDir()
+	dataDir := filepath.Join(dir, "data")
+	out, err := exec.Command(initdb, "-D", dataDir, "-U", "postgres", "--auth=trust", "--no-sync").CombinedOutput()
+	if err != nil {
+		t.Skipf("postgres: initdb: %v: %s", err, out)
+	}
+	opts := fmt.Sprintf("-p %d -k %s -c listen_addresses=127.0.0.1 -c fsync=off", port, dir)
+	out, err = exec.Command(pgCtl, "-D", dataDir, "-o", opts, "-l", filepath.Join(dir, "postgres.log"), "-w", "start").CombinedOutput()
+	if err != nil {
+		t.Skipf("postgres: pg_ctl start: %v: %s", err, out)
+	}
+	t.Cleanup(func() {
+		exec.Command(pgCtl, "-D", dataDir, "-m", "immediate", "-w", "stop").Run()
+	})
+	return fmt.Sprintf("postgres://postgres@127.0.0.1:%d/postgres?sslmode=disable", port)
+}
+
+// findPostgresBin ищет initdb и pg_ctl в PATH и в каталогах пакетов Debian
+func findPostgresBin() (initdb string, pgCtl string, ok bool) {
+	dirs := []string{""}
+	matches, _ := filepath.Glob("/usr/lib/postgresql/*/bin")
+	dirs = append(dirs, matches...)
+	for _, dir := range dirs {
+		var err1, err2 error
+		if dir == "" {
+			initdb, err1 = exec.LookPath("initdb")
+			pgCtl, err2 = exec.LookPath("pg_ctl")
+		} else {
+			initdb, err1 = exec.LookPath(filepath.Join(dir, "initdb"))
+			pgCtl, err2 = exec.LookPath(filepath.Join(dir, "pg_ctl"))
+		}
+		if err1 == nil && err2 == nil {
+			return initdb, pgCtl, true
+		}
+	}
+	return "", "", false
+}
+
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
@@ -0,0 +1,298 @@
+// Набор проверок соответствия реализаций storage.Storager
+//
+// Run проверяет все методы интерфейса на любой реализации:
+// накопление counter, перезапись gauge, пакетную запись, отсутствующие метрики
+// и конкурентный доступ. Каждая проверка получает новое пустое хранилище.
+package storagetest
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/megaded/metrictmr/internal/data"
+	"github.com/megaded/metrictmr/internal/server/handler/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Factory создает пустое хранилище для одной проверки
+type Factory func(t *testing.T) storage.Storager
+
+// Run запускает набор проверок для хранилища
+func Run(t *testing.T, newStorage Factory) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, s storage.Storager)
+	}{
+		{"MissingKeys", testMissingKeys},
+		{"GaugeOverwrite", testGaugeOverwrite},
+		{"CounterAccumulation", testCounterAccumulation},
+		{"SameNameDifferentTypes", testSameNameDifferentTypes},
+		{"Batch", testBatch},
+		{"BatchAtomicity", testBatchAtomicity},
+		{"GetMetrics", testGetMetrics},
+		{"FindMetrics", testFindMetrics},
+		{"GetMetricsByKeys", testGetMetricsByKeys},
+		{"HealthCheck", testHealthCheck},
+		{"Concurrency", testConcurrency},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.fn(t, newStorage(t))
+		})
+	}
+}
+
+func gaugeOf(name string, v float64) data.Metric {
+	return data.Metric{ID: name, MType: data.MTypeGauge, Value: &v}
+}
+
+func counterOf(name string, d int64) data.Metric {
+	return data.Metric{ID: name, MType: data.MTypeCounter, Delta: &d}
+}
+
+func requireGauge(t *testing.T, s storage.Storager, name string, want float64) {
+	t.Helper()
+	m, err := s.GetGauge(context.Background(), name)
+	require.NoError(t, err, "gauge %s", name)
+	require.NotNil(t, m.Value)
+	assert.Equal(t, name, m.ID)
+	assert.Equal(t, data.MTypeGauge, m.MType)
+	assert.Equal(t, want, *m.Value)
+}
+
+func requireCounter(t *testing.T, s storage.Storager, name string, want int64) {
+	t.Helper()
+	m, err := s.GetCounter(context.Background(), name)
+	require.NoError(t, err, "counter %s", name)
+	require.NotNil(t, m.Delta)
+	assert.Equal(t, name, m.ID)
+	assert.Equal(t, data.MTypeCounter, m.MType)
+	assert.Equal(t, want, *m.Delta)
+}
+
+func testMissingKeys(t *testing.T, s storage.Storager) {
+	ctx := context.Background()
+	_, err := s.GetGauge(ctx, "missing")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+	_, err = s.GetCounter(ctx, "missing")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	require.NoError(t, s.Store(ctx, gaugeOf("only_gauge", 1)))
+	_, err = s.GetCounter(ctx, "only_gauge")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	found, err := s.GetMetricsByKeys(ctx, []storage.MetricKey{{ID: "missing", MType: data.MTypeGauge}})
+	require.NoError(t, err)
+	assert.Empty(t, found)
+}
+
+func testGaugeOverwrite(t *testing.T, s storage.Storager) {
+	ctx := context.Background()
+	require.NoError(t, s.Store(ctx, gaugeOf("Alloc", 1.5)))
+	requireGauge(t, s, "Alloc", 1.5)
+	require.NoError(t, s.Store(ctx, gaugeOf("Alloc", -2.25)))
+	requireGauge(t, s, "Alloc", -2.25)
+	require.NoError(t, s.Store(ctx, gaugeOf("Alloc", 0)))
+	requireGauge(t, s, "Alloc", 0)
+	// gauge без значения отклоняется и не сбрасывает сохраненное значение
+	assert.ErrorIs(t, s.Store(ctx, data.Metric{ID: "Alloc", MType: data.MTypeGauge}), storage.ErrInvalid)
+	requireGauge(t, s, "Alloc", 0)
+}
+
+func testCounterAccumulation(t *testing.T, s storage.Storager) {
+	ctx := context.Background()
+	require.NoError(t, s.Store(ctx, counterOf("PollCount", 5)))
+	requireCounter(t, s, "PollCount", 5)
+	require.NoError(t, s.Store(ctx, counterOf("PollCount", 7)))
+	requireCounter(t, s, "PollCount", 12)
+	require.NoError(t, s.Store(ctx, counterOf("PollCount", 0)))
+	requireCounter(t, s, "PollCount", 12)
+}
+
+func testSameNameDifferentTypes(t *testing.T, s storage.Storager) {
+	ctx := context.Background()
+	require.NoError(t, s.Store(ctx, gaugeOf("shared", 3.5), counterOf("shared", 4)))
+	requireGauge(t, s, "shared", 3.5)
+	requireCounter(t, s, "shared", 4)
+}
+
+func testBatch(t *testing.T, s storage.Storager) {
+	ctx := context.Background()
+	require.NoError(t, s.Store(ctx))
+	require.NoError(t, s.Store(ctx,
+		gaugeOf("g1", 1),
+		counterOf("c1", 1),
+		gaugeOf("g1", 2),
+		counterOf("c1", 2),
+		counterOf("c2", 10),
+	))
+	requireGauge(t, s, "g1", 2)
+	requireCounter(t, s, "c1", 3)
+	requireCounter(t, s, "c2", 10)
+}
+
+// testBatchAtomicity пакет с некорректной метрикой отклоняется целиком,
+// пакет с отмененным контекстом применяется целиком или не применяется вовсе
+func testBatchAtomicity(t *testing.T, s storage.Storager) {
+	keys := []storage.MetricKey{
+		{ID: "a1", MType: data.MTypeGauge},
+		{ID: "a2", MType: data.MTypeCounter},
+		{ID: "a3", MType: data.MTypeGauge},
+	}
+
+	err := s.Store(context.Background(), gaugeOf("a1", 1), counterOf("a2", 2), data.Metric{ID: "a3", MType: "histogram"})
+	assert.ErrorIs(t, err, storage.ErrInvalid)
+	err = s.Store(context.Background(), gaugeOf("a1", 1), gaugeOf("", 2))
+	assert.ErrorIs(t, err, storage.ErrInvalid)
+	err = s.Store(context.Background(), gaugeOf("a1", 1), data.Metric{ID: "a3", MType: data.MTypeGauge})
+	assert.ErrorIs(t, err, storage.ErrInvalid, "gauge without value")
+	err = s.Store(context.Background(), gaugeOf("a1", 1), data.Metric{ID: "a2", MType: data.MTypeCounter})
+	assert.ErrorIs(t, err, storage.ErrInvalid, "counter without delta")
+	found, err := s.GetMetricsByKeys(context.Background(), keys)
+	require.NoError(t, err)
+	assert.Empty(t, found, "invalid batch is partially applied")
+
+	// пакет с отмененным контекстом не записывается ни одним хранилищем
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = s.Store(ctx, gaugeOf("a1", 1), counterOf("a2", 2), gaugeOf("a3", 3))
+	assert.ErrorIs(t, err, storage.ErrUnavailable)
+	found, err = s.GetMetricsByKeys(context.Background(), keys)
+	require.NoError(t, err)
+	assert.Empty(t, found, "failed batch is partially applied")
+}
+
+func testGetMetrics(t *testing.T, s storage.Storager) {
+	ctx := context.Background()
+	metrics, err := s.GetMetrics(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, metrics)
+
+	require.NoError(t, s.Store(ctx, gaugeOf("g", 1), counterOf("c", 2), counterOf("c", 3)))
+	metrics, err = s.GetMetrics(ctx)
+	require.NoError(t, err)
+	require.Len(t, metrics, 2)
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].ID < metrics[j].ID })
+	assert.Equal(t, "c", metrics[0].ID)
+	require.NotNil(t, metrics[0].Delta)
+	assert.Equal(t, int64(5), *metrics[0].Delta)
+	assert.Equal(t, "g", metrics[1].ID)
+	require.NotNil(t, metrics[1].Value)
+	assert.Equal(t, 1.0, *metrics[1].Value)
+}
+
+func testFindMetrics(t *testing.T, s storage.Storager) {
+	ctx := context.Background()
+	require.NoError(t, s.Store(ctx,
+		gaugeOf("HeapAlloc", 1),
+		gaugeOf("HeapSys", 2),
+		gaugeOf("Alloc", 3),
+		counterOf("Alloc", 4),
+		counterOf("PollCount", 5),
+		gaugeOf("Heap_x", 6),
+	))
+	ids := func(p storage.MetricPage) []string {
+		result := make([]string, 0, len(p.Metrics))
+		for _, m := range p.Metrics {
+			result = append(result, m.MType+":"+m.ID)
+		}
+		return result
+	}
+	find := func(f storage.MetricFilter) []string {
+		t.Helper()
+		page, err := s.FindMetrics(ctx, f)
+		require.NoError(t, err)
+		return ids(page)
+	}
+	assert.Equal(t, []string{"counter:Alloc", "gauge:Alloc", "gauge:HeapAlloc", "gauge:HeapSys", "gauge:Heap_x", "counter:PollCount"}, find(storage.MetricFilter{}))
+	assert.Equal(t, []string{"gauge:Heap_x"}, find(storage.MetricFilter{Prefix: "Heap_"}))
+	assert.Equal(t, []string{"counter:Alloc", "gauge:Alloc", "gauge:HeapAlloc"}, find(storage.MetricFilter{Pattern: "Alloc$"}))
+	// синтаксис RE2 одинаков для всех хранилищ
+	assert.Equal(t, []string{"gauge:HeapAlloc", "gauge:HeapSys"}, find(storage.MetricFilter{Pattern: `^(?P<p>Heap)[[:alpha:]]+\z`}))
+	page, err := s.FindMetrics(ctx, storage.MetricFilter{Pattern: `\bHeap`, Limit: 2})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"gauge:HeapAlloc", "gauge:HeapSys"}, ids(page))
+	assert.NotEmpty(t, page.Next)
+	assert.Equal(t, []string{"counter:PollCount", "counter:Alloc"}, find(storage.MetricFilter{MType: data.MTypeCounter, Desc: true}))
+	assert.Equal(t, []string{"counter:Alloc", "counter:PollCount", "gauge:Alloc"}, find(storage.MetricFilter{SortBy: storage.SortByType, Limit: 3}))
+
+	var all []string
+	filter := storage.MetricFilter{Limit: 4, Desc: true}
+	for i := 0; i < 3; i++ {
+		page, err := s.FindMetrics(ctx, filter)
+		require.NoError(t, err)
+		all = append(all, ids(page)...)
+		if page.Next == "" {
+			break
+		}
+		filter.Cursor = page.Next
+	}
+	assert.Equal(t, []string{"counter:PollCount", "gauge:Heap_x", "gauge:HeapSys", "gauge:HeapAlloc", "gauge:Alloc", "counter:Alloc"}, all)
+
+	_, err = s.FindMetrics(ctx, storage.MetricFilter{Cursor: "not a cursor"})
+	assert.ErrorIs(t, err, storage.ErrInvalid)
+	_, err = s.FindMetrics(ctx, storage.MetricFilter{Pattern: "("})
+	assert.ErrorIs(t, err, storage.ErrInvalid)
+	// конструкции RE2, которых нет в Postgres, отклоняются всеми хранилищами
+	_, err = s.FindMetrics(ctx, storage.MetricFilter{Pattern: `(?i)heap`})
+	assert.ErrorIs(t, err, storage.ErrInvalid)
+}
+
+func testGetMetricsByKeys(t *testing.T, s storage.Storager) {
+	ctx := context.Background()
+	require.NoError(t, s.Store(ctx, gaugeOf("g", 1.5), counterOf("c", 2)))
+	keys := []storage.MetricKey{
+		{ID: "g", MType: data.MTypeGauge},
+		{ID: "c", MType: data.MTypeCounter},
+		{ID: "g", MType: data.MTypeCounter},
+		{ID: "missing", MType: data.MTypeGauge},
+	}
+	found, err := s.GetMetricsByKeys(ctx, keys)
+	require.NoError(t, err)
+	require.Len(t, found, 2)
+	require.NotNil(t, found[keys[0]].Value)
+	assert.Equal(t, 1.5, *found[keys[0]].Value)
+	require.NotNil(t, found[keys[1]].Delta)
+	assert.Equal(t, int64(2), *found[keys[1]].Delta)
+
+	found, err = s.GetMetricsByKeys(ctx, nil)
+	require.NoError(t, err)
+	assert.Empty(t, found)
+}
+
+func testHealthCheck(t *testing.T, s storage.Storager) {
+	assert.True(t, s.HealthCheck(context.Background()))
+}
+
+func testConcurrency(t *testing.T, s storage.Storager) {
+	const workers = 8
+	const iterations = 50
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				err := s.Store(ctx, counterOf("hits", 1), gaugeOf("worker"+strconv.Itoa(w), float64(i)))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if _, err = s.GetMetrics(ctx); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	requireCounter(t, s, "hits", workers*iterations)
+	for w := 0; w < workers; w++ {
+		requireGauge(t, s, "worker"+strconv.Itoa(w), iterations-1)
+	}
+}
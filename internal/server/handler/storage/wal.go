@@ -0,0 +1,360 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/megaded/metrictmr/internal/data"
+	"github.com/megaded/metrictmr/internal/logger"
+	"go.uber.org/zap"
+)
+
+// Политики сброса журнала на диск
+const (
+	// WALSyncAlways fsync после каждой записи
+	WALSyncAlways = "always"
+	// WALSyncInterval fsync по таймеру
+	WALSyncInterval = "interval"
+	// WALSyncNone сброс на диск остается операционной системе
+	WALSyncNone = "none"
+)
+
+const (
+	// заголовок записи: длина полезной нагрузки и контрольная сумма
+	walHeaderSize = 8
+	walSeqSize    = 8
+	// walMaxRecordSize защищает от чтения мусора вместо длины записи
+	walMaxRecordSize = 64 << 20
+)
+
+var (
+	walCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+	errWALCorrupt = errors.New("corrupt wal record")
+	errWALClosed  = errors.New("wal is closed")
+)
+
+// wal журнал операций Store, дописываемый в конец файла.
+//
+// Формат записи: [длина uint32][crc32c uint32][seq uint64][метрики JSON].
+// Контрольная сумма считается по seq и метрикам.
+type wal struct {
+	mu     sync.Mutex
+	path   string
+	file   *os.File
+	policy string
+	seq    uint64
+	// size длина журнала, запись идет в конец
+	size  int64
+	dirty bool
+	// closed запрещает запись после остановки хранилища
+	closed bool
+}
+
+// walMark позиция журнала, до которой записи вошли в снимок
+type walMark struct {
+	seq    uint64
+	offset int64
+}
+
+// ParseWALSync проверяет название политики сброса журнала
+func ParseWALSync(policy string) (string, error) {
+	switch policy {
+	case "":
+		return WALSyncAlways, nil
+	case WALSyncAlways, WALSyncInterval, WALSyncNone:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown wal sync policy %q", policy)
+}
+
+// rotateWAL переименовывает непустой журнал, не прочитанный при запуске без восстановления.
+// Журнал не удаляется: метрики из него можно восстановить вручную.
+func rotateWAL(path string) error {
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) || (err == nil && info.Size() == 0) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	rotated := fmt.Sprintf("%s.%s", path, time.Now().Format("20060102T150405.000000000"))
+	if err = os.Rename(path, rotated); err != nil {
+		return err
+	}
+	logger.Log.Warn("wal: restore is disabled, existing journal is kept aside", zap.String("path", rotated))
+	return nil
+}
+
+// walApply применяет запись журнала при восстановлении
+type walApply func(seq uint64, metrics []data.Metric) error
+
+// segmentPath путь к сегменту журнала: сегмент n содержит записи, сделанные между
+// поколениями снимка n и n-1, 0 - текущий журнал
+func segmentPath(path string, n int) string {
+	return generationPath(path, n)
+}
+
+// openWAL открывает журнал и воспроизводит записи с seq больше after.
+// Поврежденный хвост журнала отбрасывается.
+func openWAL(path string, policy string, after uint64, apply walApply) (*wal, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	w := &wal{path: path, file: file, policy: policy, seq: after}
+	if err = w.replay(after, apply); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// replaySegment воспроизводит записи сегмента с seq больше after и возвращает
+// номер последней записи сегмента. os.ErrNotExist - сегмента нет.
+func replaySegment(path string, after uint64, apply walApply) (uint64, error) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return after, err
+	}
+	defer file.Close()
+	w := &wal{path: path, file: file, seq: after}
+	err = w.replay(after, apply)
+	return w.seq, err
+}
+
+func (w *wal) replay(after uint64, apply walApply) error {
+	r := bufio.NewReader(w.file)
+	var offset int64
+	for {
+		seq, metrics, size, err := readWALRecord(r)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			logger.Log.Warn("wal: corrupt tail skipped", zap.Int64("offset", offset), zap.Error(err))
+			if err = w.file.Truncate(offset); err != nil {
+				return err
+			}
+			break
+		}
+		offset += size
+		if seq > w.seq {
+			w.seq = seq
+		}
+		if seq <= after || apply == nil {
+			continue
+		}
+		if err = apply(seq, metrics); err != nil {
+			return err
+		}
+	}
+	w.size = offset
+	_, err := w.file.Seek(offset, io.SeekStart)
+	return err
+}
+
+// readWALRecord читает одну запись. io.EOF - журнал закончился ровно на границе записи.
+func readWALRecord(r io.Reader) (seq uint64, metrics []data.Metric, size int64, err error) {
+	header := make([]byte, walHeaderSize)
+	n, err := io.ReadFull(r, header)
+	if err != nil {
+		if n == 0 && errors.Is(err, io.EOF) {
+			return 0, nil, 0, io.EOF
+		}
+		return 0, nil, 0, errWALCorrupt
+	}
+	length := binary.BigEndian.Uint32(header[0:4])
+	sum := binary.BigEndian.Uint32(header[4:8])
+	if length < walSeqSize || length > walMaxRecordSize {
+		return 0, nil, 0, errWALCorrupt
+	}
+	body := make([]byte, length)
+	if _, err = io.ReadFull(r, body); err != nil {
+		return 0, nil, 0, errWALCorrupt
+	}
+	if crc32.Checksum(body, walCRCTable) != sum {
+		return 0, nil, 0, errWALCorrupt
+	}
+	if err = json.Unmarshal(body[walSeqSize:], &metrics); err != nil {
+		return 0, nil, 0, errWALCorrupt
+	}
+	return binary.BigEndian.Uint64(body[:walSeqSize]), metrics, int64(walHeaderSize + length), nil
+}
+
+// append дописывает метрики в журнал и возвращает номер записи
+func (w *wal) append(metrics []data.Metric) (uint64, error) {
+	payload, err := json.Marshal(metrics)
+	if err != nil {
+		return 0, err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return 0, errWALClosed
+	}
+	seq := w.seq + 1
+	record := make([]byte, walHeaderSize+walSeqSize+len(payload))
+	binary.BigEndian.PutUint64(record[walHeaderSize:], seq)
+	copy(record[walHeaderSize+walSeqSize:], payload)
+	body := record[walHeaderSize:]
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(body)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.Checksum(body, walCRCTable))
+	if _, err = w.file.Write(record); err != nil {
+		return 0, err
+	}
+	w.size += int64(len(record))
+	w.seq = seq
+	if w.policy == WALSyncAlways {
+		return seq, w.file.Sync()
+	}
+	w.dirty = true
+	return seq, nil
+}
+
+// lastSeq номер последней записи
+func (w *wal) lastSeq() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.seq
+}
+
+// mark позиция после последней записи, вызывается вместе со снятием метрик для снимка
+func (w *wal) mark() walMark {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return walMark{seq: w.seq, offset: w.size}
+}
+
+// sync сбрасывает журнал на диск, если были записи после последнего сброса
+func (w *wal) sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.dirty {
+		return nil
+	}
+	w.dirty = false
+	return w.file.Sync()
+}
+
+// rotate начинает новый журнал после записи снимка: записи до mark становятся сегментом 1,
+// старые сегменты сдвигаются, хранится segments сегментов. Записи после mark, сделанные
+// во время записи снимка, переносятся в новый журнал. Если поколение снимка повреждено,
+// записи из сегментов восполняют разницу с предыдущим поколением.
+// Нумерация записей продолжается.
+func (w *wal) rotate(segments int, mark walMark) error {
+	if segments <= 0 {
+		return w.reset(mark)
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return errWALClosed
+	}
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	tail, err := w.tail(mark)
+	if err != nil {
+		return err
+	}
+	for n := segments; n > 1; n-- {
+		err := os.Rename(segmentPath(w.path, n-1), segmentPath(w.path, n))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if err = os.Rename(w.path, segmentPath(w.path, 1)); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(w.path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	old := w.file
+	w.file = file
+	w.dirty = false
+	// до обрезки сегмента хвост должен быть на диске в новом журнале: при сбое между
+	// шагами записи окажутся в обоих файлах, повтор отбрасывается по номеру
+	n, err := file.Write(tail)
+	w.size = int64(n)
+	if err != nil {
+		old.Close()
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		old.Close()
+		return err
+	}
+	if err = old.Truncate(mark.offset); err != nil {
+		old.Close()
+		return err
+	}
+	if err = old.Sync(); err != nil {
+		old.Close()
+		return err
+	}
+	if err = old.Close(); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(w.path))
+}
+
+// reset очищает журнал после записи снимка, оставляя записи после mark.
+// Нумерация записей продолжается.
+func (w *wal) reset(mark walMark) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return errWALClosed
+	}
+	tail, err := w.tail(mark)
+	if err != nil {
+		return err
+	}
+	if _, err = w.file.WriteAt(tail, 0); err != nil {
+		return err
+	}
+	if err = w.file.Truncate(int64(len(tail))); err != nil {
+		return err
+	}
+	if _, err = w.file.Seek(int64(len(tail)), io.SeekStart); err != nil {
+		return err
+	}
+	w.size = int64(len(tail))
+	w.dirty = false
+	return w.file.Sync()
+}
+
+// tail записи журнала после mark
+func (w *wal) tail(mark walMark) ([]byte, error) {
+	tail := make([]byte, w.size-mark.offset)
+	if _, err := w.file.ReadAt(tail, mark.offset); err != nil {
+		return nil, err
+	}
+	return tail, nil
+}
+
+// close сбрасывает журнал на диск и закрывает файл, следующие append возвращают ошибку
+func (w *wal) close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	if err := w.file.Sync(); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
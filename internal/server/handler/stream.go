@@ -0,0 +1,81 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/megaded/metrictmr/internal/server/broker"
+)
+
+const streamHeartbeat = 15 * time.Second
+
+// parseStreamFilter разбирает параметры фильтра подписки: prefix, match, type
+func parseStreamFilter(r *http.Request) (broker.Filter, error) {
+	q := r.URL.Query()
+	filter := broker.Filter{Prefix: q.Get("prefix"), MType: q.Get("type")}
+	if filter.MType != "" && filter.MType != gaugeType && filter.MType != counterType {
+		return filter, fmt.Errorf("invalid metric type %q", filter.MType)
+	}
+	if match := q.Get("match"); match != "" {
+		re, err := regexp.Compile(match)
+		if err != nil {
+			return filter, err
+		}
+		filter.Pattern = re
+	}
+	return filter, nil
+}
+
+// Поток изменений метрик в формате Server-Sent Events
+//
+// Параметры запроса: prefix, match (регулярное выражение), type.
+// Событие содержит значение метрики после сохранения (для counter - накопленную сумму,
+// как в /value/) и для counter - приращение increment.
+// Клиент, не успевающий читать события, отключается.
+func (h *handler) getStreamHandler() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		filter, err := parseStreamFilter(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		rc := http.NewResponseController(w)
+		sub := h.broker.Subscribe(filter)
+		defer h.broker.Unsubscribe(sub)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.WriteHeader(http.StatusOK)
+		if err = rc.Flush(); err != nil {
+			return
+		}
+
+		heartbeat := time.NewTicker(streamHeartbeat)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-sub.Done():
+				fmt.Fprint(w, "event: close\ndata: slow consumer\n\n")
+				rc.Flush()
+				return
+			case <-heartbeat.C:
+				fmt.Fprint(w, ": ping\n\n")
+			case e := <-sub.Events():
+				b, err := json.Marshal(e)
+				if err != nil {
+					return
+				}
+				fmt.Fprintf(w, "event: metric\ndata: %s\n\n", b)
+			}
+			if err = rc.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
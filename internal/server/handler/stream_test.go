@@ -0,0 +1,61 @@
+package handler
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/megaded/metrictmr/internal/data"
+	"github.com/megaded/metrictmr/internal/server/broker"
+	"github.com/megaded/metrictmr/internal/server/handler/storage"
+	"github.com/megaded/metrictmr/internal/server/middleware"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStream(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	mem := storage.NewInMemoryStorage()
+	b := broker.NewBroker(ctx, broker.DefaultBufferSize, mem)
+	store := storage.NewObservableStorage(mem, b)
+	ts := httptest.NewServer(CreateRouter(store, b, middleware.Logger, middleware.GzipMiddleware))
+	defer ts.Close()
+
+	var delta int64 = 5
+	require.NoError(t, store.Store(ctx, data.Metric{ID: "PollCount", MType: counterType, Delta: &delta}))
+
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+"/stream?match=^(Heap|Poll)", nil)
+	res, err := ts.Client().Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+	require.Eventually(t, func() bool { return b.Len() == 1 }, time.Second, 10*time.Millisecond)
+
+	var value float64 = 1
+	delta = 1
+	store.Store(ctx,
+		data.Metric{ID: "HeapAlloc", MType: gaugeType, Value: &value},
+		data.Metric{ID: "PollCount", MType: counterType, Delta: &delta},
+		data.Metric{ID: "Alloc", MType: gaugeType, Value: &value},
+	)
+
+	scanner := bufio.NewScanner(res.Body)
+	var lines []string
+	for scanner.Scan() && len(lines) < 4 {
+		if scanner.Text() != "" {
+			lines = append(lines, scanner.Text())
+		}
+	}
+	require.Len(t, lines, 4)
+	assert.Equal(t, "event: metric", lines[0])
+	assert.True(t, strings.HasPrefix(lines[1], `data: {"metric":{"id":"HeapAlloc","type":"gauge","value":1},"time":`), lines[1])
+	// counter передается накопленной суммой и приращением
+	assert.Equal(t, "event: metric", lines[2])
+	assert.True(t, strings.HasPrefix(lines[3], `data: {"metric":{"id":"PollCount","type":"counter","delta":6},"increment":1,"time":`), lines[3])
+}
@@ -5,7 +5,11 @@ import (
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
+	"github.com/megaded/metrictmr/internal/selfmetric"
+	"github.com/megaded/metrictmr/internal/server/broker"
 	"github.com/megaded/metrictmr/internal/server/handler/storage"
+	"github.com/megaded/metrictmr/internal/server/influx"
+	"github.com/megaded/metrictmr/internal/server/otlp"
 )
 
 const (
@@ -15,8 +19,23 @@ const (
 	nameParam   = "name"
 )
 
-func CreateRouter(s storage.Storager, middleWare ...func(http.Handler) http.Handler) http.Handler {
-	handler := handler{storage: s}
+// Options дополнительные параметры маршрутизатора
+type Options struct {
+	// Influx преобразование точек line protocol в метрики, по умолчанию все поля сохраняются как gauge
+	Influx *influx.Converter
+}
+
+// CreateRouter создает маршрутизатор. Если b не nil, доступны подписки на изменения /stream и /ws
+func CreateRouter(s storage.Storager, b *broker.Broker, middleWare ...func(http.Handler) http.Handler) http.Handler {
+	return CreateRouterWithOptions(s, b, Options{}, middleWare...)
+}
+
+// CreateRouterWithOptions создает маршрутизатор с параметрами opts
+func CreateRouterWithOptions(s storage.Storager, b *broker.Broker, opts Options, middleWare ...func(http.Handler) http.Handler) http.Handler {
+	handler := handler{storage: s, broker: b, influx: opts.Influx, otlp: otlp.NewConverter()}
+	if handler.influx == nil {
+		handler.influx, _ = influx.NewConverter("")
+	}
 	router := chi.NewRouter()
 	router.Use(middleware.Compress(5, "application/json", "text/html"))
 	for _, m := range middleWare {
@@ -32,6 +51,10 @@ func CreateRouter(s storage.Storager, middleWare ...func(http.Handler) http.Hand
 		r.Get("/{type}/{name}", handler.getMetricHandler())
 	})
 
+	router.Route("/values", func(r chi.Router) {
+		r.Post("/", handler.getMetricsBulkJSONHandler())
+	})
+
 	router.Route("/ping", func(r chi.Router) {
 		r.Get("/", handler.getPingDBHandler())
 	})
@@ -40,6 +63,33 @@ func CreateRouter(s storage.Storager, middleWare ...func(http.Handler) http.Hand
 		r.Post("/", handler.getSaveBulkJSONHandler())
 	})
 
+	// прием метрик в формате InfluxDB line protocol
+	router.Route("/write", func(r chi.Router) {
+		r.Post("/", handler.getInfluxWriteHandler())
+	})
+
+	// прием метрик OpenTelemetry по OTLP/HTTP
+	router.Post("/v1/metrics", handler.getOTLPMetricsHandler())
+
+	if b != nil {
+		router.Route("/stream", func(r chi.Router) {
+			r.Get("/", handler.getStreamHandler())
+		})
+		router.Route("/ws", func(r chi.Router) {
+			r.Get("/", handler.getWSHandler())
+		})
+	}
+
+	router.Route("/list", func(r chi.Router) {
+		r.Get("/", handler.getMetricListJSONHandler())
+	})
+
+	// собственные метрики сервера: повторные попытки запросов к хранилищу и т.п.
+	router.Route("/debug/metrics", func(r chi.Router) {
+		r.Get("/", selfmetric.Default.Handler())
+	})
+
+	router.Handle("/static/*", staticHandler())
 	router.Get("/", handler.getMetricListHandler())
 	return router
 }
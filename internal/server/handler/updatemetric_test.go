@@ -1,15 +1,22 @@
 package handler
 
 import (
+	"compress/gzip"
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/megaded/metrictmr/internal/data"
 	"github.com/megaded/metrictmr/internal/server/handler/storage"
+	"github.com/megaded/metrictmr/internal/server/middleware"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestSendMetric(t *testing.T) {
@@ -29,6 +36,9 @@ func TestSendMetric(t *testing.T) {
 		{name: "400 name empty", params: "update/gauge//11", code: http.StatusNotFound, method: http.MethodPost},
 		{name: "400 invalid type", params: "update/ffff/11/11", code: http.StatusBadRequest, method: http.MethodPost},
 		{name: "400 invalid value", params: "update/gauge/11/fdfdf", code: http.StatusBadRequest, method: http.MethodPost},
+		{name: "200 list", params: "list?type=gauge&sort=name&limit=10", code: http.StatusOK, method: http.MethodGet},
+		{name: "400 list invalid sort", params: "list?sort=value", code: http.StatusBadRequest, method: http.MethodGet},
+		{name: "400 list invalid cursor", params: "list?cursor=!", code: http.StatusBadRequest, method: http.MethodGet},
 	}
 	store := storage.NewInMemoryStorage()
 	var delta int64 = 1
@@ -37,7 +47,7 @@ func TestSendMetric(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			router := CreateRouter(store)
+			router := CreateRouter(store, nil)
 			ts := httptest.NewServer(router)
 			defer ts.Close()
 			client := ts.Client()
@@ -53,3 +63,178 @@ func TestSendMetric(t *testing.T) {
 		})
 	}
 }
+
+func TestGetMetricsBulk(t *testing.T) {
+	store := storage.NewInMemoryStorage()
+	var delta int64 = 3
+	var value float64 = 1.5
+	store.Store(context.TODO(), data.Metric{ID: "g", MType: gaugeType, Value: &value}, data.Metric{ID: "c", MType: counterType, Delta: &delta})
+	ts := httptest.NewServer(CreateRouter(store, nil))
+	defer ts.Close()
+
+	body := `[{"id":"g","type":"gauge"},{"id":"c","type":"counter"},{"id":"missing","type":"gauge"}]`
+	res, err := ts.Client().Post(ts.URL+"/values/", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	var got []bulkValue
+	if err = json.NewDecoder(res.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if assert.Len(t, got, 3) {
+		assert.Equal(t, value, *got[0].Value)
+		assert.Equal(t, delta, *got[1].Delta)
+		assert.False(t, got[1].NotFound)
+		assert.True(t, got[2].NotFound)
+		assert.Equal(t, "missing", got[2].ID)
+	}
+}
+
+func TestSaveBulkConcurrent(t *testing.T) {
+	store := storage.NewInMemoryStorage()
+	ts := httptest.NewServer(CreateRouter(store, nil))
+	defer ts.Close()
+
+	const workers = 8
+	const requests = 50
+	body := `[{"id":"PollCount","type":"counter","delta":1},{"id":"Alloc","type":"gauge","value":2.5}]`
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < requests; i++ {
+				res, err := ts.Client().Post(ts.URL+"/updates/", "application/json", strings.NewReader(body))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				res.Body.Close()
+			}
+		}()
+	}
+	wg.Wait()
+
+	m, err := store.GetCounter(context.TODO(), "PollCount")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(workers*requests), *m.Delta)
+}
+
+// failingStorage хранилище, возвращающее заданную ошибку. Без ошибки метрики сохраняются.
+type failingStorage struct {
+	*storage.InMemoryStorage
+	err error
+}
+
+func (s *failingStorage) Store(ctx context.Context, metric ...data.Metric) error {
+	if s.err == nil {
+		return s.InMemoryStorage.Store(ctx, metric...)
+	}
+	return s.err
+}
+
+func (s *failingStorage) GetGauge(ctx context.Context, name string) (data.Metric, error) {
+	return data.Metric{}, s.err
+}
+
+func TestStorageErrorStatus(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		code int
+	}{
+		{"not found", fmt.Errorf("%w: gauge x", storage.ErrNotFound), http.StatusNotFound},
+		{"invalid", fmt.Errorf("%w: empty metric name", storage.ErrInvalid), http.StatusBadRequest},
+		{"unavailable", fmt.Errorf("%w: connection refused", storage.ErrUnavailable), http.StatusServiceUnavailable},
+		{"deadline", context.DeadlineExceeded, http.StatusServiceUnavailable},
+		{"other", fmt.Errorf("disk full"), http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &failingStorage{InMemoryStorage: storage.NewInMemoryStorage(), err: tt.err}
+			ts := httptest.NewServer(CreateRouter(s, nil))
+			defer ts.Close()
+
+			res, err := ts.Client().Post(ts.URL+"/updates/", "application/json", strings.NewReader(`[{"id":"a","type":"gauge","value":1}]`))
+			assert.NoError(t, err)
+			res.Body.Close()
+			assert.Equal(t, tt.code, res.StatusCode)
+
+			res, err = ts.Client().Get(ts.URL + "/value/gauge/a")
+			assert.NoError(t, err)
+			res.Body.Close()
+			assert.Equal(t, tt.code, res.StatusCode)
+		})
+	}
+}
+
+func TestSaveBulkInvalid(t *testing.T) {
+	store := storage.NewInMemoryStorage()
+	ts := httptest.NewServer(CreateRouter(store, nil))
+	defer ts.Close()
+
+	res, err := ts.Client().Post(ts.URL+"/updates/", "application/json", strings.NewReader(`[{"id":"a","type":"gauge","value":1},{"id":"b","type":"histogram"}]`))
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	_, err = store.GetGauge(context.TODO(), "a")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	// метрика без значения отклоняется и не портит сохраненную
+	var value float64 = 1
+	assert.NoError(t, store.Store(context.TODO(), data.Metric{ID: "x", MType: gaugeType, Value: &value}))
+	for _, body := range []string{`[{"id":"x","type":"gauge"}]`, `[{"id":"x","type":"counter"}]`} {
+		res, err = ts.Client().Post(ts.URL+"/updates/", "application/json", strings.NewReader(body))
+		assert.NoError(t, err)
+		res.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, res.StatusCode, body)
+	}
+	res, err = ts.Client().Get(ts.URL + "/value/gauge/x")
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	_, err = store.GetCounter(context.TODO(), "x")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+}
+
+func TestGzipResponses(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		code   int
+		want   string
+	}{
+		{name: "update", method: http.MethodPost, path: "/update/gauge/a/1.5", code: http.StatusOK},
+		{name: "value", method: http.MethodGet, path: "/value/gauge/a", code: http.StatusOK, want: "1.5"},
+		{name: "value not found", method: http.MethodGet, path: "/value/gauge/missing", code: http.StatusNotFound},
+		{name: "values", method: http.MethodPost, path: "/values/", body: `[{"id":"a","type":"gauge"}]`, code: http.StatusOK, want: `"value":1.5`},
+		{name: "invalid batch", method: http.MethodPost, path: "/updates/", body: `[{"id":"b","type":"histogram"}]`, code: http.StatusBadRequest, want: "histogram"},
+		{name: "unknown route", method: http.MethodGet, path: "/unknown", code: http.StatusNotFound, want: "404 page not found"},
+	}
+	ts := httptest.NewServer(CreateRouter(storage.NewInMemoryStorage(), nil, middleware.GzipMiddleware))
+	defer ts.Close()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, ts.URL+tt.path, strings.NewReader(tt.body))
+			require.NoError(t, err)
+			req.Header.Set("Accept-Encoding", "gzip")
+			res, err := ts.Client().Do(req)
+			require.NoError(t, err)
+			defer res.Body.Close()
+			assert.Equal(t, tt.code, res.StatusCode)
+
+			// тело любого ответа, включая ошибки, читается по заголовку Content-Encoding
+			assert.Equal(t, "gzip", res.Header.Get("Content-Encoding"))
+			zr, err := gzip.NewReader(res.Body)
+			require.NoError(t, err)
+			got, err := io.ReadAll(zr)
+			require.NoError(t, err)
+			assert.Contains(t, string(got), tt.want)
+		})
+	}
+}
@@ -0,0 +1,291 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/megaded/metrictmr/internal/data"
+	"github.com/megaded/metrictmr/internal/logger"
+	"github.com/megaded/metrictmr/internal/server/broker"
+	"go.uber.org/zap"
+)
+
+const (
+	wsWriteTimeout     = 10 * time.Second
+	wsPongTimeout      = 60 * time.Second
+	wsPingInterval     = 20 * time.Second
+	wsSnapshotInterval = 30 * time.Second
+	wsMaxMessageSize   = 64 * 1024
+	wsOutBuffer        = 256
+)
+
+const (
+	wsActionSubscribe   = "subscribe"
+	wsActionUnsubscribe = "unsubscribe"
+
+	wsTypeSubscribed   = "subscribed"
+	wsTypeUnsubscribed = "unsubscribed"
+	wsTypeUpdate       = "update"
+	wsTypeSnapshot     = "snapshot"
+	wsTypeError        = "error"
+)
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+}
+
+// wsRequest сообщение клиента
+type wsRequest struct {
+	Action string   `json:"action"`
+	ID     string   `json:"id"`
+	Names  []string `json:"names,omitempty"`
+	Prefix string   `json:"prefix,omitempty"`
+	Match  string   `json:"match,omitempty"`
+	MType  string   `json:"type,omitempty"`
+}
+
+// wsResponse сообщение сервера
+type wsResponse struct {
+	Type    string        `json:"type"`
+	ID      string        `json:"id,omitempty"`
+	Metric  *data.Metric  `json:"metric,omitempty"`
+	Metrics []data.Metric `json:"metrics,omitempty"`
+	// Increment приращение counter в update, Metric содержит накопленную сумму
+	Increment *int64    `json:"increment,omitempty"`
+	Time      time.Time `json:"time"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// wsSession состояние одного WebSocket соединения
+type wsSession struct {
+	h    *handler
+	conn *websocket.Conn
+	out  chan wsResponse
+	ctx  context.Context
+
+	mu   sync.Mutex
+	subs map[string]*broker.Subscription
+}
+
+// WebSocket подписка на изменения метрик
+//
+// Клиент отправляет сообщения {"action":"subscribe","id":"...","names":[...],"match":"...","type":"..."}
+// и {"action":"unsubscribe","id":"..."}. Сервер присылает изменения (update),
+// периодические снимки (snapshot) и ping для контроля соединения.
+// Значения counter в update и snapshot - накопленные суммы, приращение передается в increment.
+func (h *handler) getWSHandler() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		conn, err := wsUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			logger.Log.Info("websocket upgrade", zap.Error(err))
+			return
+		}
+		ctx, cancel := context.WithCancel(r.Context())
+		s := &wsSession{h: h, conn: conn, out: make(chan wsResponse, wsOutBuffer), ctx: ctx, subs: map[string]*broker.Subscription{}}
+		go func() {
+			s.writeLoop()
+			cancel()
+			// разблокирует чтение, если запись завершилась первой
+			conn.Close()
+		}()
+		s.readLoop()
+		cancel()
+		s.unsubscribeAll()
+		conn.Close()
+	}
+}
+
+func (s *wsSession) readLoop() {
+	s.conn.SetReadLimit(wsMaxMessageSize)
+	s.conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	s.conn.SetPongHandler(func(string) error {
+		return s.conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	})
+	for {
+		var req wsRequest
+		if err := s.conn.ReadJSON(&req); err != nil {
+			return
+		}
+		switch req.Action {
+		case wsActionSubscribe:
+			s.subscribe(req)
+		case wsActionUnsubscribe:
+			if s.unsubscribe(req.ID) {
+				s.send(wsResponse{Type: wsTypeUnsubscribed, ID: req.ID})
+			}
+		default:
+			s.send(wsResponse{Type: wsTypeError, ID: req.ID, Error: fmt.Sprintf("unknown action %q", req.Action)})
+		}
+	}
+}
+
+// writeLoop единственный писатель в соединение: события, снимки и ping
+func (s *wsSession) writeLoop() {
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+	snapshot := time.NewTicker(wsSnapshotInterval)
+	defer snapshot.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			s.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(wsWriteTimeout))
+			return
+		case <-ping.C:
+			if err := s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout)); err != nil {
+				return
+			}
+		case <-snapshot.C:
+			for _, msg := range s.snapshots() {
+				if err := s.write(msg); err != nil {
+					return
+				}
+			}
+		case msg := <-s.out:
+			if err := s.write(msg); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *wsSession) write(msg wsResponse) error {
+	s.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	return s.conn.WriteJSON(msg)
+}
+
+// send ставит сообщение в очередь записи, false - соединение закрыто
+func (s *wsSession) send(msg wsResponse) bool {
+	if msg.Time.IsZero() {
+		msg.Time = time.Now()
+	}
+	select {
+	case s.out <- msg:
+		return true
+	case <-s.ctx.Done():
+		return false
+	}
+}
+
+func (s *wsSession) subscribe(req wsRequest) {
+	if req.ID == "" {
+		s.send(wsResponse{Type: wsTypeError, Error: "subscription id is required"})
+		return
+	}
+	if req.MType != "" && req.MType != gaugeType && req.MType != counterType {
+		s.send(wsResponse{Type: wsTypeError, ID: req.ID, Error: fmt.Sprintf("invalid metric type %q", req.MType)})
+		return
+	}
+	filter := broker.Filter{Prefix: req.Prefix, MType: req.MType}
+	if len(req.Names) > 0 {
+		filter.Names = make(map[string]struct{}, len(req.Names))
+		for _, n := range req.Names {
+			filter.Names[n] = struct{}{}
+		}
+	}
+	if req.Match != "" {
+		re, err := regexp.Compile(req.Match)
+		if err != nil {
+			s.send(wsResponse{Type: wsTypeError, ID: req.ID, Error: err.Error()})
+			return
+		}
+		filter.Pattern = re
+	}
+	s.unsubscribe(req.ID)
+	sub := s.h.broker.Subscribe(filter)
+	s.mu.Lock()
+	s.subs[req.ID] = sub
+	s.mu.Unlock()
+	go s.forward(req.ID, sub)
+	s.send(wsResponse{Type: wsTypeSubscribed, ID: req.ID})
+	s.send(s.snapshot(req.ID, sub))
+}
+
+// forward пересылает события подписки в очередь записи
+func (s *wsSession) forward(id string, sub *broker.Subscription) {
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-sub.Done():
+			// подписка удалена из сессии только если ее отключил брокер
+			if s.remove(id, sub) {
+				s.send(wsResponse{Type: wsTypeError, ID: id, Error: "slow consumer, subscription closed"})
+			}
+			return
+		case e := <-sub.Events():
+			m := e.Metric
+			if !s.send(wsResponse{Type: wsTypeUpdate, ID: id, Metric: &m, Increment: e.Increment, Time: e.Time}) {
+				return
+			}
+		}
+	}
+}
+
+// snapshot текущие значения метрик подписки
+func (s *wsSession) snapshot(id string, sub *broker.Subscription) wsResponse {
+	metrics, err := s.h.storage.GetMetrics(s.ctx)
+	if err != nil {
+		return wsResponse{Type: wsTypeError, ID: id, Error: err.Error(), Time: time.Now()}
+	}
+	result := make([]data.Metric, 0)
+	for _, m := range metrics {
+		if sub.Filter().Match(m) {
+			result = append(result, m)
+		}
+	}
+	return wsResponse{Type: wsTypeSnapshot, ID: id, Metrics: result, Time: time.Now()}
+}
+
+// snapshots снимки по всем подпискам сессии
+func (s *wsSession) snapshots() []wsResponse {
+	s.mu.Lock()
+	subs := make(map[string]*broker.Subscription, len(s.subs))
+	for id, sub := range s.subs {
+		subs[id] = sub
+	}
+	s.mu.Unlock()
+	result := make([]wsResponse, 0, len(subs))
+	for id, sub := range subs {
+		result = append(result, s.snapshot(id, sub))
+	}
+	return result
+}
+
+// remove удаляет подписку id, если она все еще равна sub
+func (s *wsSession) remove(id string, sub *broker.Subscription) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.subs[id] != sub {
+		return false
+	}
+	delete(s.subs, id)
+	return true
+}
+
+// unsubscribe удаляет подписку, false - подписки не было
+func (s *wsSession) unsubscribe(id string) bool {
+	s.mu.Lock()
+	sub, ok := s.subs[id]
+	delete(s.subs, id)
+	s.mu.Unlock()
+	if ok {
+		s.h.broker.Unsubscribe(sub)
+	}
+	return ok
+}
+
+func (s *wsSession) unsubscribeAll() {
+	s.mu.Lock()
+	subs := s.subs
+	s.subs = map[string]*broker.Subscription{}
+	s.mu.Unlock()
+	for _, sub := range subs {
+		s.h.broker.Unsubscribe(sub)
+	}
+}
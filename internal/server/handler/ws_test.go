@@ -0,0 +1,85 @@
+package handler
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/megaded/metrictmr/internal/data"
+	"github.com/megaded/metrictmr/internal/server/broker"
+	"github.com/megaded/metrictmr/internal/server/handler/storage"
+	"github.com/megaded/metrictmr/internal/server/middleware"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWS(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	mem := storage.NewInMemoryStorage()
+	b := broker.NewBroker(ctx, broker.DefaultBufferSize, mem)
+	store := storage.NewObservableStorage(mem, b)
+	var value float64 = 1
+	store.Store(ctx, data.Metric{ID: "Alloc", MType: gaugeType, Value: &value})
+	ts := httptest.NewServer(CreateRouter(store, b, middleware.Logger, middleware.GzipMiddleware))
+	defer ts.Close()
+
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, "ws"+strings.TrimPrefix(ts.URL, "http")+"/ws", nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	read := func() wsResponse {
+		var msg wsResponse
+		require.NoError(t, conn.ReadJSON(&msg))
+		return msg
+	}
+
+	require.NoError(t, conn.WriteJSON(wsRequest{Action: "bad"}))
+	assert.Equal(t, wsTypeError, read().Type)
+
+	require.NoError(t, conn.WriteJSON(wsRequest{Action: wsActionSubscribe, ID: "mem", Names: []string{"Alloc"}}))
+	assert.Equal(t, wsResponse{Type: wsTypeSubscribed, ID: "mem"}, stripTime(read()))
+	snapshot := read()
+	assert.Equal(t, wsTypeSnapshot, snapshot.Type)
+	assert.Len(t, snapshot.Metrics, 1)
+
+	newValue := 2.0
+	store.Store(ctx, data.Metric{ID: "Other", MType: gaugeType, Value: &newValue}, data.Metric{ID: "Alloc", MType: gaugeType, Value: &newValue})
+	update := read()
+	assert.Equal(t, wsTypeUpdate, update.Type)
+	require.NotNil(t, update.Metric)
+	assert.Equal(t, "Alloc", update.Metric.ID)
+	assert.Equal(t, 2.0, *update.Metric.Value)
+
+	require.NoError(t, conn.WriteJSON(wsRequest{Action: wsActionUnsubscribe, ID: "mem"}))
+	assert.Equal(t, wsTypeUnsubscribed, read().Type)
+
+	var delta int64 = 4
+	require.NoError(t, store.Store(ctx, data.Metric{ID: "PollCount", MType: counterType, Delta: &delta}))
+	require.NoError(t, conn.WriteJSON(wsRequest{Action: wsActionSubscribe, ID: "count", MType: counterType}))
+	assert.Equal(t, wsTypeSubscribed, read().Type)
+	snapshot = read()
+	require.Len(t, snapshot.Metrics, 1)
+	assert.Equal(t, int64(4), *snapshot.Metrics[0].Delta)
+	delta = 3
+	require.NoError(t, store.Store(ctx, data.Metric{ID: "PollCount", MType: counterType, Delta: &delta}))
+	update = read()
+	assert.Equal(t, wsTypeUpdate, update.Type)
+	require.NotNil(t, update.Metric)
+	assert.Equal(t, int64(7), *update.Metric.Delta, "update carries the total like the snapshot")
+	require.NotNil(t, update.Increment)
+	assert.Equal(t, int64(3), *update.Increment)
+
+	require.NoError(t, conn.WriteJSON(wsRequest{Action: wsActionUnsubscribe, ID: "count"}))
+	assert.Equal(t, wsTypeUnsubscribed, read().Type)
+	assert.Eventually(t, func() bool { return b.Len() == 0 }, time.Second, 10*time.Millisecond)
+}
+
+func stripTime(m wsResponse) wsResponse {
+	m.Time = time.Time{}
+	return m
+}
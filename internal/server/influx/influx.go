@@ -0,0 +1,271 @@
+// Разбор InfluxDB line protocol
+//
+// Строка имеет вид measurement[,tag=value...] field=value[,field=value...] [timestamp].
+// Метрика получает имя measurement_field, теги становятся метками идентификатора (data.SeriesID).
+package influx
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/megaded/metrictmr/internal/data"
+)
+
+// FieldKind тип значения поля
+type FieldKind int
+
+const (
+	Float FieldKind = iota
+	Integer
+	Unsigned
+	Boolean
+	String
+)
+
+// Point одна строка line protocol
+type Point struct {
+	Measurement string
+	Tags        map[string]string
+	Fields      []Field
+	Time        time.Time
+}
+
+type Field struct {
+	Key   string
+	Kind  FieldKind
+	Value float64
+	// Int значение целочисленного поля без потери точности
+	Int int64
+}
+
+// LineError ошибка разбора строки с ее номером (с единицы)
+type LineError struct {
+	Line int    `json:"line"`
+	Err  string `json:"error"`
+}
+
+// ErrPrecision неизвестная точность временной метки
+var ErrPrecision = errors.New("invalid precision")
+
+// maxLineSize ограничение длины строки
+const maxLineSize = 1 << 20
+
+// Precision единица временной метки по значению параметра precision, по умолчанию наносекунды
+func Precision(value string) (time.Duration, error) {
+	switch value {
+	case "", "n", "ns":
+		return time.Nanosecond, nil
+	case "u", "us":
+		return time.Microsecond, nil
+	case "ms":
+		return time.Millisecond, nil
+	case "s":
+		return time.Second, nil
+	}
+	return 0, fmt.Errorf("%w %q: expected ns, us, ms or s", ErrPrecision, value)
+}
+
+// Parse разбирает строки из r. Ошибочные строки пропускаются и возвращаются в списке ошибок,
+// ошибка возвращается только при сбое чтения.
+func Parse(r io.Reader, precision time.Duration, now time.Time) ([]Point, []LineError, error) {
+	points := make([]Point, 0)
+	var lineErrors []LineError
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineSize)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		p, err := ParseLine(line, precision, now)
+		if err != nil {
+			lineErrors = append(lineErrors, LineError{Line: n, Err: err.Error()})
+			continue
+		}
+		points = append(points, p)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	return points, lineErrors, nil
+}
+
+// ParseLine разбирает одну строку. Без временной метки точке присваивается now.
+func ParseLine(line string, precision time.Duration, now time.Time) (Point, error) {
+	sections := split(line, ' ', true)
+	if len(sections) < 2 || len(sections) > 3 {
+		return Point{}, errors.New("expected measurement, fields and optional timestamp")
+	}
+	p := Point{Tags: map[string]string{}, Time: now}
+
+	key := split(sections[0], ',', false)
+	p.Measurement = unescape(key[0])
+	if p.Measurement == "" {
+		return Point{}, errors.New("missing measurement")
+	}
+	for _, tag := range key[1:] {
+		k, v, ok := cut(tag)
+		if !ok || k == "" || v == "" {
+			return Point{}, fmt.Errorf("invalid tag %q", tag)
+		}
+		p.Tags[unescape(k)] = unescape(v)
+	}
+
+	for _, f := range split(sections[1], ',', true) {
+		k, v, ok := cut(f)
+		if !ok || k == "" || v == "" {
+			return Point{}, fmt.Errorf("invalid field %q", f)
+		}
+		field, err := parseField(unescape(k), v)
+		if err != nil {
+			return Point{}, err
+		}
+		p.Fields = append(p.Fields, field)
+	}
+
+	if len(sections) == 3 {
+		ts, err := strconv.ParseInt(sections[2], 10, 64)
+		if err != nil {
+			return Point{}, fmt.Errorf("invalid timestamp %q", sections[2])
+		}
+		if ts > math.MaxInt64/int64(precision) || ts < math.MinInt64/int64(precision) {
+			return Point{}, fmt.Errorf("timestamp %q out of range", sections[2])
+		}
+		p.Time = time.Unix(0, ts*int64(precision))
+	}
+	return p, nil
+}
+
+func parseField(key string, value string) (Field, error) {
+	f := Field{Key: key}
+	switch {
+	case strings.HasPrefix(value, `"`):
+		if len(value) < 2 || !strings.HasSuffix(value, `"`) {
+			return f, fmt.Errorf("field %s: unterminated string", key)
+		}
+		f.Kind = String
+		return f, nil
+	case strings.HasSuffix(value, "i"):
+		n, err := strconv.ParseInt(value[:len(value)-1], 10, 64)
+		if err != nil {
+			return f, fmt.Errorf("field %s: invalid integer %q", key, value)
+		}
+		f.Kind, f.Int, f.Value = Integer, n, float64(n)
+		return f, nil
+	case strings.HasSuffix(value, "u"):
+		n, err := strconv.ParseUint(value[:len(value)-1], 10, 64)
+		if err != nil || n > math.MaxInt64 {
+			return f, fmt.Errorf("field %s: invalid unsigned integer %q", key, value)
+		}
+		f.Kind, f.Int, f.Value = Unsigned, int64(n), float64(n)
+		return f, nil
+	}
+	switch value {
+	case "t", "T", "true", "True", "TRUE":
+		f.Kind, f.Value = Boolean, 1
+		return f, nil
+	case "f", "F", "false", "False", "FALSE":
+		f.Kind, f.Value = Boolean, 0
+		return f, nil
+	}
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		return f, fmt.Errorf("field %s: invalid float %q", key, value)
+	}
+	f.Kind, f.Value = Float, v
+	return f, nil
+}
+
+// split делит строку по неэкранированному разделителю. При quoted разделители
+// внутри строк в двойных кавычках не учитываются.
+func split(s string, sep byte, quoted bool) []string {
+	var parts []string
+	start := 0
+	inQuotes := false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && i+1 < len(s):
+			i++
+		case quoted && s[i] == '"':
+			inQuotes = !inQuotes
+		case s[i] == sep && !inQuotes:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// cut делит пару key=value по первому неэкранированному знаку равенства
+func cut(s string) (string, string, bool) {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '=':
+			return s[:i], s[i+1:], true
+		}
+	}
+	return s, "", false
+}
+
+// unescape убирает экранирование запятых, пробелов, знаков равенства и обратной косой черты
+func unescape(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && strings.IndexByte(`, =\"`, s[i+1]) >= 0 {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// Converter переводит точки в метрики. Целочисленные поля, имя которых (measurement_field)
+// подходит под выражение counterFields, становятся приращениями counter, остальные поля - gauge.
+// Логические поля передаются как 0 и 1, строковые пропускаются.
+type Converter struct {
+	counterFields *regexp.Regexp
+}
+
+// NewConverter пустое выражение означает, что все поля сохраняются как gauge
+func NewConverter(counterFields string) (*Converter, error) {
+	c := &Converter{}
+	if counterFields != "" {
+		re, err := regexp.Compile(counterFields)
+		if err != nil {
+			return nil, fmt.Errorf("invalid counter fields rule: %w", err)
+		}
+		c.counterFields = re
+	}
+	return c, nil
+}
+
+func (c *Converter) Metrics(p Point) []data.Metric {
+	metrics := make([]data.Metric, 0, len(p.Fields))
+	for _, f := range p.Fields {
+		if f.Kind == String {
+			continue
+		}
+		name := p.Measurement + "_" + f.Key
+		id := data.SeriesID(name, p.Tags)
+		if (f.Kind == Integer || f.Kind == Unsigned) && c.counterFields != nil && c.counterFields.MatchString(name) {
+			delta := f.Int
+			metrics = append(metrics, data.Metric{ID: id, MType: data.MTypeCounter, Delta: &delta})
+			continue
+		}
+		value := f.Value
+		metrics = append(metrics, data.Metric{ID: id, MType: data.MTypeGauge, Value: &value})
+	}
+	return metrics
+}
@@ -0,0 +1,198 @@
+package influx
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/megaded/metrictmr/internal/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLine(t *testing.T) {
+	now := time.Unix(100, 0)
+	testCases := []struct {
+		name      string
+		line      string
+		precision time.Duration
+		want      Point
+	}{
+		{
+			name:      "float without tags and timestamp",
+			line:      "cpu value=0.64",
+			precision: time.Nanosecond,
+			want: Point{
+				Measurement: "cpu",
+				Tags:        map[string]string{},
+				Fields:      []Field{{Key: "value", Kind: Float, Value: 0.64}},
+				Time:        now,
+			},
+		},
+		{
+			name:      "tags, all field kinds and nanosecond timestamp",
+			line:      `mem,host=a,region=eu used=12i,free=3u,ok=t,note="x y, z=1",ratio=1e-2 1700000000123456789`,
+			precision: time.Nanosecond,
+			want: Point{
+				Measurement: "mem",
+				Tags:        map[string]string{"host": "a", "region": "eu"},
+				Fields: []Field{
+					{Key: "used", Kind: Integer, Value: 12, Int: 12},
+					{Key: "free", Kind: Unsigned, Value: 3, Int: 3},
+					{Key: "ok", Kind: Boolean, Value: 1},
+					{Key: "note", Kind: String},
+					{Key: "ratio", Kind: Float, Value: 0.01},
+				},
+				Time: time.Unix(1700000000, 123456789),
+			},
+		},
+		{
+			name:      "escaped measurement, tags and field key",
+			line:      `disk\ io,path=/var\,log,k\=1=v\ 2 read\ bytes=-5i`,
+			precision: time.Nanosecond,
+			want: Point{
+				Measurement: "disk io",
+				Tags:        map[string]string{"path": "/var,log", "k=1": "v 2"},
+				Fields:      []Field{{Key: "read bytes", Kind: Integer, Value: -5, Int: -5}},
+				Time:        now,
+			},
+		},
+		{
+			name:      "second precision",
+			line:      "up value=F 1700000000",
+			precision: time.Second,
+			want: Point{
+				Measurement: "up",
+				Tags:        map[string]string{},
+				Fields:      []Field{{Key: "value", Kind: Boolean}},
+				Time:        time.Unix(1700000000, 0),
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := ParseLine(tc.line, tc.precision, now)
+			require.NoError(t, err)
+			assert.Equal(t, tc.want.Measurement, p.Measurement)
+			assert.Equal(t, tc.want.Tags, p.Tags)
+			assert.Equal(t, tc.want.Fields, p.Fields)
+			assert.True(t, tc.want.Time.Equal(p.Time), "time %v, want %v", p.Time, tc.want.Time)
+		})
+	}
+}
+
+func TestParseLineErrors(t *testing.T) {
+	testCases := []struct {
+		name      string
+		line      string
+		precision time.Duration
+	}{
+		{name: "no fields", line: "cpu", precision: time.Nanosecond},
+		{name: "too many sections", line: "cpu value=1 1 2", precision: time.Nanosecond},
+		{name: "empty measurement", line: ",host=a value=1", precision: time.Nanosecond},
+		{name: "tag without value", line: "cpu,host value=1", precision: time.Nanosecond},
+		{name: "field without value", line: "cpu value=", precision: time.Nanosecond},
+		{name: "invalid float", line: "cpu value=abc", precision: time.Nanosecond},
+		{name: "NaN", line: "cpu value=NaN", precision: time.Nanosecond},
+		{name: "invalid integer", line: "cpu value=1.5i", precision: time.Nanosecond},
+		{name: "negative unsigned", line: "cpu value=-1u", precision: time.Nanosecond},
+		{name: "unterminated string", line: `cpu value="abc`, precision: time.Nanosecond},
+		{name: "invalid timestamp", line: "cpu value=1 now", precision: time.Nanosecond},
+		{name: "timestamp out of range", line: "cpu value=1 9223372036854775807", precision: time.Second},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := ParseLine(tc.line, tc.precision, time.Now())
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	body := strings.Join([]string{
+		"# comment",
+		"cpu value=1",
+		"",
+		"cpu value=oops",
+		"mem used=2i 1700000000000",
+		"broken",
+	}, "\n")
+	points, lineErrors, err := Parse(strings.NewReader(body), time.Millisecond, time.Now())
+	require.NoError(t, err)
+	require.Len(t, points, 2)
+	assert.Equal(t, "cpu", points[0].Measurement)
+	assert.True(t, time.Unix(1700000000, 0).Equal(points[1].Time))
+	require.Len(t, lineErrors, 2)
+	assert.Equal(t, 4, lineErrors[0].Line)
+	assert.Equal(t, 6, lineErrors[1].Line)
+}
+
+func TestPrecision(t *testing.T) {
+	testCases := []struct {
+		value string
+		want  time.Duration
+	}{
+		{value: "", want: time.Nanosecond},
+		{value: "ns", want: time.Nanosecond},
+		{value: "us", want: time.Microsecond},
+		{value: "ms", want: time.Millisecond},
+		{value: "s", want: time.Second},
+	}
+	for _, tc := range testCases {
+		got, err := Precision(tc.value)
+		require.NoError(t, err)
+		assert.Equal(t, tc.want, got)
+	}
+	_, err := Precision("h")
+	assert.ErrorIs(t, err, ErrPrecision)
+}
+
+func TestConverter(t *testing.T) {
+	p := Point{
+		Measurement: "http",
+		Tags:        map[string]string{"method": "GET", "host": "a"},
+		Fields: []Field{
+			{Key: "requests", Kind: Integer, Value: 5, Int: 5},
+			{Key: "inflight", Kind: Integer, Value: 2, Int: 2},
+			{Key: "latency", Kind: Float, Value: 0.25},
+			{Key: "up", Kind: Boolean, Value: 1},
+			{Key: "path", Kind: String},
+		},
+	}
+
+	t.Run("counter rule", func(t *testing.T) {
+		c, err := NewConverter(`_requests$`)
+		require.NoError(t, err)
+		metrics := c.Metrics(p)
+		require.Len(t, metrics, 4)
+		assert.Equal(t, "http_requests;host=a;method=GET", metrics[0].ID)
+		assert.Equal(t, data.MTypeCounter, metrics[0].MType)
+		assert.Equal(t, int64(5), *metrics[0].Delta)
+		for _, m := range metrics[1:] {
+			assert.Equal(t, data.MTypeGauge, m.MType, m.ID)
+		}
+		assert.Equal(t, 2.0, *metrics[1].Value)
+		assert.Equal(t, 0.25, *metrics[2].Value)
+		assert.Equal(t, 1.0, *metrics[3].Value)
+	})
+
+	t.Run("without rule all fields are gauges", func(t *testing.T) {
+		c, err := NewConverter("")
+		require.NoError(t, err)
+		for _, m := range c.Metrics(p) {
+			assert.Equal(t, data.MTypeGauge, m.MType, m.ID)
+		}
+	})
+
+	t.Run("float fields never become counters", func(t *testing.T) {
+		c, err := NewConverter(`.*`)
+		require.NoError(t, err)
+		metrics := c.Metrics(p)
+		assert.Equal(t, data.MTypeGauge, metrics[2].MType)
+	})
+
+	t.Run("invalid rule", func(t *testing.T) {
+		_, err := NewConverter(`(`)
+		assert.Error(t, err)
+	})
+}
@@ -26,7 +26,9 @@ func GzipMiddleware(h http.Handler) http.Handler {
 
 		acceptEncoding := r.Header.Get("Accept-Encoding")
 		supportsGzip := strings.Contains(acceptEncoding, "gzip")
-		if supportsGzip {
+		// соединение с Upgrade (WebSocket) перехватывается обработчиком, сжимать нечего
+		isUpgrade := r.Header.Get("Upgrade") != ""
+		if supportsGzip && !isUpgrade {
 			cw := newCompressWriter(w)
 			ow = cw
 			defer cw.Close()
@@ -1,8 +1,10 @@
 package middleware
 
 import (
+	"bufio"
 	"compress/gzip"
 	"io"
+	"net"
 	"net/http"
 	"strings"
 )
@@ -41,16 +43,17 @@ func (c *GZipCompressor) WriteHeader(statusCode int) {
 	c.ResponseWriter.WriteHeader(statusCode)
 }
 
+// compressWriter сжимает тело ответа. Сжатие включается при отправке кода ответа,
+// если ответ с этим кодом может иметь тело
 type compressWriter struct {
 	w  http.ResponseWriter
 	zw *gzip.Writer
+	// wroteHeader код ответа отправлен
+	wroteHeader bool
 }
 
 func newCompressWriter(w http.ResponseWriter) *compressWriter {
-	return &compressWriter{
-		w:  w,
-		zw: gzip.NewWriter(w),
-	}
+	return &compressWriter{w: w}
 }
 
 func (c *compressWriter) Header() http.Header {
@@ -58,17 +61,55 @@ func (c *compressWriter) Header() http.Header {
 }
 
 func (c *compressWriter) Write(p []byte) (int, error) {
+	if !c.wroteHeader {
+		c.WriteHeader(http.StatusOK)
+	}
+	if c.zw == nil {
+		return c.w.Write(p)
+	}
 	return c.zw.Write(p)
 }
 
+// WriteHeader тело сжимается при любом коде ответа, поэтому заголовок ставится всегда:
+// иначе клиент не сможет прочитать текст ошибки. Ответы без тела (1xx, 204, 304) не сжимаются.
 func (c *compressWriter) WriteHeader(statusCode int) {
-	if statusCode < 300 {
+	if c.wroteHeader || statusCode < http.StatusOK {
+		c.w.WriteHeader(statusCode)
+		return
+	}
+	c.wroteHeader = true
+	if statusCode != http.StatusNoContent && statusCode != http.StatusNotModified {
 		c.w.Header().Set("Content-Encoding", "gzip")
+		c.w.Header().Del("Content-Length")
+		c.zw = gzip.NewWriter(c.w)
 	}
 	c.w.WriteHeader(statusCode)
 }
 
+// Flush сбрасывает сжатые данные клиенту, нужен для потоковых ответов
+func (c *compressWriter) Flush() {
+	if !c.wroteHeader {
+		c.WriteHeader(http.StatusOK)
+	}
+	if c.zw != nil {
+		c.zw.Flush()
+	}
+	http.NewResponseController(c.w).Flush()
+}
+
+func (c *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(c.w).Hijack()
+}
+
+func (c *compressWriter) Unwrap() http.ResponseWriter {
+	return c.w
+}
+
+// Close завершает сжатый поток. Если обработчик не отправил ни кода, ни тела, ответ остается без тела.
 func (c *compressWriter) Close() error {
+	if c.zw == nil {
+		return nil
+	}
 	return c.zw.Close()
 }
 
@@ -0,0 +1,90 @@
+package middleware
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGzipMiddleware(t *testing.T) {
+	tests := []struct {
+		name     string
+		handler  http.HandlerFunc
+		accept   bool
+		code     int
+		encoding string
+		body     string
+	}{
+		{
+			name:     "implicit ok",
+			handler:  func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "hello") },
+			accept:   true,
+			code:     http.StatusOK,
+			encoding: "gzip",
+			body:     "hello",
+		},
+		{
+			name:     "error text",
+			handler:  func(w http.ResponseWriter, r *http.Request) { http.Error(w, "bad request", http.StatusBadRequest) },
+			accept:   true,
+			code:     http.StatusBadRequest,
+			encoding: "gzip",
+			body:     "bad request\n",
+		},
+		{
+			name:    "no content",
+			handler: func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) },
+			accept:  true,
+			code:    http.StatusNoContent,
+		},
+		{
+			name:    "not modified",
+			handler: func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNotModified) },
+			accept:  true,
+			code:    http.StatusNotModified,
+		},
+		{
+			name:    "empty handler",
+			handler: func(w http.ResponseWriter, r *http.Request) {},
+			accept:  true,
+			code:    http.StatusOK,
+		},
+		{
+			name:    "gzip not accepted",
+			handler: func(w http.ResponseWriter, r *http.Request) { http.Error(w, "not found", http.StatusNotFound) },
+			code:    http.StatusNotFound,
+			body:    "not found\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := httptest.NewServer(GzipMiddleware(tt.handler))
+			defer ts.Close()
+			req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+			require.NoError(t, err)
+			if tt.accept {
+				req.Header.Set("Accept-Encoding", "gzip")
+			}
+			res, err := ts.Client().Do(req)
+			require.NoError(t, err)
+			defer res.Body.Close()
+
+			assert.Equal(t, tt.code, res.StatusCode)
+			assert.Equal(t, tt.encoding, res.Header.Get("Content-Encoding"))
+			var body io.Reader = res.Body
+			if tt.encoding == "gzip" {
+				zr, err := gzip.NewReader(res.Body)
+				require.NoError(t, err)
+				body = zr
+			}
+			got, err := io.ReadAll(body)
+			require.NoError(t, err)
+			assert.Equal(t, tt.body, string(got))
+		})
+	}
+}
@@ -1,11 +1,13 @@
 package middleware
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
 	"io"
+	"net"
 	"net/http"
 
 	"github.com/megaded/metrictmr/internal/logger"
@@ -73,3 +75,11 @@ func (r *hashWriter) Write(b []byte) (int, error) {
 func (r *hashWriter) WriteHeader(statusCode int) {
 	r.ResponseWriter.WriteHeader(statusCode)
 }
+
+func (r *hashWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(r.ResponseWriter).Hijack()
+}
+
+func (r *hashWriter) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
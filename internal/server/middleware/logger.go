@@ -1,8 +1,10 @@
 package middleware
 
 import (
+	"bufio"
 	"bytes"
 	"io"
+	"net"
 	"net/http"
 	"time"
 
@@ -31,6 +33,14 @@ func (r *responseLogWriter) WriteHeader(statusCode int) {
 	r.data.status = statusCode
 }
 
+func (r *responseLogWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(r.ResponseWriter).Hijack()
+}
+
+func (r *responseLogWriter) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
 func (r *responseLogWriter) logResponse() {
 	logger.Log.Info("Response status", zap.Int("status", r.data.status))
 	logger.Log.Info("Response size", zap.Int("size", r.data.size))
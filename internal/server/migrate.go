@@ -0,0 +1,94 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/megaded/metrictmr/internal/logger"
+	"github.com/megaded/metrictmr/internal/server/handler/config"
+	"github.com/megaded/metrictmr/internal/server/handler/storage"
+	"go.uber.org/zap"
+)
+
+const migrateUsage = "usage: server migrate [up | down [steps] | status] [flags]"
+
+// Migrate выполняет подкоманду migrate без запуска сервера.
+// args - аргументы после "migrate": действие и флаги конфигурации в любом порядке.
+func Migrate(ctx context.Context, args []string, out io.Writer) error {
+	logger.SetupLogger("Info")
+	command, flags := splitMigrateArgs(args)
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	fs.SetOutput(out)
+	cfg, err := config.ParseConfig(fs, flags)
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, migrateUsage)
+	}
+	command = append(command, fs.Args()...)
+	if cfg.DBConnString == "" || storage.IsSQLiteDSN(cfg.DBConnString) {
+		return errors.New("migrate requires a postgres DATABASE_DSN")
+	}
+	db, err := sql.Open("pgx", cfg.DBConnString)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	action := "up"
+	if len(command) > 0 {
+		action = command[0]
+	}
+	switch action {
+	case "up":
+		n, err := storage.MigrateUp(ctx, db)
+		if err != nil {
+			return err
+		}
+		logger.Log.Info("migrations applied", zap.Int("count", n))
+		return nil
+	case "down":
+		steps := 1
+		if len(command) > 1 {
+			steps, err = strconv.Atoi(command[1])
+			if err != nil || steps < 1 {
+				return fmt.Errorf("invalid steps %q: %s", command[1], migrateUsage)
+			}
+		}
+		n, err := storage.MigrateDown(ctx, db, steps)
+		if err != nil {
+			return err
+		}
+		logger.Log.Info("migrations reverted", zap.Int("count", n))
+		return nil
+	case "status":
+		states, err := storage.MigrationStatus(ctx, db)
+		if err != nil {
+			return err
+		}
+		for _, s := range states {
+			applied := "pending"
+			if s.Applied {
+				applied = "applied " + s.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Fprintf(out, "%04d %-30s %s\n", s.Version, s.Name, applied)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown migrate action %q: %s", action, migrateUsage)
+}
+
+// splitMigrateArgs отделяет действие и его параметры, идущие до первого флага
+func splitMigrateArgs(args []string) (command []string, flags []string) {
+	for i, a := range args {
+		if strings.HasPrefix(a, "-") {
+			return command, args[i:]
+		}
+		command = append(command, a)
+	}
+	return command, nil
+}
@@ -0,0 +1,38 @@
+package server
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitMigrateArgs(t *testing.T) {
+	tests := []struct {
+		args    []string
+		command []string
+		flags   []string
+	}{
+		{nil, nil, nil},
+		{[]string{"up"}, []string{"up"}, nil},
+		{[]string{"down", "2", "-d", "dsn"}, []string{"down", "2"}, []string{"-d", "dsn"}},
+		{[]string{"-d", "dsn", "status"}, nil, []string{"-d", "dsn", "status"}},
+	}
+	for _, tt := range tests {
+		command, flags := splitMigrateArgs(tt.args)
+		assert.Equal(t, tt.command, command)
+		assert.Equal(t, tt.flags, flags)
+	}
+}
+
+func TestMigrate_Flags(t *testing.T) {
+	t.Setenv("DATABASE_DSN", "")
+	// флаги разбираются в собственный FlagSet, поэтому Migrate можно вызывать повторно
+	for i := 0; i < 2; i++ {
+		err := Migrate(context.Background(), []string{"status", "-d", "sqlite://metrics.db"}, io.Discard)
+		assert.ErrorContains(t, err, "requires a postgres")
+	}
+	err := Migrate(context.Background(), []string{"up", "-unknown"}, io.Discard)
+	assert.ErrorContains(t, err, migrateUsage)
+}
@@ -0,0 +1,347 @@
+package otlp
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/megaded/metrictmr/internal/data"
+	"github.com/megaded/metrictmr/internal/selfmetric"
+)
+
+const (
+	// seriesTTL ряд counter, не обновлявшийся дольше, забывается: при появлении снова
+	// его первая накопительная точка только запоминается, как у нового ряда
+	seriesTTL = 30 * time.Minute
+	// sweepInterval как часто ищутся забытые ряды
+	sweepInterval = time.Minute
+
+	selfMetricEvictedSeries = "OTLPEvictedSeries"
+)
+
+// Converter переводит точки OTLP в метрики metrictmr.
+//
+// Gauge и немонотонная накопительная Sum сохраняются как gauge. Монотонная Sum и гистограммы
+// (_count, _sum и накопительные _bucket с меткой le) сохраняются как приращения counter:
+// для накопительных рядов отправляется разность с предыдущей точкой, первая точка ряда только
+// запоминается, уменьшение значения или смена времени начала считаются сбросом. Ряды, не
+// обновлявшиеся дольше seriesTTL, забываются, чтобы состояние не росло без ограничений.
+// Атрибуты ресурса и точки становятся метками, атрибуты точки имеют приоритет.
+type Converter struct {
+	mu sync.Mutex
+	// series состояние рядов counter по идентификатору
+	series map[string]series
+	// swept время последнего поиска забытых рядов
+	swept time.Time
+	now   func() time.Time
+}
+
+type series struct {
+	start uint64
+	// total последнее накопительное значение или сумма полученных приращений
+	total float64
+	// seen время последнего сохранения точки ряда
+	seen time.Time
+}
+
+// Result метрики запроса и отклоненные точки
+type Result struct {
+	Metrics  []data.Metric
+	Rejected int64
+	// Errors причины отклонения без повторов
+	Errors []string
+	// pending новое состояние рядов, применяется после сохранения метрик
+	pending map[string]series
+}
+
+func NewConverter() *Converter {
+	return &Converter{series: make(map[string]series), now: time.Now}
+}
+
+// Message текст ошибки для частичного успеха
+func (r Result) Message() string {
+	return strings.Join(r.Errors, "; ")
+}
+
+// Convert переводит запрос целиком, ошибочные и неподдерживаемые точки учитываются в Rejected.
+// Состояние рядов не меняется: Convert показывает, какие метрики сохранил бы Ingest.
+func (c *Converter) Convert(req ExportRequest) Result {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.convert(req)
+}
+
+// Ingest переводит запрос и сохраняет метрики функцией store. Состояние рядов запоминается
+// только после успешного сохранения: если клиент повторит запрос, приращения будут посчитаны заново.
+// Перевод, сохранение и обновление состояния выполняются под одной блокировкой, иначе
+// параллельные запросы с одним накопительным рядом посчитали бы приращение дважды.
+func (c *Converter) Ingest(req ExportRequest, store func(metrics []data.Metric) error) (Result, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r := c.convert(req)
+	if len(r.Metrics) > 0 {
+		if err := store(r.Metrics); err != nil {
+			return r, err
+		}
+	}
+	c.commit(r)
+	return r, nil
+}
+
+func (c *Converter) convert(req ExportRequest) Result {
+	b := resultBuilder{errors: make(map[string]struct{}), pending: make(map[string]series)}
+	for _, rm := range req.ResourceMetrics {
+		resource := attributes(nil, rm.Resource.Attributes)
+		for _, sm := range rm.ScopeMetrics {
+			for _, m := range sm.Metrics {
+				c.convertMetric(&b, resource, m)
+			}
+		}
+	}
+	return b.result()
+}
+
+// commit запоминает состояние рядов после успешного сохранения метрик r
+// и забывает ряды, не обновлявшиеся дольше seriesTTL
+func (c *Converter) commit(r Result) {
+	now := c.now()
+	for id, s := range r.pending {
+		s.seen = now
+		c.series[id] = s
+	}
+	if now.Sub(c.swept) < sweepInterval {
+		return
+	}
+	c.swept = now
+	evicted := 0
+	for id, s := range c.series {
+		if now.Sub(s.seen) > seriesTTL {
+			delete(c.series, id)
+			evicted++
+		}
+	}
+	selfmetric.Default.Counter(selfMetricEvictedSeries).Add(int64(evicted))
+}
+
+func (c *Converter) convertMetric(b *resultBuilder, resource map[string]string, m Metric) {
+	switch {
+	case m.Name == "":
+		b.reject(pointCount(m), "metric without name")
+	case m.Gauge != nil:
+		for _, p := range m.Gauge.DataPoints {
+			value, ok, err := p.value()
+			if err != nil {
+				b.reject(1, fmt.Sprintf("metric %s: %v", m.Name, err))
+				continue
+			}
+			if ok {
+				b.gauge(data.SeriesID(m.Name, attributes(resource, p.Attributes)), value)
+			}
+		}
+	case m.Sum != nil:
+		c.convertSum(b, resource, m.Name, m.Sum)
+	case m.Histogram != nil:
+		c.convertHistogram(b, resource, m.Name, m.Histogram)
+	case m.ExponentialHistogram != nil:
+		b.reject(int64(len(m.ExponentialHistogram.DataPoints)), fmt.Sprintf("metric %s: exponential histogram is not supported", m.Name))
+	case m.Summary != nil:
+		b.reject(int64(len(m.Summary.DataPoints)), fmt.Sprintf("metric %s: summary is not supported", m.Name))
+	}
+}
+
+func (c *Converter) convertSum(b *resultBuilder, resource map[string]string, name string, sum *Sum) {
+	if err := checkTemporality(sum.AggregationTemporality); err != nil {
+		b.reject(int64(len(sum.DataPoints)), fmt.Sprintf("metric %s: %v", name, err))
+		return
+	}
+	if !sum.IsMonotonic && sum.AggregationTemporality == TemporalityDelta {
+		b.reject(int64(len(sum.DataPoints)), fmt.Sprintf("metric %s: non-monotonic delta sum is not supported", name))
+		return
+	}
+	for _, p := range sum.DataPoints {
+		value, ok, err := p.value()
+		if err != nil {
+			b.reject(1, fmt.Sprintf("metric %s: %v", name, err))
+			continue
+		}
+		if !ok {
+			continue
+		}
+		id := data.SeriesID(name, attributes(resource, p.Attributes))
+		if !sum.IsMonotonic {
+			b.gauge(id, value)
+			continue
+		}
+		if value < 0 && sum.AggregationTemporality == TemporalityDelta {
+			b.reject(1, fmt.Sprintf("metric %s: negative delta for monotonic sum", name))
+			continue
+		}
+		c.counter(b, id, value, sum.AggregationTemporality, uint64(p.StartTimeUnixNano))
+	}
+}
+
+func (c *Converter) convertHistogram(b *resultBuilder, resource map[string]string, name string, h *Histogram) {
+	if err := checkTemporality(h.AggregationTemporality); err != nil {
+		b.reject(int64(len(h.DataPoints)), fmt.Sprintf("metric %s: %v", name, err))
+		return
+	}
+	for _, p := range h.DataPoints {
+		if p.Flags&flagNoRecordedValue != 0 {
+			continue
+		}
+		if len(p.BucketCounts) > 0 && len(p.BucketCounts) != len(p.ExplicitBounds)+1 {
+			b.reject(1, fmt.Sprintf("metric %s: %d bucket counts for %d bounds", name, len(p.BucketCounts), len(p.ExplicitBounds)))
+			continue
+		}
+		if p.Sum != nil && !finite(float64(*p.Sum)) {
+			b.reject(1, fmt.Sprintf("metric %s: invalid sum", name))
+			continue
+		}
+		labels := attributes(resource, p.Attributes)
+		start := uint64(p.StartTimeUnixNano)
+		c.counter(b, data.SeriesID(name+"_count", labels), float64(p.Count), h.AggregationTemporality, start)
+		if p.Sum != nil {
+			c.counter(b, data.SeriesID(name+"_sum", labels), float64(*p.Sum), h.AggregationTemporality, start)
+		}
+		var cumulative uint64
+		for i, n := range p.BucketCounts {
+			cumulative += uint64(n)
+			le := "+Inf"
+			if i < len(p.ExplicitBounds) {
+				le = strconv.FormatFloat(float64(p.ExplicitBounds[i]), 'g', -1, 64)
+			}
+			bucket := attributes(labels, []KeyValue{{Key: "le", Value: AnyValue{StringValue: &le}}})
+			c.counter(b, data.SeriesID(name+"_bucket", bucket), float64(cumulative), h.AggregationTemporality, start)
+		}
+	}
+}
+
+// counter добавляет приращение ряда. Дробные значения накапливаются в состоянии ряда,
+// приращение - разность целых частей, поэтому дробные части не теряются.
+func (c *Converter) counter(b *resultBuilder, id string, value float64, temporality int, start uint64) {
+	s, seen := b.pending[id]
+	if !seen {
+		s, seen = c.series[id]
+	}
+	if !seen {
+		s.start = start
+	}
+	defer func() { b.pending[id] = s }()
+	var delta float64
+	switch temporality {
+	case TemporalityDelta:
+		delta = math.Floor(s.total+value) - math.Floor(s.total)
+		s.total += value
+	case TemporalityCumulative:
+		reset := value < s.total || (start != 0 && start != s.start)
+		switch {
+		case !seen:
+		case reset:
+			delta = math.Floor(value)
+		default:
+			delta = math.Floor(value) - math.Floor(s.total)
+		}
+		s.total, s.start = value, start
+		if !seen {
+			return
+		}
+	}
+	b.counter(id, int64(delta))
+}
+
+func checkTemporality(t int) error {
+	switch t {
+	case TemporalityDelta, TemporalityCumulative:
+		return nil
+	}
+	return fmt.Errorf("unsupported aggregation temporality %d", t)
+}
+
+// value значение точки, ok=false для точек без значения
+func (p NumberDataPoint) value() (float64, bool, error) {
+	if p.Flags&flagNoRecordedValue != 0 {
+		return 0, false, nil
+	}
+	switch {
+	case p.AsInt != nil:
+		return float64(*p.AsInt), true, nil
+	case p.AsDouble != nil:
+		v := float64(*p.AsDouble)
+		if !finite(v) {
+			return 0, false, fmt.Errorf("invalid value %v", v)
+		}
+		return v, true, nil
+	}
+	return 0, false, fmt.Errorf("data point without value")
+}
+
+func finite(v float64) bool {
+	return !math.IsNaN(v) && !math.IsInf(v, 0)
+}
+
+// attributes копирует base и добавляет к нему атрибуты
+func attributes(base map[string]string, attrs []KeyValue) map[string]string {
+	labels := make(map[string]string, len(base)+len(attrs))
+	for k, v := range base {
+		labels[k] = v
+	}
+	for _, kv := range attrs {
+		if kv.Key == "" {
+			continue
+		}
+		labels[kv.Key] = kv.Value.String()
+	}
+	return labels
+}
+
+func pointCount(m Metric) int64 {
+	switch {
+	case m.Gauge != nil:
+		return int64(len(m.Gauge.DataPoints))
+	case m.Sum != nil:
+		return int64(len(m.Sum.DataPoints))
+	case m.Histogram != nil:
+		return int64(len(m.Histogram.DataPoints))
+	case m.ExponentialHistogram != nil:
+		return int64(len(m.ExponentialHistogram.DataPoints))
+	case m.Summary != nil:
+		return int64(len(m.Summary.DataPoints))
+	}
+	return 0
+}
+
+type resultBuilder struct {
+	metrics  []data.Metric
+	rejected int64
+	errors   map[string]struct{}
+	pending  map[string]series
+}
+
+func (b *resultBuilder) gauge(id string, value float64) {
+	b.metrics = append(b.metrics, data.Metric{ID: id, MType: data.MTypeGauge, Value: &value})
+}
+
+func (b *resultBuilder) counter(id string, delta int64) {
+	b.metrics = append(b.metrics, data.Metric{ID: id, MType: data.MTypeCounter, Delta: &delta})
+}
+
+func (b *resultBuilder) reject(points int64, reason string) {
+	if points == 0 {
+		return
+	}
+	b.rejected += points
+	b.errors[reason] = struct{}{}
+}
+
+func (b *resultBuilder) result() Result {
+	r := Result{Metrics: b.metrics, Rejected: b.rejected, pending: b.pending}
+	for reason := range b.errors {
+		r.Errors = append(r.Errors, reason)
+	}
+	sort.Strings(r.Errors)
+	return r
+}
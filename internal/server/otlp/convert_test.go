@@ -0,0 +1,198 @@
+package otlp
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/megaded/metrictmr/internal/data"
+	"github.com/megaded/metrictmr/internal/selfmetric"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func decode(t *testing.T, body string) ExportRequest {
+	t.Helper()
+	var req ExportRequest
+	require.NoError(t, json.Unmarshal([]byte(body), &req))
+	return req
+}
+
+// byID метрики результата по идентификатору и типу
+func byID(metrics []data.Metric) map[string]data.Metric {
+	result := make(map[string]data.Metric, len(metrics))
+	for _, m := range metrics {
+		result[m.MType+" "+m.ID] = m
+	}
+	return result
+}
+
+func request(metric string) string {
+	return `{"resourceMetrics":[{"resource":{"attributes":[` +
+		`{"key":"service.name","value":{"stringValue":"api"}},` +
+		`{"key":"host","value":{"stringValue":"a"}}]},` +
+		`"scopeMetrics":[{"scope":{"name":"test"},"metrics":[` + metric + `]}]}]}`
+}
+
+func TestDecode(t *testing.T) {
+	req := decode(t, request(`{"name":"g","gauge":{"dataPoints":[`+
+		`{"attributes":[{"key":"n","value":{"intValue":"7"}},{"key":"ok","value":{"boolValue":true}},{"key":"l","value":{"arrayValue":{"values":[]}}}],`+
+		`"timeUnixNano":"1700000000000000000","asDouble":"NaN"},`+
+		`{"timeUnixNano":1700000000000000000,"asInt":"-3"}]}}`))
+	points := req.ResourceMetrics[0].ScopeMetrics[0].Metrics[0].Gauge.DataPoints
+	require.Len(t, points, 2)
+	labels := attributes(nil, points[0].Attributes)
+	assert.Equal(t, map[string]string{"n": "7", "ok": "true", "l": `{"values":[]}`}, labels)
+	assert.Equal(t, Uint64(1700000000000000000), points[0].TimeUnixNano)
+	assert.Equal(t, Uint64(1700000000000000000), points[1].TimeUnixNano)
+	assert.Equal(t, Int64(-3), *points[1].AsInt)
+
+	var bad ExportRequest
+	assert.Error(t, json.Unmarshal([]byte(request(`{"name":"g","gauge":{"dataPoints":[{"asInt":"x"}]}}`)), &bad))
+}
+
+func TestConvertGauge(t *testing.T) {
+	c := NewConverter()
+	r := c.Convert(decode(t, request(`{"name":"cpu","gauge":{"dataPoints":[`+
+		`{"attributes":[{"key":"host","value":{"stringValue":"b"}}],"asDouble":0.5},`+
+		`{"asDouble":"Infinity"},`+
+		`{"flags":1}]}}`)))
+	require.Len(t, r.Metrics, 1)
+	// атрибут точки важнее атрибута ресурса
+	assert.Equal(t, "cpu;host=b;service.name=api", r.Metrics[0].ID)
+	assert.Equal(t, data.MTypeGauge, r.Metrics[0].MType)
+	assert.Equal(t, 0.5, *r.Metrics[0].Value)
+	assert.Equal(t, int64(1), r.Rejected)
+}
+
+func TestConvertSum(t *testing.T) {
+	t.Run("delta monotonic", func(t *testing.T) {
+		c := NewConverter()
+		sum := `{"name":"requests","sum":{"aggregationTemporality":1,"isMonotonic":true,"dataPoints":[{"asInt":"3"},{"asDouble":0.6},{"asDouble":0.6}]}}`
+		r := c.Convert(decode(t, request(sum)))
+		require.Len(t, r.Metrics, 3)
+		// дробные приращения накапливаются: 3 + 0.6 + 0.6 = 4.2
+		assert.Equal(t, int64(3), *r.Metrics[0].Delta)
+		assert.Equal(t, int64(0), *r.Metrics[1].Delta)
+		assert.Equal(t, int64(1), *r.Metrics[2].Delta)
+		assert.Equal(t, int64(0), r.Rejected)
+	})
+
+	t.Run("cumulative monotonic", func(t *testing.T) {
+		c := NewConverter()
+		point := func(value string, start string) string {
+			return request(`{"name":"bytes","sum":{"aggregationTemporality":2,"isMonotonic":true,"dataPoints":[` +
+				`{"startTimeUnixNano":"` + start + `","asInt":"` + value + `"}]}}`)
+		}
+		commit := func(body string) []data.Metric {
+			r, err := c.Ingest(decode(t, body), func([]data.Metric) error { return nil })
+			require.NoError(t, err)
+			return r.Metrics
+		}
+		assert.Empty(t, commit(point("100", "1")), "first point sets baseline")
+		m := commit(point("130", "1"))
+		require.Len(t, m, 1)
+		assert.Equal(t, data.MTypeCounter, m[0].MType)
+		assert.Equal(t, "bytes;host=a;service.name=api", m[0].ID)
+		assert.Equal(t, int64(30), *m[0].Delta)
+
+		// Convert не меняет состояние: повтор запроса дает то же приращение
+		r := c.Convert(decode(t, point("150", "1")))
+		assert.Equal(t, int64(20), *r.Metrics[0].Delta)
+		// ошибка сохранения тоже не меняет состояние
+		_, err := c.Ingest(decode(t, point("150", "1")), func([]data.Metric) error { return errors.New("unavailable") })
+		assert.Error(t, err)
+		m = commit(point("150", "1"))
+		assert.Equal(t, int64(20), *m[0].Delta)
+
+		m = commit(point("5", "1"))
+		assert.Equal(t, int64(5), *m[0].Delta, "decrease is a reset")
+		m = commit(point("7", "2"))
+		assert.Equal(t, int64(7), *m[0].Delta, "new start time is a reset")
+	})
+
+	t.Run("cumulative non-monotonic is a gauge", func(t *testing.T) {
+		c := NewConverter()
+		r := c.Convert(decode(t, request(`{"name":"queue","sum":{"aggregationTemporality":2,"dataPoints":[{"asInt":"-4"}]}}`)))
+		require.Len(t, r.Metrics, 1)
+		assert.Equal(t, data.MTypeGauge, r.Metrics[0].MType)
+		assert.Equal(t, -4.0, *r.Metrics[0].Value)
+	})
+
+	t.Run("rejected", func(t *testing.T) {
+		c := NewConverter()
+		r := c.Convert(decode(t, request(
+			`{"name":"a","sum":{"aggregationTemporality":1,"dataPoints":[{"asInt":"1"}]}},`+
+				`{"name":"b","sum":{"aggregationTemporality":0,"isMonotonic":true,"dataPoints":[{"asInt":"1"},{"asInt":"2"}]}},`+
+				`{"name":"c","sum":{"aggregationTemporality":1,"isMonotonic":true,"dataPoints":[{"asInt":"-1"}]}}`)))
+		assert.Empty(t, r.Metrics)
+		assert.Equal(t, int64(4), r.Rejected)
+		assert.Len(t, r.Errors, 3)
+	})
+}
+
+func TestConverterEvictsStaleSeries(t *testing.T) {
+	c := NewConverter()
+	now := time.Now()
+	c.now = func() time.Time { return now }
+	ingest := func(name, value string) []data.Metric {
+		t.Helper()
+		sum := `{"name":"` + name + `","sum":{"aggregationTemporality":2,"isMonotonic":true,"dataPoints":[{"asInt":"` + value + `"}]}}`
+		r, err := c.Ingest(decode(t, request(sum)), func([]data.Metric) error { return nil })
+		require.NoError(t, err)
+		return r.Metrics
+	}
+	evicted := selfmetric.Default.Counter(selfMetricEvictedSeries).Value()
+
+	ingest("a", "5")
+	ingest("b", "1")
+	now = now.Add(seriesTTL / 2)
+	ingest("b", "2")
+	assert.Len(t, c.series, 2)
+
+	// ряд a не обновлялся дольше seriesTTL и забыт, ряд b остался
+	now = now.Add(seriesTTL/2 + sweepInterval)
+	m := ingest("b", "4")
+	require.Len(t, m, 1)
+	assert.Equal(t, int64(2), *m[0].Delta)
+	assert.Len(t, c.series, 1)
+	assert.Equal(t, evicted+1, selfmetric.Default.Counter(selfMetricEvictedSeries).Value())
+
+	// вернувшийся ряд считается новым: первая точка только запоминается
+	assert.Empty(t, ingest("a", "8"))
+	assert.Equal(t, int64(1), *ingest("a", "9")[0].Delta)
+}
+
+func TestConvertHistogram(t *testing.T) {
+	c := NewConverter()
+	r := c.Convert(decode(t, request(`{"name":"latency","histogram":{"aggregationTemporality":1,"dataPoints":[`+
+		`{"count":"6","sum":1.5,"bucketCounts":["1","2","3"],"explicitBounds":[0.1,0.5]},`+
+		`{"count":"1","bucketCounts":["1"],"explicitBounds":[0.1]}]}}`)))
+	assert.Equal(t, int64(1), r.Rejected)
+	got := byID(r.Metrics)
+	want := map[string]int64{
+		"latency_count;host=a;service.name=api":          6,
+		"latency_sum;host=a;service.name=api":            1,
+		"latency_bucket;host=a;le=0.1;service.name=api":  1,
+		"latency_bucket;host=a;le=0.5;service.name=api":  3,
+		"latency_bucket;host=a;le=+Inf;service.name=api": 6,
+	}
+	require.Len(t, got, len(want))
+	for id, delta := range want {
+		m, ok := got[data.MTypeCounter+" "+id]
+		require.True(t, ok, id)
+		assert.Equal(t, delta, *m.Delta, id)
+	}
+}
+
+func TestConvertUnsupported(t *testing.T) {
+	c := NewConverter()
+	r := c.Convert(decode(t, request(
+		`{"name":"exp","exponentialHistogram":{"aggregationTemporality":1,"dataPoints":[{},{}]}},`+
+			`{"name":"sum","summary":{"dataPoints":[{}]}},`+
+			`{"name":"ok","gauge":{"dataPoints":[{"asInt":"1"}]}}`)))
+	assert.Len(t, r.Metrics, 1)
+	assert.Equal(t, int64(3), r.Rejected)
+	assert.Equal(t, "metric exp: exponential histogram is not supported; metric sum: summary is not supported", r.Message())
+}
@@ -0,0 +1,222 @@
+// Прием метрик OpenTelemetry по OTLP/HTTP в кодировке JSON
+//
+// Типы повторяют сообщения ExportMetricsServiceRequest в JSON-представлении protobuf:
+// имена полей в lowerCamelCase, 64-битные целые могут передаваться строками.
+package otlp
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// Temporality значения AggregationTemporality
+const (
+	TemporalityUnspecified = 0
+	TemporalityDelta       = 1
+	TemporalityCumulative  = 2
+)
+
+// flagNoRecordedValue признак точки без значения (DataPointFlags)
+const flagNoRecordedValue = 1
+
+// ExportRequest тело запроса /v1/metrics
+type ExportRequest struct {
+	ResourceMetrics []ResourceMetrics `json:"resourceMetrics"`
+}
+
+type ResourceMetrics struct {
+	Resource     Resource       `json:"resource"`
+	ScopeMetrics []ScopeMetrics `json:"scopeMetrics"`
+}
+
+type Resource struct {
+	Attributes []KeyValue `json:"attributes"`
+}
+
+type ScopeMetrics struct {
+	Metrics []Metric `json:"metrics"`
+}
+
+// Metric содержит данные одного из видов, неподдерживаемые виды только подсчитываются
+type Metric struct {
+	Name                 string     `json:"name"`
+	Gauge                *Gauge     `json:"gauge"`
+	Sum                  *Sum       `json:"sum"`
+	Histogram            *Histogram `json:"histogram"`
+	ExponentialHistogram *struct {
+		DataPoints []json.RawMessage `json:"dataPoints"`
+	} `json:"exponentialHistogram"`
+	Summary *struct {
+		DataPoints []json.RawMessage `json:"dataPoints"`
+	} `json:"summary"`
+}
+
+type Gauge struct {
+	DataPoints []NumberDataPoint `json:"dataPoints"`
+}
+
+type Sum struct {
+	DataPoints             []NumberDataPoint `json:"dataPoints"`
+	AggregationTemporality int               `json:"aggregationTemporality"`
+	IsMonotonic            bool              `json:"isMonotonic"`
+}
+
+type Histogram struct {
+	DataPoints             []HistogramDataPoint `json:"dataPoints"`
+	AggregationTemporality int                  `json:"aggregationTemporality"`
+}
+
+type NumberDataPoint struct {
+	Attributes        []KeyValue `json:"attributes"`
+	StartTimeUnixNano Uint64     `json:"startTimeUnixNano"`
+	TimeUnixNano      Uint64     `json:"timeUnixNano"`
+	AsDouble          *Double    `json:"asDouble"`
+	AsInt             *Int64     `json:"asInt"`
+	Flags             uint32     `json:"flags"`
+}
+
+type HistogramDataPoint struct {
+	Attributes        []KeyValue `json:"attributes"`
+	StartTimeUnixNano Uint64     `json:"startTimeUnixNano"`
+	TimeUnixNano      Uint64     `json:"timeUnixNano"`
+	Count             Uint64     `json:"count"`
+	Sum               *Double    `json:"sum"`
+	BucketCounts      []Uint64   `json:"bucketCounts"`
+	ExplicitBounds    []Double   `json:"explicitBounds"`
+	Flags             uint32     `json:"flags"`
+}
+
+type KeyValue struct {
+	Key   string   `json:"key"`
+	Value AnyValue `json:"value"`
+}
+
+// AnyValue значение атрибута. Массивы и вложенные списки сохраняются исходным JSON.
+type AnyValue struct {
+	StringValue *string         `json:"stringValue"`
+	BoolValue   *bool           `json:"boolValue"`
+	IntValue    *Int64          `json:"intValue"`
+	DoubleValue *Double         `json:"doubleValue"`
+	ArrayValue  json.RawMessage `json:"arrayValue"`
+	KvlistValue json.RawMessage `json:"kvlistValue"`
+	BytesValue  *string         `json:"bytesValue"`
+}
+
+// String значение атрибута для метки
+func (v AnyValue) String() string {
+	switch {
+	case v.StringValue != nil:
+		return *v.StringValue
+	case v.BoolValue != nil:
+		return strconv.FormatBool(*v.BoolValue)
+	case v.IntValue != nil:
+		return strconv.FormatInt(int64(*v.IntValue), 10)
+	case v.DoubleValue != nil:
+		return strconv.FormatFloat(float64(*v.DoubleValue), 'g', -1, 64)
+	case v.ArrayValue != nil:
+		return string(v.ArrayValue)
+	case v.KvlistValue != nil:
+		return string(v.KvlistValue)
+	case v.BytesValue != nil:
+		return *v.BytesValue
+	}
+	return ""
+}
+
+// Int64 целое, передаваемое числом или строкой
+type Int64 int64
+
+func (i *Int64) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		return nil
+	}
+	s, err := unquote(b)
+	if err != nil {
+		return err
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid int64 %s", b)
+	}
+	*i = Int64(n)
+	return nil
+}
+
+// Uint64 беззнаковое целое, передаваемое числом или строкой
+type Uint64 uint64
+
+func (u *Uint64) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		return nil
+	}
+	s, err := unquote(b)
+	if err != nil {
+		return err
+	}
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid uint64 %s", b)
+	}
+	*u = Uint64(n)
+	return nil
+}
+
+// Double число с плавающей точкой, специальные значения передаются строками "NaN", "Infinity", "-Infinity"
+type Double float64
+
+func (d *Double) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		return nil
+	}
+	s, err := unquote(b)
+	if err != nil {
+		return err
+	}
+	switch s {
+	case "NaN":
+		*d = Double(math.NaN())
+		return nil
+	case "Infinity":
+		*d = Double(math.Inf(1))
+		return nil
+	case "-Infinity":
+		*d = Double(math.Inf(-1))
+		return nil
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return fmt.Errorf("invalid double %s", b)
+	}
+	*d = Double(v)
+	return nil
+}
+
+func unquote(b []byte) (string, error) {
+	if len(b) > 0 && b[0] == '"' {
+		var s string
+		if err := json.Unmarshal(b, &s); err != nil {
+			return "", err
+		}
+		return s, nil
+	}
+	return string(b), nil
+}
+
+// ExportResponse ответ на запрос, PartialSuccess заполняется, если часть точек отклонена
+type ExportResponse struct {
+	PartialSuccess *PartialSuccess `json:"partialSuccess,omitempty"`
+}
+
+type PartialSuccess struct {
+	// RejectedDataPoints int64 передается строкой, как в JSON-представлении protobuf
+	RejectedDataPoints string `json:"rejectedDataPoints"`
+	ErrorMessage       string `json:"errorMessage"`
+}
+
+// Status тело ответа с ошибкой
+type Status struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
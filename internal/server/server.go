@@ -2,13 +2,24 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/megaded/metrictmr/internal/logger"
+	"github.com/megaded/metrictmr/internal/server/broker"
+	"github.com/megaded/metrictmr/internal/server/exporter"
+	"github.com/megaded/metrictmr/internal/server/graphite"
 	"github.com/megaded/metrictmr/internal/server/handler"
 	"github.com/megaded/metrictmr/internal/server/handler/config"
 	"github.com/megaded/metrictmr/internal/server/handler/storage"
+	"github.com/megaded/metrictmr/internal/server/influx"
 	"github.com/megaded/metrictmr/internal/server/middleware"
 	"go.uber.org/zap"
 )
@@ -18,25 +29,126 @@ type Server struct {
 	Address   string
 	Cert      string
 	PublicKey string
+	// ClientCA файл удостоверяющих центров для проверки клиентских сертификатов
+	ClientCA string
+	// Graphite прием Graphite plaintext, nil если отключен
+	Graphite *graphite.Listener
+	// Exporter пересылка сохраненных метрик, nil если отключена.
+	// Останавливается после завершения запросов и приема Graphite.
+	Exporter *exporter.Exporter
 }
 
+// shutdownTimeout время на завершение запросов и отправку накопленных метрик при остановке
+const shutdownTimeout = 10 * time.Second
+
+// Start обслуживает запросы до отмены ctx или отказа приема Graphite. После этого Start ждет
+// завершения запросов, приема Graphite и пересылки метрик, но не дольше shutdownTimeout.
 func (s *Server) Start(ctx context.Context) {
-	server := http.Server{Addr: s.Address, Handler: s.Handler}
+	tlsConfig, err := s.tlsConfig()
+	if err != nil {
+		panic(err)
+	}
+	if s.Graphite != nil {
+		// адрес занят или неверен: сервер не запускается
+		if err = s.Graphite.Listen(); err != nil {
+			panic(err)
+		}
+	}
+	// отказ приема Graphite останавливает сервер тем же путем, что и отмена ctx
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+	server := http.Server{Addr: s.Address, Handler: s.Handler, TLSConfig: tlsConfig}
+	graphiteDone := make(chan struct{})
+	if s.Graphite != nil {
+		go func() {
+			defer close(graphiteDone)
+			if err := s.Graphite.Serve(ctx); err != nil {
+				logger.Log.Error("graphite listener failed, shutting down", zap.Error(err))
+				stop()
+			}
+		}()
+	} else {
+		close(graphiteDone)
+	}
+	stopped := make(chan struct{})
 	go func() {
+		defer close(stopped)
 		<-ctx.Done()
-		server.Shutdown(ctx)
+		shutdownCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			logger.Log.Warn("http server shutdown failed", zap.Error(err))
+		}
+		s.wait(shutdownCtx, graphiteDone)
 	}()
-	if s.Cert != "" && s.PublicKey != "" {
-		err := server.ListenAndServeTLS(s.Cert, s.PublicKey)
+	if s.tls() {
+		reloader, err := newCertReloader(s.Cert, s.PublicKey)
 		if err != nil {
 			panic(err)
 		}
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		defer signal.Stop(hup)
+		go reloader.watch(ctx, certCheckInterval, hup)
+		if server.TLSConfig == nil {
+			server.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		}
+		server.TLSConfig.GetCertificate = reloader.GetCertificate
+		// сертификат берется из GetCertificate, пути к файлам не передаются
+		err = server.ListenAndServeTLS("", "")
 	} else {
-		err := server.ListenAndServe()
-		if err != nil {
-			panic(err)
+		err = server.ListenAndServe()
+	}
+	if !errors.Is(err, http.ErrServerClosed) {
+		panic(err)
+	}
+	<-stopped
+}
+
+// wait ждет остановки приема Graphite и пересылки метрик до истечения ctx
+func (s *Server) wait(ctx context.Context, graphiteDone <-chan struct{}) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		<-graphiteDone
+		// запросы и прием Graphite завершены, больше метрик не будет
+		if s.Exporter != nil {
+			s.Exporter.Stop()
+			s.Exporter.Wait()
 		}
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		logger.Log.Warn("shutdown timeout exceeded, pending metrics may be lost")
+	}
+}
+
+func (s *Server) tls() bool {
+	return s.Cert != "" && s.PublicKey != ""
+}
+
+// tlsConfig при заданном ClientCA требует и проверяет клиентские сертификаты
+func (s *Server) tlsConfig() (*tls.Config, error) {
+	if s.ClientCA == "" {
+		return nil, nil
+	}
+	if !s.tls() {
+		return nil, errors.New("client_ca requires server certificate and key")
+	}
+	pem, err := os.ReadFile(s.ClientCA)
+	if err != nil {
+		return nil, fmt.Errorf("read client CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in client CA %s", s.ClientCA)
 	}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  pool,
+	}, nil
 }
 
 type Configer interface {
@@ -57,13 +169,70 @@ func CreateServer(ctx context.Context) (s Listener) {
 		server.Cert = cert
 		server.PublicKey = publicKey
 	}
-	storage := storage.CreateStorage(ctx, *serverConfig)
-	server.Handler = handler.CreateRouter(storage, middleware.Logger, middleware.GzipMiddleware)
+	base := storage.CreateStorage(ctx, *serverConfig)
+	b := broker.NewBroker(ctx, broker.DefaultBufferSize, base)
+	publishers := []storage.Publisher{b}
+	if exports := serverConfig.GetExports(); len(exports) > 0 {
+		// метрики запросов, завершаемых при остановке, тоже пересылаются: экспорт останавливает Start
+		server.Exporter = createExporter(context.WithoutCancel(ctx), exports)
+		publishers = append(publishers, server.Exporter)
+	}
+	storage := storage.NewObservableStorage(base, publishers...)
+	server.ClientCA = serverConfig.ClientCA
+	converter, err := influx.NewConverter(serverConfig.InfluxCounterFields)
+	if err != nil {
+		logger.Log.Fatal("invalid influx config", zap.Error(err))
+	}
+	opts := handler.Options{Influx: converter}
+	server.Handler = handler.CreateRouterWithOptions(storage, b, opts, middleware.Logger, middleware.GzipMiddleware)
 	server.Address = serverConfig.Address
+	if serverConfig.GraphiteAddress != "" {
+		rules, err := graphite.NewRules(serverConfig.GraphiteCounterPaths)
+		if err != nil {
+			logger.Log.Fatal("invalid graphite config", zap.Error(err))
+		}
+		server.Graphite = &graphite.Listener{
+			Addr:          serverConfig.GraphiteAddress,
+			Network:       serverConfig.GraphiteNetwork,
+			Storage:       storage,
+			Rules:         rules,
+			MaxConns:      serverConfig.GraphiteMaxConns,
+			MaxLineLength: serverConfig.GraphiteMaxLineLength,
+		}
+	}
 
 	return server
 }
 
+// createExporter запускает пересылку сохраненных метрик получателям из конфигурации
+func createExporter(ctx context.Context, exports []config.Export) *exporter.Exporter {
+	targets := make([]exporter.Target, 0, len(exports))
+	for i, e := range exports {
+		if e.URL == "" {
+			logger.Log.Fatal("export url is empty", zap.String("type", e.Type))
+		}
+		var sink exporter.Sink
+		switch e.Type {
+		case config.ExportHTTP:
+			sink = exporter.NewHTTPSink(e.URL, nil)
+		case config.ExportPushgateway:
+			sink = exporter.NewPushgatewaySink(e.URL, e.Job, nil)
+		default:
+			logger.Log.Fatal("unknown export type", zap.String("type", e.Type), zap.String("url", e.URL))
+		}
+		settings := exporter.Settings{
+			Name:          fmt.Sprintf("%s%d", e.Type, i),
+			QueueSize:     e.QueueSize,
+			BatchSize:     e.BatchSize,
+			FlushInterval: time.Duration(e.FlushInterval) * time.Second,
+			Timeout:       time.Duration(e.Timeout) * time.Second,
+		}
+		logger.Log.Info("export enabled", zap.String("sink", settings.Name), zap.String("url", e.URL))
+		targets = append(targets, exporter.Target{Sink: sink, Settings: settings})
+	}
+	return exporter.New(ctx, targets...)
+}
+
 func logConfig(c config.Config) {
 	nConfig := "Config"
 	logger.Log.Info(nConfig, zap.String("add", c.Address))
@@ -72,6 +241,14 @@ func logConfig(c config.Config) {
 	logger.Log.Info(nConfig, zap.Int("internal", *c.StoreInterval))
 	logger.Log.Info(nConfig, zap.String("db conn string", c.DBConnString))
 	logger.Log.Info(nConfig, zap.String("key", c.Key))
+	logger.Log.Info(nConfig, zap.String("wal sync", c.WALSync))
+	logger.Log.Info(nConfig, zap.String("snapshot format", c.SnapshotFormat))
+	logger.Log.Info(nConfig, zap.String("bolt path", c.BoltPath))
+	logger.Log.Info(nConfig, zap.Int("db max conns", c.DBMaxConns))
+	logger.Log.Info(nConfig, zap.String("client ca", c.ClientCA))
+	logger.Log.Info(nConfig, zap.String("influx counter fields", c.InfluxCounterFields))
+	logger.Log.Info(nConfig, zap.String("graphite address", c.GraphiteAddress))
+	logger.Log.Info(nConfig, zap.String("graphite network", c.GraphiteNetwork))
 }
 
 func getFilesFromPath(cryptoPath string) (string, string, error) {
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/megaded/metrictmr/internal/data"
+	"github.com/megaded/metrictmr/internal/server/exporter"
+	"github.com/megaded/metrictmr/internal/server/graphite"
+	"github.com/megaded/metrictmr/internal/tlstest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_TLSConfig(t *testing.T) {
+	ca := tlstest.NewCA(t, "metrics")
+	serverCert := ca.Server(t, "server", time.Now().Add(time.Hour))
+
+	t.Run("without client ca", func(t *testing.T) {
+		s := &Server{Cert: serverCert.CertFile, PublicKey: serverCert.KeyFile}
+		tlsConfig, err := s.tlsConfig()
+		require.NoError(t, err)
+		assert.Nil(t, tlsConfig)
+	})
+	t.Run("client ca without server certificate", func(t *testing.T) {
+		s := &Server{ClientCA: ca.CertFile}
+		_, err := s.tlsConfig()
+		assert.Error(t, err)
+	})
+	t.Run("invalid client ca", func(t *testing.T) {
+		s := &Server{Cert: serverCert.CertFile, PublicKey: serverCert.KeyFile, ClientCA: serverCert.KeyFile}
+		_, err := s.tlsConfig()
+		assert.Error(t, err)
+	})
+	t.Run("client ca", func(t *testing.T) {
+		s := &Server{Cert: serverCert.CertFile, PublicKey: serverCert.KeyFile, ClientCA: ca.CertFile}
+		tlsConfig, err := s.tlsConfig()
+		require.NoError(t, err)
+		assert.Equal(t, tls.RequireAndVerifyClientCert, tlsConfig.ClientAuth)
+
+		ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		ts.TLS = tlsConfig
+		ts.TLS.Certificates = []tls.Certificate{serverCert.TLSCertificate(t)}
+		ts.StartTLS()
+		defer ts.Close()
+
+		get := func(certs ...tls.Certificate) error {
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: ca.Pool(), Certificates: certs}}}
+			resp, err := client.Get(ts.URL)
+			if err == nil {
+				resp.Body.Close()
+			}
+			return err
+		}
+		assert.NoError(t, get(ca.Client(t, "agent").TLSCertificate(t)))
+		assert.Error(t, get())
+		assert.Error(t, get(tlstest.NewCA(t, "other").Client(t, "foreign").TLSCertificate(t)))
+	})
+}
+
+// slowSink получатель с медленной отправкой, запоминающий количество отправок
+type slowSink struct {
+	mu   sync.Mutex
+	sent int
+}
+
+func (s *slowSink) Encode(metrics []data.Metric) ([]byte, error) {
+	return []byte("ok"), nil
+}
+
+func (s *slowSink) Send(ctx context.Context, body []byte) error {
+	time.Sleep(50 * time.Millisecond)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sent++
+	return nil
+}
+
+func (s *slowSink) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sent
+}
+
+// freeAddr свободный локальный адрес для сервера
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func TestServer_Shutdown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sink := &slowSink{}
+	e := exporter.New(context.Background(), exporter.Target{Sink: sink, Settings: exporter.Settings{Name: "shutdown", FlushInterval: time.Hour}})
+	entered, release := make(chan struct{}), make(chan struct{})
+	value := 1.0
+	// запрос, сохраняющий метрику уже после начала остановки сервера
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(entered)
+		<-release
+		e.Publish(data.Metric{ID: "a", MType: data.MTypeGauge, Value: &value})
+	})
+	s := &Server{Address: freeAddr(t), Handler: h, Exporter: e}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Start(ctx)
+	}()
+
+	requested := make(chan error, 1)
+	go func() {
+		var res *http.Response
+		var err error
+		for range 100 {
+			if res, err = http.Get("http://" + s.Address); err == nil {
+				res.Body.Close()
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		requested <- err
+	}()
+	select {
+	case <-entered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("request did not reach the server")
+	}
+	cancel()
+	// остановка начинается, пока запрос еще выполняется
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	require.NoError(t, <-requested)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not stop")
+	}
+	// Start возвращается только после отправки метрик, сохраненных во время остановки
+	assert.Equal(t, 1, sink.count())
+}
+
+func TestServer_GraphiteAddressInUse(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer busy.Close()
+
+	// занятый адрес Graphite останавливает запуск до приема запросов
+	s := &Server{Address: freeAddr(t), Handler: http.NotFoundHandler(),
+		Graphite: &graphite.Listener{Addr: busy.Addr().String(), Network: graphite.NetworkTCP}}
+	assert.Panics(t, func() { s.Start(context.Background()) })
+}
@@ -0,0 +1,150 @@
+// Package tlstest выпускает сертификаты для тестов TLS: удостоверяющий центр,
+// сертификаты сервера для localhost и клиентские сертификаты.
+package tlstest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// CA удостоверяющий центр, подписывающий выпущенные сертификаты
+type CA struct {
+	Cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	// CertFile путь к сертификату в PEM
+	CertFile string
+}
+
+// Cert выпущенный сертификат с файлами сертификата и ключа в PEM
+type Cert struct {
+	Cert     *x509.Certificate
+	CertFile string
+	KeyFile  string
+}
+
+// NewCA создает удостоверяющий центр, файлы удаляются по завершении теста
+func NewCA(t testing.TB, name string) *CA {
+	t.Helper()
+	key := newKey(t)
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial(t),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &CA{Cert: cert, key: key, CertFile: writePEM(t, name+"-ca.pem", "CERTIFICATE", der)}
+}
+
+// Server выпускает сертификат сервера для localhost и 127.0.0.1 со сроком действия до notAfter
+func (ca *CA) Server(t testing.TB, name string, notAfter time.Time) *Cert {
+	t.Helper()
+	return ca.issue(t, name, notAfter, x509.ExtKeyUsageServerAuth)
+}
+
+// Client выпускает клиентский сертификат
+func (ca *CA) Client(t testing.TB, name string) *Cert {
+	t.Helper()
+	return ca.issue(t, name, time.Now().Add(24*time.Hour), x509.ExtKeyUsageClientAuth)
+}
+
+func (ca *CA) issue(t testing.TB, name string, notAfter time.Time, usage x509.ExtKeyUsage) *Cert {
+	key := newKey(t)
+	tmpl := &x509.Certificate{
+		SerialNumber: serial(t),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.Cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Cert{
+		Cert:     cert,
+		CertFile: writePEM(t, name+".pem", "CERTIFICATE", der),
+		KeyFile:  writePEM(t, name+".key", "PRIVATE KEY", keyDER),
+	}
+}
+
+// TLSCertificate пара сертификат-ключ для tls.Config
+func (c *Cert) TLSCertificate(t testing.TB) tls.Certificate {
+	t.Helper()
+	pair, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pair
+}
+
+// Pool пул с сертификатом удостоверяющего центра
+func (ca *CA) Pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Cert)
+	return pool
+}
+
+// SPKIPin хеш SHA-256 открытого ключа сертификата в base64
+func SPKIPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func newKey(t testing.TB) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func serial(t testing.TB) *big.Int {
+	n, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func writePEM(t testing.TB, name string, blockType string, der []byte) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}